@@ -5,13 +5,22 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
@@ -28,7 +37,7 @@ import (
 	"github.com/RishiMunagala/go-libp4dlog/metrics"
 )
 
-const statementsPerTransaction = 50 * 1000
+const defaultStatementsPerTransaction = 50 * 1000
 
 func writeHeader(f io.Writer) {
 	fmt.Fprintf(f, `CREATE TABLE IF NOT EXISTS process
@@ -41,7 +50,7 @@ func writeHeader(f io.Writer) {
 	rpcSnd FLOAT NULL, rpcRcv FLOAT NULL, running INT NULL,
 	netSyncFilesAdded INT NULL, netSyncFilesUpdated INT NULL, netSyncFilesDeleted INT NULL,
 	netSyncBytesAdded INT NULL, netSyncBytesUpdated INT NULL,
-	error TEXT NULL,
+	error TEXT NULL, changelist INT NULL,
 	PRIMARY KEY (processkey, lineNumber));
 `)
 	fmt.Fprintf(f, `CREATE TABLE IF NOT EXISTS tableUse
@@ -80,6 +89,21 @@ func dateStr(t time.Time) string {
 	return t.Format("2006/01/02 15:04:05")
 }
 
+// Changelist is NULL for commands without one
+func changelistValue(cmd *p4dlog.Command) interface{} {
+	if cmd.Changelist == 0 {
+		return nil
+	}
+	return cmd.Changelist
+}
+
+func changelistSQL(cmd *p4dlog.Command) string {
+	if cmd.Changelist == 0 {
+		return "NULL"
+	}
+	return fmt.Sprintf("%d", cmd.Changelist)
+}
+
 func getProcessStatement() string {
 	return `INSERT INTO process
 		(processkey, lineNumber, pid,
@@ -91,8 +115,8 @@ func getProcessStatement() string {
 		rpcSnd, rpcRcv, running,
 		netSyncFilesAdded, netSyncFilesUpdated, netSyncFilesDeleted,
 		netSyncBytesAdded, netSyncBytesAdded,
-		error)
-		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+		error, changelist)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
 }
 
 func getTableUseStatement() string {
@@ -120,7 +144,7 @@ func preparedInsert(logger *logrus.Logger, stmtProcess, stmtTableuse *sqlite3.St
 		float64(cmd.RPCSnd), float64(cmd.RPCRcv), cmd.Running,
 		cmd.NetFilesAdded, cmd.NetFilesUpdated, cmd.NetFilesDeleted,
 		cmd.NetBytesAdded, cmd.NetBytesUpdated,
-		cmd.CmdError)
+		cmd.CmdError, changelistValue(cmd))
 	if err != nil {
 		logger.Errorf("Process insert: %v pid %d, lineNo %d, %s",
 			err, cmd.Pid, cmd.LineNo, string(cmd.Cmd))
@@ -146,7 +170,7 @@ func writeSQL(f io.Writer, cmd *p4dlog.Command) int64 {
 	rows := 1
 	fmt.Fprintf(f, `INSERT INTO process VALUES ("%s",%d,%d,"%s","%s",%0.3f,%0.3f,`+
 		`"%s","%s","%s","%s","%s","%s",%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,`+
-		`%.3f,%.3f,%d,%d,%d,%d,%d,%d,"%v");`+"\n",
+		`%.3f,%.3f,%d,%d,%d,%d,%d,%d,"%v",%v);`+"\n",
 		cmd.GetKey(), cmd.LineNo, cmd.Pid, dateStr(cmd.StartTime), dateStr(cmd.EndTime),
 		cmd.ComputeLapse, cmd.CompletedLapse,
 		cmd.User, cmd.Workspace, cmd.IP, cmd.App, cmd.Cmd, cmd.Args,
@@ -156,7 +180,7 @@ func writeSQL(f io.Writer, cmd *p4dlog.Command) int64 {
 		cmd.RPCSnd, cmd.RPCRcv, cmd.Running,
 		cmd.NetFilesAdded, cmd.NetFilesUpdated, cmd.NetFilesDeleted,
 		cmd.NetBytesAdded, cmd.NetBytesUpdated,
-		cmd.CmdError)
+		cmd.CmdError, changelistSQL(cmd))
 	for _, t := range cmd.Tables {
 		rows++
 		fmt.Fprintf(f, "INSERT INTO tableuse VALUES ("+
@@ -171,6 +195,159 @@ func writeSQL(f io.Writer, cmd *p4dlog.Command) int64 {
 	return int64(rows)
 }
 
+var csvHeader = []string{"cmd", "user", "client", "ip", "start", "lapse", "ucpu", "scpu", "netfiles", "netbytes", "args", "lineno"}
+
+func writeCSVHeader(w *csv.Writer) error {
+	return w.Write(csvHeader)
+}
+
+// One row per command - csv.Writer handles quoting of args etc.
+// lineno is last so that existing column positions are unchanged.
+func writeCSV(w *csv.Writer, cmd *p4dlog.Command) error {
+	return w.Write([]string{
+		cmd.Cmd, cmd.User, cmd.Workspace, cmd.IP, dateStr(cmd.StartTime),
+		fmt.Sprintf("%0.3f", cmd.CompletedLapse),
+		fmt.Sprintf("%d", cmd.UCpu), fmt.Sprintf("%d", cmd.SCpu),
+		fmt.Sprintf("%d", cmd.NetFilesAdded+cmd.NetFilesUpdated+cmd.NetFilesDeleted),
+		fmt.Sprintf("%d", cmd.NetBytesAdded+cmd.NetBytesUpdated),
+		cmd.Args,
+		fmt.Sprintf("%d", cmd.LineNo),
+	})
+}
+
+// One JSON object per command - indented if pretty, otherwise one per line (JSON lines)
+func writeJSON(w io.Writer, cmd *p4dlog.Command, pretty bool) error {
+	if !pretty {
+		_, err := fmt.Fprintf(w, "%s\n", cmd.String())
+		return err
+	}
+	j, err := json.MarshalIndent(cmd, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", j)
+	return err
+}
+
+// cmdWriter writes cmds to whichever of the JSON, CSV and SQL outputs and the database are set
+type cmdWriter struct {
+	logger     *logrus.Logger
+	debug      int
+	json       *bufio.Writer
+	jsonPretty bool
+	flushJSON  bool // Flush after every cmd, e.g. for stdout
+	csv        *csv.Writer
+	sql        io.Writer
+	db         *sqlite3.Conn
+	batchSize  int64 // Rows per transaction for SQL output and database
+}
+
+// writeCmds writes all cmds from cmdChan, committing every batchSize rows. The final partial
+// batch is committed when cmdChan is closed, including when parsing stops early on interrupt.
+// Returns the number of transactions committed.
+func (w *cmdWriter) writeCmds(cmdChan <-chan p4dlog.Command) int {
+	var err error
+	var stmtProcess, stmtTableuse *sqlite3.Stmt
+	if w.csv != nil {
+		if err = writeCSVHeader(w.csv); err != nil {
+			w.logger.Fatalf("Error writing CSV: %v", err)
+		}
+	}
+	if w.sql != nil {
+		writeHeader(w.sql)
+		startTransaction(w.sql)
+	}
+	if w.db != nil {
+		stmt := new(bytes.Buffer)
+		writeHeader(stmt)
+		err = w.db.Exec(stmt.String())
+		if err != nil {
+			w.logger.Fatalf("%q: %s", err, stmt)
+		}
+		stmtProcess, err = w.db.Prepare(getProcessStatement())
+		if err != nil {
+			w.logger.Fatalf("Error preparing statement: %v", err)
+		}
+		defer stmtProcess.Close()
+		stmtTableuse, err = w.db.Prepare(getTableUseStatement())
+		if err != nil {
+			w.logger.Fatalf("Error preparing statement: %v", err)
+		}
+		defer stmtTableuse.Close()
+		if err = w.db.Begin(); err != nil {
+			w.logger.Errorf("begin error: %v", err)
+		}
+	}
+	commit := func() {
+		if w.db != nil {
+			if err := w.db.Commit(); err != nil {
+				w.logger.Errorf("commit error: %v", err)
+			}
+		}
+	}
+
+	commits := 0
+	rows := int64(0) // Rows in the current transaction
+	for cmd := range cmdChan {
+		if p4dlog.FlagSet(w.debug, p4dlog.DebugDatabase) {
+			w.logger.Debugf("Main processing cmd: %v", cmd.String())
+		}
+		if w.json != nil {
+			if p4dlog.FlagSet(w.debug, p4dlog.DebugJSON) {
+				w.logger.Debugf("outputting JSON")
+			}
+			if err = writeJSON(w.json, &cmd, w.jsonPretty); err != nil {
+				w.logger.Errorf("Error writing JSON: %v", err)
+			}
+			if w.flushJSON {
+				w.json.Flush()
+			}
+		}
+		if w.csv != nil {
+			if err = writeCSV(w.csv, &cmd); err != nil {
+				w.logger.Errorf("Error writing CSV: %v", err)
+			}
+		}
+		if w.sql != nil {
+			if p4dlog.FlagSet(w.debug, p4dlog.DebugDatabase) {
+				w.logger.Debugf("writing SQL")
+			}
+			rows += writeSQL(w.sql, &cmd)
+		}
+		if w.db != nil {
+			if p4dlog.FlagSet(w.debug, p4dlog.DebugDatabase) {
+				w.logger.Debugf("writing to DB")
+			}
+			j := preparedInsert(w.logger, stmtProcess, stmtTableuse, &cmd)
+			if w.sql == nil { // Avoid double counting
+				rows += j
+			}
+		}
+		if rows >= w.batchSize && (w.sql != nil || w.db != nil) {
+			if w.sql != nil {
+				writeTransaction(w.sql)
+			}
+			commit()
+			if w.db != nil {
+				if err = w.db.Begin(); err != nil {
+					w.logger.Errorf("begin error: %v", err)
+				}
+			}
+			commits++
+			rows = 0
+		}
+	}
+	if w.sql == nil && w.db == nil {
+		return commits
+	}
+	// An empty final transaction is still written as the SQL output has already begun it
+	if w.sql != nil {
+		writeTrailer(w.sql)
+	}
+	commit()
+	return commits + 1
+}
+
 func byteCountDecimal(b int64) string {
 	const unit = 1000
 	if b < unit {
@@ -184,19 +361,14 @@ func byteCountDecimal(b int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
 }
 
-func readerFromFile(file *os.File) (io.Reader, int64, error) {
+// readerFromFile - returns a reader of the log content, decompressing if gzipped, and its estimated size
+func readerFromFile(r io.Reader, fileSize int64) (io.Reader, int64, error) {
 	//create a bufio.Reader so we can 'peek' at the first few bytes
-	bReader := bufio.NewReader(file)
+	bReader := bufio.NewReader(r)
 	testBytes, err := bReader.Peek(64) //read a few bytes without consuming
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return nil, 0, err
 	}
-	var fileSize int64
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, 0, err
-	}
-	fileSize = stat.Size()
 
 	// Detect if the content is gzipped
 	contentType := http.DetectContentType(testBytes)
@@ -211,32 +383,139 @@ func readerFromFile(file *os.File) (io.Reader, int64, error) {
 	return bReader, fileSize, nil
 }
 
-// Parse single log file - output is sent via linesChan channel
-func parseLog(logger *logrus.Logger, logfile string, linesChan chan string) {
-	var file *os.File
-	if logfile == "-" {
-		file = os.Stdin
-	} else {
+func isURL(logfile string) bool {
+	return strings.HasPrefix(logfile, "http://") || strings.HasPrefix(logfile, "https://")
+}
+
+// Content-Range of a 416 response, e.g. "bytes */1234"
+var reUnsatisfiedRange = regexp.MustCompile(`^bytes \*/(\d+)$`)
+
+// openURL - streams a log from an http(s) URL, e.g. from a central log store, starting at offset.
+// Growing logs are resumed with a range request where the server supports them, otherwise the
+// first offset bytes are skipped. Returns the body, its size if known (-1 if not) and the offset
+// actually used, which is 0 if the log is smaller than offset, i.e. has been rotated.
+func openURL(ctx context.Context, logger *logrus.Logger, logURL string, offset int64) (io.ReadCloser, int64, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, logURL, nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		logger.Infof("Resuming %s from offset %d", logURL, offset)
+		size := resp.ContentLength
+		if size >= 0 {
+			size += offset
+		}
+		return resp.Body, size, offset, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		// Nothing new if the log is exactly offset bytes
+		if m := reUnsatisfiedRange.FindStringSubmatch(resp.Header.Get("Content-Range")); len(m) > 0 {
+			if size, _ := strconv.ParseInt(m[1], 10, 64); size >= offset {
+				logger.Infof("Resuming %s from offset %d", logURL, offset)
+				return io.NopCloser(strings.NewReader("")), offset, offset, nil
+			}
+		}
+		logger.Warnf("%s is smaller than the saved offset %d - assuming it has been rotated and processing from the start", logURL, offset)
+		return openURL(ctx, logger, logURL, 0)
+	case http.StatusOK:
+		if offset == 0 {
+			return resp.Body, resp.ContentLength, 0, nil
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength < offset {
+			logger.Warnf("%s is smaller than the saved offset %d - assuming it has been rotated and processing from the start", logURL, offset)
+			return resp.Body, resp.ContentLength, 0, nil
+		}
+		// Range requests not supported
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, 0, 0, fmt.Errorf("failed to skip to offset %d: %v", offset, err)
+		}
+		logger.Infof("Resuming %s from offset %d", logURL, offset)
+		return resp.Body, resp.ContentLength, offset, nil
+	}
+	resp.Body.Close()
+	return nil, 0, 0, fmt.Errorf("failed to get %s: %s", logURL, resp.Status)
+}
+
+// Parse single log file - output is sent via linesChan channel. Logfile may also be "-" for stdin or an http(s) URL.
+// If resumable, processing starts from offset and an incomplete last line (still being written) is left for the next run.
+// Returns the offset of the end of the last line processed, and false if processing was cancelled
+func parseLog(ctx context.Context, logger *logrus.Logger, logfile string, maxLineLength int, linesChan chan string,
+	offset int64, resumable bool) (int64, bool) {
+	var input io.ReadCloser
+	var inputSize int64
+	if isURL(logfile) {
 		var err error
-		file, err = os.Open(logfile)
+		input, inputSize, offset, err = openURL(ctx, logger, logfile, offset)
 		if err != nil {
 			logger.Fatal(err)
 		}
+	} else {
+		var file *os.File
+		if logfile == "-" {
+			file = os.Stdin
+		} else {
+			var err error
+			file, err = os.Open(logfile)
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			logger.Fatalf("Failed to open file: %v", err)
+		}
+		if offset > 0 {
+			if stat.Size() < offset {
+				logger.Warnf("%s is smaller than the saved offset %d - assuming it has been rotated and processing from the start", logfile, offset)
+				offset = 0
+			} else {
+				if _, err := file.Seek(offset, io.SeekStart); err != nil {
+					logger.Fatalf("Failed to seek to offset %d: %v", offset, err)
+				}
+				logger.Infof("Resuming %s from offset %d", logfile, offset)
+			}
+		}
+		input, inputSize = file, stat.Size()
 	}
-	defer file.Close()
+	defer input.Close()
 
-	const maxCapacity = 5 * 1024 * 1024
-	ctx := context.Background()
+	// Lines longer than maxLineLength are truncated by the parser, but the scanner must be able to read them first
+	maxCapacity := 5 * 1024 * 1024
+	if 2*maxLineLength > maxCapacity {
+		maxCapacity = 2 * maxLineLength
+	}
 	inbuf := make([]byte, maxCapacity)
-	reader, fileSize, err := readerFromFile(file)
+	reader, fileSize, err := readerFromFile(input, inputSize)
 	if err != nil {
 		logger.Fatalf("Failed to open file: %v", err)
 	}
+	// Offsets are into the uncompressed content so can't be resumed from - detected by content as
+	// for reading, since compressed logs don't always end with .gz
+	if _, gzipped := reader.(*gzip.Reader); gzipped && resumable {
+		logger.Fatalf("--state.file requires an uncompressed logfile but %s is gzipped", logfile)
+	}
 	logger.Debugf("Opened %s, size %v", logfile, fileSize)
 	reader = bufio.NewReaderSize(reader, maxCapacity)
 	preader := progress.NewReader(reader)
 	scanner := bufio.NewScanner(preader)
 	scanner.Buffer(inbuf, maxCapacity)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if resumable && advance > 0 && data[advance-1] != '\n' {
+			return 0, nil, nil
+		}
+		offset += int64(advance)
+		return advance, token, err
+	})
 
 	// Start a goroutine printing progress
 	go func() {
@@ -261,14 +540,14 @@ func parseLog(logger *logrus.Logger, logfile string, linesChan chan string) {
 		fmt.Fprintln(os.Stderr, "processing completed")
 	}()
 
-	const maxLineLen = 5000
 	i := 0
 	for scanner.Scan() {
-		if len(scanner.Text()) > maxLineLen {
-			line := fmt.Sprintf("%s...'", scanner.Text()[:maxLineLen])
-			linesChan <- line
-		} else {
-			linesChan <- scanner.Text()
+		line := scanner.Text()
+		select {
+		case linesChan <- line:
+		case <-ctx.Done():
+			logger.Infof("Processing of %s cancelled on line: %d", logfile, i)
+			return offset, false
 		}
 		i += 1
 	}
@@ -276,7 +555,49 @@ func parseLog(logger *logrus.Logger, logfile string, linesChan chan string) {
 	if err := scanner.Err(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to read input file on line: %d, %v\n", i, err)
 	}
+	return offset, true
+}
 
+// Writes the summary of a --validate run
+func writeValidateReport(w io.Writer, stats p4dlog.ParseStats, asJSON bool) error {
+	if asJSON {
+		j, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", j)
+		return err
+	}
+	percent := func(n int64) float64 {
+		if stats.Lines == stats.BlankLines {
+			return 0
+		}
+		return 100 * float64(n) / float64(stats.Lines-stats.BlankLines)
+	}
+	fmt.Fprintf(w, "Lines:              %d\n", stats.Lines)
+	fmt.Fprintf(w, "Blank lines:        %d\n", stats.BlankLines)
+	fmt.Fprintf(w, "Matched lines:      %d (%.1f%%)\n", stats.MatchedLines, percent(stats.MatchedLines))
+	fmt.Fprintf(w, "Unrecognised lines: %d (%.1f%%)\n", stats.UnrecognisedLines, percent(stats.UnrecognisedLines))
+	fmt.Fprintf(w, "Commands parsed:    %d\n", stats.CmdsParsed)
+	if len(stats.UnrecognisedPrefixes) == 0 {
+		return nil
+	}
+	prefixes := make([]string, 0, len(stats.UnrecognisedPrefixes))
+	for p := range stats.UnrecognisedPrefixes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		ci, cj := stats.UnrecognisedPrefixes[prefixes[i]], stats.UnrecognisedPrefixes[prefixes[j]]
+		if ci == cj {
+			return prefixes[i] < prefixes[j]
+		}
+		return ci > cj
+	})
+	fmt.Fprintf(w, "Unrecognised line prefixes:\n")
+	for _, p := range prefixes {
+		fmt.Fprintf(w, "%10d %s\n", stats.UnrecognisedPrefixes[p], p)
+	}
+	return nil
 }
 
 func getFilename(name, suffix string, requireSuffix bool, logfiles []string) string {
@@ -284,7 +605,14 @@ func getFilename(name, suffix string, requireSuffix bool, logfiles []string) str
 		if len(logfiles) == 0 {
 			name = "logs"
 		} else {
-			name = strings.TrimSuffix(logfiles[0], ".gz")
+			name = logfiles[0]
+			if isURL(name) {
+				// Output to the current directory, e.g. https://logs.example.com/p4/log.gz -> log.db
+				if u, err := url.Parse(name); err == nil {
+					name = path.Base(u.Path)
+				}
+			}
+			name = strings.TrimSuffix(name, ".gz")
 			name = strings.TrimSuffix(name, ".log")
 		}
 		if !requireSuffix && !strings.HasSuffix(name, suffix) {
@@ -314,6 +642,85 @@ func getSQLFilename(name string, logfiles []string) string {
 	return getFilename(name, ".sql", false, logfiles)
 }
 
+func getCSVFilename(name string, logfiles []string) string {
+	return getFilename(name, ".csv", false, logfiles)
+}
+
+// discoverServerIDs - server ids of SDP instances, read from <sdpRoot>/*/root/server.id (instance -> serverid).
+// Unreadable files are logged and skipped.
+func discoverServerIDs(logger *logrus.Logger, sdpRoot string) map[string]string {
+	ids := make(map[string]string)
+	files, err := filepath.Glob(filepath.Join(sdpRoot, "*", "root", "server.id"))
+	if err != nil {
+		logger.Warnf("Failed to search for SDP server.id files in %s: %v", sdpRoot, err)
+		return ids
+	}
+	for _, f := range files {
+		instance := filepath.Base(filepath.Dir(filepath.Dir(f)))
+		buf, err := os.ReadFile(f)
+		if err != nil {
+			logger.Warnf("Failed to read server.id for SDP instance %s: %v", instance, err)
+			continue
+		}
+		if id := strings.TrimSpace(string(buf)); id != "" {
+			ids[instance] = id
+		}
+	}
+	return ids
+}
+
+// logInstance - the SDP instance of a log under sdpRoot, e.g. /p4/1/logs/log -> 1, or "" if not under sdpRoot
+func logInstance(sdpRoot, logfile string) string {
+	abs, err := filepath.Abs(logfile)
+	if err != nil {
+		return ""
+	}
+	root, err := filepath.Abs(sdpRoot)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	parts := strings.SplitN(rel, string(filepath.Separator), 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[0]
+}
+
+// sdpServerID - the server id of instance, or if not set of the instance the logfiles are in.
+// Logs from more than one instance share one set of metrics so are not given a server id.
+func sdpServerID(logger *logrus.Logger, sdpRoot, instance string, logfiles []string) string {
+	if instance == "" {
+		instances := make(map[string]bool)
+		for _, f := range logfiles {
+			if i := logInstance(sdpRoot, f); i != "" {
+				instances[i] = true
+			}
+		}
+		if len(instances) > 1 {
+			logger.Warnf("Logs are from multiple SDP instances - not setting serverid. Process each instance separately, or use --server.id")
+			return ""
+		}
+		for i := range instances {
+			instance = i
+		}
+	}
+	if instance == "" {
+		return ""
+	}
+	ids := discoverServerIDs(logger, sdpRoot)
+	id, ok := ids[instance]
+	if !ok {
+		logger.Warnf("No server.id found for SDP instance %s under %s", instance, sdpRoot)
+		return ""
+	}
+	logger.Infof("Using serverid %s of SDP instance %s", id, instance)
+	return id
+}
+
 func openFile(outputName string) (*os.File, *bufio.Writer, error) {
 	var fd *os.File
 	var err error
@@ -345,7 +752,7 @@ func main() {
 	var (
 		logfiles = kingpin.Arg(
 			"logfile",
-			"Log files to process.").Strings()
+			"Log files to process - may be - for stdin or http(s) URLs.").Strings()
 		debug = kingpin.Flag(
 			"debug",
 			"Enable debugging level.",
@@ -358,10 +765,26 @@ func main() {
 			"sql",
 			"Output SQL statements (to default or --sql.output file).",
 		).Bool()
+		csvOutput = kingpin.Flag(
+			"csv",
+			"Output CSV rows, one per cmd (to default or --csv.output file).",
+		).Bool()
 		jsonOutputFile = kingpin.Flag(
 			"json.output",
-			"Name of file to which to write JSON if that flag is set. Defaults to <logfile-prefix>.json",
+			"Name of file to which to write JSON if that flag is set. Defaults to <logfile-prefix>.json. Use - for stdout (flushed per cmd, e.g. to pipe into jq).",
 		).String()
+		jsonPretty = kingpin.Flag(
+			"json.pretty",
+			"Indent JSON output rather than writing one cmd per line.",
+		).Bool()
+		csvOutputFile = kingpin.Flag(
+			"csv.output",
+			"Name of file to which to write CSV if that flag is set. Defaults to <logfile-prefix>.csv",
+		).String()
+		sqlBatchSize = kingpin.Flag(
+			"sql.batch.size",
+			"Number of rows to insert per transaction for SQL output and database.",
+		).Default(fmt.Sprintf("%d", defaultStatementsPerTransaction)).Int64()
 		sqlOutputFile = kingpin.Flag(
 			"sql.output",
 			"Name of file to which to write SQL if that flag is set. Defaults to <logfile-prefix>.sql",
@@ -380,7 +803,7 @@ func main() {
 		).Bool()
 		metricsOutputFile = kingpin.Flag(
 			"metrics.output",
-			"File to write historical metrics to in Graphite format for use with VictoriaMetrics. Default is <logfile-prefix>.metrics",
+			"File to write historical metrics to in Graphite format for use with VictoriaMetrics. Default is <logfile-prefix>.metrics - gzip compressed if it ends with .gz",
 		).Short('m').String()
 		serverID = kingpin.Flag(
 			"server.id",
@@ -390,10 +813,50 @@ func main() {
 			"sdp.instance",
 			"SDP instance if required in historical metrics. (Not usually required)",
 		).String()
+		sdpRoot = kingpin.Flag(
+			"sdp.root",
+			"If --server.id is not set it is read from <sdp.root>/<instance>/root/server.id, for --sdp.instance or the instance the logfiles are in, e.g. /p4/1/logs/log.",
+		).Default("/p4").String()
 		updateInterval = kingpin.Flag(
 			"update.interval",
 			"Update interval for historical metrics - time is assumed to advance as per time in log entries.",
 		).Default("10s").Duration()
+		alignToInterval = kingpin.Flag(
+			"align.interval",
+			"Align historical metrics to update.interval boundaries (e.g. top of each minute) rather than the time of the first log entry.",
+		).Bool()
+		replaySpeed = kingpin.Flag(
+			"replay.speed",
+			"Replay cmds at the pace they started in the log sped up by this factor, e.g. 1 for real time or 60 for an hour of log per minute, to drive live dashboards or load tests. Default is as fast as possible. Requires metrics.",
+		).Float64()
+		outputHourOfDay = kingpin.Flag(
+			"hour.of.day",
+			"Add a report of cmd counts and durations by hour of day (for the whole log) to the historical metrics.",
+		).Bool()
+		stateFile = kingpin.Flag(
+			"state.file",
+			"Save how far a single (uncompressed) log was processed to this file, and resume from there on the next run, e.g. when run hourly against a growing log. Cmds still running at the end of a run are output as incomplete, and their completion records in the next run are counted as orphans.",
+		).String()
+		graphiteAddress = kingpin.Flag(
+			"graphite.address",
+			"Also send historical metrics to this Graphite carbon endpoint (plaintext protocol), e.g. localhost:2003.",
+		).String()
+		prometheusFile = kingpin.Flag(
+			"prometheus.file",
+			"Also write each historical metrics update to this file in Prometheus format (replaced each time, e.g. for node_exporter).",
+		).String()
+		remoteWriteURL = kingpin.Flag(
+			"remote.write.url",
+			"Also send historical metrics to this Prometheus remote write endpoint, e.g. http://localhost:9090/api/v1/write. The endpoint must accept samples with old timestamps.",
+		).String()
+		pushgatewayURL = kingpin.Flag(
+			"pushgateway.url",
+			"Also push the metrics at the end of the log(s) to this Prometheus Pushgateway, e.g. http://localhost:9091, grouped by job p4dlog and serverid/sdpinst.",
+		).String()
+		remoteWriteAuth = kingpin.Flag(
+			"remote.write.auth",
+			"Authorization header for --remote.write.url, e.g. 'Bearer <token>'. Can be set with env var LOG2SQL_REMOTE_WRITE_AUTH to keep it off the command line.",
+		).Envar("LOG2SQL_REMOTE_WRITE_AUTH").String()
 		noOutputCmdsByUser = kingpin.Flag(
 			"no.output.cmds.by.user",
 			"Turns off the output of cmds_by_user - can be useful for large sites with many thousands of users.",
@@ -410,6 +873,34 @@ func main() {
 			"case.insensitive.server",
 			"Set if server is case insensitive and usernames may occur in either case.",
 		).Default("false").Bool()
+		windowStart = kingpin.Flag(
+			"start.time",
+			"Only process cmds starting at or after this time for historical metrics (RFC3339 or 'YYYY/MM/DD HH:MM:SS').",
+		).String()
+		windowEnd = kingpin.Flag(
+			"end.time",
+			"Only process cmds starting at or before this time for historical metrics (RFC3339 or 'YYYY/MM/DD HH:MM:SS').",
+		).String()
+		logTimeZone = kingpin.Flag(
+			"log.time.zone",
+			"Time zone of the p4d server which wrote the log, e.g. America/New_York (default local time zone). Used for historical metrics timestamps.",
+		).String()
+		maxLineLength = kingpin.Flag(
+			"max.line.length",
+			"Log lines longer than this are truncated (e.g. commands with huge argument lists).",
+		).Default(fmt.Sprintf("%d", metrics.DefaultMaxLineLength)).Int()
+		linePrefix = kingpin.Flag(
+			"line.prefix",
+			"Regex matching a prefix to remove from each log line before parsing, e.g. the timestamp and hostname added when logs are shipped via syslog.",
+		).String()
+		redactCmds = kingpin.Flag(
+			"redact.cmds",
+			"Comma separated list of cmds whose args are replaced by *** in output as they may contain passwords. Empty for none.",
+		).Default(strings.Join(p4dlog.DefaultRedactCommands, ",")).String()
+		validate = kingpin.Flag(
+			"validate",
+			"Parse logs and report counts of recognised/unrecognised lines only (no other output). Report is JSON if --json is also set.",
+		).Bool()
 		debugPID = kingpin.Flag(
 			"debug.pid",
 			"Set for debug output for specified PID - requires debug.cmd to be also specified.",
@@ -433,6 +924,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *maxLineLength <= 0 {
+		fmt.Printf("ERROR: --max.line.length must be greater than 0\n")
+		os.Exit(1)
+	}
+
+	if *sqlBatchSize <= 0 {
+		fmt.Printf("ERROR: --sql.batch.size must be greater than 0\n")
+		os.Exit(1)
+	}
+
+	if *stateFile != "" && (len(*logfiles) != 1 || (*logfiles)[0] == "-") {
+		fmt.Printf("ERROR: --state.file requires a single uncompressed logfile\n")
+		os.Exit(1)
+	}
+
 	if *debug > 0 {
 		// CPU profiling by default
 		defer profile.Start().Stop()
@@ -448,8 +954,8 @@ func main() {
 	startTime := time.Now()
 	logger.Infof("%v", version.Print("log2sql"))
 	logger.Infof("Starting %s, Logfiles: %v", startTime, *logfiles)
-	logger.Infof("Flags: debug %v, json/file %v/%v, sql/file %v/%v, dbName %s, noMetrics/file %v/%v",
-		*debug, *jsonOutput, *jsonOutputFile, *sqlOutput, *sqlOutputFile, *dbName, *noMetrics, *metricsOutputFile)
+	logger.Infof("Flags: debug %v, json/file %v/%v, csv/file %v/%v, sql/file/batch %v/%v/%v, dbName %s, noMetrics/file %v/%v",
+		*debug, *jsonOutput, *jsonOutputFile, *csvOutput, *csvOutputFile, *sqlOutput, *sqlOutputFile, *sqlBatchSize, *dbName, *noMetrics, *metricsOutputFile)
 	logger.Infof("       serverID %v, sdpInstance %v, updateInterval %v, noOutputCmdsByUser %v, outputCmdsByUserRegex %s caseInsensitve %v, debugPID/cmd %v/%s",
 		*serverID, *sdpInstance, *updateInterval, *noOutputCmdsByUser, *outputCmdsByUserRegex, *caseInsensitiveServer, *debugPID, *debugCmd)
 
@@ -457,6 +963,42 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+
+	// On interrupt stop reading input, so that results so far (including the
+	// final partial batch of rows) are committed before exiting.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Infof("Signal %v received - finishing", sig)
+		cancel()
+	}()
+
+	if *validate {
+		fp := p4dlog.NewP4dFileParser(logger)
+		fp.SetMaxLineLength(*maxLineLength)
+		fp.SetLinePrefixRegex(*linePrefix)
+		cmdChan := fp.LogParser(ctx, linesChan, nil)
+		go func() {
+			for _, f := range *logfiles {
+				logger.Infof("Processing: %s", f)
+				if _, ok := parseLog(ctx, logger, f, *maxLineLength, linesChan, 0, false); !ok {
+					break
+				}
+			}
+			close(linesChan)
+		}()
+		for range cmdChan {
+		}
+		if err := writeValidateReport(os.Stdout, fp.ParseStats(), *jsonOutput); err != nil {
+			logger.Fatalf("Error writing report: %v", err)
+		}
+		return
+	}
+
+	if *serverID == "" {
+		*serverID = sdpServerID(logger, *sdpRoot, *sdpInstance, *logfiles)
+	}
 	mconfig := &metrics.Config{
 		Debug:                 *debug,
 		ServerID:              *serverID,
@@ -466,11 +1008,26 @@ func main() {
 		OutputCmdsByUserRegex: *outputCmdsByUserRegex,
 		OutputCmdsByIP:        !*noOutputCmdsByIP,
 		CaseSensitiveServer:   !*caseInsensitiveServer,
+		StartTime:             *windowStart,
+		EndTime:               *windowEnd,
+		LogTimeZone:           *logTimeZone,
+		MaxLineLength:         *maxLineLength,
+		LinePrefixRegex:       *linePrefix,
+		AlignToInterval:       *alignToInterval,
+		GraphiteAddress:       *graphiteAddress,
+		PrometheusFile:        *prometheusFile,
+		RemoteWriteURL:        *remoteWriteURL,
+		RemoteWriteAuth:       *remoteWriteAuth,
+		PushgatewayURL:        *pushgatewayURL,
+		OutputHourOfDay:       *outputHourOfDay,
+		ReplaySpeed:           *replaySpeed,
+		RedactCommands:        strings.Split(*redactCmds, ","),
 	}
 
-	var fJSON, fSQL, fMetrics *bufio.Writer
-	var fdJSON, fdSQL, fdMetrics *os.File
-	var jsonFilename, sqlFilename, metricsFilename string
+	var fJSON, fCSV, fSQL, fMetrics *bufio.Writer
+	var fdJSON, fdCSV, fdSQL, fdMetrics *os.File
+	var csvWriter *csv.Writer
+	var jsonFilename, csvFilename, sqlFilename, metricsFilename string
 	if *jsonOutput {
 		jsonFilename = getJSONFilename(*jsonOutputFile, *logfiles)
 		fdJSON, fJSON, err = openFile(jsonFilename)
@@ -481,6 +1038,18 @@ func main() {
 		defer fJSON.Flush()
 		logger.Infof("Creating JSON output: %s", jsonFilename)
 	}
+	if *csvOutput {
+		csvFilename = getCSVFilename(*csvOutputFile, *logfiles)
+		fdCSV, fCSV, err = openFile(csvFilename)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer fdCSV.Close()
+		defer fCSV.Flush()
+		csvWriter = csv.NewWriter(fCSV)
+		defer csvWriter.Flush()
+		logger.Infof("Creating CSV output: %s", csvFilename)
+	}
 	if *sqlOutput {
 		sqlFilename = getSQLFilename(*sqlOutputFile, *logfiles)
 		fdSQL, fSQL, err = openFile(sqlFilename)
@@ -499,6 +1068,12 @@ func main() {
 			logger.Fatal(err)
 		}
 		defer fdMetrics.Close()
+		if strings.HasSuffix(metricsFilename, ".gz") {
+			// Appending to an existing file adds a gzip member, which readers concatenate
+			zw := gzip.NewWriter(fdMetrics)
+			defer zw.Close()
+			fMetrics = bufio.NewWriterSize(zw, 1024*1024)
+		}
 		defer fMetrics.Flush()
 		logger.Infof("Creating metrics output: %s, config: %+v", metricsFilename, mconfig)
 	}
@@ -516,25 +1091,42 @@ func main() {
 		defer db.Close()
 	}
 
+	var state metrics.HistoricalState
+	if *stateFile != "" {
+		if state, err = metrics.ReadStateFile(*stateFile); err != nil {
+			logger.Fatalf("Error reading state file: %v", err)
+		}
+		if state.Logfile != "" && state.Logfile != (*logfiles)[0] {
+			logger.Warnf("State file %s is for %s - ignoring it", *stateFile, state.Logfile)
+			state = metrics.HistoricalState{}
+		}
+		state.Logfile = (*logfiles)[0]
+	}
+	cancelled := false
+
 	var wg sync.WaitGroup
 	var mp *metrics.P4DMetrics
 	var fp *p4dlog.P4dFileParser
 	var metricsChan chan string
 	var cmdChan chan p4dlog.Command
-	needCmdChan := writeDB || *sqlOutput || *jsonOutput
+	needCmdChan := writeDB || *sqlOutput || *jsonOutput || *csvOutput
 
 	logger.Debugf("Metrics: %v, needCmdChan: %v", writeMetrics, needCmdChan)
 
 	if writeMetrics {
 		wg.Add(1)
 		logger.Debugf("Main: creating metrics")
-		mp = metrics.NewP4DMetricsLogParser(mconfig, logger, true)
+		mp = metrics.NewP4DMetrics(mconfig, logger, metrics.ModeHistorical)
 		if *debug != 0 {
 			mp.SetDebugMode(*debug)
 		}
-		if *debugPID != 0 && *debugCmd != "" {
+		if *debugPID != 0 || *debugCmd != "" {
 			mp.SetDebugPID(*debugPID, *debugCmd)
 		}
+		if err := mp.Err(); err != nil {
+			logger.Fatalf("Invalid configuration: %v", err)
+		}
+		mp.SetHistoricalState(state)
 		cmdChan, metricsChan = mp.ProcessEvents(ctx, linesChan, needCmdChan)
 
 		// Process all metrics - need to consume them even if we ignore them (overhead is minimal)
@@ -548,111 +1140,68 @@ func main() {
 
 	} else {
 		fp = p4dlog.NewP4dFileParser(logger)
-		if *debugPID != 0 && *debugCmd != "" {
+		fp.SetMaxLineLength(*maxLineLength)
+		fp.SetLinePrefixRegex(*linePrefix)
+		fp.SetRedactCommands(strings.Split(*redactCmds, ","))
+		if *debugPID != 0 || *debugCmd != "" {
 			fp.SetDebugPID(*debugPID, *debugCmd)
 		}
 		if *debug > 0 {
 			fp.SetDebugMode(*debug)
 		}
+		if err := fp.Err(); err != nil {
+			logger.Fatalf("Invalid configuration: %v", err)
+		}
 		cmdChan = fp.LogParser(ctx, linesChan, nil)
 	}
 
-	// Process all input files, sending lines into linesChan
+	// Process all input files, sending lines into linesChan. Files share a parser so cmds
+	// spanning rotated logs are matched as long as the logs are given in order.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
 		for _, f := range *logfiles {
 			logger.Infof("Processing: %s", f)
-			parseLog(logger, f, linesChan)
+			offset, ok := parseLog(ctx, logger, f, *maxLineLength, linesChan, state.Offset, *stateFile != "")
+			if !ok {
+				cancelled = true
+				break
+			}
+			state.Offset = offset
 		}
 		logger.Infof("Finished all log files")
 		close(linesChan)
 	}()
 
 	if needCmdChan {
-		var stmtProcess, stmtTableuse *sqlite3.Stmt
-		if *sqlOutput {
-			writeHeader(fSQL)
-			startTransaction(fSQL)
+		w := &cmdWriter{logger: logger, debug: *debug, jsonPretty: *jsonPretty,
+			flushJSON: jsonFilename == "-", batchSize: *sqlBatchSize}
+		if *jsonOutput {
+			w.json = fJSON
 		}
-		if writeDB {
-			stmt := new(bytes.Buffer)
-			writeHeader(stmt)
-			// startTransaction(stmt)
-			err = db.Exec(stmt.String())
-			if err != nil {
-				logger.Fatalf("%q: %s", err, stmt)
-				return
-			}
-			stmtProcess, err = db.Prepare(getProcessStatement())
-			if err != nil {
-				logger.Fatalf("Error preparing statement: %v", err)
-			}
-			stmtTableuse, err = db.Prepare(getTableUseStatement())
-			if err != nil {
-				logger.Fatalf("Error preparing statement: %v", err)
-			}
-			err = db.Begin()
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
-
-		i := int64(1)
-		for cmd := range cmdChan {
-			if p4dlog.FlagSet(*debug, p4dlog.DebugDatabase) {
-				logger.Debugf("Main processing cmd: %v", cmd.String())
-			}
-			if *jsonOutput {
-				if p4dlog.FlagSet(*debug, p4dlog.DebugJSON) {
-					logger.Debugf("outputting JSON")
-				}
-				fmt.Fprintf(fJSON, "%s\n", cmd.String())
-			}
-			if *sqlOutput {
-				if p4dlog.FlagSet(*debug, p4dlog.DebugDatabase) {
-					logger.Debugf("writing SQL")
-				}
-				i += writeSQL(fSQL, &cmd)
-			}
-			if writeDB {
-				if p4dlog.FlagSet(*debug, p4dlog.DebugDatabase) {
-					logger.Debugf("writing to DB")
-				}
-				j := preparedInsert(logger, stmtProcess, stmtTableuse, &cmd)
-				if !*sqlOutput { // Avoid double counting
-					i += j
-				}
-			}
-			if i >= statementsPerTransaction && (*sqlOutput || writeDB) {
-				if *sqlOutput {
-					writeTransaction(fSQL)
-				}
-				if writeDB {
-					err = db.Commit()
-					if err != nil {
-						logger.Errorf("commit error: %v", err)
-					}
-					err = db.Begin()
-					if err != nil {
-						fmt.Println(err)
-					}
-				}
-				i = 1
-			}
+		if *csvOutput {
+			w.csv = csvWriter
 		}
 		if *sqlOutput {
-			writeTrailer(fSQL)
+			w.sql = fSQL
 		}
 		if writeDB {
-			err = db.Commit()
-			if err != nil {
-				logger.Errorf("commit error: %v", err)
-			}
+			w.db = db
 		}
+		w.writeCmds(cmdChan)
 	}
 
 	wg.Wait()
+	if *stateFile != "" && !cancelled {
+		if mp != nil {
+			mstate := mp.HistoricalState()
+			state.LatestStartCmdBuf, state.TimeLatestStartCmd = mstate.LatestStartCmdBuf, mstate.TimeLatestStartCmd
+		}
+		if err := metrics.WriteStateFile(*stateFile, state); err != nil {
+			logger.Errorf("Error writing state file: %v", err)
+		}
+		logger.Infof("Saved state to %s: offset %d", *stateFile, state.Offset)
+	}
 	logger.Infof("Completed %s, elapsed %s", time.Now(), time.Since(startTime))
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	p4dlog "github.com/RishiMunagala/go-libp4dlog"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteCSV(t *testing.T) {
+	startTime, _ := time.Parse("2006/01/02 15:04:05", "2015/09/02 15:23:09")
+	cmd := p4dlog.Command{Cmd: "user-change", LineNo: 42, User: "fred", Workspace: "fred_ws", IP: "127.0.0.1",
+		StartTime: startTime, CompletedLapse: 0.413, UCpu: 10, SCpu: 11,
+		NetFilesAdded: 1, NetFilesUpdated: 3, NetFilesDeleted: 2, NetBytesAdded: 123, NetBytesUpdated: 456,
+		Args: `-d "my, quoted" desc`}
+
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	assert.NoError(t, writeCSVHeader(w))
+	assert.NoError(t, writeCSV(w, &cmd))
+	w.Flush()
+	assert.Equal(t, "cmd,user,client,ip,start,lapse,ucpu,scpu,netfiles,netbytes,args,lineno\n"+
+		`user-change,fred,fred_ws,127.0.0.1,2015/09/02 15:23:09,0.413,10,11,6,579,"-d ""my, quoted"" desc",42`+"\n",
+		buf.String())
+
+	// Round trip to check quoting
+	records, err := csv.NewReader(buf).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, `-d "my, quoted" desc`, records[1][10])
+	assert.Equal(t, "42", records[1][11])
+}
+
+func TestWriteValidateReport(t *testing.T) {
+	stats := p4dlog.ParseStats{Lines: 12, BlankLines: 2, MatchedLines: 7, UnrecognisedLines: 3, CmdsParsed: 2,
+		UnrecognisedPrefixes: map[string]int64{"---": 1, "server": 2}}
+	buf := new(bytes.Buffer)
+	assert.NoError(t, writeValidateReport(buf, stats, false))
+	assert.Equal(t, `Lines:              12
+Blank lines:        2
+Matched lines:      7 (70.0%)
+Unrecognised lines: 3 (30.0%)
+Commands parsed:    2
+Unrecognised line prefixes:
+         2 server
+         1 ---
+`, buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeValidateReport(buf, stats, true))
+	assert.JSONEq(t, `{"lines":12,"blankLines":2,"matchedLines":7,"unrecognisedLines":3,"cmdsParsed":2,
+		"unrecognisedPrefixes":{"---":1,"server":2}}`, buf.String())
+}
+
+func TestWriteSQLChangelist(t *testing.T) {
+	cmd := p4dlog.Command{Cmd: "dm-CommitSubmit", Pid: 25568, Changelist: 12345}
+	buf := new(bytes.Buffer)
+	writeSQL(buf, &cmd)
+	assert.True(t, strings.HasSuffix(buf.String(), `"false",12345);`+"\n"), buf.String())
+
+	buf.Reset()
+	cmd.Changelist = 0
+	writeSQL(buf, &cmd)
+	assert.True(t, strings.HasSuffix(buf.String(), `"false",NULL);`+"\n"), buf.String())
+}
+
+func testCmds(n int) chan p4dlog.Command {
+	cmdChan := make(chan p4dlog.Command, n)
+	for i := 1; i <= n; i++ {
+		cmdChan <- p4dlog.Command{Cmd: "user-sync", Pid: int64(i), LineNo: int64(i),
+			ProcessKey: fmt.Sprintf("key%d", i)}
+	}
+	return cmdChan
+}
+
+func TestWriteCmdsBatches(t *testing.T) {
+	cmdChan := testCmds(5)
+	close(cmdChan)
+	buf := new(bytes.Buffer)
+	w := &cmdWriter{logger: logrus.New(), sql: buf, batchSize: 2}
+	assert.Equal(t, 3, w.writeCmds(cmdChan))
+	assert.Equal(t, 3, strings.Count(buf.String(), "COMMIT;\n"))
+	assert.Equal(t, 3, strings.Count(buf.String(), "BEGIN TRANSACTION;\n"))
+	assert.Equal(t, 5, strings.Count(buf.String(), "INSERT INTO process"))
+}
+
+func TestWriteCmdsStopped(t *testing.T) {
+	// The parser closes cmdChan when parsing is cancelled - the rows read so far must still be committed
+	cmdChan := testCmds(3)
+	close(cmdChan)
+	name := filepath.Join(t.TempDir(), "test.db")
+	db, err := sqlite3.Open(name)
+	assert.NoError(t, err)
+	w := &cmdWriter{logger: logrus.New(), db: db, batchSize: 10}
+	assert.Equal(t, 1, w.writeCmds(cmdChan))
+	assert.NoError(t, db.Close())
+
+	db, err = sqlite3.Open(name)
+	assert.NoError(t, err)
+	defer db.Close()
+	stmt, err := db.Prepare("SELECT count(*) FROM process")
+	assert.NoError(t, err)
+	defer stmt.Close()
+	hasRow, err := stmt.Step()
+	assert.NoError(t, err)
+	assert.True(t, hasRow)
+	var count int
+	assert.NoError(t, stmt.Scan(&count))
+	assert.Equal(t, 3, count)
+}
+
+func TestWriteJSON(t *testing.T) {
+	cmd := p4dlog.Command{Cmd: "user-sync", User: "fred", Pid: 1616, Args: "//..."}
+	buf := new(bytes.Buffer)
+	assert.NoError(t, writeJSON(buf, &cmd, false))
+	assert.NoError(t, writeJSON(buf, &cmd, false))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, cmd.String(), lines[0])
+
+	buf.Reset()
+	assert.NoError(t, writeJSON(buf, &cmd, true))
+	assert.Contains(t, buf.String(), "\n  \"cmd\": \"user-sync\",\n")
+	assert.JSONEq(t, cmd.String(), buf.String())
+}
+
+func TestParseLogResume(t *testing.T) {
+	logger := logrus.New()
+	logfile := filepath.Join(t.TempDir(), "log")
+	// Last line is still being written
+	assert.NoError(t, os.WriteFile(logfile, []byte("line1\nline2\r\nline3"), 0644))
+	read := func(offset int64) (int64, []string) {
+		linesChan := make(chan string, 100)
+		offset, ok := parseLog(context.Background(), logger, logfile, 1000, linesChan, offset, true)
+		assert.True(t, ok)
+		close(linesChan)
+		lines := []string{}
+		for l := range linesChan {
+			lines = append(lines, l)
+		}
+		return offset, lines
+	}
+	offset, lines := read(0)
+	assert.Equal(t, []string{"line1", "line2"}, lines)
+	assert.Equal(t, int64(13), offset)
+
+	f, err := os.OpenFile(logfile, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(" continued\nline4\n")
+	assert.NoError(t, err)
+	f.Close()
+	offset, lines = read(offset)
+	assert.Equal(t, []string{"line3 continued", "line4"}, lines)
+	assert.Equal(t, int64(35), offset)
+
+	// Nothing new
+	offset, lines = read(offset)
+	assert.Equal(t, []string{}, lines)
+	assert.Equal(t, int64(35), offset)
+
+	// Rotated - smaller than the offset so processed from the start
+	assert.NoError(t, os.WriteFile(logfile, []byte("new1\n"), 0644))
+	offset, lines = read(offset)
+	assert.Equal(t, []string{"new1"}, lines)
+	assert.Equal(t, int64(5), offset)
+}
+
+func TestParseLogURL(t *testing.T) {
+	logger := logrus.New()
+	var m sync.Mutex
+	content := "line1\nline2\r\nline3"
+	ranges := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if !ranges {
+			w.Write([]byte(content))
+			return
+		}
+		http.ServeContent(w, r, "log", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+	setContent := func(c string, supportRanges bool) {
+		m.Lock()
+		defer m.Unlock()
+		content, ranges = c, supportRanges
+	}
+	read := func(offset int64, resumable bool) (int64, []string) {
+		linesChan := make(chan string, 100)
+		offset, ok := parseLog(context.Background(), logger, server.URL+"/logs/log", 1000, linesChan, offset, resumable)
+		assert.True(t, ok)
+		close(linesChan)
+		lines := []string{}
+		for l := range linesChan {
+			lines = append(lines, l)
+		}
+		return offset, lines
+	}
+
+	// Static file read in one go
+	_, lines := read(0, false)
+	assert.Equal(t, []string{"line1", "line2", "line3"}, lines)
+
+	// Growing file resumed with range requests
+	offset, lines := read(0, true)
+	assert.Equal(t, []string{"line1", "line2"}, lines)
+	assert.Equal(t, int64(13), offset)
+	setContent("line1\nline2\r\nline3 continued\nline4\n", true)
+	offset, lines = read(offset, true)
+	assert.Equal(t, []string{"line3 continued", "line4"}, lines)
+	assert.Equal(t, int64(35), offset)
+
+	// Nothing new
+	offset, lines = read(offset, true)
+	assert.Equal(t, []string{}, lines)
+	assert.Equal(t, int64(35), offset)
+
+	// Server without range support - already read content is skipped
+	setContent("line1\nline2\r\nline3 continued\nline4\nline5\n", false)
+	offset, lines = read(offset, true)
+	assert.Equal(t, []string{"line5"}, lines)
+	assert.Equal(t, int64(41), offset)
+
+	// Rotated - smaller than the offset so processed from the start
+	setContent("new1\n", true)
+	offset, lines = read(offset, true)
+	assert.Equal(t, []string{"new1"}, lines)
+	assert.Equal(t, int64(5), offset)
+
+	assert.Equal(t, "log.db", getDBName("", []string{server.URL + "/logs/log.gz"}))
+}
+
+func TestParseLogRotated(t *testing.T) {
+	// The sync starts in the rotated log and completes in the new one
+	dir := t.TempDir()
+	log1 := filepath.Join(dir, "log.1")
+	log2 := filepath.Join(dir, "log")
+	assert.NoError(t, os.WriteFile(log1, []byte(`Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+`), 0644))
+	assert.NoError(t, os.WriteFile(log2, []byte(`Perforce server info:
+	2015/09/02 15:23:11 pid 1616 completed 2.031s
+Perforce server info:
+	2015/09/02 15:23:20 pid 1617 completed .011s
+`), 0644))
+
+	logger := logrus.New()
+	fp := p4dlog.NewP4dFileParser(logger)
+	linesChan := make(chan string, 100)
+	cmdChan := fp.LogParser(context.Background(), linesChan, nil)
+	for _, f := range []string{log1, log2} {
+		_, ok := parseLog(context.Background(), logger, f, 1000, linesChan, 0, false)
+		assert.True(t, ok)
+	}
+	close(linesChan)
+	cmds := map[int64]p4dlog.Command{}
+	for cmd := range cmdChan {
+		cmds[cmd.Pid] = cmd
+	}
+	assert.Equal(t, 2, len(cmds))
+	assert.Equal(t, "user-sync", cmds[1616].Cmd)
+	assert.False(t, cmds[1616].Truncated)
+	assert.Equal(t, float32(2.031), cmds[1616].CompletedLapse)
+	// Start of pid 1617 was before the first log
+	assert.Equal(t, "", cmds[1617].Cmd)
+	assert.Equal(t, int64(1), fp.CmdsOrphaned())
+}
+
+func TestSDPServerID(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.InfoLevel
+	root := t.TempDir()
+	for instance, id := range map[string]string{"1": "master.1\n", "2": "edge.2"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, instance, "root"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(root, instance, "root", "server.id"), []byte(id), 0644))
+	}
+	// Instance without server.id, and one which can't be read
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "3", "root"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "4", "root", "server.id"), 0755))
+
+	assert.Equal(t, map[string]string{"1": "master.1", "2": "edge.2"}, discoverServerIDs(logger, root))
+
+	assert.Equal(t, "1", logInstance(root, filepath.Join(root, "1", "logs", "log")))
+	assert.Equal(t, "", logInstance(root, filepath.Join(root, "log")))
+	assert.Equal(t, "", logInstance(root, "/var/log/p4d.log"))
+
+	assert.Equal(t, "edge.2", sdpServerID(logger, root, "2", nil))
+	assert.Equal(t, "master.1", sdpServerID(logger, root, "", []string{filepath.Join(root, "1", "logs", "log"),
+		filepath.Join(root, "1", "logs", "log.2023-01-01.gz")}))
+	assert.Equal(t, "", sdpServerID(logger, root, "", []string{filepath.Join(root, "1", "logs", "log"),
+		filepath.Join(root, "2", "logs", "log")}))
+	assert.Equal(t, "", sdpServerID(logger, root, "3", nil))
+	assert.Equal(t, "", sdpServerID(logger, root, "4", nil))
+	assert.Equal(t, "", sdpServerID(logger, root, "", []string{"/var/log/p4d.log"}))
+	assert.Equal(t, "", sdpServerID(logger, filepath.Join(root, "missing"), "1", nil))
+}
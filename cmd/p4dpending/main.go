@@ -288,9 +288,12 @@ func main() {
 	if *debug > 0 {
 		fp.SetDebugMode(*debug)
 	}
-	if *debugPID != 0 && *debugCmd != "" {
+	if *debugPID != 0 || *debugCmd != "" {
 		fp.SetDebugPID(*debugPID, *debugCmd)
 	}
+	if err := fp.Err(); err != nil {
+		logger.Fatalf("Invalid configuration: %v", err)
+	}
 	cmdChan = fp.LogParser(ctx, linesChan, nil)
 
 	// Process all input files, sending lines into linesChan
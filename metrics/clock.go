@@ -0,0 +1,49 @@
+package metrics
+
+import "time"
+
+// Clock - source of the current time and of the ticker which triggers each output of live metrics.
+// Replace with SetClock to control flushing, e.g. in tests.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// AfterClock - optionally implemented by a Clock to control waits, as time.After, e.g. between cmds
+// replayed with Config.ReplaySpeed. Clocks which don't implement it wait in real time.
+type AfterClock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker - as time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock - the default Clock, using the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTicker) Stop() {
+	r.t.Stop()
+}
@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	p4dlog "github.com/RishiMunagala/go-libp4dlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock - a Clock whose time only changes when advance or After is called, and whose tickers
+// only tick when tick is called with their duration
+type fakeClock struct {
+	m       sync.Mutex
+	now     time.Time
+	tickers map[time.Duration]fakeTicker
+	waits   []time.Duration // Passed to After
+}
+
+type fakeTicker chan time.Time
+
+func (f fakeTicker) C() <-chan time.Time {
+	return f
+}
+
+func (f fakeTicker) Stop() {}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, tickers: make(map[time.Duration]fakeTicker)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTicker(d time.Duration) Ticker {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.tickers[d] = make(fakeTicker)
+	return f.tickers[d]
+}
+
+// After returns immediately, advancing the time by d
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.waits = append(f.waits, d)
+	f.now = f.now.Add(d)
+	c := make(chan time.Time, 1)
+	c <- f.now
+	return c
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func (f *fakeClock) tick(d time.Duration) {
+	f.m.Lock()
+	c, now := f.tickers[d], f.now
+	f.m.Unlock()
+	c <- now
+}
+
+// Waits for the parser to process n cmds in total
+func waitForCmds(t *testing.T, p4m *P4DMetrics, n int64) {
+	for i := 0; i < 100; i++ {
+		p4m.m.Lock()
+		processed := p4m.cmdsProcessed
+		p4m.m.Unlock()
+		if processed == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d cmds", n)
+}
+
+func TestFakeClock(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	fp := p4dlog.NewP4dFileParser(logger)
+	fp.SetDurations(10*time.Millisecond, 20*time.Millisecond)
+	p4m.fp = fp
+	clock := newFakeClock(time.Date(2015, 9, 2, 15, 24, 9, 0, time.UTC))
+	p4m.SetClock(clock)
+
+	linesChan := make(chan string, 100)
+	_, metricsChan := p4m.ProcessEvents(ctx, linesChan, false)
+	for _, l := range eol.Split(`Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:19 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+`, -1) {
+		linesChan <- l
+	}
+	// No output until the clock ticks
+	waitForCmds(t, p4m, 1)
+	assert.Equal(t, 0, len(metricsChan))
+
+	clock.tick(cfg.UpdateInterval)
+	output := <-metricsChan
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+	assert.Contains(t, output, `p4_prom_log_lag_seconds{serverid="myserverid"} 50.000`)
+	// Counts are reset after each output
+	clock.tick(cfg.UpdateInterval)
+	output = <-metricsChan
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 0`)
+	close(linesChan)
+	for range metricsChan {
+	}
+}
+
+func TestIdleFlush(t *testing.T) {
+	cfg := &Config{
+		ServerID:          "myserverid",
+		UpdateInterval:    time.Hour,
+		IdleFlushInterval: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	fp := p4dlog.NewP4dFileParser(logger)
+	fp.SetDurations(10*time.Millisecond, 20*time.Millisecond)
+	p4m.fp = fp
+	clock := newFakeClock(time.Date(2015, 9, 2, 15, 24, 9, 0, time.UTC))
+	p4m.SetClock(clock)
+
+	linesChan := make(chan string, 100)
+	_, metricsChan := p4m.ProcessEvents(ctx, linesChan, false)
+	for _, l := range eol.Split(`Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:19 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+`, -1) {
+		linesChan <- l
+	}
+	waitForCmds(t, p4m, 1)
+
+	// Not yet idle for long enough
+	clock.advance(30 * time.Second)
+	clock.tick(cfg.IdleFlushInterval)
+	assert.Equal(t, 0, len(metricsChan))
+
+	clock.advance(30 * time.Second)
+	clock.tick(cfg.IdleFlushInterval)
+	output := <-metricsChan
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+
+	// Only one idle flush until more cmds are processed - the next output is the regular one, reset to zero
+	clock.advance(time.Minute)
+	clock.tick(cfg.IdleFlushInterval)
+	clock.tick(cfg.UpdateInterval)
+	output = <-metricsChan
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 0`)
+	close(linesChan)
+	for range metricsChan {
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: time.Hour,
+		ReplaySpeed:    10}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p4m := NewP4DMetrics(cfg, logger, ModeHistorical)
+	fp := p4dlog.NewP4dFileParser(logger)
+	fp.SetDurations(10*time.Millisecond, 20*time.Millisecond)
+	p4m.fp = fp
+	clock := newFakeClock(time.Date(2015, 9, 2, 15, 24, 9, 0, time.UTC))
+	p4m.SetClock(clock)
+
+	linesChan := make(chan string, 100)
+	_, metricsChan := p4m.ProcessEvents(ctx, linesChan, false)
+	for _, l := range eol.Split(`Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:19 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:19 pid 1617 completed .010s
+Perforce server info:
+	2015/09/02 15:23:39 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+	2015/09/02 15:23:39 pid 1618 completed .010s
+`, -1) {
+		linesChan <- l
+	}
+	close(linesChan)
+	for range metricsChan {
+	}
+	assert.Equal(t, int64(3), p4m.cmdsProcessed)
+	// The parser doesn't output cmds in a fixed order, so waits are only bounded by the 30s of log at 10x
+	clock.m.Lock()
+	var total time.Duration
+	for _, d := range clock.waits {
+		assert.Greater(t, d, time.Duration(0))
+		total += d
+	}
+	assert.LessOrEqual(t, total, 3*time.Second)
+	clock.m.Unlock()
+
+	// In order cmds wait for the time between their starts. Cmds completing out of order don't wait,
+	// and time is measured from the latest start
+	p4m = NewP4DMetrics(cfg, logger, ModeHistorical)
+	clock = newFakeClock(time.Date(2015, 9, 2, 15, 24, 9, 0, time.UTC))
+	p4m.SetClock(clock)
+	start := time.Date(2015, 9, 2, 15, 23, 39, 0, time.UTC)
+	for _, offset := range []time.Duration{0, 10 * time.Second, 5 * time.Second, 30 * time.Second, 35 * time.Second} {
+		assert.True(t, p4m.replayWait(ctx, start.Add(offset)))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 500 * time.Millisecond}, clock.waits)
+
+	// Cancelled while waiting in real time
+	p4m.SetClock(realClock{})
+	cancel()
+	assert.False(t, p4m.replayWait(ctx, start.Add(time.Hour)))
+}
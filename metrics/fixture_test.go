@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// fixtureMetrics - runs testdata/<name>.log through ProcessEvents and returns the final metrics, sorted and
+// without the metrics which vary per run. The interval ticker never fires (see oneOutputTest) so the result
+// doesn't depend on how long processing takes.
+func fixtureMetrics(t *testing.T, cfg *Config, name string) string {
+	input, err := os.ReadFile(filepath.Join("testdata", name+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0)
+	for _, line := range oneOutputTest(t, cfg, string(input), false) {
+		if !hasPrefix(variableMetrics, line) {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// checkGolden - compares metrics with testdata/<name>.golden, or rewrites it if run with -update
+func checkGolden(t *testing.T, name, metrics string) {
+	golden := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(metrics), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v - run with -update to create it", err)
+	}
+	assert.Equal(t, string(expected), metrics, "%s differs - if the change is intended run: go test -run %s -update", golden, t.Name())
+}
+
+func TestFixtures(t *testing.T) {
+	for _, name := range []string{"sync-heavy", "lock-contended", "trigger-heavy"} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{
+				ServerID:         "myserverid",
+				UpdateInterval:   10 * time.Millisecond,
+				OutputCmdsByUser: true,
+				OutputCmdsByIP:   true}
+			checkGolden(t, name, fixtureMetrics(t, cfg, name))
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults for sending historical metrics to a Graphite carbon endpoint (plaintext protocol)
+const (
+	graphiteBufferSize  = 1000
+	graphiteAttempts    = 5
+	graphiteDialTimeout = 10 * time.Second
+	graphiteRetryDelay  = 2 * time.Second
+)
+
+// GraphiteSender streams Graphite formatted metrics to a carbon endpoint over TCP.
+// Metrics are buffered (up to a limit) and written by a background goroutine which
+// reconnects on failure.
+type GraphiteSender struct {
+	addr       string
+	logger     *logrus.Logger
+	conn       net.Conn
+	buf        chan string
+	wg         sync.WaitGroup
+	retryDelay time.Duration
+	m          sync.Mutex
+	dropped    int64
+}
+
+// NewGraphiteSender - returns a sender for addr, e.g. localhost:2003, and starts its writer goroutine.
+// Call Close when finished to flush any buffered metrics.
+func NewGraphiteSender(addr string, logger *logrus.Logger) *GraphiteSender {
+	g := &GraphiteSender{
+		addr:       addr,
+		logger:     logger,
+		buf:        make(chan string, graphiteBufferSize),
+		retryDelay: graphiteRetryDelay,
+	}
+	g.wg.Add(1)
+	go g.run()
+	return g
+}
+
+// Send queues metrics for sending - never blocks. If the buffer is full the metrics are dropped.
+func (g *GraphiteSender) Send(metrics string) {
+	select {
+	case g.buf <- metrics:
+	default:
+		g.m.Lock()
+		g.dropped++
+		g.m.Unlock()
+		g.logger.Warnf("Graphite buffer full, dropping metrics for %s", g.addr)
+	}
+}
+
+// Dropped returns the count of metrics batches dropped due to a full buffer or repeated send failures
+func (g *GraphiteSender) Dropped() int64 {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.dropped
+}
+
+// Close sends any buffered metrics and closes the connection
+func (g *GraphiteSender) Close() {
+	close(g.buf)
+	g.wg.Wait()
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+}
+
+func (g *GraphiteSender) run() {
+	defer g.wg.Done()
+	for metrics := range g.buf {
+		if err := g.write(metrics); err != nil {
+			g.m.Lock()
+			g.dropped++
+			g.m.Unlock()
+			g.logger.Errorf("Failed to send metrics to graphite %s after %d attempts: %v", g.addr, graphiteAttempts, err)
+		}
+	}
+}
+
+// write sends metrics, (re)connecting as required
+func (g *GraphiteSender) write(metrics string) error {
+	var err error
+	for attempt := 1; attempt <= graphiteAttempts; attempt++ {
+		if attempt > 1 {
+			g.logger.Warnf("Retrying send to graphite %s: %v", g.addr, err)
+			time.Sleep(g.retryDelay)
+		}
+		if g.conn == nil {
+			if g.conn, err = net.DialTimeout("tcp", g.addr, graphiteDialTimeout); err != nil {
+				g.conn = nil
+				continue
+			}
+		}
+		if _, err = g.conn.Write([]byte(metrics)); err == nil {
+			return nil
+		}
+		g.conn.Close()
+		g.conn = nil
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Carbon listener which sends all lines received (on any connection) to the returned channel
+func newTestCarbon(t *testing.T, addr string) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lines := make(chan string, 1000)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				scanner := bufio.NewScanner(c)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}(conn)
+		}
+	}()
+	return l, lines
+}
+
+func readLines(lines chan string, count int) []string {
+	result := make([]string, 0)
+	for len(result) < count {
+		select {
+		case line := <-lines:
+			result = append(result, line)
+		case <-time.After(5 * time.Second):
+			return result
+		}
+	}
+	return result
+}
+
+func TestGraphiteSender(t *testing.T) {
+	l, lines := newTestCarbon(t, "127.0.0.1:0")
+	defer l.Close()
+
+	g := NewGraphiteSender(l.Addr().String(), logger)
+	g.Send("p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389\n")
+	g.Send("p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 2 1441207449\n")
+	g.Close()
+	assert.Equal(t, []string{
+		"p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389",
+		"p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 2 1441207449"}, readLines(lines, 2))
+	assert.Equal(t, int64(0), g.Dropped())
+}
+
+func TestGraphiteSenderReconnect(t *testing.T) {
+	// Endpoint is down when the first metrics are sent, and comes up while retrying
+	l, _ := newTestCarbon(t, "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	g := NewGraphiteSender(addr, logger)
+	g.retryDelay = 100 * time.Millisecond
+	g.Send("p4_test 1 1441207389\n")
+	time.Sleep(50 * time.Millisecond)
+	l, lines := newTestCarbon(t, addr)
+	defer l.Close()
+	g.Close()
+	assert.Equal(t, []string{"p4_test 1 1441207389"}, readLines(lines, 1))
+	assert.Equal(t, int64(0), g.Dropped())
+}
+
+func TestGraphiteHistorical(t *testing.T) {
+	l, lines := newTestCarbon(t, "127.0.0.1:0")
+	defer l.Close()
+
+	cfg := &Config{
+		ServerID:        "myserverid",
+		UpdateInterval:  10 * time.Millisecond,
+		GraphiteAddress: l.Addr().String()}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	output := basicTest(t, cfg, input, true)
+	received := readLines(lines, len(output))
+	assert.Equal(t, len(output), len(received))
+	found := false
+	for _, line := range received {
+		if strings.HasPrefix(line, "p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 ") {
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
@@ -11,13 +11,20 @@ package metrics
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	p4dlog "github.com/RishiMunagala/go-libp4dlog"
+	"github.com/perforce/p4prometheus/version"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,87 +35,481 @@ import (
 // In addition any backslashes must be double quoted for node_exporter.
 var NotLabelValueRE = regexp.MustCompile(`[^a-zA-Z0-9_/+:@{}&%<>*\\.,\(\)\[\]-]`)
 
+// labelNameRE - valid Prometheus label names. Names starting with __ are reserved.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 // Config for metrics
 type Config struct {
-	Debug                 int           `yaml:"debug"`
-	ServerID              string        `yaml:"server_id"`
-	SDPInstance           string        `yaml:"sdp_instance"`
-	UpdateInterval        time.Duration `yaml:"update_interval"`
-	OutputCmdsByUser      bool          `yaml:"output_cmds_by_user"`
-	OutputCmdsByUserRegex string        `yaml:"output_cmds_by_user_regex"`
-	OutputCmdsByIP        bool          `yaml:"output_cmds_by_ip"`
-	CaseSensitiveServer   bool          `yaml:"case_sensitive_server"`
+	Debug                    int               `yaml:"debug"`
+	ServerID                 string            `yaml:"server_id"`
+	SDPInstance              string            `yaml:"sdp_instance"`
+	UpdateInterval           time.Duration     `yaml:"update_interval"`
+	OutputCmdsByUser         bool              `yaml:"output_cmds_by_user"`
+	OutputCmdsByUserRegex    string            `yaml:"output_cmds_by_user_regex"`
+	OutputCmdsByIP           bool              `yaml:"output_cmds_by_ip"`
+	CaseSensitiveServer      bool              `yaml:"case_sensitive_server"`
+	OutputOpenMetrics        bool              `yaml:"output_openmetrics"`
+	StartTime                string            `yaml:"start_time"` // Historical only: ignore cmds starting before this
+	EndTime                  string            `yaml:"end_time"`   // Historical only: ignore cmds starting after this
+	Quantiles                []float64         `yaml:"quantiles"`  // e.g. [0.5, 0.9, 0.99] - if set p4_cmd_duration_seconds is output
+	NormalizeProgramVersions bool              `yaml:"normalize_program_versions"`
+	OutputCmdsByDepot        bool              `yaml:"output_cmds_by_depot"`
+	OutputCmdsByPlatform     bool              `yaml:"output_cmds_by_platform"`
+	DepotDepth               int               `yaml:"depot_depth"`            // Number of depot path components, default 2, e.g. //depot/main
+	MaxLineLength            int               `yaml:"max_line_length"`        // Longer log lines are truncated, default DefaultMaxLineLength
+	PushgatewayURL           string            `yaml:"pushgateway_url"`        // If set, final metrics are pushed here at end of input, in Prometheus format
+	JobName                  string            `yaml:"job_name"`               // Pushgateway job name, default p4dlog
+	AlignToInterval          bool              `yaml:"align_to_interval"`      // Historical only: output on UpdateInterval boundaries, e.g. top of each minute
+	GraphiteAddress          string            `yaml:"graphite_address"`       // If set, metrics are also sent to this carbon endpoint in Graphite format, e.g. localhost:2003
+	PrometheusFile           string            `yaml:"prometheus_file"`        // If set, each update is also written here in Prometheus format, e.g. for node_exporter - gzipped if *.gz
+	RemoteWriteURL           string            `yaml:"remote_write_url"`       // If set, each update is also sent here with the Prometheus remote write protocol
+	RemoteWriteAuth          string            `yaml:"remote_write_auth"`      // Authorization header for RemoteWriteURL, e.g. Bearer <token>
+	MaxLabelValueLen         int               `yaml:"max_label_value_len"`    // If set, longer label values are truncated, ending with LabelValueTruncatedSuffix
+	SummaryLogging           bool              `yaml:"summary_logging"`        // Live only: log a summary of each interval at INFO, e.g. busiest cmd and user
+	RedactCommands           []string          `yaml:"redact_commands"`        // Args of these cmds are redacted, default p4dlog.DefaultRedactCommands
+	PendingWarnThreshold     int               `yaml:"pending_warn_threshold"` // If set, log a warning when pending cmds exceed this
+	PendingTimeout           time.Duration     `yaml:"pending_timeout"`        // If set, cmds pending longer than this (in log time) are output as truncated
+	MaxPendingCmds           int               `yaml:"max_pending_cmds"`       // If set, caps memory used by pending cmds - see PendingOverflow
+	PendingOverflow          string            `yaml:"pending_overflow"`       // PendingOverflowBlock (default) or PendingOverflowShed
+	ExtraLabels              map[string]string `yaml:"extra_labels"`           // Added to every metric, e.g. {region: eu-west, tier: prod}
+	OutputHourOfDay          bool              `yaml:"output_hour_of_day"`     // Historical only: output a report of cmds by hour of day at end of log
+	TriggerClasses           []TriggerClass    `yaml:"trigger_classes"`        // If set, trigger metrics have a class label - first matching regex wins
+	MetricPrefix             string            `yaml:"metric_prefix"`          // Replaces p4 in metric names, e.g. perforce_prod -> perforce_prod_cmd_counter
+	SlowCommandThreshold     time.Duration     `yaml:"slow_command_threshold"` // If set, cmds taking at least this long are logged at WARN with full detail
+	SlowCommandLogLimit      int               `yaml:"slow_command_log_limit"` // Max slow cmds logged per UpdateInterval, default DefaultSlowCommandLogLimit
+	// If set, p4_cmd_latency_ewma_seconds is output: an exponentially weighted moving average of cmd duration
+	// which is not reset each interval. Alpha (0 < alpha <= 1) is the weight given to each new cmd, so higher
+	// values track changes faster. The weight of older cmds halves every ln(0.5)/ln(1-alpha) cmds, e.g. 0.1 ~= 6.6 cmds.
+	LatencyEWMAAlpha float64 `yaml:"latency_ewma_alpha"`
+	// Cmds taking longer than this are counted by p4_cmd_long_running_total, default DefaultLongRunningThreshold
+	LongRunningThreshold time.Duration `yaml:"long_running_threshold"`
+	// If set, each output only includes series whose value changed since the previous output, plus a full
+	// snapshot every DeltaFullEvery outputs (default DefaultDeltaFullEvery), to reduce I/O for large sites.
+	// The tradeoff is staleness: readers which only see the latest output (e.g. node_exporter reading
+	// PrometheusFile) lose unchanged series until the next snapshot, so it suits sinks which keep the last
+	// value received such as Graphite.
+	DeltaOutput bool `yaml:"delta_output"`
+	// Outputs between full snapshots when DeltaOutput is set, default DefaultDeltaFullEvery
+	DeltaFullEvery int `yaml:"delta_full_every"`
+	// If > 1, only every Nth cmd is counted in the by-user, by-user detail and by-program metrics, with
+	// the sampled counts and cumulative seconds multiplied by N, to reduce per-cmd overhead on very busy
+	// servers. Totals are then estimates: accurate for users/programs running many cmds, but those running
+	// fewer than N cmds may be missed or overcounted. Aggregate metrics such as p4_cmd_counter are exact.
+	DetailSampleRate int `yaml:"detail_sample_rate"`
+	// If set, p4_cmd_topn_seconds is output for the TopN cmds by cumulative seconds in each interval,
+	// a low cardinality alternative to the full by cmd metrics
+	TopN int `yaml:"top_n"`
+	// IANA time zone of the server writing the log, e.g. "America/New_York" - p4d logs local times with no
+	// zone. Used for historical timestamps and the start/end time window. Defaults to the local zone.
+	LogTimeZone string `yaml:"log_time_zone"`
+	// Prefix of the table names which p4d trigger records are stored as, reported by the p4_trigger_* metrics
+	// rather than as tables. Defaults to p4dlog.DefaultTriggerPrefix.
+	TriggerPrefix string `yaml:"trigger_prefix"`
+	// Background/maintenance cmds, output as p4_maint_cmd_* rather than p4_cmd_* so they don't skew
+	// user facing latency. They still count towards health metrics such as p4_cmd_running_max and
+	// p4_unique_users. Names may be given with or without the "user-" prefix. If not set
+	// DefaultMaintenanceCmds are used - set to an empty list to treat all cmds alike.
+	MaintenanceCmds []string `yaml:"maintenance_cmds"`
+	// If set, p4_cmd_apilevel_counter is output: cmds by client protocol level, e.g. to see when it's safe to
+	// drop support for old clients. Cmds whose level isn't logged are not counted.
+	OutputCmdsByAPILevel bool `yaml:"output_cmds_by_api_level"`
+	// Live only: if set, and no cmds have been processed for this long, metrics are output and reset early
+	// rather than waiting for the next UpdateInterval, so dashboards are current when the log goes quiet.
+	// Idleness is checked every IdleFlushInterval so the flush happens within twice this of the last cmd.
+	// Only one early output is made per quiet period.
+	IdleFlushInterval time.Duration `yaml:"idle_flush_interval"`
+	// If set, p4_cmd_duration_seconds quantiles cover cmds completed within roughly this window of log
+	// time, rather than being reset each interval, and _sum and _count are cumulative. Useful for
+	// long-running processes with short update intervals, where per interval estimates are noisy.
+	QuantileWindow time.Duration `yaml:"quantile_window"`
+	// If set, user, client and IP label values are replaced by a hash of the value with AnonymizeSalt,
+	// e.g. for sharing metrics externally. The same value always gives the same hash for a given salt,
+	// so series are stable. Regexes such as OutputCmdsByUserRegex still match the original names.
+	AnonymizeLabels bool   `yaml:"anonymize_labels"`
+	AnonymizeSalt   string `yaml:"anonymize_salt"`
+	// Regexes which must match the whole table name as in the table label, e.g. "rev|have|locks".
+	// If either is set, only included and not excluded tables are output individually by the table lock
+	// and page metrics, the rest being summed as table OtherTableLabel.
+	IncludeTables string `yaml:"include_tables"`
+	ExcludeTables string `yaml:"exclude_tables"`
+	// Historical only: if > 0 cmds are published at the pace they started in the log, sped up by
+	// this factor, e.g. 1 for real time or 60 for an hour of log per minute, rather than as fast as
+	// possible. For driving dashboards or load tests from an old log.
+	ReplaySpeed float64 `yaml:"replay_speed"`
+	// If both set, RetryStormThreshold or more cmds with the same user, cmd and client starting within
+	// RetryStormWindow are counted as a retry storm by p4_cmd_retry_storm_total, e.g. a failing CI job
+	// retrying in a loop. A storm continuing for another RetryStormThreshold cmds is counted again.
+	RetryStormThreshold int           `yaml:"retry_storm_threshold"`
+	RetryStormWindow    time.Duration `yaml:"retry_storm_window"`
+	// If set, text matching this regex at the start of each line is removed before parsing, e.g.
+	// `\w{3} [ \d]\d \d\d:\d\d:\d\d \S+ p4d\[\d+\]: ` for logs shipped via syslog
+	LinePrefixRegex string `yaml:"line_prefix_regex"`
+}
+
+// DefaultMaintenanceCmds - cmds run for server maintenance such as checkpoints (p4 admin) and verification
+var DefaultMaintenanceCmds = []string{"admin", "dbstat", "dbverify", "journaldbchecksums", "verify"}
+
+// LabelValueTruncatedSuffix - ends label values truncated due to Config.MaxLabelValueLen.
+// Only uses chars allowed by NotLabelValueRE.
+const LabelValueTruncatedSuffix = "..."
+
+// Values of Config.PendingOverflow - what happens when Config.MaxPendingCmds is set.
+// Block stops parsing of the log at MaxPendingCmds pending cmds until completed ones have been output, so a
+// slow consumer blocks reading of the log (backpressure), and caps channel buffers to MaxPendingCmds.
+// Shed outputs the oldest pending cmds once there are more than MaxPendingCmds, as incomplete if still
+// running, counted by p4_prom_shed_total. See p4dlog.P4dFileParser.SetMaxPending.
+const (
+	PendingOverflowBlock = "block"
+	PendingOverflowShed  = "shed"
+)
+
+// DefaultSlowCommandLogLimit - default for Config.SlowCommandLogLimit
+const DefaultSlowCommandLogLimit = 10
+
+// DefaultLongRunningThreshold - default for Config.LongRunningThreshold
+const DefaultLongRunningThreshold = 30 * time.Second
+
+// DefaultDeltaFullEvery - default for Config.DeltaFullEvery
+const DefaultDeltaFullEvery = 10
+
+// DefaultMetricPrefix - default for Config.MetricPrefix
+const DefaultMetricPrefix = "p4"
+
+// metricPrefixRE - valid start of a Prometheus metric name
+var metricPrefixRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// TriggerClass - triggers with names matching Regex are labelled with Class, e.g. swarm.* -> swarm
+type TriggerClass struct {
+	Regex string `yaml:"regex"`
+	Class string `yaml:"class"`
+}
+
+// OtherTableLabel - table label of tables filtered out by Config.IncludeTables/ExcludeTables
+const OtherTableLabel = "other"
+
+// DefaultTriggerClass - class of triggers not matching any of Config.TriggerClasses
+const DefaultTriggerClass = "other"
+
+type triggerClassRE struct {
+	re    *regexp.Regexp
+	class string
 }
 
+// DefaultMaxLineLength - default for Config.MaxLineLength
+const DefaultMaxLineLength = 1024 * 1024
+
 // P4DMetrics structure
 type P4DMetrics struct {
+	m                         sync.Mutex // Protects the values below which are updated by publishEvent
 	config                    *Config
 	historical                bool
 	debug                     int
 	fp                        *p4dlog.P4dFileParser
 	timeLatestStartCmd        time.Time
+	timeLastFlush             time.Time // Time of previous output, for rates - log time if historical
+	intervalCmds              int64     // Cmds published since last reset (live) or output (historical)
+	intervalCPU               float64   // User+system CPU seconds of cmds published since last reset
 	latestStartCmdBuf         string
 	logger                    *logrus.Logger
 	metricWriter              io.Writer
+	pushRetryDelay            time.Duration
 	timeChan                  chan time.Time
+	fpLinesChan               chan string         // Set by ProcessEvents, lines for the parser
+	cmdsInChan                chan p4dlog.Command // Set by ProcessEvents, cmds output by the parser
+	remoteWrite               *RemoteWriteSender  // Set by ProcessEvents if Config.RemoteWriteURL is set
 	cmdRunning                int64
+	cmdRunningMax             int64
+	cmdsPendingMax            int64
+	pendingWarned             bool
+	slowCmdsLogged            int  // Slow cmds logged this interval
+	slowCmdsSuppressed        int  // Slow cmds not logged this interval due to SlowCommandLogLimit
+	flushing                  bool // Set while building the output for the end of an interval, see flushMetricsBuffer
 	cmdCounter                map[string]int64
-	cmdErrorCounter           map[string]int64
+	cmdErrorCounter           map[string]map[string]int64 // cmd -> severity -> count
+	cmdOutcomeCounter         map[string]map[string]int64 // cmd -> outcome -> count
+	cmdGovernorRejections     map[string]int64
+	cmdGovernorHits           map[string]map[string]int64 // cmd -> limit -> count, never reset
+	cmdTruncatedCounter       map[string]int64
+	cmdIncompleteCounter      map[string]int64       // Never reset, as a counter
+	cmdLongRunningCounter     map[string]int64       // Cmds exceeding Config.LongRunningThreshold
+	retryStormStarts          map[string][]time.Time // Recent start times by user/cmd/client, see Config.RetryStormThreshold
+	retryStormCounter         map[string]int64       // By user, never reset
+	cmdsForwarded             int64                  // Cmds forwarded by a replica/edge, never reset
+	cmdsDirect                int64                  // Cmds from clients connected directly, never reset
 	cmdCumulative             map[string]float64
 	cmduCPUCumulative         map[string]float64
+	cmdLockWaitCumulative     map[string]float64
+	cmdLockHeldCumulative     map[string]float64
 	cmdsCPUCumulative         map[string]float64
 	cmdByUserCounter          map[string]int64
+	uniqueUsers               map[string]bool
+	uniqueClients             map[string]bool
+	uniqueIPs                 map[string]bool
 	cmdByUserCumulative       map[string]float64
+	userCmdIntervals          map[string][]cmdInterval // Cmds since last output - used to calculate userConcurrentMax
+	userConcurrentMax         map[string]int64
 	cmdByIPCounter            map[string]int64
 	cmdByIPCumulative         map[string]float64
 	cmdByReplicaCounter       map[string]int64
 	cmdByReplicaCumulative    map[string]float64
 	cmdByProgramCounter       map[string]int64
 	cmdByProgramCumulative    map[string]float64
+	cmdByDepotCounter         map[string]int64
+	cmdByPlatformCounter      map[string]int64
+	cmdByAPILevelCounter      map[string]int64
+	cmdByDepotBytes           map[string]int64
 	cmdByUserDetailCounter    map[string]map[string]int64
 	cmdByUserDetailCumulative map[string]map[string]float64
 	totalReadWait             map[string]float64
 	totalReadHeld             map[string]float64
 	totalWriteWait            map[string]float64
 	totalWriteHeld            map[string]float64
+	totalPeekCount            map[string]int64 // Only tables with peek (lockless read) locks
+	totalPeekWait             map[string]float64
+	totalPeekHeld             map[string]float64
+	totalPagesIn              map[string]int64 // Never reset, as counters
+	totalPagesOut             map[string]int64
+	maxPagesCached            map[string]int64 // Max reported by a cmd this interval
 	totalTriggerLapse         map[string]float64
+	triggerCounter            map[string]int64
+	triggerMaxLapse           map[string]float64
+	triggerFailures           map[string]int64 // Never reset - only triggers which have failed
+	quantiles                 []float64
+	ewmaAlpha                 float64            // Validated Config.LatencyEWMAAlpha, 0 if not output
+	cmdLatencyEWMA            map[string]float64 // Never reset
+	deltaPrev                 map[string]string  // Series -> value last output, if Config.DeltaOutput
+	deltaOutputs              int                // Count of outputs, if Config.DeltaOutput
+	deltaFull                 bool               // Current output is a full snapshot
+	detailSampleCount         int64              // Cmds published, for Config.DetailSampleRate
+	extraLabels               []labelStruct      // Validated Config.ExtraLabels, sorted by name
+	metricPrefix              string             // Validated Config.MetricPrefix including trailing _
+	triggerClasses            []triggerClassRE
+	includeTables             *regexp.Regexp // From Config.IncludeTables
+	excludeTables             *regexp.Regexp
+	triggerClass              map[string]string // trigger -> class, cached
+	hourOfDayCounter          [24]int64         // Historical only - for OutputHourOfDay report
+	hourOfDayCumulative       [24]float64
+	cmdDurationSummary        map[string]*cmdSummary
 	syncFilesAdded            int64
 	syncFilesUpdated          int64
 	syncFilesDeleted          int64
 	syncBytesAdded            int64
 	syncBytesUpdated          int64
+	cmdNetFilesAdded          map[string]int64
+	cmdNetFilesUpdated        map[string]int64
+	cmdNetFilesDeleted        map[string]int64
+	cmdNetBytesAdded          map[string]int64
+	cmdNetBytesUpdated        map[string]int64
+	cmdNetBytesSent           map[string]int64
+	cmdNetBytesRcvd           map[string]int64
+	cmdIntegFiles             map[string]int64
+	pullSeen                  bool  // Only output pull metrics for replicas/edges
+	pullFiles                 int64 // Archive files transferred by pull -u threads
+	pullBytes                 int64
+	pullQueueDepth            int64 // Estimated from rdb.lbr puts (pull -i) less deletes (pull -u)
+	cmdResolveFiles           map[string]int64
 	cmdsProcessed             int64
 	linesRead                 int64
 	outputCmdsByUserRegex     *regexp.Regexp
+	scratch                   []byte // Reused by printMetric for formatting each series
+	windowStart               time.Time
+	windowEnd                 time.Time
+	logLocation               *time.Location // From LogTimeZone
+	triggerPrefix             string
+	clock                     Clock
+	maintCmds                 map[string]bool // From MaintenanceCmds
+	replayLast                time.Time       // Latest start time of cmds replayed with Config.ReplaySpeed
+	maintCmdCounter           map[string]map[string]int64
+	maintCmdCumulative        map[string]float64
+	maintCmduCPUCumulative    map[string]float64
+	maintCmdsCPUCumulative    map[string]float64
 }
 
-// NewP4DMetricsLogParser - wraps P4dFileParser
+// Mode says whether a log is being tailed or processed after the event, see NewP4DMetrics
+type Mode int
+
+const (
+	// ModeLive - for tailing a running server's log, e.g. p4prometheus. Metrics are output every
+	// UpdateInterval of wall clock time in Prometheus text format with HELP/TYPE lines and without
+	// timestamps, so the scraper or node_exporter time stamps them. Optional sinks such as a
+	// Pushgateway and IdleFlushInterval only apply in this mode.
+	ModeLive Mode = iota
+	// ModeHistorical - for processing old logs, e.g. log2sql. Output is driven by log time: whenever
+	// the log passes another UpdateInterval. The primary format is Graphite plaintext (labels are
+	// ;name=value tags, no HELP/TYPE lines) and every value is time stamped with the log time so it can
+	// be back filled into a time series database. Config.StartTime/EndTime and OutputHourOfDay only apply
+	// in this mode, and rates are per second of log time.
+	ModeHistorical
+)
+
+// NewP4DMetricsLogParser - wraps P4dFileParser.
+//
+// Deprecated: use NewP4DMetrics, which takes a Mode rather than a bare historical bool.
 func NewP4DMetricsLogParser(config *Config, logger *logrus.Logger, historical bool) *P4DMetrics {
+	mode := ModeLive
+	if historical {
+		mode = ModeHistorical
+	}
+	return NewP4DMetrics(config, logger, mode)
+}
+
+// NewP4DMetrics - wraps P4dFileParser, producing metrics as described for mode
+func NewP4DMetrics(config *Config, logger *logrus.Logger, mode Mode) *P4DMetrics {
+	historical := mode == ModeHistorical
+	quantiles := make([]float64, 0)
+	for _, q := range config.Quantiles {
+		if q <= 0 || q >= 1 {
+			logger.Errorf("Ignoring invalid quantile %v - must be between 0 and 1", q)
+			continue
+		}
+		quantiles = append(quantiles, q)
+	}
+	ewmaAlpha := config.LatencyEWMAAlpha
+	if ewmaAlpha < 0 || ewmaAlpha > 1 {
+		logger.Errorf("Ignoring invalid latency EWMA alpha %v - must be between 0 and 1", ewmaAlpha)
+		ewmaAlpha = 0
+	}
+	extraLabels := make([]labelStruct, 0)
+	for name, value := range config.ExtraLabels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			logger.Errorf("Ignoring invalid extra label name %q", name)
+			continue
+		}
+		if name == "serverid" || name == "sdpinst" {
+			logger.Errorf("Ignoring extra label %q - use ServerID/SDPInstance", name)
+			continue
+		}
+		extraLabels = append(extraLabels, labelStruct{name: name, value: NotLabelValueRE.ReplaceAllString(value, "_")})
+	}
+	sort.Slice(extraLabels, func(i, j int) bool { return extraLabels[i].name < extraLabels[j].name })
+	triggerClasses := make([]triggerClassRE, 0)
+	for _, tc := range config.TriggerClasses {
+		re, err := regexp.Compile(tc.Regex)
+		if err != nil {
+			logger.Errorf("Ignoring invalid trigger class regex %q: %v", tc.Regex, err)
+			continue
+		}
+		triggerClasses = append(triggerClasses, triggerClassRE{re: re, class: NotLabelValueRE.ReplaceAllString(tc.Class, "_")})
+	}
+	includeTables := compileTablesRegex(config.IncludeTables, logger)
+	excludeTables := compileTablesRegex(config.ExcludeTables, logger)
+	logLocation := time.Local
+	if config.LogTimeZone != "" {
+		if loc, err := time.LoadLocation(config.LogTimeZone); err == nil {
+			logLocation = loc
+		} else {
+			logger.Errorf("Ignoring invalid log time zone %q - using local time: %v", config.LogTimeZone, err)
+		}
+	}
+	triggerPrefix := config.TriggerPrefix
+	if triggerPrefix == "" {
+		triggerPrefix = p4dlog.DefaultTriggerPrefix
+	}
+	maintNames := config.MaintenanceCmds
+	if maintNames == nil {
+		maintNames = DefaultMaintenanceCmds
+	}
+	maintCmds := make(map[string]bool, len(maintNames))
+	for _, c := range maintNames {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "-") {
+			c = "user-" + c
+		}
+		maintCmds[c] = true
+	}
+	metricPrefix := DefaultMetricPrefix
+	if config.MetricPrefix != "" {
+		if metricPrefixRE.MatchString(config.MetricPrefix) {
+			metricPrefix = strings.TrimSuffix(config.MetricPrefix, "_")
+		} else {
+			logger.Errorf("Ignoring invalid metric prefix %q - using %s", config.MetricPrefix, DefaultMetricPrefix)
+		}
+	}
 	return &P4DMetrics{
+		metricPrefix:              metricPrefix + "_",
+		triggerClasses:            triggerClasses,
+		includeTables:             includeTables,
+		excludeTables:             excludeTables,
+		triggerClass:              make(map[string]string),
 		config:                    config,
 		logger:                    logger,
 		fp:                        p4dlog.NewP4dFileParser(logger),
 		historical:                historical,
 		cmdCounter:                make(map[string]int64),
-		cmdErrorCounter:           make(map[string]int64),
+		cmdErrorCounter:           make(map[string]map[string]int64),
+		cmdOutcomeCounter:         make(map[string]map[string]int64),
+		cmdGovernorRejections:     make(map[string]int64),
+		cmdGovernorHits:           make(map[string]map[string]int64),
+		uniqueUsers:               make(map[string]bool),
+		uniqueClients:             make(map[string]bool),
+		uniqueIPs:                 make(map[string]bool),
+		cmdTruncatedCounter:       make(map[string]int64),
+		cmdIncompleteCounter:      make(map[string]int64),
+		cmdLongRunningCounter:     make(map[string]int64),
+		retryStormStarts:          make(map[string][]time.Time),
+		retryStormCounter:         make(map[string]int64),
 		cmdCumulative:             make(map[string]float64),
 		cmduCPUCumulative:         make(map[string]float64),
+		cmdLockWaitCumulative:     make(map[string]float64),
+		cmdLockHeldCumulative:     make(map[string]float64),
 		cmdsCPUCumulative:         make(map[string]float64),
 		cmdByUserCounter:          make(map[string]int64),
 		cmdByUserCumulative:       make(map[string]float64),
+		userCmdIntervals:          make(map[string][]cmdInterval),
+		userConcurrentMax:         make(map[string]int64),
 		cmdByIPCounter:            make(map[string]int64),
 		cmdByIPCumulative:         make(map[string]float64),
 		cmdByReplicaCounter:       make(map[string]int64),
 		cmdByReplicaCumulative:    make(map[string]float64),
 		cmdByProgramCounter:       make(map[string]int64),
 		cmdByProgramCumulative:    make(map[string]float64),
+		cmdByDepotCounter:         make(map[string]int64),
+		cmdByPlatformCounter:      make(map[string]int64),
+		cmdByAPILevelCounter:      make(map[string]int64),
+		cmdNetFilesAdded:          make(map[string]int64),
+		cmdNetFilesUpdated:        make(map[string]int64),
+		cmdNetFilesDeleted:        make(map[string]int64),
+		cmdNetBytesAdded:          make(map[string]int64),
+		cmdIntegFiles:             make(map[string]int64),
+		cmdResolveFiles:           make(map[string]int64),
+		cmdNetBytesUpdated:        make(map[string]int64),
+		cmdNetBytesSent:           make(map[string]int64),
+		cmdNetBytesRcvd:           make(map[string]int64),
+		cmdByDepotBytes:           make(map[string]int64),
 		cmdByUserDetailCounter:    make(map[string]map[string]int64),
 		cmdByUserDetailCumulative: make(map[string]map[string]float64),
 		totalReadWait:             make(map[string]float64),
 		totalReadHeld:             make(map[string]float64),
 		totalWriteWait:            make(map[string]float64),
 		totalWriteHeld:            make(map[string]float64),
+		totalPeekCount:            make(map[string]int64),
+		totalPeekWait:             make(map[string]float64),
+		totalPeekHeld:             make(map[string]float64),
+		totalPagesIn:              make(map[string]int64),
+		totalPagesOut:             make(map[string]int64),
+		maxPagesCached:            make(map[string]int64),
 		totalTriggerLapse:         make(map[string]float64),
+		triggerCounter:            make(map[string]int64),
+		triggerMaxLapse:           make(map[string]float64),
+		triggerFailures:           make(map[string]int64),
+		quantiles:                 quantiles,
+		ewmaAlpha:                 ewmaAlpha,
+		cmdLatencyEWMA:            make(map[string]float64),
+		deltaPrev:                 make(map[string]string),
+		extraLabels:               extraLabels,
+		cmdDurationSummary:        make(map[string]*cmdSummary),
+		pushRetryDelay:            5 * time.Second,
+		logLocation:               logLocation,
+		triggerPrefix:             triggerPrefix,
+		clock:                     realClock{},
+		maintCmds:                 maintCmds,
+		maintCmdCounter:           make(map[string]map[string]int64),
+		maintCmdCumulative:        make(map[string]float64),
+		maintCmduCPUCumulative:    make(map[string]float64),
+		maintCmdsCPUCumulative:    make(map[string]float64),
 	}
 }
 
@@ -117,74 +518,562 @@ func (p4m *P4DMetrics) SetDebugPID(pid int64, cmdName string) {
 	p4m.fp.SetDebugPID(pid, cmdName)
 }
 
+// Err - any invalid parser configuration, e.g. from SetDebugPID - see p4dlog.P4dFileParser.Err.
+// Check before calling ProcessEvents, which processes no lines if set.
+func (p4m *P4DMetrics) Err() error {
+	return p4m.fp.Err()
+}
+
 // SetDebugMode - for debug purposes
 func (p4m *P4DMetrics) SetDebugMode(level int) {
 	p4m.debug = level
 	p4m.fp.SetDebugMode(level)
 }
 
+// SetClock - replaces the real clock, e.g. to drive the output of live metrics in tests.
+// Call before ProcessEvents.
+func (p4m *P4DMetrics) SetClock(clock Clock) {
+	p4m.clock = clock
+}
+
+// replayWait - waits for the time since the previous replayed cmd started, scaled by
+// Config.ReplaySpeed. Cmds are parsed in completion order so may start before the previous one, in
+// which case there is no wait. Returns false if cancelled.
+func (p4m *P4DMetrics) replayWait(ctx context.Context, start time.Time) bool {
+	if start.IsZero() {
+		return true
+	}
+	if p4m.replayLast.IsZero() || !start.After(p4m.replayLast) {
+		if p4m.replayLast.IsZero() {
+			p4m.replayLast = start
+		}
+		return true
+	}
+	d := time.Duration(float64(start.Sub(p4m.replayLast)) / p4m.config.ReplaySpeed)
+	p4m.replayLast = start
+	var after <-chan time.Time
+	if clock, ok := p4m.clock.(AfterClock); ok {
+		after = clock.After(d)
+	} else {
+		after = time.After(d)
+	}
+	select {
+	case <-after:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // defines metrics label
 type labelStruct struct {
 	name  string
 	value string
 }
 
-func (p4m *P4DMetrics) printMetricHeader(f io.Writer, name string, help string, metricType string) {
-	if !p4m.historical {
-		fmt.Fprintf(f, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+// OpenMetrics units which are recognised from the metric name suffix
+var openMetricsUnits = []string{"seconds", "bytes"}
+
+// metricsFormat - metrics are accumulated once and can be formatted for more than one sink
+type metricsFormat int
+
+const (
+	formatPrometheus metricsFormat = iota
+	formatGraphite
+)
+
+// metricsBuffer - metrics being output, one buffer per format, with the primary format first
+type metricsBuffer struct {
+	formats   []metricsFormat
+	bufs      []bytes.Buffer
+	timestamp time.Time // Of the metrics - log time if historical
+}
+
+// newMetricsBuffer - the primary format is Graphite for historical and Prometheus otherwise.
+// Other formats are only added if another sink needs them (Config.GraphiteAddress/PrometheusFile/RemoteWriteURL/PushgatewayURL).
+func (p4m *P4DMetrics) newMetricsBuffer() *metricsBuffer {
+	formats := []metricsFormat{formatPrometheus}
+	timestamp := p4m.clock.Now()
+	if p4m.historical {
+		formats[0] = formatGraphite
+		timestamp = p4m.timeLatestStartCmd
+		if p4m.config.PrometheusFile != "" || p4m.config.RemoteWriteURL != "" || p4m.config.PushgatewayURL != "" {
+			formats = append(formats, formatPrometheus)
+		}
+	} else if p4m.config.GraphiteAddress != "" {
+		formats = append(formats, formatGraphite)
+	}
+	return &metricsBuffer{formats: formats, bufs: make([]bytes.Buffer, len(formats)), timestamp: timestamp}
+}
+
+// String - metrics in the primary format
+func (mb *metricsBuffer) String() string {
+	return mb.bufs[0].String()
+}
+
+// format - metrics in format f, or "" if not required
+func (mb *metricsBuffer) format(f metricsFormat) string {
+	for i := range mb.formats {
+		if mb.formats[i] == f {
+			return mb.bufs[i].String()
+		}
+	}
+	return ""
+}
+
+// append - adds the metrics in other, which must have been created with the same formats
+func (mb *metricsBuffer) append(other *metricsBuffer) {
+	for i := range mb.bufs {
+		mb.bufs[i].Write(other.bufs[i].Bytes())
+	}
+}
+
+// openMetrics - true if Prometheus output is in OpenMetrics text format. Exemplars are not
+// output as they link samples to trace IDs, which p4d logs don't record.
+func (p4m *P4DMetrics) openMetrics(f metricsFormat) bool {
+	return p4m.config.OutputOpenMetrics && f == formatPrometheus
+}
+
+// metricName - applies Config.MetricPrefix to names which are all defined with a p4_ prefix
+func (p4m *P4DMetrics) metricName(name string) string {
+	if p4m.metricPrefix == "" || p4m.metricPrefix == DefaultMetricPrefix+"_" {
+		return name
+	}
+	return p4m.metricPrefix + strings.TrimPrefix(name, DefaultMetricPrefix+"_")
+}
+
+func (p4m *P4DMetrics) printMetricHeader(metrics *metricsBuffer, name string, help string, metricType string) {
+	for i, f := range metrics.formats {
+		if f == formatPrometheus {
+			p4m.writeMetricHeader(&metrics.bufs[i], f, name, help, metricType)
+		}
+	}
+}
+
+// writeMetricHeader - Prometheus HELP/TYPE lines, not used by Graphite
+func (p4m *P4DMetrics) writeMetricHeader(w io.Writer, f metricsFormat, name string, help string, metricType string) {
+	name = p4m.metricName(name)
+	if p4m.openMetrics(f) && metricType == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	if p4m.openMetrics(f) {
+		// OpenMetrics requires the unit to be a suffix of the metric family name
+		for _, unit := range openMetricsUnits {
+			if strings.HasSuffix(name, "_"+unit) {
+				fmt.Fprintf(w, "# UNIT %s %s\n", name, unit)
+			}
+		}
 	}
 }
 
 // Prometheus format: 	metric_name{label1="val1",label2="val2"}
 // Graphite format:  	metric_name;label1=val1;label2=val2
-func (p4m *P4DMetrics) formatLabels(mname string, labels []labelStruct) string {
-	nonBlankLabels := make([]labelStruct, 0)
+// Appended to b to avoid allocating per series.
+func (p4m *P4DMetrics) appendLabels(b []byte, f metricsFormat, mname string, metricType string, labels []labelStruct) []byte {
+	b = p4m.appendMetricName(b, mname)
+	if p4m.openMetrics(f) && metricType == "counter" {
+		// OpenMetrics counter samples have the _total suffix, the family name does not
+		b = append(bytes.TrimSuffix(b, []byte("_total")), "_total"...)
+	}
+	sep := byte(';')
+	if f == formatPrometheus {
+		b = append(b, '{')
+		sep = ','
+	}
+	first := true
 	for _, l := range labels {
-		if l.value != "" {
-			if !p4m.historical {
-				l.value = fmt.Sprintf("\"%s\"", l.value)
-			}
-			nonBlankLabels = append(nonBlankLabels, l)
+		if l.value == "" {
+			continue
+		}
+		if !first || f == formatGraphite {
+			b = append(b, sep)
+		}
+		first = false
+		b = append(b, l.name...)
+		b = append(b, '=')
+		if f == formatPrometheus {
+			b = append(b, '"')
+			b = appendLabelValue(b, p4m.truncateLabelValue(l.value))
+			b = append(b, '"')
+		} else {
+			b = appendLabelValue(b, p4m.truncateLabelValue(l.value))
+		}
+	}
+	if f == formatPrometheus {
+		b = append(b, '}')
+	}
+	return b
+}
+
+// appendLabelValue - control chars, which would break the line based output formats, are dropped
+func appendLabelValue(b []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c >= ' ' && c != 0x7f {
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// appendMetricName - as metricName without allocating
+func (p4m *P4DMetrics) appendMetricName(b []byte, name string) []byte {
+	if p4m.metricPrefix == "" || p4m.metricPrefix == DefaultMetricPrefix+"_" {
+		return append(b, name...)
+	}
+	b = append(b, p4m.metricPrefix...)
+	return append(b, strings.TrimPrefix(name, DefaultMetricPrefix+"_")...)
+}
+
+// truncateLabelValue - limits value to Config.MaxLabelValueLen bytes including the suffix, without splitting a UTF-8 char
+func (p4m *P4DMetrics) truncateLabelValue(value string) string {
+	max := p4m.config.MaxLabelValueLen
+	if max <= 0 || len(value) <= max {
+		return value
+	}
+	n := max - len(LabelValueTruncatedSuffix)
+	if n < 1 {
+		n = 1
+	}
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return value[:n] + LabelValueTruncatedSuffix
+}
+
+func (p4m *P4DMetrics) appendMetric(b []byte, f metricsFormat, mname string, metricType string, labels []labelStruct, metricVal string) []byte {
+	b = p4m.appendLabels(b, f, mname, metricType, labels)
+	b = append(b, ' ')
+	b = append(b, metricVal...)
+	if f == formatGraphite {
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, p4m.timeLatestStartCmd.Unix(), 10)
+	}
+	return append(b, '\n')
+}
+
+// printMetric - called for every series so formats into p4m.scratch rather than allocating.
+// metricType is as passed to printMetricHeader for the metric.
+func (p4m *P4DMetrics) printMetric(metrics *metricsBuffer, mname string, metricType string, labels []labelStruct, metricVal string) {
+	if p4m.flushing && p4m.config.DeltaOutput && !p4m.deltaChanged(mname, labels, metricVal) {
+		return
+	}
+	for i, f := range metrics.formats {
+		p4m.scratch = p4m.appendMetric(p4m.scratch[:0], f, mname, metricType, labels, metricVal)
+		if p4dlog.FlagSet(p4m.debug, p4dlog.DebugMetricStats) {
+			p4m.logger.Debugf(string(p4m.scratch))
+		}
+		writeEscaped(&metrics.bufs[i], p4m.scratch)
+	}
+}
+
+// writeEscaped writes b doubling any backslashes, as required by node_exporter
+func writeEscaped(buf *bytes.Buffer, b []byte) {
+	for {
+		j := bytes.IndexByte(b, '\\')
+		if j < 0 {
+			buf.Write(b)
+			return
+		}
+		buf.Write(b[:j+1])
+		buf.WriteByte('\\')
+		b = b[j+1:]
+	}
+}
+
+// GetCumulativeMetrics - returns current metrics in the same format as output by ProcessEvents.
+// Safe to call from other goroutines while events are being processed, e.g. an HTTP handler.
+func (p4m *P4DMetrics) GetCumulativeMetrics() string {
+	return p4m.getCumulativeMetrics()
+}
+
+// Snapshot - returns the metrics for the interval so far, in the same format as output at the end
+// of each interval but always in full (Config.DeltaOutput doesn't apply). It has no side effects.
+// Together with Reset this lets embedders decide when an interval ends, e.g. to report on each
+// file or day of historical logs. Events published between Snapshot and Reset are lost, so stop
+// feeding events first if that matters.
+func (p4m *P4DMetrics) Snapshot() string {
+	return p4m.getCumulativeMetrics()
+}
+
+// Reset - ends the interval as done after each output of live metrics: interval values are cleared
+// and the per interval bookkeeping done, e.g. the SlowCommandLogLimit count is restarted.
+// Cumulative values such as p4_cmd_cumulative_seconds are kept, as are the parser's counts.
+func (p4m *P4DMetrics) Reset() {
+	p4m.endInterval()
+	p4m.resetToZero()
+}
+
+// compileTablesRegex - nil if not set or invalid, anchored to match whole table names
+func compileTablesRegex(regex string, logger *logrus.Logger) *regexp.Regexp {
+	if regex == "" {
+		return nil
+	}
+	re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", regex))
+	if err != nil {
+		logger.Errorf("Ignoring invalid tables regex %q: %v", regex, err)
+		return nil
+	}
+	return re
+}
+
+// tableLabel - the table, or OtherTableLabel if filtered out by Config.IncludeTables/ExcludeTables
+func (p4m *P4DMetrics) tableLabel(table string) string {
+	if (p4m.includeTables != nil && !p4m.includeTables.MatchString(table)) ||
+		(p4m.excludeTables != nil && p4m.excludeTables.MatchString(table)) {
+		return OtherTableLabel
+	}
+	return table
+}
+
+// foldTables - the totals by tableLabel, or totals itself if no tables are filtered
+func (p4m *P4DMetrics) foldTables(totals map[string]float64) map[string]float64 {
+	if p4m.includeTables == nil && p4m.excludeTables == nil {
+		return totals
+	}
+	result := make(map[string]float64, len(totals))
+	for table, total := range totals {
+		result[p4m.tableLabel(table)] += total
+	}
+	return result
+}
+
+// foldTableCounts - as foldTables for counts
+func (p4m *P4DMetrics) foldTableCounts(totals map[string]int64) map[string]int64 {
+	if p4m.includeTables == nil && p4m.excludeTables == nil {
+		return totals
+	}
+	result := make(map[string]int64, len(totals))
+	for table, total := range totals {
+		result[p4m.tableLabel(table)] += total
+	}
+	return result
+}
+
+// foldTableMax - as foldTableCounts for maximums
+func (p4m *P4DMetrics) foldTableMax(maxes map[string]int64) map[string]int64 {
+	if p4m.includeTables == nil && p4m.excludeTables == nil {
+		return maxes
+	}
+	result := make(map[string]int64, len(maxes))
+	for table, max := range maxes {
+		label := p4m.tableLabel(table)
+		if current, ok := result[label]; !ok || max > current {
+			result[label] = max
+		}
+	}
+	return result
+}
+
+// classifyTrigger - the class of the first matching Config.TriggerClasses regex, or DefaultTriggerClass
+func (p4m *P4DMetrics) classifyTrigger(trigger string) string {
+	for _, tc := range p4m.triggerClasses {
+		if tc.re.MatchString(trigger) {
+			return tc.class
 		}
 	}
-	vals := make([]string, 0)
-	for _, l := range nonBlankLabels {
-		vals = append(vals, fmt.Sprintf("%s=%s", l.name, l.value))
+	return DefaultTriggerClass
+}
+
+// triggerLabels - class label is only added if Config.TriggerClasses is set
+func (p4m *P4DMetrics) triggerLabels(fixedLabels []labelStruct, trigger string) []labelStruct {
+	labels := append(fixedLabels, labelStruct{"trigger", trigger})
+	if len(p4m.triggerClasses) > 0 {
+		labels = append(labels, labelStruct{"class", p4m.triggerClass[trigger]})
+	}
+	return labels
+}
+
+// getFixedLabels - labels on every metric. Exact capacity so that appending per metric labels always copies.
+func (p4m *P4DMetrics) getFixedLabels() []labelStruct {
+	fixedLabels := make([]labelStruct, 0, len(p4m.extraLabels)+2)
+	fixedLabels = append(fixedLabels, p4m.extraLabels...)
+	return append(fixedLabels, labelStruct{name: "serverid", value: p4m.config.ServerID},
+		labelStruct{name: "sdpinst", value: p4m.config.SDPInstance})
+}
+
+// getHourOfDayReport - historical cmd counts and durations bucketed by hour of day of cmd start (log time) for
+// the whole log, e.g. to find quiet windows for checkpoints. Output once at the end rather than
+// per interval, with all hours present so that quiet hours show as zero.
+func (p4m *P4DMetrics) getHourOfDayReport() *metricsBuffer {
+	p4m.m.Lock()
+	defer p4m.m.Unlock()
+	fixedLabels := p4m.getFixedLabels()
+	metrics := p4m.newMetricsBuffer()
+	mname := "p4_cmd_hour_of_day_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds by hour of day for the whole log", "gauge")
+	for hour, count := range p4m.hourOfDayCounter {
+		labels := append(fixedLabels, labelStruct{"hour", fmt.Sprintf("%02d", hour)})
+		p4m.printMetric(metrics, mname, "gauge", labels, fmt.Sprintf("%d", count))
+	}
+	mname = "p4_cmd_hour_of_day_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in seconds of completed p4 cmds by hour of day for the whole log", "gauge")
+	for hour, lapse := range p4m.hourOfDayCumulative {
+		labels := append(fixedLabels, labelStruct{"hour", fmt.Sprintf("%02d", hour)})
+		p4m.printMetric(metrics, mname, "gauge", labels, fmt.Sprintf("%0.3f", lapse))
 	}
+	return metrics
+}
+
+// cmdRate returns cmds per second since the previous output - which may be less than UpdateInterval
+// ago, e.g. after an idle flush or a Reset by an embedder. Historical mode uses log timestamps, which
+// have a resolution of one second so that is the minimum historical interval.
+func (p4m *P4DMetrics) cmdRate() float64 {
+	interval := p4m.config.UpdateInterval.Seconds()
 	if p4m.historical {
-		labelStr := strings.Join(vals, ";")
-		if len(labelStr) > 0 {
-			return fmt.Sprintf("%s;%s", mname, labelStr)
+		interval = p4m.timeLatestStartCmd.Sub(p4m.timeLastFlush).Seconds()
+		if interval < 1 {
+			interval = 1
 		}
-		return fmt.Sprintf("%s", mname)
+	} else if !p4m.timeLastFlush.IsZero() {
+		interval = p4m.clock.Now().Sub(p4m.timeLastFlush).Seconds()
+	}
+	if interval <= 0 {
+		return 0
+	}
+	return float64(p4m.intervalCmds) / interval
+}
+
+// checkPending records the high-water mark of pending cmds, warning once each time the threshold is exceeded
+func (p4m *P4DMetrics) checkPending(pending int64) {
+	if pending > p4m.cmdsPendingMax {
+		p4m.cmdsPendingMax = pending
+	}
+	threshold := int64(p4m.config.PendingWarnThreshold)
+	if threshold <= 0 {
+		return
+	}
+	if pending > threshold && !p4m.pendingWarned {
+		p4m.logger.Warnf("Pending cmds %d exceeds threshold %d - completion records may be missing from the log", pending, threshold)
+		p4m.pendingWarned = true
+	} else if pending <= threshold {
+		p4m.pendingWarned = false
+	}
+}
+
+// logSlowCmd dumps details of cmds exceeding SlowCommandThreshold, up to SlowCommandLogLimit per interval.
+// This captures slow outliers without knowing their pids in advance (see SetDebugPID).
+func (p4m *P4DMetrics) logSlowCmd(cmd *p4dlog.Command) {
+	threshold := p4m.config.SlowCommandThreshold
+	if threshold <= 0 || float64(cmd.CompletedLapse) < threshold.Seconds() {
+		return
+	}
+	limit := p4m.config.SlowCommandLogLimit
+	if limit <= 0 {
+		limit = DefaultSlowCommandLogLimit
+	}
+	if p4m.slowCmdsLogged >= limit {
+		p4m.slowCmdsSuppressed++
+		return
+	}
+	p4m.slowCmdsLogged++
+	p4m.logger.Warnf("Slow cmd %s pid %d took %0.3fs: %s", cmd.Cmd, cmd.Pid, cmd.CompletedLapse, cmd.String())
+}
+
+// resetSlowCmds restarts the slow cmd rate limit at the end of each interval
+func (p4m *P4DMetrics) resetSlowCmds() {
+	if p4m.slowCmdsSuppressed > 0 {
+		p4m.logger.Warnf("%d further slow cmds not logged - limit %d per interval", p4m.slowCmdsSuppressed, p4m.slowCmdsLogged)
 	}
-	labelStr := strings.Join(vals, ",")
-	return fmt.Sprintf("%s{%s}", mname, labelStr)
+	p4m.slowCmdsLogged = 0
+	p4m.slowCmdsSuppressed = 0
 }
 
-func (p4m *P4DMetrics) formatMetric(mname string, labels []labelStruct, metricVal string) string {
+// endInterval - bookkeeping once the output for an interval has been sent. Values which are
+// reset each interval are left to resetToZero, which is not done in historical mode.
+func (p4m *P4DMetrics) endInterval() {
+	p4m.m.Lock()
+	defer p4m.m.Unlock()
+	p4m.resetSlowCmds()
+	p4m.updateUserConcurrency()
 	if p4m.historical {
-		return fmt.Sprintf("%s %s %d\n", p4m.formatLabels(mname, labels),
-			metricVal, p4m.timeLatestStartCmd.Unix())
+		p4m.timeLastFlush = p4m.timeLatestStartCmd
+	} else {
+		p4m.timeLastFlush = p4m.clock.Now()
 	}
-	return fmt.Sprintf("%s %s\n", p4m.formatLabels(mname, labels), metricVal)
+	p4m.intervalCmds = 0
 }
 
-func (p4m *P4DMetrics) printMetric(metrics *bytes.Buffer, mname string, labels []labelStruct, metricVal string) {
-	buf := p4m.formatMetric(mname, labels, metricVal)
-	if p4dlog.FlagSet(p4m.debug, p4dlog.DebugMetricStats) {
-		p4m.logger.Debugf(buf)
+// buildInfoLabels - version details set at build time via ldflags, see the Makefiles
+func buildInfoLabels() []labelStruct {
+	labels := make([]labelStruct, 0, 3)
+	for _, l := range []labelStruct{{"version", version.Version}, {"revision", version.Revision}, {"goversion", version.GoVersion}} {
+		if l.value == "" {
+			l.value = "unknown"
+		}
+		labels = append(labels, labelStruct{name: l.name, value: NotLabelValueRE.ReplaceAllString(l.value, "_")})
+	}
+	return labels
+}
+
+// startDeltaOutput - decides whether the next output is a full snapshot, if Config.DeltaOutput
+func (p4m *P4DMetrics) startDeltaOutput() {
+	fullEvery := p4m.config.DeltaFullEvery
+	if fullEvery <= 0 {
+		fullEvery = DefaultDeltaFullEvery
+	}
+	p4m.deltaFull = p4m.deltaOutputs%fullEvery == 0
+	p4m.deltaOutputs++
+}
+
+// deltaChanged - true if the series is to be output: its value has changed or this is a full snapshot
+func (p4m *P4DMetrics) deltaChanged(mname string, labels []labelStruct, metricVal string) bool {
+	// The type only changes the suffix of OpenMetrics counter samples, so isn't needed for the key
+	p4m.scratch = p4m.appendLabels(p4m.scratch[:0], formatPrometheus, mname, "", labels)
+	prev, ok := p4m.deltaPrev[string(p4m.scratch)]
+	if !ok || prev != metricVal {
+		p4m.deltaPrev[string(p4m.scratch)] = metricVal
 	}
-	// node_exporter requires doubling of backslashes
-	buf = strings.Replace(buf, `\`, "\\\\", -1)
-	fmt.Fprint(metrics, buf)
+	return p4m.deltaFull || !ok || prev != metricVal
 }
 
-// Publish cumulative results - called on a ticker or in historical mode
+// Publish cumulative results in the primary format
 func (p4m *P4DMetrics) getCumulativeMetrics() string {
-	fixedLabels := []labelStruct{{name: "serverid", value: p4m.config.ServerID},
-		{name: "sdpinst", value: p4m.config.SDPInstance}}
-	metrics := new(bytes.Buffer)
+	return p4m.getMetricsBuffer().String()
+}
+
+// getMetricsBuffer - cumulative results in all formats, without changing any state
+func (p4m *P4DMetrics) getMetricsBuffer() *metricsBuffer {
+	return p4m.buildMetricsBuffer(false)
+}
+
+// flushMetricsBuffer - results in all formats for output at the end of an interval - on a ticker
+// or in historical mode. Unlike getMetricsBuffer this applies Config.DeltaOutput, rotates windowed
+// quantiles and records the pending cmds high-water mark. Call endInterval once output.
+func (p4m *P4DMetrics) flushMetricsBuffer() *metricsBuffer {
+	return p4m.buildMetricsBuffer(true)
+}
+
+func (p4m *P4DMetrics) buildMetricsBuffer(flush bool) *metricsBuffer {
+	// Parser values are read before locking - the parser can block sending cmds to publishEvent
+	// while holding its own lock
+	pending := int64(p4m.fp.CmdsPendingCount())
+	shed := p4m.fp.CmdsShed()
+	orphans := p4m.fp.CmdsOrphaned()
+	restarts, lastRestart := p4m.fp.ServerRestarts()
+	var remoteWriteDropped int64
+	if p4m.remoteWrite != nil {
+		remoteWriteDropped = p4m.remoteWrite.Dropped()
+	}
+	p4m.m.Lock()
+	defer p4m.m.Unlock()
+	p4m.flushing = flush
+	defer func() { p4m.flushing = false }()
+	pendingMax := p4m.cmdsPendingMax
+	if flush {
+		if p4m.config.DeltaOutput {
+			p4m.startDeltaOutput()
+		}
+		for _, summary := range p4m.cmdDurationSummary {
+			summary.rotate(p4m.timeLatestStartCmd)
+		}
+		p4m.checkPending(pending)
+		pendingMax = p4m.cmdsPendingMax
+	} else if pending > pendingMax {
+		pendingMax = pending
+	}
+	fixedLabels := p4m.getFixedLabels()
+	metrics := p4m.newMetricsBuffer()
 	if p4dlog.FlagSet(p4m.debug, p4dlog.DebugMetricStats) {
 		p4m.logger.Debugf("Writing stats")
 	}
@@ -194,111 +1083,477 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 	mname = "p4_prom_log_lines_read"
 	p4m.printMetricHeader(metrics, mname, "A count of log lines read", "gauge")
 	metricVal = fmt.Sprintf("%d", p4m.linesRead)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	mname = "p4_prom_build_info"
+	p4m.printMetricHeader(metrics, mname, "A metric with a constant '1' value labelled by the version and revision the exporter was built from", "gauge")
+	p4m.printMetric(metrics, mname, "gauge", append(fixedLabels, buildInfoLabels()...), "1")
+
+	mname = "p4_prom_log_lag_seconds"
+	p4m.printMetricHeader(metrics, mname, "How far the latest log time is behind the wall clock - growth indicates stalled or lagging log ingestion (0 if historical)", "gauge")
+	metricVal = fmt.Sprintf("%0.3f", p4m.logLag(p4m.clock.Now()))
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	mname = "p4_prom_log_lines_truncated"
+	p4m.printMetricHeader(metrics, mname, "A count of log lines truncated due to exceeding max line length", "counter")
+	metricVal = fmt.Sprintf("%d", p4m.fp.LinesTruncated())
+	p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
+
+	if badLines := p4m.fp.BadLines(); badLines > 0 {
+		mname = "p4_prom_bad_lines_total"
+		p4m.printMetricHeader(metrics, mname, "A count of log lines with invalid UTF-8 or control chars, which were repaired before parsing", "counter")
+		metricVal = fmt.Sprintf("%d", badLines)
+		p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
+	}
 
 	mname = "p4_prom_cmds_processed"
 	p4m.printMetricHeader(metrics, mname, "A count of all cmds processed", "counter")
 	metricVal = fmt.Sprintf("%d", p4m.cmdsProcessed)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
+
+	mname = "p4_cmd_rate_per_second"
+	p4m.printMetricHeader(metrics, mname, "The rate of cmds completed per second over the last update interval", "gauge")
+	metricVal = fmt.Sprintf("%0.3f", p4m.cmdRate())
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	// Only known once a startup banner has been seen
+	if restarts > 0 {
+		mname = "p4_server_restart_timestamp"
+		p4m.printMetricHeader(metrics, mname, "The time (unix seconds) of the latest p4d restart seen in the log", "gauge")
+		metricVal = fmt.Sprintf("%d", p4m.logTime(lastRestart).Unix())
+		p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+		mname = "p4_server_restarts_total"
+		p4m.printMetricHeader(metrics, mname, "A count of p4d restarts seen in the log", "counter")
+		metricVal = fmt.Sprintf("%d", restarts)
+		p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
+	}
 
 	mname = "p4_prom_cmds_pending"
 	p4m.printMetricHeader(metrics, mname, "A count of all current cmds (not completed)", "gauge")
-	metricVal = fmt.Sprintf("%d", p4m.fp.CmdsPendingCount())
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	metricVal = fmt.Sprintf("%d", pending)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	mname = "p4_prom_cmds_pending_max"
+	p4m.printMetricHeader(metrics, mname, "The maximum count of current cmds (not completed) seen - steady growth indicates missing completion records", "gauge")
+	metricVal = fmt.Sprintf("%d", pendingMax)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	// Channel lengths are safe to read from any goroutine - sustained high depth means the consumer can't keep up
+	mname = "p4_prom_cmd_chan_depth"
+	p4m.printMetricHeader(metrics, mname, "The number of parsed cmds buffered waiting to be processed", "gauge")
+	metricVal = fmt.Sprintf("%d", len(p4m.cmdsInChan))
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	mname = "p4_prom_line_chan_depth"
+	p4m.printMetricHeader(metrics, mname, "The number of log lines buffered waiting to be parsed", "gauge")
+	metricVal = fmt.Sprintf("%d", len(p4m.fpLinesChan))
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	if p4m.config.MaxPendingCmds > 0 && p4m.config.PendingOverflow == PendingOverflowShed {
+		mname = "p4_prom_shed_total"
+		p4m.printMetricHeader(metrics, mname, "A count of pending cmds output early, as incomplete if still running, due to exceeding max pending cmds", "counter")
+		metricVal = fmt.Sprintf("%d", shed)
+		p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
+	}
+
+	if p4m.remoteWrite != nil {
+		mname = "p4_prom_remote_write_dropped_total"
+		p4m.printMetricHeader(metrics, mname, "A count of remote write requests dropped due to a full buffer or send failures", "counter")
+		metricVal = fmt.Sprintf("%d", remoteWriteDropped)
+		p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
+	}
+
+	if orphans > 0 {
+		mname = "p4_prom_rotation_orphans_total"
+		p4m.printMetricHeader(metrics, mname, "A count of cmds split across the start or end of the log, e.g. by rotation, so only partly seen", "counter")
+		metricVal = fmt.Sprintf("%d", orphans)
+		p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
+	}
 
 	mname = "p4_cmd_running"
 	p4m.printMetricHeader(metrics, mname, "The number of running commands at any one time", "gauge")
 	metricVal = fmt.Sprintf("%d", p4m.cmdRunning)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	mname = "p4_cmd_running_max"
+	p4m.printMetricHeader(metrics, mname, "The maximum number of running commands seen during the interval", "gauge")
+	metricVal = fmt.Sprintf("%d", p4m.cmdRunningMax)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	mname = "p4_unique_users"
+	p4m.printMetricHeader(metrics, mname, "The number of distinct users running cmds during the interval", "gauge")
+	metricVal = fmt.Sprintf("%d", len(p4m.uniqueUsers))
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	mname = "p4_unique_clients"
+	p4m.printMetricHeader(metrics, mname, "The number of distinct clients (workspaces) used by cmds during the interval", "gauge")
+	metricVal = fmt.Sprintf("%d", len(p4m.uniqueClients))
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	mname = "p4_unique_ips"
+	p4m.printMetricHeader(metrics, mname, "The number of distinct client IP addresses running cmds during the interval", "gauge")
+	metricVal = fmt.Sprintf("%d", len(p4m.uniqueIPs))
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+	if p4m.pullSeen {
+		mname = "p4_pull_files"
+		p4m.printMetricHeader(metrics, mname, "The number of archive files transferred by replica pull threads", "gauge")
+		metricVal = fmt.Sprintf("%d", p4m.pullFiles)
+		p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+		mname = "p4_pull_bytes"
+		p4m.printMetricHeader(metrics, mname, "The number of archive bytes transferred by replica pull threads", "gauge")
+		metricVal = fmt.Sprintf("%d", p4m.pullBytes)
+		p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+
+		mname = "p4_pull_queue_depth"
+		p4m.printMetricHeader(metrics, mname, "Estimated pull queue (rdb.lbr) depth - files scheduled less files transferred since start of log", "gauge")
+		// We can only see changes since the start of the log, and pull threads may be output in any order
+		depth := p4m.pullQueueDepth
+		if depth < 0 {
+			depth = 0
+		}
+		metricVal = fmt.Sprintf("%d", depth)
+		p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+	}
 
 	// Cross platform call - eventually when Windows implemented
 	userCPU, systemCPU := getCPUStats()
 	mname = "p4_prom_cpu_user"
 	p4m.printMetricHeader(metrics, mname, "User CPU used by p4prometheus", "counter")
 	metricVal = fmt.Sprintf("%.6f", userCPU)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
 
 	mname = "p4_prom_cpu_system"
 	p4m.printMetricHeader(metrics, mname, "System CPU used by p4prometheus", "counter")
 	metricVal = fmt.Sprintf("%.6f", systemCPU)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "counter", fixedLabels, metricVal)
 
 	mname = "p4_sync_files_added"
 	p4m.printMetricHeader(metrics, mname, "The number of files added to workspaces by syncs", "gauge")
 	metricVal = fmt.Sprintf("%d", p4m.syncFilesAdded)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
 
 	mname = "p4_sync_files_updated"
 	p4m.printMetricHeader(metrics, mname, "The number of files updated in workspaces by syncs", "gauge")
 	metricVal = fmt.Sprintf("%d", p4m.syncFilesUpdated)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
 
 	mname = "p4_sync_files_deleted"
 	p4m.printMetricHeader(metrics, mname, "The number of files deleted in workspaces by syncs", "gauge")
 	metricVal = fmt.Sprintf("%d", p4m.syncFilesDeleted)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
 
 	mname = "p4_sync_bytes_added"
 	p4m.printMetricHeader(metrics, mname, "The number of bytes added to workspaces by syncs", "gauge")
 	metricVal = fmt.Sprintf("%d", p4m.syncBytesAdded)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
 
 	mname = "p4_sync_bytes_updated"
 	p4m.printMetricHeader(metrics, mname, "The number of bytes updated in workspaces by syncs", "gauge")
 	metricVal = fmt.Sprintf("%d", p4m.syncBytesUpdated)
-	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
+	p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
 
-	mname = "p4_cmd_counter"
-	p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by cmd)", "gauge")
-	for cmd, count := range p4m.cmdCounter {
+	// Derived from the totals above, only output when files were transferred
+	syncFiles := p4m.syncFilesAdded + p4m.syncFilesUpdated
+	if syncFiles > 0 {
+		mname = "p4_sync_bytes_per_file"
+		p4m.printMetricHeader(metrics, mname, "The average bytes per file added or updated by syncs", "gauge")
+		metricVal = fmt.Sprintf("%0.3f", float64(p4m.syncBytesAdded+p4m.syncBytesUpdated)/float64(syncFiles))
+		p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+		if syncs := p4m.cmdCounter["user-sync"]; syncs > 0 {
+			mname = "p4_sync_files_per_cmd"
+			p4m.printMetricHeader(metrics, mname, "The average number of files added or updated per user-sync", "gauge")
+			metricVal = fmt.Sprintf("%0.3f", float64(syncFiles)/float64(syncs))
+			p4m.printMetric(metrics, mname, "gauge", fixedLabels, metricVal)
+		}
+	}
+
+	mname = "p4_net_files_added"
+	p4m.printMetricHeader(metrics, mname, "The number of files added to workspaces (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdNetFilesAdded {
 		metricVal = fmt.Sprintf("%d", count)
 		labels := append(fixedLabels, labelStruct{"cmd", cmd})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
-	mname = "p4_cmd_cumulative_seconds"
-	p4m.printMetricHeader(metrics, mname, "The total in seconds (by cmd)", "gauge")
-	for cmd, lapse := range p4m.cmdCumulative {
-		metricVal = fmt.Sprintf("%0.3f", lapse)
+	mname = "p4_net_files_updated"
+	p4m.printMetricHeader(metrics, mname, "The number of files updated in workspaces (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdNetFilesUpdated {
+		metricVal = fmt.Sprintf("%d", count)
 		labels := append(fixedLabels, labelStruct{"cmd", cmd})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
-	mname = "p4_cmd_cpu_user_cumulative_seconds"
-	p4m.printMetricHeader(metrics, mname, "The total in user CPU seconds (by cmd)", "gauge")
-	for cmd, lapse := range p4m.cmduCPUCumulative {
-		metricVal = fmt.Sprintf("%0.3f", lapse)
+	mname = "p4_net_files_deleted"
+	p4m.printMetricHeader(metrics, mname, "The number of files deleted in workspaces (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdNetFilesDeleted {
+		metricVal = fmt.Sprintf("%d", count)
 		labels := append(fixedLabels, labelStruct{"cmd", cmd})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
-	mname = "p4_cmd_cpu_system_cumulative_seconds"
-	p4m.printMetricHeader(metrics, mname, "The total in system CPU seconds (by cmd)", "gauge")
-	for cmd, lapse := range p4m.cmdsCPUCumulative {
-		metricVal = fmt.Sprintf("%0.3f", lapse)
+	mname = "p4_net_bytes_added"
+	p4m.printMetricHeader(metrics, mname, "The number of bytes added to workspaces (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdNetBytesAdded {
+		metricVal = fmt.Sprintf("%d", count)
 		labels := append(fixedLabels, labelStruct{"cmd", cmd})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
-	mname = "p4_cmd_error_counter"
-	p4m.printMetricHeader(metrics, mname, "A count of cmd errors (by cmd)", "gauge")
-	for cmd, count := range p4m.cmdErrorCounter {
+	mname = "p4_net_bytes_updated"
+	p4m.printMetricHeader(metrics, mname, "The number of bytes updated in workspaces (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdNetBytesUpdated {
 		metricVal = fmt.Sprintf("%d", count)
 		labels := append(fixedLabels, labelStruct{"cmd", cmd})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
-	// For large sites this might not be sensible - so they can turn it off
-	if p4m.config.OutputCmdsByUser {
-		mname = "p4_cmd_user_counter"
-		p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by user)", "gauge")
-		for user, count := range p4m.cmdByUserCounter {
-			metricVal = fmt.Sprintf("%d", count)
-			labels := append(fixedLabels, labelStruct{"user", user})
-			p4m.printMetric(metrics, mname, labels, metricVal)
-		}
-		mname = "p4_cmd_user_cumulative_seconds"
-		p4m.printMetricHeader(metrics, mname, "The total in seconds (by user)", "gauge")
-		for user, lapse := range p4m.cmdByUserCumulative {
-			metricVal = fmt.Sprintf("%0.3f", lapse)
-			labels := append(fixedLabels, labelStruct{"user", user})
-			p4m.printMetric(metrics, mname, labels, metricVal)
-		}
+	mname = "p4_cmd_net_bytes_sent"
+	p4m.printMetricHeader(metrics, mname, "The total bytes sent over the network to clients, including file content, from rpc track records (logged in MB), not reset each interval (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdNetBytesSent {
+		metricVal = fmt.Sprintf("%d", count)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	mname = "p4_cmd_net_bytes_rcvd"
+	p4m.printMetricHeader(metrics, mname, "The total bytes received over the network from clients, including file content, from rpc track records (logged in MB), not reset each interval (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdNetBytesRcvd {
+		metricVal = fmt.Sprintf("%d", count)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+
+	mname = "p4_cmd_integ_files"
+	p4m.printMetricHeader(metrics, mname, "The number of files integrated (by cmd: integrate/copy/merge/populate)", "gauge")
+	for cmd, count := range p4m.cmdIntegFiles {
+		metricVal = fmt.Sprintf("%d", count)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	mname = "p4_cmd_resolve_files"
+	p4m.printMetricHeader(metrics, mname, "The number of files resolved (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdResolveFiles {
+		metricVal = fmt.Sprintf("%d", count)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+
+	mname = "p4_cmd_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by cmd and outcome: ok/error/governor/cancelled)", "gauge")
+	for cmd, outcomes := range p4m.cmdOutcomeCounter {
+		for outcome, count := range outcomes {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			labels = append(labels, labelStruct{"outcome", outcome})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	mname = "p4_cmd_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in seconds (by cmd)", "gauge")
+	for cmd, lapse := range p4m.cmdCumulative {
+		metricVal = fmt.Sprintf("%0.3f", lapse)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	if p4m.config.TopN > 0 {
+		mname = "p4_cmd_topn_seconds"
+		p4m.printMetricHeader(metrics, mname, "The total in seconds of the top N cmds by total seconds (by cmd and rank)", "gauge")
+		for i, cmd := range topN(p4m.cmdCumulative, p4m.config.TopN) {
+			metricVal = fmt.Sprintf("%0.3f", p4m.cmdCumulative[cmd])
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			labels = append(labels, labelStruct{"rank", fmt.Sprintf("%d", i+1)})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	mname = "p4_cmd_lock_wait_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in seconds cmds waited for read/write table locks, summed over tables (by cmd)", "gauge")
+	for cmd, wait := range p4m.cmdLockWaitCumulative {
+		metricVal = fmt.Sprintf("%0.3f", wait)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	mname = "p4_cmd_lock_held_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in seconds cmds held read/write table locks, summed over tables (by cmd)", "gauge")
+	for cmd, held := range p4m.cmdLockHeldCumulative {
+		metricVal = fmt.Sprintf("%0.3f", held)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	if len(p4m.quantiles) > 0 {
+		mname = "p4_cmd_duration_seconds"
+		p4m.printMetricHeader(metrics, mname, "Quantiles of cmd duration in seconds (by cmd)", "summary")
+		for cmd, summary := range p4m.cmdDurationSummary {
+			for _, q := range summary.quantiles() {
+				metricVal = fmt.Sprintf("%0.3f", q.value())
+				labels := append(fixedLabels, labelStruct{"cmd", cmd})
+				labels = append(labels, labelStruct{"quantile", fmt.Sprintf("%g", q.p)})
+				p4m.printMetric(metrics, mname, "summary", labels, metricVal)
+			}
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			metricVal = fmt.Sprintf("%0.3f", summary.sum)
+			p4m.printMetric(metrics, mname+"_sum", "summary", labels, metricVal)
+			metricVal = fmt.Sprintf("%d", summary.count)
+			p4m.printMetric(metrics, mname+"_count", "summary", labels, metricVal)
+		}
+	}
+	if p4m.ewmaAlpha > 0 {
+		mname = "p4_cmd_latency_ewma_seconds"
+		p4m.printMetricHeader(metrics, mname, "Exponentially weighted moving average of cmd duration in seconds, not reset each interval (by cmd)", "gauge")
+		for cmd, ewma := range p4m.cmdLatencyEWMA {
+			metricVal = fmt.Sprintf("%0.3f", ewma)
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	mname = "p4_cmd_cpu_user_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in user CPU seconds (by cmd)", "gauge")
+	for cmd, lapse := range p4m.cmduCPUCumulative {
+		metricVal = fmt.Sprintf("%0.3f", lapse)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	mname = "p4_cmd_cpu_system_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in system CPU seconds (by cmd)", "gauge")
+	for cmd, lapse := range p4m.cmdsCPUCumulative {
+		metricVal = fmt.Sprintf("%0.3f", lapse)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	mname = "p4_cmd_cpu_efficiency"
+	p4m.printMetricHeader(metrics, mname, "Ratio of CPU (user+system) to elapsed time (by cmd) - low values indicate lock or IO bound cmds", "gauge")
+	for cmd, lapse := range p4m.cmdCumulative {
+		if lapse <= 0 {
+			continue
+		}
+		metricVal = fmt.Sprintf("%0.3f", (p4m.cmduCPUCumulative[cmd]+p4m.cmdsCPUCumulative[cmd])/lapse)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	mname = "p4_maint_cmd_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of completed maintenance cmds, not included in p4_cmd_counter (by cmd and outcome)", "gauge")
+	for cmd, outcomes := range p4m.maintCmdCounter {
+		for outcome, count := range outcomes {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			labels = append(labels, labelStruct{"outcome", outcome})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	mname = "p4_maint_cmd_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in seconds of maintenance cmds (by cmd)", "gauge")
+	for cmd, lapse := range p4m.maintCmdCumulative {
+		metricVal = fmt.Sprintf("%0.3f", lapse)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	mname = "p4_maint_cmd_cpu_user_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in user CPU seconds of maintenance cmds (by cmd)", "gauge")
+	for cmd, lapse := range p4m.maintCmduCPUCumulative {
+		metricVal = fmt.Sprintf("%0.3f", lapse)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	mname = "p4_maint_cmd_cpu_system_cumulative_seconds"
+	p4m.printMetricHeader(metrics, mname, "The total in system CPU seconds of maintenance cmds (by cmd)", "gauge")
+	for cmd, lapse := range p4m.maintCmdsCPUCumulative {
+		metricVal = fmt.Sprintf("%0.3f", lapse)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	// Deprecated: use the outcome label of p4_cmd_counter - to be removed in the next release
+	mname = "p4_cmd_error_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of cmd errors (by cmd and severity) - deprecated, use p4_cmd_counter outcome", "gauge")
+	for cmd, sevMap := range p4m.cmdErrorCounter {
+		for severity, count := range sevMap {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			labels = append(labels, labelStruct{"severity", severity})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	mname = "p4_cmd_governor_rejections"
+	p4m.printMetricHeader(metrics, mname, "A count of cmds rejected by server resource limits such as maxresults/maxscanrows (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdGovernorRejections {
+		metricVal = fmt.Sprintf("%d", count)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	if len(p4m.cmdGovernorHits) > 0 {
+		mname = "p4_cmd_governor_hit_total"
+		p4m.printMetricHeader(metrics, mname, "A count of cmds which exceeded a server resource limit (by cmd and type of limit, e.g. maxscanrows)", "counter")
+		for cmd, limits := range p4m.cmdGovernorHits {
+			for limit, count := range limits {
+				metricVal = fmt.Sprintf("%d", count)
+				labels := append(fixedLabels, labelStruct{"cmd", cmd})
+				labels = append(labels, labelStruct{"type", limit})
+				p4m.printMetric(metrics, mname, "counter", labels, metricVal)
+			}
+		}
+	}
+	if len(p4m.cmdLongRunningCounter) > 0 {
+		mname = "p4_cmd_long_running_total"
+		p4m.printMetricHeader(metrics, mname, "A count of cmds taking longer than the long running threshold (by cmd)", "counter")
+		for cmd, count := range p4m.cmdLongRunningCounter {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			p4m.printMetric(metrics, mname, "counter", labels, metricVal)
+		}
+	}
+	if len(p4m.retryStormCounter) > 0 {
+		mname = "p4_cmd_retry_storm_total"
+		p4m.printMetricHeader(metrics, mname, "A count of bursts of the same cmd from the same user and client, e.g. automation retrying (by user)", "counter")
+		for user, count := range p4m.retryStormCounter {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"user", user})
+			p4m.printMetric(metrics, mname, "counter", labels, metricVal)
+		}
+	}
+	// Only output on servers which replicas/edges forward cmds to, otherwise every cmd is direct
+	if p4m.cmdsForwarded > 0 {
+		mname = "p4_cmd_forwarded_total"
+		p4m.printMetricHeader(metrics, mname, "A count of cmds forwarded by a replica or edge server", "counter")
+		p4m.printMetric(metrics, mname, "counter", fixedLabels, fmt.Sprintf("%d", p4m.cmdsForwarded))
+		mname = "p4_cmd_direct_total"
+		p4m.printMetricHeader(metrics, mname, "A count of cmds from clients connected directly to this server", "counter")
+		p4m.printMetric(metrics, mname, "counter", fixedLabels, fmt.Sprintf("%d", p4m.cmdsDirect))
+	}
+	mname = "p4_cmd_truncated_counter"
+	p4m.printMetricHeader(metrics, mname, "A count of cmds with truncated args or no completion record in the log (by cmd)", "gauge")
+	for cmd, count := range p4m.cmdTruncatedCounter {
+		metricVal = fmt.Sprintf("%d", count)
+		labels := append(fixedLabels, labelStruct{"cmd", cmd})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	// Only output once seen - many logs never have any
+	if len(p4m.cmdIncompleteCounter) > 0 {
+		mname = "p4_cmd_incomplete_total"
+		p4m.printMetricHeader(metrics, mname, "A count of cmds output with no completion record, e.g. pending at end of log or evicted (by cmd)", "counter")
+		for cmd, count := range p4m.cmdIncompleteCounter {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"cmd", cmd})
+			p4m.printMetric(metrics, mname, "counter", labels, metricVal)
+		}
+	}
+	// For large sites this might not be sensible - so they can turn it off
+	if p4m.config.OutputCmdsByUser {
+		mname = "p4_user_concurrent_max"
+		p4m.printMetricHeader(metrics, mname, "The max number of cmds running simultaneously (by user)", "gauge")
+		for user, count := range p4m.userConcurrency() {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"user", user})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+		mname = "p4_cmd_user_counter"
+		p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by user)", "gauge")
+		for user, count := range p4m.cmdByUserCounter {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"user", user})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+		mname = "p4_cmd_user_cumulative_seconds"
+		p4m.printMetricHeader(metrics, mname, "The total in seconds (by user)", "gauge")
+		for user, lapse := range p4m.cmdByUserCumulative {
+			metricVal = fmt.Sprintf("%0.3f", lapse)
+			labels := append(fixedLabels, labelStruct{"user", user})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
 	}
 	// For large sites this might not be sensible - so they can turn it off
 	if p4m.config.OutputCmdsByIP {
@@ -307,14 +1562,14 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 		for ip, count := range p4m.cmdByIPCounter {
 			metricVal = fmt.Sprintf("%d", count)
 			labels := append(fixedLabels, labelStruct{"ip", ip})
-			p4m.printMetric(metrics, mname, labels, metricVal)
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 		}
 		mname = "p4_cmd_ip_cumulative_seconds"
 		p4m.printMetricHeader(metrics, mname, "The total in seconds (by IP)", "gauge")
 		for ip, lapse := range p4m.cmdByIPCumulative {
 			metricVal = fmt.Sprintf("%0.3f", lapse)
 			labels := append(fixedLabels, labelStruct{"ip", ip})
-			p4m.printMetric(metrics, mname, labels, metricVal)
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 		}
 	}
 	// For large sites this might not be sensible - so they can turn it off
@@ -326,7 +1581,7 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 				metricVal = fmt.Sprintf("%d", count)
 				labels := append(fixedLabels, labelStruct{"user", user})
 				labels = append(labels, labelStruct{"cmd", cmd})
-				p4m.printMetric(metrics, mname, labels, metricVal)
+				p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 			}
 		}
 		mname = "p4_cmd_user_detail_cumulative_seconds"
@@ -336,7 +1591,7 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 				metricVal = fmt.Sprintf("%0.3f", lapse)
 				labels := append(fixedLabels, labelStruct{"user", user})
 				labels = append(labels, labelStruct{"cmd", cmd})
-				p4m.printMetric(metrics, mname, labels, metricVal)
+				p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 			}
 		}
 	}
@@ -345,60 +1600,177 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 	for replica, count := range p4m.cmdByReplicaCounter {
 		metricVal = fmt.Sprintf("%d", count)
 		labels := append(fixedLabels, labelStruct{"replica", replica})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
 	mname = "p4_cmd_replica_cumulative_seconds"
 	p4m.printMetricHeader(metrics, mname, "The total in seconds (by broker/replica/proxy)", "gauge")
 	for replica, lapse := range p4m.cmdByReplicaCumulative {
 		metricVal = fmt.Sprintf("%0.3f", lapse)
 		labels := append(fixedLabels, labelStruct{"replica", replica})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
 	mname = "p4_cmd_program_counter"
 	p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by program)", "gauge")
 	for program, count := range p4m.cmdByProgramCounter {
 		metricVal = fmt.Sprintf("%d", count)
 		labels := append(fixedLabels, labelStruct{"program", program})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
 	mname = "p4_cmd_program_cumulative_seconds"
 	p4m.printMetricHeader(metrics, mname, "The total in seconds (by program)", "gauge")
 	for program, lapse := range p4m.cmdByProgramCumulative {
 		metricVal = fmt.Sprintf("%0.3f", lapse)
 		labels := append(fixedLabels, labelStruct{"program", program})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
+	// For large sites this might not be sensible - so they can turn it off
+	if p4m.config.OutputCmdsByDepot {
+		mname = "p4_cmd_depot_counter"
+		p4m.printMetricHeader(metrics, mname, "A count of completed p4 sync/submit cmds (by depot path)", "gauge")
+		for depot, count := range p4m.cmdByDepotCounter {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"depot", depot})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+		mname = "p4_cmd_depot_bytes"
+		p4m.printMetricHeader(metrics, mname, "The number of bytes transferred by p4 sync/submit cmds (by depot path)", "gauge")
+		for depot, bytes := range p4m.cmdByDepotBytes {
+			metricVal = fmt.Sprintf("%d", bytes)
+			labels := append(fixedLabels, labelStruct{"depot", depot})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	if p4m.config.OutputCmdsByPlatform {
+		mname = "p4_cmd_platform_counter"
+		p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by client platform, where the program reports one)", "gauge")
+		for platform, count := range p4m.cmdByPlatformCounter {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"platform", platform})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	if p4m.config.OutputCmdsByAPILevel {
+		mname = "p4_cmd_apilevel_counter"
+		p4m.printMetricHeader(metrics, mname, "A count of completed p4 cmds (by client protocol level, where logged)", "gauge")
+		for level, count := range p4m.cmdByAPILevelCounter {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"level", level})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	// Tables not of interest are folded into OtherTableLabel
+	readWait := p4m.foldTables(p4m.totalReadWait)
+	readHeld := p4m.foldTables(p4m.totalReadHeld)
+	writeWait := p4m.foldTables(p4m.totalWriteWait)
+	writeHeld := p4m.foldTables(p4m.totalWriteHeld)
+	peekCount := p4m.foldTableCounts(p4m.totalPeekCount)
+	peekWait := p4m.foldTables(p4m.totalPeekWait)
+	peekHeld := p4m.foldTables(p4m.totalPeekHeld)
+	pagesIn := p4m.foldTableCounts(p4m.totalPagesIn)
+	pagesOut := p4m.foldTableCounts(p4m.totalPagesOut)
+	pagesCached := p4m.foldTableMax(p4m.maxPagesCached)
 	mname = "p4_total_read_wait_seconds"
 	p4m.printMetricHeader(metrics, mname,
 		"The total waiting for read locks in seconds (by table)", "gauge")
-	for table, total := range p4m.totalReadWait {
+	for table, total := range readWait {
 		metricVal = fmt.Sprintf("%0.3f", total)
 		labels := append(fixedLabels, labelStruct{"table", table})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
 	mname = "p4_total_read_held_seconds"
 	p4m.printMetricHeader(metrics, mname,
 		"The total read locks held in seconds (by table)", "gauge")
-	for table, total := range p4m.totalReadHeld {
+	for table, total := range readHeld {
 		metricVal = fmt.Sprintf("%0.3f", total)
 		labels := append(fixedLabels, labelStruct{"table", table})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
 	mname = "p4_total_write_wait_seconds"
 	p4m.printMetricHeader(metrics, mname,
 		"The total waiting for write locks in seconds (by table)", "gauge")
-	for table, total := range p4m.totalWriteWait {
+	for table, total := range writeWait {
 		metricVal = fmt.Sprintf("%0.3f", total)
 		labels := append(fixedLabels, labelStruct{"table", table})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
 	}
 	mname = "p4_total_write_held_seconds"
 	p4m.printMetricHeader(metrics, mname,
 		"The total write locks held in seconds (by table)", "gauge")
-	for table, total := range p4m.totalWriteHeld {
+	for table, total := range writeHeld {
 		metricVal = fmt.Sprintf("%0.3f", total)
 		labels := append(fixedLabels, labelStruct{"table", table})
-		p4m.printMetric(metrics, mname, labels, metricVal)
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	if len(peekCount) > 0 {
+		mname = "p4_total_peek_count"
+		p4m.printMetricHeader(metrics, mname,
+			"The total number of peek locks, as used by lockless reads (by table)", "gauge")
+		for table, count := range peekCount {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+		mname = "p4_total_peek_wait_seconds"
+		p4m.printMetricHeader(metrics, mname,
+			"The total waiting for peek locks in seconds (by table)", "gauge")
+		for table, total := range peekWait {
+			metricVal = fmt.Sprintf("%0.3f", total)
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+		mname = "p4_total_peek_held_seconds"
+		p4m.printMetricHeader(metrics, mname,
+			"The total peek locks held in seconds (by table)", "gauge")
+		for table, total := range peekHeld {
+			metricVal = fmt.Sprintf("%0.3f", total)
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	mname = "p4_table_pages_in"
+	p4m.printMetricHeader(metrics, mname,
+		"The total db pages read (by table) - high values indicate tables which need more cache", "counter")
+	for table, total := range pagesIn {
+		metricVal = fmt.Sprintf("%d", total)
+		labels := append(fixedLabels, labelStruct{"table", table})
+		p4m.printMetric(metrics, mname, "counter", labels, metricVal)
+	}
+	mname = "p4_table_pages_out"
+	p4m.printMetricHeader(metrics, mname,
+		"The total db pages written (by table)", "counter")
+	for table, total := range pagesOut {
+		metricVal = fmt.Sprintf("%d", total)
+		labels := append(fixedLabels, labelStruct{"table", table})
+		p4m.printMetric(metrics, mname, "counter", labels, metricVal)
+	}
+	mname = "p4_table_pages_cached"
+	p4m.printMetricHeader(metrics, mname,
+		"The max db pages cached reported by a cmd during the interval (by table)", "gauge")
+	for table, max := range pagesCached {
+		metricVal = fmt.Sprintf("%d", max)
+		labels := append(fixedLabels, labelStruct{"table", table})
+		p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+	}
+	// Derived at emit time - proportion of lock time spent waiting, skipped if no locks held or waited for
+	mname = "p4_table_read_contention_ratio"
+	p4m.printMetricHeader(metrics, mname,
+		"The ratio of read lock wait to wait+held time, 0-1 (by table)", "gauge")
+	for table, wait := range readWait {
+		if total := wait + readHeld[table]; total > 0 {
+			metricVal = fmt.Sprintf("%0.3f", wait/total)
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	mname = "p4_table_write_contention_ratio"
+	p4m.printMetricHeader(metrics, mname,
+		"The ratio of write lock wait to wait+held time, 0-1 (by table)", "gauge")
+	for table, wait := range writeWait {
+		if total := wait + writeHeld[table]; total > 0 {
+			metricVal = fmt.Sprintf("%0.3f", wait/total)
+			labels := append(fixedLabels, labelStruct{"table", table})
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
 	}
 	if len(p4m.totalTriggerLapse) > 0 {
 		mname = "p4_total_trigger_lapse_seconds"
@@ -406,47 +1778,171 @@ func (p4m *P4DMetrics) getCumulativeMetrics() string {
 			"The total lapse time for triggers in seconds (by trigger)", "gauge")
 		for table, total := range p4m.totalTriggerLapse {
 			metricVal = fmt.Sprintf("%0.3f", total)
-			labels := append(fixedLabels, labelStruct{"trigger", table})
-			p4m.printMetric(metrics, mname, labels, metricVal)
+			labels := p4m.triggerLabels(fixedLabels, table)
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	if len(p4m.triggerCounter) > 0 {
+		mname = "p4_trigger_counter"
+		p4m.printMetricHeader(metrics, mname,
+			"A count of trigger invocations (by trigger)", "gauge")
+		for trigger, count := range p4m.triggerCounter {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := p4m.triggerLabels(fixedLabels, trigger)
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	if len(p4m.triggerMaxLapse) > 0 {
+		mname = "p4_trigger_max_seconds"
+		p4m.printMetricHeader(metrics, mname,
+			"The maximum lapse time of a single trigger invocation in seconds (by trigger)", "gauge")
+		for trigger, max := range p4m.triggerMaxLapse {
+			metricVal = fmt.Sprintf("%0.3f", max)
+			labels := p4m.triggerLabels(fixedLabels, trigger)
+			p4m.printMetric(metrics, mname, "gauge", labels, metricVal)
+		}
+	}
+	if len(p4m.triggerFailures) > 0 {
+		mname = "p4_trigger_failures_total"
+		p4m.printMetricHeader(metrics, mname,
+			"A count of trigger invocations which failed with a nonzero exit status (by trigger)", "counter")
+		for trigger, count := range p4m.triggerFailures {
+			metricVal = fmt.Sprintf("%d", count)
+			labels := p4m.triggerLabels(fixedLabels, trigger)
+			p4m.printMetric(metrics, mname, "counter", labels, metricVal)
+		}
+	}
+	for i, f := range metrics.formats {
+		if p4m.openMetrics(f) {
+			metrics.bufs[i].WriteString("# EOF\n")
+		}
+	}
+	return metrics
+}
+
+// busiest - the key with the highest count, lowest key first on ties so that output is stable
+func busiest(counts map[string]int64) (string, int64) {
+	var name string
+	var max int64
+	for k, v := range counts {
+		if v > max || (v == max && v > 0 && k < name) {
+			name, max = k, v
+		}
+	}
+	return name, max
+}
+
+// topN - names of up to n non zero values, largest first. Ties are ordered by name so ranks are stable.
+func topN(values map[string]float64, n int) []string {
+	names := make([]string, 0, len(values))
+	for k, v := range values {
+		if v > 0 {
+			names = append(names, k)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		vi, vj := values[names[i]], values[names[j]]
+		if vi == vj {
+			return names[i] < names[j]
 		}
+		return vi > vj
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+// intervalSummary - human readable heartbeat built from the interval values, so call before resetToZero
+func (p4m *P4DMetrics) intervalSummary() string {
+	p4m.m.Lock()
+	defer p4m.m.Unlock()
+	cmd, cmdCount := busiest(p4m.cmdCounter)
+	user, userCount := busiest(p4m.cmdByUserCounter)
+	if cmd == "" {
+		cmd = "none"
 	}
-	return metrics.String()
+	if user == "" {
+		user = "none"
+	}
+	return fmt.Sprintf("Interval summary: cmds %d, cpu %0.3fs, busiest cmd %s (%d), busiest user %s (%d), max running %d",
+		p4m.intervalCmds, p4m.intervalCPU, cmd, cmdCount, user, userCount, p4m.cmdRunningMax)
 }
 
 func (p4m *P4DMetrics) resetToZero() {
+	p4m.m.Lock()
+	defer p4m.m.Unlock()
 	for t := range p4m.totalReadHeld {
 		p4m.totalReadHeld[t] = 0
 		p4m.totalReadWait[t] = 0
 		p4m.totalWriteHeld[t] = 0
 		p4m.totalWriteWait[t] = 0
 	}
+	for t := range p4m.totalPeekCount {
+		p4m.totalPeekCount[t] = 0
+		p4m.totalPeekWait[t] = 0
+		p4m.totalPeekHeld[t] = 0
+	}
+	for t := range p4m.maxPagesCached {
+		p4m.maxPagesCached[t] = 0
+	}
 
 	p4m.syncFilesAdded = 0
 	p4m.syncFilesUpdated = 0
 	p4m.syncFilesDeleted = 0
 	p4m.syncBytesAdded = 0
 	p4m.syncBytesUpdated = 0
+	for t := range p4m.cmdNetFilesAdded {
+		p4m.cmdNetFilesAdded[t] = 0
+		p4m.cmdNetFilesUpdated[t] = 0
+		p4m.cmdNetFilesDeleted[t] = 0
+		p4m.cmdNetBytesAdded[t] = 0
+		p4m.cmdNetBytesUpdated[t] = 0
+	}
+	for t := range p4m.cmdIntegFiles {
+		p4m.cmdIntegFiles[t] = 0
+	}
+	for t := range p4m.cmdResolveFiles {
+		p4m.cmdResolveFiles[t] = 0
+	}
 
 	p4m.cmdRunning = 0
+	p4m.cmdRunningMax = 0
 	p4m.linesRead = 0
-	
+
 	for t := range p4m.totalTriggerLapse {
 		p4m.totalTriggerLapse[t] = float64(0)
 	}
 
- 
+	for t := range p4m.triggerCounter {
+		p4m.triggerCounter[t] = int64(0)
+		p4m.triggerMaxLapse[t] = float64(0)
+	}
 
 	for t := range p4m.cmdByProgramCounter {
 		p4m.cmdByProgramCounter[t] = int64(0)
 	}
 
- 
-
 	for t := range p4m.cmdByReplicaCounter {
 		p4m.cmdByReplicaCounter[t] = int64(0)
 	}
 
- 
+	for t := range p4m.userConcurrentMax {
+		p4m.userConcurrentMax[t] = 0
+	}
+
+	for t := range p4m.cmdByDepotCounter {
+		p4m.cmdByDepotCounter[t] = int64(0)
+		p4m.cmdByDepotBytes[t] = int64(0)
+	}
+
+	for t := range p4m.cmdByPlatformCounter {
+		p4m.cmdByPlatformCounter[t] = int64(0)
+	}
+
+	for t := range p4m.cmdByAPILevelCounter {
+		p4m.cmdByAPILevelCounter[t] = int64(0)
+	}
 
 	for t := range p4m.cmdByUserDetailCounter {
 		for x := range p4m.cmdByUserDetailCounter[t] {
@@ -454,76 +1950,310 @@ func (p4m *P4DMetrics) resetToZero() {
 		}
 	}
 
- 
-
 	for t := range p4m.cmdByIPCounter {
 		p4m.cmdByIPCounter[t] = int64(0)
 	}
 
- 
-
 	for t := range p4m.cmdByUserCounter {
 		p4m.cmdByUserCounter[t] = int64(0)
 	}
 
- 
-
 	for t := range p4m.cmdErrorCounter {
-		p4m.cmdErrorCounter[t] = int64(0)
+		for x := range p4m.cmdErrorCounter[t] {
+			p4m.cmdErrorCounter[t][x] = int64(0)
+		}
 	}
 
- 
+	for t := range p4m.cmdOutcomeCounter {
+		for x := range p4m.cmdOutcomeCounter[t] {
+			p4m.cmdOutcomeCounter[t][x] = int64(0)
+		}
+	}
+
+	for t := range p4m.cmdGovernorRejections {
+		p4m.cmdGovernorRejections[t] = int64(0)
+	}
+
+	for t := range p4m.cmdTruncatedCounter {
+		p4m.cmdTruncatedCounter[t] = int64(0)
+	}
+
+	p4m.pruneRetryStorms()
+	for t := range p4m.cmdLongRunningCounter {
+		p4m.cmdLongRunningCounter[t] = int64(0)
+	}
 
 	for t := range p4m.cmdCounter {
 		p4m.cmdCounter[t] = int64(0)
 	}
-		
-		
+
+	for t := range p4m.maintCmdCounter {
+		for x := range p4m.maintCmdCounter[t] {
+			p4m.maintCmdCounter[t][x] = int64(0)
+		}
+	}
+	p4m.intervalCmds = 0
+	p4m.intervalCPU = 0
+	p4m.pullFiles = 0
+	p4m.pullBytes = 0
+	p4m.uniqueUsers = make(map[string]bool)
+	p4m.uniqueClients = make(map[string]bool)
+	p4m.uniqueIPs = make(map[string]bool)
+
+	// Quantile estimates are per interval unless windowed
+	if p4m.config.QuantileWindow <= 0 {
+		p4m.cmdDurationSummary = make(map[string]*cmdSummary)
+	}
+
+}
+
+// Replica pull threads: pull -i schedules archive transfers by writing rdb.lbr records,
+// and pull -u deletes them once the file has been transferred.
+func (p4m *P4DMetrics) publishPull(cmd *p4dlog.Command) {
+	p4m.pullSeen = true
+	t, ok := cmd.Tables["rdb.lbr"]
+	if !ok {
+		return
+	}
+	p4m.pullQueueDepth += t.PutRows - t.DelRows
+	p4m.pullFiles += t.DelRows
+	p4m.pullBytes += cmd.LbrRcsWriteBytes + cmd.LbrCompressWriteBytes + cmd.LbrUncompressWriteBytes
+}
+
+// Values of the outcome label of p4_cmd_counter
+const (
+	OutcomeOK        = "ok"
+	OutcomeError     = "error"
+	OutcomeGovernor  = "governor"
+	OutcomeCancelled = "cancelled"
+)
+
+// cmdOutcome - warnings such as "file(s) up-to-date" are not failures so count as ok
+func cmdOutcome(cmd *p4dlog.Command) string {
+	if !cmd.CmdError || cmd.ErrorSeverity == p4dlog.ErrorSeverityWarning {
+		return OutcomeOK
+	}
+	switch cmd.ErrorSubsys {
+	case p4dlog.ErrorSubsysGovernor:
+		return OutcomeGovernor
+	case p4dlog.ErrorSubsysCancel:
+		return OutcomeCancelled
+	}
+	return OutcomeError
+}
+
+// sampleDetail - whether the current cmd is counted in detail metrics, see Config.DetailSampleRate
+func (p4m *P4DMetrics) sampleDetail() bool {
+	p4m.detailSampleCount++
+	return p4m.config.DetailSampleRate <= 1 || p4m.detailSampleCount%int64(p4m.config.DetailSampleRate) == 0
+}
+
+// anonymize - the label value to use for a user, client or IP, hashed if configured.
+// Empty values are left empty.
+func (p4m *P4DMetrics) anonymize(value string) string {
+	if !p4m.config.AnonymizeLabels || value == "" {
+		return value
+	}
+	h := sha256.Sum256([]byte(p4m.config.AnonymizeSalt + "\x00" + value))
+	return hex.EncodeToString(h[:8])
+}
+
+// detectRetryStorm - counts a retry storm for user when Config.RetryStormThreshold cmds the same as cmd
+// start within Config.RetryStormWindow. Times are log times.
+func (p4m *P4DMetrics) detectRetryStorm(cmd *p4dlog.Command, user string, client string) {
+	if p4m.config.RetryStormThreshold <= 0 || p4m.config.RetryStormWindow <= 0 || cmd.StartTime.IsZero() {
+		return
+	}
+	key := user + "/" + cmd.Cmd + "/" + client
+	starts := append(p4m.retryStormStarts[key], cmd.StartTime)
+	// Start times are nearly in order, as cmds are output when they complete
+	earliest := cmd.StartTime.Add(-p4m.config.RetryStormWindow)
+	i := 0
+	for i < len(starts) && starts[i].Before(earliest) {
+		i++
+	}
+	starts = starts[i:]
+	if len(starts) >= p4m.config.RetryStormThreshold {
+		p4m.retryStormCounter[user]++
+		starts = nil
+	}
+	if len(starts) == 0 {
+		delete(p4m.retryStormStarts, key)
+	} else {
+		p4m.retryStormStarts[key] = starts
+	}
+}
+
+// pruneRetryStorms - forgets cmds which can no longer be part of a retry storm, as of the latest log time
+func (p4m *P4DMetrics) pruneRetryStorms() {
+	earliest := parserTime(p4m.timeLatestStartCmd).Add(-p4m.config.RetryStormWindow)
+	for key, starts := range p4m.retryStormStarts {
+		if starts[len(starts)-1].Before(earliest) {
+			delete(p4m.retryStormStarts, key)
+		}
+	}
+}
+
+// publishDetail updates the by-user and by-program metrics for a sampled cmd, scaled by the sample rate
+func (p4m *P4DMetrics) publishDetail(cmd *p4dlog.Command, user string) {
+	scale := int64(1)
+	if p4m.config.DetailSampleRate > 1 {
+		scale = int64(p4m.config.DetailSampleRate)
+	}
+	lapse := float64(cmd.CompletedLapse) * float64(scale)
+	label := p4m.anonymize(user)
+	p4m.cmdByUserCounter[label] += scale
+	p4m.cmdByUserCumulative[label] += lapse
+	if p4m.config.OutputCmdsByUserRegex != "" {
+		if p4m.outputCmdsByUserRegex == nil {
+			regexStr := fmt.Sprintf("(%s)", p4m.config.OutputCmdsByUserRegex)
+			p4m.outputCmdsByUserRegex = regexp.MustCompile(regexStr)
+		}
+		if p4m.outputCmdsByUserRegex.MatchString(user) {
+			if _, ok := p4m.cmdByUserDetailCounter[label]; !ok {
+				p4m.cmdByUserDetailCounter[label] = make(map[string]int64)
+				p4m.cmdByUserDetailCumulative[label] = make(map[string]float64)
+			}
+			p4m.cmdByUserDetailCounter[label][cmd.Cmd] += scale
+			p4m.cmdByUserDetailCumulative[label][cmd.Cmd] += lapse
+		}
+	}
+	// Various chars not allowed in label names - see comment for NotLabelValueRE
+	program := strings.ReplaceAll(cmd.App, " (brokered)", "")
+	if p4m.config.NormalizeProgramVersions {
+		program = normalizeProgramName(program)
+	}
+	program = NotLabelValueRE.ReplaceAllString(program, "_")
+	if !p4m.config.CaseSensitiveServer {
+		program = strings.ToLower(program)
+	}
+	p4m.cmdByProgramCounter[program] += scale
+	p4m.cmdByProgramCumulative[program] += lapse
 }
 
 func (p4m *P4DMetrics) publishEvent(cmd p4dlog.Command) {
+	p4m.m.Lock()
+	defer p4m.m.Unlock()
 	// p4m.logger.Debugf("publish cmd: %s\n", cmd.String())
 
+	// Names differing only in case are the same user/client on case insensitive servers. IPs are left as is.
+	user := cmd.User
+	client := cmd.Workspace
+	if !p4m.config.CaseSensitiveServer {
+		user = strings.ToLower(user)
+		client = strings.ToLower(client)
+	}
+	replica, ip := cmd.ReplicaIP()
+	ip = p4m.anonymize(ip)
+	if p4m.maintCmds[cmd.Cmd] {
+		p4m.publishMaintenance(&cmd)
+	} else {
+		p4m.publishCmd(&cmd, user, replica, ip)
+	}
+	p4m.publishHealth(&cmd, p4m.anonymize(user), p4m.anonymize(client), ip)
+	p4m.publishTables(&cmd)
+}
+
+// publishCmd - the p4_cmd_* latency, count and resource metrics, and those by user, IP etc, which
+// exclude maintenance cmds
+func (p4m *P4DMetrics) publishCmd(cmd *p4dlog.Command, user string, replica string, ip string) {
+	p4m.intervalCmds++
 	p4m.cmdCounter[cmd.Cmd]++
+	if _, ok := p4m.cmdOutcomeCounter[cmd.Cmd]; !ok {
+		p4m.cmdOutcomeCounter[cmd.Cmd] = make(map[string]int64)
+	}
+	p4m.cmdOutcomeCounter[cmd.Cmd][cmdOutcome(cmd)]++
 	p4m.cmdCumulative[cmd.Cmd] += float64(cmd.CompletedLapse)
+	if p4m.historical && p4m.config.OutputHourOfDay {
+		// Cmds are often published after the log has moved on, so use their own start time
+		start := cmd.StartTime
+		if start.IsZero() {
+			start = p4m.timeLatestStartCmd
+		}
+		hour := start.Hour()
+		p4m.hourOfDayCounter[hour]++
+		p4m.hourOfDayCumulative[hour] += float64(cmd.CompletedLapse)
+	}
+	if wait, held := cmd.LockTotals(); wait > 0 || held > 0 {
+		p4m.cmdLockWaitCumulative[cmd.Cmd] += float64(wait) / 1000
+		p4m.cmdLockHeldCumulative[cmd.Cmd] += float64(held) / 1000
+	}
+	if len(p4m.quantiles) > 0 {
+		if _, ok := p4m.cmdDurationSummary[cmd.Cmd]; !ok {
+			p4m.cmdDurationSummary[cmd.Cmd] = newCmdSummary(p4m.quantiles, p4m.config.QuantileWindow)
+		}
+		endTime := cmd.EndTime
+		if endTime.IsZero() {
+			endTime = cmd.StartTime
+		}
+		p4m.cmdDurationSummary[cmd.Cmd].add(float64(cmd.CompletedLapse), endTime)
+	}
+	if p4m.ewmaAlpha > 0 {
+		lapse := float64(cmd.CompletedLapse)
+		if ewma, ok := p4m.cmdLatencyEWMA[cmd.Cmd]; ok {
+			p4m.cmdLatencyEWMA[cmd.Cmd] = ewma + p4m.ewmaAlpha*(lapse-ewma)
+		} else {
+			p4m.cmdLatencyEWMA[cmd.Cmd] = lapse
+		}
+	}
 	p4m.cmduCPUCumulative[cmd.Cmd] += float64(cmd.UCpu) / 1000
 	p4m.cmdsCPUCumulative[cmd.Cmd] += float64(cmd.SCpu) / 1000
+	p4m.intervalCPU += float64(cmd.UCpu+cmd.SCpu) / 1000
 	if cmd.CmdError {
-		p4m.cmdErrorCounter[cmd.Cmd]++
+		if _, ok := p4m.cmdErrorCounter[cmd.Cmd]; !ok {
+			p4m.cmdErrorCounter[cmd.Cmd] = make(map[string]int64)
+		}
+		p4m.cmdErrorCounter[cmd.Cmd][cmd.ErrorSeverity]++
+		if cmd.ErrorSubsys == p4dlog.ErrorSubsysGovernor {
+			p4m.cmdGovernorRejections[cmd.Cmd]++
+			if cmd.GovernorLimit != "" {
+				if _, ok := p4m.cmdGovernorHits[cmd.Cmd]; !ok {
+					p4m.cmdGovernorHits[cmd.Cmd] = make(map[string]int64)
+				}
+				p4m.cmdGovernorHits[cmd.Cmd][cmd.GovernorLimit]++
+			}
+		}
 	}
-	p4m.cmdRunning = cmd.Running
 	p4m.syncFilesAdded += cmd.NetFilesAdded
 	p4m.syncFilesUpdated += cmd.NetFilesUpdated
 	p4m.syncFilesDeleted += cmd.NetFilesDeleted
 	p4m.syncBytesAdded += cmd.NetBytesAdded
 	p4m.syncBytesUpdated += cmd.NetBytesUpdated
-	user := cmd.User
-	if !p4m.config.CaseSensitiveServer {
-		user = strings.ToLower(user)
+	// Only cmds which transfer files (sync/submit/populate etc) are recorded
+	if cmd.NetFilesAdded+cmd.NetFilesUpdated+cmd.NetFilesDeleted+cmd.NetBytesAdded+cmd.NetBytesUpdated > 0 {
+		p4m.cmdNetFilesAdded[cmd.Cmd] += cmd.NetFilesAdded
+		p4m.cmdNetFilesUpdated[cmd.Cmd] += cmd.NetFilesUpdated
+		p4m.cmdNetFilesDeleted[cmd.Cmd] += cmd.NetFilesDeleted
+		p4m.cmdNetBytesAdded[cmd.Cmd] += cmd.NetBytesAdded
+		p4m.cmdNetBytesUpdated[cmd.Cmd] += cmd.NetBytesUpdated
 	}
-	p4m.cmdByUserCounter[user]++
-	p4m.cmdByUserCumulative[user] += float64(cmd.CompletedLapse)
-	if p4m.config.OutputCmdsByUserRegex != "" {
-		if p4m.outputCmdsByUserRegex == nil {
-			regexStr := fmt.Sprintf("(%s)", p4m.config.OutputCmdsByUserRegex)
-			p4m.outputCmdsByUserRegex = regexp.MustCompile(regexStr)
-		}
-		if p4m.outputCmdsByUserRegex.MatchString(user) {
-			if _, ok := p4m.cmdByUserDetailCounter[user]; !ok {
-				p4m.cmdByUserDetailCounter[user] = make(map[string]int64)
-				p4m.cmdByUserDetailCumulative[user] = make(map[string]float64)
-			}
-			p4m.cmdByUserDetailCounter[user][cmd.Cmd]++
-			p4m.cmdByUserDetailCumulative[user][cmd.Cmd] += float64(cmd.CompletedLapse)
-		}
+	// Wire traffic from the rpc track values (logged in MB, out being sent to the client), which includes the
+	// file bytes above, so kept separate rather than added to them
+	if cmd.RPCSizeOut+cmd.RPCSizeIn > 0 {
+		p4m.cmdNetBytesSent[cmd.Cmd] += cmd.RPCSizeOut * 1024 * 1024
+		p4m.cmdNetBytesRcvd[cmd.Cmd] += cmd.RPCSizeIn * 1024 * 1024
+	}
+	if cmd.IntegFiles > 0 {
+		p4m.cmdIntegFiles[cmd.Cmd] += cmd.IntegFiles
+	}
+	if cmd.Cmd == "pull" {
+		p4m.publishPull(cmd)
+	}
+	if cmd.ResolveFiles > 0 {
+		p4m.cmdResolveFiles[cmd.Cmd] += cmd.ResolveFiles
 	}
-	var ip, replica string
-	j := strings.Index(cmd.IP, "/")
-	if j > 0 {
-		replica = cmd.IP[:j]
-		ip = cmd.IP[j+1:]
+	if p4m.sampleDetail() {
+		p4m.publishDetail(cmd, user)
+	}
+	if p4m.config.OutputCmdsByUser {
+		end := cmd.StartTime.Add(time.Duration(float64(cmd.CompletedLapse) * float64(time.Second)))
+		user := p4m.anonymize(user)
+		p4m.userCmdIntervals[user] = append(p4m.userCmdIntervals[user], cmdInterval{cmd.StartTime, end})
+	}
+	if replica != "" {
+		p4m.cmdsForwarded++
 	} else {
-		ip = cmd.IP
+		p4m.cmdsDirect++
 	}
 	p4m.cmdByIPCounter[ip]++
 	p4m.cmdByIPCumulative[ip] += float64(cmd.CompletedLapse)
@@ -531,128 +2261,548 @@ func (p4m *P4DMetrics) publishEvent(cmd p4dlog.Command) {
 		p4m.cmdByReplicaCounter[replica]++
 		p4m.cmdByReplicaCumulative[replica] += float64(cmd.CompletedLapse)
 	}
-	// Various chars not allowed in label names - see comment for NotLabelValueRE
-	program := strings.ReplaceAll(cmd.App, " (brokered)", "")
-	program = NotLabelValueRE.ReplaceAllString(program, "_")
-	p4m.cmdByProgramCounter[program]++
-	p4m.cmdByProgramCumulative[program] += float64(cmd.CompletedLapse)
-	const triggerPrefix = "trigger_"
+	if p4m.config.OutputCmdsByPlatform {
+		if _, platform, _ := cmd.AppComponents(); platform != "" {
+			p4m.cmdByPlatformCounter[NotLabelValueRE.ReplaceAllString(platform, "_")]++
+		}
+	}
+	if p4m.config.OutputCmdsByAPILevel && cmd.ClientAPILevel > 0 {
+		p4m.cmdByAPILevelCounter[fmt.Sprintf("%d", cmd.ClientAPILevel)]++
+	}
+	if p4m.config.OutputCmdsByDepot && (cmd.Cmd == "user-sync" || cmd.Cmd == "user-submit") {
+		depth := p4m.config.DepotDepth
+		if depth <= 0 {
+			depth = 2
+		}
+		depots := depotPaths(cmd.Args, cmd.Workspace, depth)
+		for _, depot := range depots {
+			depot = NotLabelValueRE.ReplaceAllString(depot, "_")
+			p4m.cmdByDepotCounter[depot]++
+			// Bytes can't be attributed to individual paths so are shared equally
+			p4m.cmdByDepotBytes[depot] += (cmd.NetBytesAdded + cmd.NetBytesUpdated) / int64(len(depots))
+		}
+	}
+}
+
+// publishHealth - metrics of server health and of the log, which include maintenance cmds:
+// running cmds, slow/long running and incomplete cmds, unique users/clients/IPs and retry storms
+func (p4m *P4DMetrics) publishHealth(cmd *p4dlog.Command, user string, client string, ip string) {
+	p4m.logSlowCmd(cmd)
+	if cmd.Truncated {
+		p4m.cmdTruncatedCounter[cmd.Cmd]++
+	}
+	if cmd.Incomplete {
+		p4m.cmdIncompleteCounter[cmd.Cmd]++
+	}
+	longRunning := p4m.config.LongRunningThreshold
+	if longRunning <= 0 {
+		longRunning = DefaultLongRunningThreshold
+	}
+	if float64(cmd.CompletedLapse) > longRunning.Seconds() {
+		p4m.cmdLongRunningCounter[cmd.Cmd]++
+	}
+	p4m.cmdRunning = cmd.Running
+	if cmd.Running > p4m.cmdRunningMax {
+		p4m.cmdRunningMax = cmd.Running
+	}
+	p4m.detectRetryStorm(cmd, user, client)
+	if user != "" {
+		p4m.uniqueUsers[user] = true
+	}
+	if client != "" {
+		p4m.uniqueClients[client] = true
+	}
+	if ip != "" {
+		p4m.uniqueIPs[ip] = true
+	}
+}
+
+// publishMaintenance - maintenance cmds contribute to the p4_maint_cmd_* metrics rather than p4_cmd_*,
+// as well as to the health, table and trigger metrics as the locks they hold still affect other cmds
+func (p4m *P4DMetrics) publishMaintenance(cmd *p4dlog.Command) {
+	if _, ok := p4m.maintCmdCounter[cmd.Cmd]; !ok {
+		p4m.maintCmdCounter[cmd.Cmd] = make(map[string]int64)
+	}
+	p4m.maintCmdCounter[cmd.Cmd][cmdOutcome(cmd)]++
+	p4m.maintCmdCumulative[cmd.Cmd] += float64(cmd.CompletedLapse)
+	p4m.maintCmduCPUCumulative[cmd.Cmd] += float64(cmd.UCpu) / 1000
+	p4m.maintCmdsCPUCumulative[cmd.Cmd] += float64(cmd.SCpu) / 1000
+}
 
+// publishTables - table lock and page metrics, and trigger metrics from the trigger pseudo tables
+func (p4m *P4DMetrics) publishTables(cmd *p4dlog.Command) {
+	triggerPrefix := p4m.triggerPrefix
 	for _, t := range cmd.Tables {
 		if len(t.TableName) > len(triggerPrefix) && t.TableName[:len(triggerPrefix)] == triggerPrefix {
 			triggerName := t.TableName[len(triggerPrefix):]
+			if len(p4m.triggerClasses) > 0 {
+				if _, ok := p4m.triggerClass[triggerName]; !ok {
+					p4m.triggerClass[triggerName] = p4m.classifyTrigger(triggerName)
+				}
+			}
 			p4m.totalTriggerLapse[triggerName] += float64(t.TriggerLapse)
+			p4m.triggerCounter[triggerName]++
+			if t.TriggerExitStatus != 0 {
+				p4m.triggerFailures[triggerName]++
+			}
+			if float64(t.TriggerLapse) > p4m.triggerMaxLapse[triggerName] {
+				p4m.triggerMaxLapse[triggerName] = float64(t.TriggerLapse)
+			}
 		} else {
 			p4m.totalReadHeld[t.TableName] += float64(t.TotalReadHeld) / 1000
 			p4m.totalReadWait[t.TableName] += float64(t.TotalReadWait) / 1000
 			p4m.totalWriteHeld[t.TableName] += float64(t.TotalWriteHeld) / 1000
 			p4m.totalWriteWait[t.TableName] += float64(t.TotalWriteWait) / 1000
+			if t.PeekCount > 0 {
+				p4m.totalPeekCount[t.TableName] += t.PeekCount
+				p4m.totalPeekWait[t.TableName] += float64(t.TotalPeekWait) / 1000
+				p4m.totalPeekHeld[t.TableName] += float64(t.TotalPeekHeld) / 1000
+			}
+			p4m.totalPagesIn[t.TableName] += t.PagesIn
+			p4m.totalPagesOut[t.TableName] += t.PagesOut
+			if t.PagesCached > p4m.maxPagesCached[t.TableName] {
+				p4m.maxPagesCached[t.TableName] = t.PagesCached
+			}
 		}
 	}
 }
 
+// Removes version/platform info from program names to reduce cardinality, e.g.
+// "P4V/NTX64/2023.1/2442900" -> "P4V", "p4/2016.2/LINUX26X86_64/1598668" -> "p4",
+// "c:\\scripts\\gen.py [PY3.7/P4PY2020.1/API2020.1/2051818]/v88" -> "c:\\scripts\\gen.py"
+func normalizeProgramName(program string) string {
+	if i := strings.IndexAny(program, "/["); i > 0 {
+		program = strings.TrimSpace(program[:i])
+	}
+	return program
+}
+
+type cmdInterval struct {
+	start time.Time
+	end   time.Time
+}
+
+// Returns the max number of overlapping intervals. A cmd ending at the same time another starts
+// is not counted as overlapping.
+func maxConcurrent(intervals []cmdInterval) int64 {
+	type event struct {
+		t     time.Time
+		delta int64
+	}
+	events := make([]event, 0, 2*len(intervals))
+	for _, i := range intervals {
+		events = append(events, event{i.start, 1}, event{i.end, -1})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].t.Equal(events[j].t) {
+			return events[i].delta < events[j].delta // ends before starts
+		}
+		return events[i].t.Before(events[j].t)
+	})
+	var running, max int64
+	for _, e := range events {
+		running += e.delta
+		if running > max {
+			max = running
+		}
+	}
+	return max
+}
+
+// Returns userConcurrentMax including cmds received since the last output, without updating it
+func (p4m *P4DMetrics) userConcurrency() map[string]int64 {
+	result := make(map[string]int64, len(p4m.userConcurrentMax))
+	for user, c := range p4m.userConcurrentMax {
+		result[user] = c
+	}
+	for user, intervals := range p4m.userCmdIntervals {
+		if c := maxConcurrent(intervals); c > result[user] {
+			result[user] = c
+		}
+	}
+	return result
+}
+
+// Folds cmds received since the last output into userConcurrentMax. Note that overlaps with
+// cmds from previous intervals are not counted.
+func (p4m *P4DMetrics) updateUserConcurrency() {
+	for user, intervals := range p4m.userCmdIntervals {
+		if c := maxConcurrent(intervals); c > p4m.userConcurrentMax[user] {
+			p4m.userConcurrentMax[user] = c
+		}
+	}
+	p4m.userCmdIntervals = make(map[string][]cmdInterval)
+}
+
+// Returns the distinct depot path prefixes (up to depth components) found in cmd args, e.g.
+// "//depot/main/src/...@123" with depth 2 -> "//depot/main".
+// Local paths and client syntax paths (//<workspace>/...) are ignored, as are wildcards and revision specifiers.
+func depotPaths(args string, workspace string, depth int) []string {
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, arg := range strings.Fields(args) {
+		if !strings.HasPrefix(arg, "//") {
+			continue
+		}
+		if i := strings.IndexAny(arg, "@#"); i >= 0 {
+			arg = arg[:i]
+		}
+		parts := make([]string, 0, depth)
+		for _, p := range strings.Split(arg[2:], "/") {
+			if len(parts) == depth || p == "" || strings.Contains(p, "...") || strings.Contains(p, "*") {
+				break
+			}
+			parts = append(parts, p)
+		}
+		if len(parts) == 0 || (workspace != "" && parts[0] == workspace) {
+			continue
+		}
+		depot := "//" + strings.Join(parts, "/")
+		if !seen[depot] {
+			seen[depot] = true
+			result = append(result, depot)
+		}
+	}
+	return result
+}
+
 // GO standard reference value/format: Mon Jan 2 15:04:05 -0700 MST 2006
 const p4timeformat = "2006/01/02 15:04:05"
 
-// Searches for log lines starting with a <tab>date - assumes increasing dates in log
-func (p4m *P4DMetrics) historicalUpdateRequired(line string) bool {
-	if !p4m.historical {
-		return false
+// writeSinks - outputs metrics to the configured sinks other than the channel returned by ProcessEvents
+func (p4m *P4DMetrics) writeSinks(metrics *metricsBuffer, graphite *GraphiteSender, remoteWrite *RemoteWriteSender) {
+	if graphite != nil {
+		graphite.Send(metrics.format(formatGraphite))
 	}
+	if remoteWrite != nil {
+		remoteWrite.Send(metrics.format(formatPrometheus), metrics.timestamp)
+	}
+	if p4m.config.PrometheusFile != "" {
+		if err := WriteMetricsFile(p4m.config.PrometheusFile, metrics.format(formatPrometheus)); err != nil {
+			p4m.logger.Errorf("Failed to write metrics file %s: %v", p4m.config.PrometheusFile, err)
+		}
+	}
+}
+
+// Returns the <tab>date prefix of log lines (including any fractional seconds), or "" if line doesn't start with one
+func logTimePrefix(line string) string {
 	// This next section is more efficient than regex parsing - we return ASAP
 	const lenPrefix = len("\t2020/03/04 12:13:14")
 	if len(line) < lenPrefix {
-		return false
+		return ""
 	}
 	// Check for expected chars at specific points
 	if line[0] != '\t' || line[5] != '/' || line[8] != '/' ||
 		line[11] != ' ' || line[14] != ':' || line[17] != ':' {
-		return false
+		return ""
 	}
 	// Check for digits
 	for _, i := range []int{1, 2, 3, 4, 6, 7, 9, 10, 12, 13, 15, 16, 18, 19} {
 		if line[i] < byte('0') || line[i] > byte('9') {
-			return false
+			return ""
 		}
 	}
+	// Some p4d builds log fractional seconds, e.g. 12:13:14.123 - include them in the prefix
+	n := lenPrefix
+	if n < len(line) && line[n] == '.' {
+		n++
+		for n < len(line) && line[n] >= byte('0') && line[n] <= byte('9') {
+			n++
+		}
+	}
+	return line[:n]
+}
+
+// Live only - tracks the latest log time seen, for p4_prom_log_lag_seconds
+func (p4m *P4DMetrics) updateLatestLogTime(line string) {
+	prefix := logTimePrefix(line)
+	if prefix == "" || strings.Compare(prefix, p4m.latestStartCmdBuf) <= 0 {
+		return
+	}
+	p4m.latestStartCmdBuf = prefix
+	p4m.timeLatestStartCmd, _ = time.ParseInLocation(p4timeformat, prefix[1:], p4m.logLocation)
+}
+
+// logLag returns how far the latest log time is behind the wall clock (live only, otherwise 0).
+func (p4m *P4DMetrics) logLag(now time.Time) float64 {
+	if p4m.historical || p4m.timeLatestStartCmd.IsZero() {
+		return 0
+	}
+	return now.Sub(p4m.timeLatestStartCmd).Seconds()
+}
+
+// logTime converts a time from the log parser, which holds the logged wall clock time as UTC, to the
+// time in the log's zone
+func (p4m *P4DMetrics) logTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), p4m.logLocation)
+}
+
+// parserTime is the inverse of logTime, for passing times back to the log parser
+func parserTime(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// Searches for log lines starting with a <tab>date (optionally with fractional seconds) - assumes increasing dates in log.
+// Also returns the time to send the parser on timeChan, or zero if none. This is sent once p4m.m is released, as the
+// send waits for the parser, which may be waiting to output a cmd to publishEvent, which takes p4m.m.
+func (p4m *P4DMetrics) historicalUpdateRequired(line string) (bool, time.Time) {
+	if !p4m.historical {
+		return false, time.Time{}
+	}
+	prefix := logTimePrefix(line)
+	if prefix == "" {
+		return false, time.Time{}
+	}
+	n := len(prefix)
 	if len(p4m.latestStartCmdBuf) == 0 {
-		p4m.latestStartCmdBuf = line[:lenPrefix]
-		p4m.timeLatestStartCmd, _ = time.Parse(p4timeformat, line[1:lenPrefix])
-		return false
+		p4m.latestStartCmdBuf = line[:n]
+		p4m.timeLatestStartCmd, _ = time.ParseInLocation(p4timeformat, line[1:n], p4m.logLocation)
+		p4m.timeLastFlush = p4m.timeLatestStartCmd
+		return false, time.Time{}
 	}
-	if len(p4m.latestStartCmdBuf) > 0 && p4m.latestStartCmdBuf == line[:lenPrefix] {
-		return false
+	if len(p4m.latestStartCmdBuf) > 0 && p4m.latestStartCmdBuf == line[:n] {
+		return false, time.Time{}
 	}
 	// Update only if greater (due to log format we do see out of sequence dates with track records)
-	if strings.Compare(line[:lenPrefix], p4m.latestStartCmdBuf) <= 0 {
-		return false
+	if strings.Compare(line[:n], p4m.latestStartCmdBuf) <= 0 {
+		return false, time.Time{}
 	}
-	dt, _ := time.Parse(p4timeformat, string(line[1:lenPrefix]))
+	dt, _ := time.ParseInLocation(p4timeformat, string(line[1:n]), p4m.logLocation)
+	var toParser time.Time
 	if dt.Sub(p4m.timeLatestStartCmd) >= 3*time.Second {
-		p4m.timeChan <- dt
+		toParser = parserTime(dt)
+	}
+	if p4m.config.AlignToInterval {
+		// Output when a boundary is crossed, timestamped with the boundary so series line up with other sources
+		boundary := dt.Truncate(p4m.config.UpdateInterval)
+		if boundary.After(p4m.timeLatestStartCmd.Truncate(p4m.config.UpdateInterval)) {
+			p4m.timeLatestStartCmd = boundary
+			p4m.latestStartCmdBuf = line[:n]
+			return true, toParser
+		}
+		return false, toParser
 	}
 	if dt.Sub(p4m.timeLatestStartCmd) >= p4m.config.UpdateInterval {
 		p4m.timeLatestStartCmd = dt
-		p4m.latestStartCmdBuf = line[:lenPrefix]
-		return true
+		p4m.latestStartCmdBuf = line[:n]
+		return true, toParser
+	}
+	return false, toParser
+}
+
+// Parses a time window value - either RFC3339 or the p4d log format (which is in the log's zone)
+func parseWindowTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(p4timeformat, value, loc)
+}
+
+func (p4m *P4DMetrics) setTimeWindow() {
+	var err error
+	if p4m.config.StartTime != "" {
+		if p4m.windowStart, err = parseWindowTime(p4m.config.StartTime, p4m.logLocation); err != nil {
+			p4m.logger.Errorf("Ignoring invalid start time '%s': %v", p4m.config.StartTime, err)
+		}
+	}
+	if p4m.config.EndTime != "" {
+		if p4m.windowEnd, err = parseWindowTime(p4m.config.EndTime, p4m.logLocation); err != nil {
+			p4m.logger.Errorf("Ignoring invalid end time '%s': %v", p4m.config.EndTime, err)
+		}
 	}
-	return false
+}
+
+// Returns true if time (e.g. a cmd start time) is within the configured window
+func (p4m *P4DMetrics) inTimeWindow(t time.Time) bool {
+	if !p4m.windowStart.IsZero() && t.Before(p4m.windowStart) {
+		return false
+	}
+	if !p4m.windowEnd.IsZero() && t.After(p4m.windowEnd) {
+		return false
+	}
+	return true
 }
 
 // ProcessEvents - main event loop for P4Prometheus - reads lines and outputs metrics
 // Wraps p4dlog.LogParser event loop
 func (p4m *P4DMetrics) ProcessEvents(ctx context.Context, linesInChan <-chan string, needCmdChan bool) (
 	chan p4dlog.Command, chan string) {
-	ticker := time.NewTicker(p4m.config.UpdateInterval)
+	ticker := p4m.clock.NewTicker(p4m.config.UpdateInterval)
+	if !p4m.historical {
+		p4m.m.Lock()
+		p4m.timeLastFlush = p4m.clock.Now()
+		p4m.m.Unlock()
+	}
 
 	if p4m.config.Debug > 0 {
 		p4m.fp.SetDebugMode(p4m.config.Debug)
 	}
-	fpLinesChan := make(chan string, 10000)
+	maxLineLength := p4m.config.MaxLineLength
+	if maxLineLength <= 0 {
+		maxLineLength = DefaultMaxLineLength
+	}
+	p4m.fp.SetMaxLineLength(maxLineLength)
+	p4m.fp.SetLinePrefixRegex(p4m.config.LinePrefixRegex)
+	p4m.fp.SetTriggerPrefix(p4m.triggerPrefix)
+	if p4m.config.RedactCommands != nil {
+		p4m.fp.SetRedactCommands(p4m.config.RedactCommands)
+	}
+	if p4m.config.PendingTimeout > 0 {
+		p4m.fp.SetPendingTimeout(p4m.config.PendingTimeout)
+	}
+	linesBufSize, metricsBufSize, cmdsBufSize := 10000, 1000, 10000
+	if p4m.config.MaxPendingCmds > 0 {
+		switch p4m.config.PendingOverflow {
+		case PendingOverflowShed:
+			p4m.fp.SetMaxPending(p4m.config.MaxPendingCmds, false)
+		case "", PendingOverflowBlock:
+			// Parsing waits at the max, so buffered lines and output are capped too
+			p4m.fp.SetMaxPending(p4m.config.MaxPendingCmds, true)
+			if p4m.config.MaxPendingCmds < linesBufSize {
+				linesBufSize = p4m.config.MaxPendingCmds
+				cmdsBufSize = p4m.config.MaxPendingCmds
+			}
+			if p4m.config.MaxPendingCmds < metricsBufSize {
+				metricsBufSize = p4m.config.MaxPendingCmds
+			}
+		default:
+			p4m.logger.Errorf("Ignoring invalid pending overflow %q - must be %s or %s",
+				p4m.config.PendingOverflow, PendingOverflowBlock, PendingOverflowShed)
+		}
+	}
+	fpLinesChan := make(chan string, linesBufSize)
+	p4m.fpLinesChan = fpLinesChan
 	// Leave as unset
 	if p4m.historical {
 		p4m.timeChan = make(chan time.Time, 1000)
+		p4m.setTimeWindow()
 	}
 
-	metricsChan := make(chan string, 1000)
+	metricsChan := make(chan string, metricsBufSize)
 	var cmdsOutChan chan p4dlog.Command
 	if needCmdChan {
-		cmdsOutChan = make(chan p4dlog.Command, 10000)
+		cmdsOutChan = make(chan p4dlog.Command, cmdsBufSize)
 	}
 	cmdsInChan := p4m.fp.LogParser(ctx, fpLinesChan, p4m.timeChan)
+	p4m.cmdsInChan = cmdsInChan
+	var graphite *GraphiteSender
+	if p4m.config.GraphiteAddress != "" {
+		graphite = NewGraphiteSender(p4m.config.GraphiteAddress, p4m.logger)
+	}
+	var remoteWrite *RemoteWriteSender
+	if p4m.config.RemoteWriteURL != "" {
+		remoteWrite = NewRemoteWriteSender(p4m.config.RemoteWriteURL, p4m.config.RemoteWriteAuth, p4m.logger)
+		p4m.remoteWrite = remoteWrite
+	}
+
+	var idleTicker Ticker
+	var idleTickerC <-chan time.Time // Nil unless idle flushing is configured, so never selected
+	if p4m.config.IdleFlushInterval > 0 && !p4m.historical {
+		idleTicker = p4m.clock.NewTicker(p4m.config.IdleFlushInterval)
+		idleTickerC = idleTicker.C()
+	}
 
 	go func() {
+		defer ticker.Stop()
+		if idleTicker != nil {
+			defer idleTicker.Stop()
+		}
 		defer close(metricsChan)
 		if needCmdChan {
 			defer close(cmdsOutChan)
 		}
+		if graphite != nil {
+			defer graphite.Close()
+		}
+		if remoteWrite != nil {
+			defer remoteWrite.Close()
+		}
+		// Live output of the interval so far - false if cancelled
+		outputLive := func() bool {
+			metrics := p4m.flushMetricsBuffer()
+			p4m.writeSinks(metrics, graphite, remoteWrite)
+			select {
+			case metricsChan <- metrics.String():
+			case <-ctx.Done():
+				return false
+			}
+			if p4m.config.SummaryLogging {
+				p4m.logger.Info(p4m.intervalSummary())
+			}
+			p4m.Reset()
+			return true
+		}
+		var lastCmdTime time.Time
+		idleFlushDue := false // Cmds processed since the last output
 		for {
 			select {
 			case <-ctx.Done():
 				p4m.logger.Info("Done received")
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				// Ticker only relevant for live log processing
 				if p4dlog.FlagSet(p4m.debug, p4dlog.DebugMetricStats) {
 					p4m.logger.Debugf("publishCumulative")
 				}
 				if !p4m.historical {
-					metricsChan <- p4m.getCumulativeMetrics()
-					p4m.resetToZero()
+					if !outputLive() {
+						return
+					}
+					idleFlushDue = false
+				}
+			case <-idleTickerC:
+				if idleFlushDue && p4m.clock.Now().Sub(lastCmdTime) >= p4m.config.IdleFlushInterval {
+					p4m.logger.Debugf("Idle flush - no cmds since %s", lastCmdTime)
+					if !outputLive() {
+						return
+					}
+					idleFlushDue = false
 				}
 			case cmd, ok := <-cmdsInChan:
 				if ok {
+					if p4m.historical && !p4m.inTimeWindow(p4m.logTime(cmd.StartTime)) {
+						continue
+					}
+					if p4m.historical && p4m.config.ReplaySpeed > 0 && !p4m.replayWait(ctx, cmd.StartTime) {
+						return
+					}
 					if p4m.logger.Level > logrus.DebugLevel && p4dlog.FlagSet(p4m.debug, p4dlog.DebugCommands) {
 						p4m.logger.Tracef("Publishing cmd: %s", cmd.String())
 					}
+					p4m.m.Lock()
 					p4m.cmdsProcessed++
+					p4m.m.Unlock()
 					p4m.publishEvent(cmd)
+					if idleTickerC != nil {
+						lastCmdTime = p4m.clock.Now()
+						idleFlushDue = true
+					}
 					if needCmdChan {
-						cmdsOutChan <- cmd
+						select {
+						case cmdsOutChan <- cmd:
+						case <-ctx.Done():
+							return
+						}
 					}
 				} else {
 					p4m.logger.Debugf("FP Cmd closed")
-					metricsChan <- p4m.getCumulativeMetrics()
+					metrics := p4m.flushMetricsBuffer()
+					if p4m.historical && p4m.config.OutputHourOfDay {
+						metrics.append(p4m.getHourOfDayReport())
+					}
+					if p4m.config.PushgatewayURL != "" {
+						if err := p4m.pushMetrics(metrics.format(formatPrometheus)); err != nil {
+							p4m.logger.Errorf("%v", err)
+						}
+					}
+					p4m.writeSinks(metrics, graphite, remoteWrite)
+					select {
+					case metricsChan <- metrics.String():
+					case <-ctx.Done():
+					}
 					return
 				}
 			case line, ok := <-linesInChan:
@@ -660,10 +2810,40 @@ func (p4m *P4DMetrics) ProcessEvents(ctx context.Context, linesInChan <-chan str
 					if p4m.logger.Level > logrus.DebugLevel && p4dlog.FlagSet(p4m.debug, p4dlog.DebugLines) {
 						p4m.logger.Tracef("Line: %s", line)
 					}
+					// The parser strips any prefix itself, this is just for finding log times
+					logLine := p4m.fp.StripLinePrefix(line)
+					p4m.m.Lock()
 					p4m.linesRead++
-					fpLinesChan <- line
-					if p4m.historical && p4m.historicalUpdateRequired(line) {
-						metricsChan <- p4m.getCumulativeMetrics()
+					if !p4m.historical {
+						p4m.updateLatestLogTime(logLine)
+					}
+					p4m.m.Unlock()
+					// Don't block forever if the parser is not draining and we are cancelled
+					select {
+					case fpLinesChan <- line:
+					case <-ctx.Done():
+						return
+					}
+					p4m.m.Lock()
+					update, toParser := p4m.historicalUpdateRequired(logLine)
+					update = update && p4m.inTimeWindow(p4m.timeLatestStartCmd)
+					p4m.m.Unlock()
+					if !toParser.IsZero() {
+						select {
+						case p4m.timeChan <- toParser:
+						case <-ctx.Done():
+							return
+						}
+					}
+					if update {
+						metrics := p4m.flushMetricsBuffer()
+						p4m.writeSinks(metrics, graphite, remoteWrite)
+						select {
+						case metricsChan <- metrics.String():
+						case <-ctx.Done():
+							return
+						}
+						p4m.endInterval()
 					}
 				} else {
 					if fpLinesChan != nil {
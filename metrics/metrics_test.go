@@ -1,9 +1,12 @@
 package metrics
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
@@ -11,11 +14,16 @@ import (
 	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 
-	p4dlog "github.com/rcowham/go-libp4dlog"
+	p4dlog "github.com/RishiMunagala/go-libp4dlog"
+	"github.com/perforce/p4prometheus/version"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 )
 
 var (
@@ -26,6 +34,11 @@ var (
 		Level: logrus.InfoLevel}
 )
 
+// Expected timestamps assume logs in UTC, which LogTimeZone defaults to via the local zone
+func init() {
+	time.Local = time.UTC
+}
+
 func getResult(output chan string) []string {
 	lines := []string{}
 	for line := range output {
@@ -75,6 +88,17 @@ func getOutput(testchan chan string, historical bool) []string {
 }
 
 func basicTest(t *testing.T, cfg *Config, input string, historical bool) []string {
+	return clockTest(t, cfg, input, historical, nil)
+}
+
+// oneOutputTest - as basicTest but the live ticker never fires, so the only output is written
+// when input is exhausted and covers all of it
+func oneOutputTest(t *testing.T, cfg *Config, input string, historical bool) []string {
+	return clockTest(t, cfg, input, historical, newFakeClock(time.Now()))
+}
+
+// clockTest - as basicTest, using clock if not nil
+func clockTest(t *testing.T, cfg *Config, input string, historical bool, clock *fakeClock) []string {
 	logrus.SetFormatter(&logrus.TextFormatter{TimestampFormat: "15:04:05.000", FullTimestamp: true})
 	logger.SetReportCaller(true)
 	logger.Debugf("Function: %s", funcName())
@@ -90,10 +114,17 @@ func basicTest(t *testing.T, cfg *Config, input string, historical bool) []strin
 
 	p4m := NewP4DMetricsLogParser(cfg, logger, historical)
 	p4m.fp = fp
+	if clock != nil {
+		p4m.SetClock(clock)
+	}
 
 	var wg sync.WaitGroup
 
 	_, metricsChan := p4m.ProcessEvents(ctx, linesChan, false)
+	if clock != nil {
+		// Rates are as if the output were at the end of one interval
+		clock.advance(cfg.UpdateInterval)
+	}
 
 	for _, l := range eol.Split(input, -1) {
 		linesChan <- l
@@ -124,18 +155,20 @@ func hasPrefix(prefixes []string, line string) bool {
 	return false
 }
 
+// Metrics whose values vary per test run
+var variableMetrics = []string{"p4_prom_cmds_pending", "p4_prom_cpu_user", "p4_prom_cpu_system", "p4_prom_log_lag_seconds",
+	"p4_prom_cmd_chan_depth", "p4_prom_line_chan_depth", "p4_prom_build_info"}
+
 func compareOutput(t *testing.T, expected, actual []string) {
 	nExpected := make([]string, 0)
 	nActual := make([]string, 0)
-	// Ignore these elements as the contents varies per test run
-	ignorePrefixes := []string{"p4_prom_cmds_pending", "p4_prom_cpu_user", "p4_prom_cpu_system"}
 	for _, line := range expected {
-		if !hasPrefix(ignorePrefixes, line) {
+		if !hasPrefix(variableMetrics, line) {
 			nExpected = append(nExpected, line)
 		}
 	}
 	for _, line := range actual {
-		if !hasPrefix(ignorePrefixes, line) {
+		if !hasPrefix(variableMetrics, line) {
 			nActual = append(nActual, line)
 		}
 	}
@@ -144,6 +177,19 @@ func compareOutput(t *testing.T, expected, actual []string) {
 	assert.Equal(t, nExpected, nActual)
 }
 
+// updateRequired - as historicalUpdateRequired, ignoring the time for the parser
+func updateRequired(p4m *P4DMetrics, line string) bool {
+	update, _ := p4m.historicalUpdateRequired(line)
+	return update
+}
+
+// flushMetrics - the output at the end of an interval, as done by ProcessEvents
+func flushMetrics(p4m *P4DMetrics) string {
+	output := p4m.flushMetricsBuffer().String()
+	p4m.endInterval()
+	return output
+}
+
 func TestP4PromBasic(t *testing.T) {
 	cfg := &Config{
 		ServerID:         "myserverid",
@@ -161,54 +207,94 @@ Perforce server info:
 `
 	cmdTime, _ := time.Parse(p4timeformat, "2015/09/02 15:23:09")
 	historical := false
-	output := basicTest(t, cfg, input, historical)
+	output := oneOutputTest(t, cfg, input, historical)
 
-	expected := eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1
+	expected := eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1
+p4_user_concurrent_max{serverid="myserverid",user="robert"} 1
 p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 0.031
-p4_cmd_program_counter{serverid="myserverid",program="p4/2016.2/LINUX26X86_64/1598668"} 1
-p4_cmd_program_cumulative_seconds{serverid="myserverid",program="p4/2016.2/LINUX26X86_64/1598668"} 0.031
+p4_cmd_program_counter{serverid="myserverid",program="p4/2016.2/linux26x86_64/1598668"} 1
+p4_cmd_program_cumulative_seconds{serverid="myserverid",program="p4/2016.2/linux26x86_64/1598668"} 0.031
 p4_cmd_running{serverid="myserverid"} 1
+p4_cmd_running_max{serverid="myserverid"} 1
 p4_cmd_user_counter{serverid="myserverid",user="robert"} 1
 p4_cmd_cpu_system_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 0.000
 p4_cmd_cpu_user_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 0.000
 p4_cmd_user_cumulative_seconds{serverid="myserverid",user="robert"} 0.031
 p4_prom_cmds_pending{serverid="myserverid"} 0
+p4_prom_cmds_pending_max{serverid="myserverid"} 0
+p4_prom_cmd_chan_depth{serverid="myserverid"} 0
+p4_prom_line_chan_depth{serverid="myserverid"} 0
 p4_prom_cmds_processed{serverid="myserverid"} 1
 p4_prom_log_lines_read{serverid="myserverid"} 10
+p4_prom_build_info{serverid="myserverid",version="unknown",revision="unknown",goversion="go1.18"} 1
+p4_prom_log_lag_seconds{serverid="myserverid"} 0.000
+p4_prom_log_lines_truncated{serverid="myserverid"} 0
 p4_prom_cpu_system{serverid="myserverid"} 0.0
 p4_prom_cpu_user{serverid="myserverid"} 0.0
 p4_sync_bytes_added{serverid="myserverid"} 123
+p4_sync_bytes_per_file{serverid="myserverid"} 144.750
 p4_sync_bytes_updated{serverid="myserverid"} 456
 p4_sync_files_added{serverid="myserverid"} 1
 p4_sync_files_deleted{serverid="myserverid"} 2
-p4_sync_files_updated{serverid="myserverid"} 3`, -1)
+p4_sync_files_per_cmd{serverid="myserverid"} 4.000
+p4_sync_files_updated{serverid="myserverid"} 3
+p4_net_bytes_added{serverid="myserverid",cmd="user-sync"} 123
+p4_net_bytes_updated{serverid="myserverid",cmd="user-sync"} 456
+p4_net_files_added{serverid="myserverid",cmd="user-sync"} 1
+p4_net_files_deleted{serverid="myserverid",cmd="user-sync"} 2
+p4_cmd_rate_per_second{serverid="myserverid"} 100.000
+p4_unique_clients{serverid="myserverid"} 1
+p4_unique_ips{serverid="myserverid"} 1
+p4_unique_users{serverid="myserverid"} 1
+p4_cmd_cpu_efficiency{serverid="myserverid",cmd="user-sync"} 0.000
+p4_net_files_updated{serverid="myserverid",cmd="user-sync"} 3`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
 
 	historical = true
-	output = basicTest(t, cfg, input, historical)
+	output = oneOutputTest(t, cfg, input, historical)
 
 	// Cross check appropriate time is being produced for historical runs
 	assert.Contains(t, output[0], fmt.Sprintf("%d", cmdTime.Unix()))
-	expected = eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync 1 1441207389
+	expected = eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389
+p4_user_concurrent_max;serverid=myserverid;user=robert 1 1441207389
 p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.031 1441207389
-p4_cmd_program_counter;serverid=myserverid;program=p4/2016.2/LINUX26X86_64/1598668 1 1441207389
-p4_cmd_program_cumulative_seconds;serverid=myserverid;program=p4/2016.2/LINUX26X86_64/1598668 0.031 1441207389
+p4_cmd_program_counter;serverid=myserverid;program=p4/2016.2/linux26x86_64/1598668 1 1441207389
+p4_cmd_program_cumulative_seconds;serverid=myserverid;program=p4/2016.2/linux26x86_64/1598668 0.031 1441207389
 p4_cmd_running;serverid=myserverid 1 1441207389
+p4_cmd_running_max;serverid=myserverid 1 1441207389
 p4_cmd_user_counter;serverid=myserverid;user=robert 1 1441207389
 p4_cmd_cpu_system_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441207389
 p4_cmd_cpu_user_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441207389
 p4_cmd_user_cumulative_seconds;serverid=myserverid;user=robert 0.031 1441207389
 p4_prom_cmds_pending;serverid=myserverid 0 1441207389
+p4_prom_cmds_pending_max;serverid=myserverid 0 1441207389
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1441207389
+p4_prom_line_chan_depth;serverid=myserverid 0 1441207389
 p4_prom_cmds_processed;serverid=myserverid 1 1441207389
 p4_prom_log_lines_read;serverid=myserverid 10 1441207389
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1441207389
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1441207389
+p4_prom_log_lines_truncated;serverid=myserverid 0 1441207389
 p4_prom_cpu_system;serverid=myserverid 0.0 1441207389
 p4_prom_cpu_user;serverid=myserverid 0.0 1441207389
 p4_sync_bytes_added;serverid=myserverid 123 1441207389
+p4_sync_bytes_per_file;serverid=myserverid 144.750 1441207389
 p4_sync_bytes_updated;serverid=myserverid 456 1441207389
 p4_sync_files_added;serverid=myserverid 1 1441207389
 p4_sync_files_deleted;serverid=myserverid 2 1441207389
-p4_sync_files_updated;serverid=myserverid 3 1441207389`, -1)
+p4_sync_files_per_cmd;serverid=myserverid 4.000 1441207389
+p4_sync_files_updated;serverid=myserverid 3 1441207389
+p4_net_bytes_added;serverid=myserverid;cmd=user-sync 123 1441207389
+p4_net_bytes_updated;serverid=myserverid;cmd=user-sync 456 1441207389
+p4_net_files_added;serverid=myserverid;cmd=user-sync 1 1441207389
+p4_net_files_deleted;serverid=myserverid;cmd=user-sync 2 1441207389
+p4_cmd_rate_per_second;serverid=myserverid 1.000 1441207389
+p4_unique_clients;serverid=myserverid 1 1441207389
+p4_unique_ips;serverid=myserverid 1 1441207389
+p4_unique_users;serverid=myserverid 1 1441207389
+p4_cmd_cpu_efficiency;serverid=myserverid;cmd=user-sync 0.000 1441207389
+p4_net_files_updated;serverid=myserverid;cmd=user-sync 3 1441207389`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
 
@@ -241,40 +327,71 @@ Perforce server info:
 `
 	cmdTime, _ := time.Parse(p4timeformat, "2015/09/02 16:23:10")
 	historical := true
-	output := basicTest(t, cfg, input, historical)
+	output := oneOutputTest(t, cfg, input, historical)
 
 	// Cross check appropriate time is being produced for historical runs
 	assert.Contains(t, output[0], fmt.Sprintf("%d", cmdTime.Unix()))
-	expected := eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync 2 1441210990
+	expected := eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 2 1441210990
+p4_user_concurrent_max;serverid=myserverid;user=robert 1 1441210990
 p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.062 1441210990
-p4_cmd_program_counter;serverid=myserverid;program=p4/2016.2/LINUX26X86_64/1598668 2 1441210990
-p4_cmd_program_cumulative_seconds;serverid=myserverid;program=p4/2016.2/LINUX26X86_64/1598668 0.062 1441210990
+p4_cmd_program_counter;serverid=myserverid;program=p4/2016.2/linux26x86_64/1598668 2 1441210990
+p4_cmd_program_cumulative_seconds;serverid=myserverid;program=p4/2016.2/linux26x86_64/1598668 0.062 1441210990
 p4_cmd_running;serverid=myserverid 0 1441210990
+p4_cmd_running_max;serverid=myserverid 0 1441210990
 p4_cmd_running;serverid=myserverid 1 1441210990
+p4_cmd_running_max;serverid=myserverid 1 1441210990
 p4_cmd_user_counter;serverid=myserverid;user=robert 2 1441210990
 p4_cmd_cpu_system_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441210990
 p4_cmd_cpu_user_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441210990
 p4_cmd_user_cumulative_seconds;serverid=myserverid;user=robert 0.062 1441210990
 p4_prom_cmds_pending;serverid=myserverid 0 1441210990
+p4_prom_cmds_pending_max;serverid=myserverid 0 1441210990
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1441210990
+p4_prom_line_chan_depth;serverid=myserverid 0 1441210990
 p4_prom_cmds_pending;serverid=myserverid 0 1441210990
+p4_prom_cmds_pending_max;serverid=myserverid 0 1441210990
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1441210990
+p4_prom_line_chan_depth;serverid=myserverid 0 1441210990
 p4_prom_cmds_processed;serverid=myserverid 0 1441210990
 p4_prom_cmds_processed;serverid=myserverid 2 1441210990
 p4_prom_log_lines_read;serverid=myserverid 12 1441210990
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1441210990
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1441210990
+p4_prom_log_lines_truncated;serverid=myserverid 0 1441210990
 p4_prom_log_lines_read;serverid=myserverid 19 1441210990
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1441210990
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1441210990
+p4_prom_log_lines_truncated;serverid=myserverid 0 1441210990
 p4_prom_cpu_system;serverid=myserverid 0.0 1441207389
 p4_prom_cpu_system;serverid=myserverid 0.0 1441207389
 p4_prom_cpu_user;serverid=myserverid 0.0 1441207389
 p4_prom_cpu_user;serverid=myserverid 0.0 1441207389
 p4_sync_bytes_added;serverid=myserverid 0 1441210990
 p4_sync_bytes_added;serverid=myserverid 246 1441210990
+p4_sync_bytes_per_file;serverid=myserverid 144.750 1441210990
 p4_sync_bytes_updated;serverid=myserverid 0 1441210990
 p4_sync_bytes_updated;serverid=myserverid 912 1441210990
 p4_sync_files_added;serverid=myserverid 0 1441210990
 p4_sync_files_added;serverid=myserverid 2 1441210990
 p4_sync_files_deleted;serverid=myserverid 0 1441210990
 p4_sync_files_deleted;serverid=myserverid 4 1441210990
+p4_sync_files_per_cmd;serverid=myserverid 4.000 1441210990
 p4_sync_files_updated;serverid=myserverid 0 1441210990
-p4_sync_files_updated;serverid=myserverid 6 1441210990`, -1)
+p4_sync_files_updated;serverid=myserverid 6 1441210990
+p4_net_bytes_added;serverid=myserverid;cmd=user-sync 246 1441210990
+p4_net_bytes_updated;serverid=myserverid;cmd=user-sync 912 1441210990
+p4_net_files_added;serverid=myserverid;cmd=user-sync 2 1441210990
+p4_net_files_deleted;serverid=myserverid;cmd=user-sync 4 1441210990
+p4_cmd_rate_per_second;serverid=myserverid 0.000 1441210990
+p4_cmd_rate_per_second;serverid=myserverid 2.000 1441210990
+p4_unique_clients;serverid=myserverid 0 1441210990
+p4_unique_ips;serverid=myserverid 0 1441210990
+p4_unique_clients;serverid=myserverid 1 1441210990
+p4_unique_ips;serverid=myserverid 1 1441210990
+p4_unique_users;serverid=myserverid 0 1441210990
+p4_unique_users;serverid=myserverid 1 1441210990
+p4_cmd_cpu_efficiency;serverid=myserverid;cmd=user-sync 0.000 1441210990
+p4_net_files_updated;serverid=myserverid;cmd=user-sync 6 1441210990`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
 
@@ -297,49 +414,73 @@ Perforce server info:
 
 	cmdTime, _ := time.Parse(p4timeformat, "2015/09/02 15:23:09")
 	historical := false
-	output := basicTest(t, cfg, input, historical)
+	output := oneOutputTest(t, cfg, input, historical)
 
-	expected := eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1
+	expected := eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1
 p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 0.031
 p4_cmd_program_counter{serverid="myserverid",program="some_unknown_prog_p4python_v2"} 1
 p4_cmd_program_cumulative_seconds{serverid="myserverid",program="some_unknown_prog_p4python_v2"} 0.031
 p4_cmd_running{serverid="myserverid"} 1
+p4_cmd_running_max{serverid="myserverid"} 1
 p4_cmd_cpu_system_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 0.000
 p4_cmd_cpu_user_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 0.000
 p4_prom_cmds_pending{serverid="myserverid"} 0
+p4_prom_cmds_pending_max{serverid="myserverid"} 0
+p4_prom_cmd_chan_depth{serverid="myserverid"} 0
+p4_prom_line_chan_depth{serverid="myserverid"} 0
 p4_prom_cmds_processed{serverid="myserverid"} 1
 p4_prom_log_lines_read{serverid="myserverid"} 8
+p4_prom_build_info{serverid="myserverid",version="unknown",revision="unknown",goversion="go1.18"} 1
+p4_prom_log_lag_seconds{serverid="myserverid"} 0.000
+p4_prom_log_lines_truncated{serverid="myserverid"} 0
 p4_prom_cpu_system{serverid="myserverid"} 0.0
 p4_prom_cpu_user{serverid="myserverid"} 0.0
 p4_sync_bytes_added{serverid="myserverid"} 0
 p4_sync_bytes_updated{serverid="myserverid"} 0
 p4_sync_files_added{serverid="myserverid"} 0
 p4_sync_files_deleted{serverid="myserverid"} 0
+p4_cmd_rate_per_second{serverid="myserverid"} 50.000
+p4_unique_clients{serverid="myserverid"} 1
+p4_unique_ips{serverid="myserverid"} 1
+p4_unique_users{serverid="myserverid"} 1
+p4_cmd_cpu_efficiency{serverid="myserverid",cmd="user-sync"} 0.000
 p4_sync_files_updated{serverid="myserverid"} 0`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
 
 	historical = true
-	output = basicTest(t, cfg, input, historical)
+	output = oneOutputTest(t, cfg, input, historical)
 
 	// Cross check appropriate time is being produced for historical runs
 	assert.Contains(t, output[0], fmt.Sprintf("%d", cmdTime.Unix()))
-	expected = eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync 1 1441207389
+	expected = eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389
 p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.031 1441207389
 p4_cmd_program_counter;serverid=myserverid;program=some_unknown_prog_p4python_v2 1 1441207389
 p4_cmd_program_cumulative_seconds;serverid=myserverid;program=some_unknown_prog_p4python_v2 0.031 1441207389
 p4_cmd_running;serverid=myserverid 1 1441207389
+p4_cmd_running_max;serverid=myserverid 1 1441207389
 p4_cmd_cpu_system_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441207389
 p4_cmd_cpu_user_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441207389
 p4_prom_cmds_pending;serverid=myserverid 0 1441207389
+p4_prom_cmds_pending_max;serverid=myserverid 0 1441207389
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1441207389
+p4_prom_line_chan_depth;serverid=myserverid 0 1441207389
 p4_prom_cmds_processed;serverid=myserverid 1 1441207389
 p4_prom_log_lines_read;serverid=myserverid 8 1441207389
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1441207389
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1441207389
+p4_prom_log_lines_truncated;serverid=myserverid 0 1441207389
 p4_prom_cpu_system;serverid=myserverid 0.0 1441207389
 p4_prom_cpu_user;serverid=myserverid 0.0 1441207389
 p4_sync_bytes_added;serverid=myserverid 0 1441207389
 p4_sync_bytes_updated;serverid=myserverid 0 1441207389
 p4_sync_files_added;serverid=myserverid 0 1441207389
 p4_sync_files_deleted;serverid=myserverid 0 1441207389
+p4_cmd_rate_per_second;serverid=myserverid 1.000 1441207389
+p4_unique_clients;serverid=myserverid 1 1441207389
+p4_unique_ips;serverid=myserverid 1 1441207389
+p4_unique_users;serverid=myserverid 1 1441207389
+p4_cmd_cpu_efficiency;serverid=myserverid;cmd=user-sync 0.000 1441207389
 p4_sync_files_updated;serverid=myserverid 0 1441207389`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
@@ -362,26 +503,38 @@ Perforce server info:
 
 	cmdTime, _ := time.Parse(p4timeformat, "2015/09/02 15:23:09")
 	historical := true
-	output := basicTest(t, cfg, input, historical)
+	output := oneOutputTest(t, cfg, input, historical)
 
 	// Cross check appropriate time is being produced for historical runs
 	assert.Contains(t, output[0], fmt.Sprintf("%d", cmdTime.Unix()))
-	expected := eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync 1 1441207389
+	expected := eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389
 p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.031 1441207389
-p4_cmd_program_counter;serverid=myserverid;program=c:\\jenkins\\workspacegen_stubs.py_[PY2.7.9+/P4PY2020.1/API2020.1/2051818]/v88 1 1441207389
-p4_cmd_program_cumulative_seconds;serverid=myserverid;program=c:\\jenkins\\workspacegen_stubs.py_[PY2.7.9+/P4PY2020.1/API2020.1/2051818]/v88 0.031 1441207389
+p4_cmd_program_counter;serverid=myserverid;program=c:\\jenkins\\workspacegen_stubs.py_[py2.7.9+/p4py2020.1/api2020.1/2051818]/v88 1 1441207389
+p4_cmd_program_cumulative_seconds;serverid=myserverid;program=c:\\jenkins\\workspacegen_stubs.py_[py2.7.9+/p4py2020.1/api2020.1/2051818]/v88 0.031 1441207389
 p4_cmd_running;serverid=myserverid 1 1441207389
+p4_cmd_running_max;serverid=myserverid 1 1441207389
 p4_cmd_cpu_system_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441207389
 p4_cmd_cpu_user_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441207389
 p4_prom_cmds_pending;serverid=myserverid 0 1441207389
+p4_prom_cmds_pending_max;serverid=myserverid 0 1441207389
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1441207389
+p4_prom_line_chan_depth;serverid=myserverid 0 1441207389
 p4_prom_cmds_processed;serverid=myserverid 1 1441207389
 p4_prom_log_lines_read;serverid=myserverid 8 1441207389
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1441207389
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1441207389
+p4_prom_log_lines_truncated;serverid=myserverid 0 1441207389
 p4_prom_cpu_system;serverid=myserverid 0.0 1441207389
 p4_prom_cpu_user;serverid=myserverid 0.0 1441207389
 p4_sync_bytes_added;serverid=myserverid 0 1441207389
 p4_sync_bytes_updated;serverid=myserverid 0 1441207389
 p4_sync_files_added;serverid=myserverid 0 1441207389
 p4_sync_files_deleted;serverid=myserverid 0 1441207389
+p4_cmd_rate_per_second;serverid=myserverid 1.000 1441207389
+p4_unique_clients;serverid=myserverid 1 1441207389
+p4_unique_ips;serverid=myserverid 1 1441207389
+p4_unique_users;serverid=myserverid 1 1441207389
+p4_cmd_cpu_efficiency;serverid=myserverid;cmd=user-sync 0.000 1441207389
 p4_sync_files_updated;serverid=myserverid 0 1441207389`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
@@ -419,28 +572,49 @@ Perforce server info:
 
 	cmdTime, _ := time.Parse(p4timeformat, "2015/09/02 15:25:11")
 	historical := true
-	output := basicTest(t, cfg, input, historical)
+	output := oneOutputTest(t, cfg, input, historical)
 
 	// Cross check appropriate time is being produced for historical runs
 	assert.Contains(t, output[0], fmt.Sprintf("%d", cmdTime.Unix()))
-	expected := eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync 3 1441207511
+	expected := eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 3 1441207511
 p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.096 1441207511
-p4_cmd_program_counter;serverid=myserverid;program=p4/2016.2/LINUX26X86_64/1598668 3 1441207511
-p4_cmd_program_cumulative_seconds;serverid=myserverid;program=p4/2016.2/LINUX26X86_64/1598668 0.096 1441207511
+p4_cmd_program_counter;serverid=myserverid;program=p4/2016.2/linux26x86_64/1598668 3 1441207511
+p4_cmd_program_cumulative_seconds;serverid=myserverid;program=p4/2016.2/linux26x86_64/1598668 0.096 1441207511
 p4_cmd_running;serverid=myserverid 0 1441207450
+p4_cmd_running_max;serverid=myserverid 0 1441207450
 p4_cmd_running;serverid=myserverid 0 1441207511
+p4_cmd_running_max;serverid=myserverid 0 1441207511
 p4_cmd_running;serverid=myserverid 1 1441207511
+p4_cmd_running_max;serverid=myserverid 1 1441207511
 p4_cmd_cpu_system_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441207511
 p4_cmd_cpu_user_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.000 1441207511
 p4_prom_cmds_pending;serverid=myserverid 0 1441207450
+p4_prom_cmds_pending_max;serverid=myserverid 0 1441207450
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1441207450
+p4_prom_line_chan_depth;serverid=myserverid 0 1441207450
 p4_prom_cmds_pending;serverid=myserverid 0 1441207511
+p4_prom_cmds_pending_max;serverid=myserverid 0 1441207511
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1441207511
+p4_prom_line_chan_depth;serverid=myserverid 0 1441207511
 p4_prom_cmds_pending;serverid=myserverid 0 1441207511
+p4_prom_cmds_pending_max;serverid=myserverid 0 1441207511
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1441207511
+p4_prom_line_chan_depth;serverid=myserverid 0 1441207511
 p4_prom_cmds_processed;serverid=myserverid 0 1441207450
 p4_prom_cmds_processed;serverid=myserverid 0 1441207511
 p4_prom_cmds_processed;serverid=myserverid 3 1441207511
 p4_prom_log_lines_read;serverid=myserverid 10 1441207450
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1441207450
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1441207450
+p4_prom_log_lines_truncated;serverid=myserverid 0 1441207450
 p4_prom_log_lines_read;serverid=myserverid 17 1441207511
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1441207511
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1441207511
+p4_prom_log_lines_truncated;serverid=myserverid 0 1441207511
 p4_prom_log_lines_read;serverid=myserverid 22 1441207511
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1441207511
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1441207511
+p4_prom_log_lines_truncated;serverid=myserverid 0 1441207511
 p4_prom_cpu_system;serverid=myserverid 0.0 1441207450
 p4_prom_cpu_system;serverid=myserverid 0.0 1441207511
 p4_prom_cpu_system;serverid=myserverid 0.0 1441207511
@@ -461,11 +635,278 @@ p4_sync_files_deleted;serverid=myserverid 0 1441207511
 p4_sync_files_deleted;serverid=myserverid 0 1441207511
 p4_sync_files_updated;serverid=myserverid 0 1441207450
 p4_sync_files_updated;serverid=myserverid 0 1441207511
+p4_cmd_rate_per_second;serverid=myserverid 0.000 1441207450
+p4_cmd_rate_per_second;serverid=myserverid 0.000 1441207511
+p4_cmd_rate_per_second;serverid=myserverid 3.000 1441207511
+p4_unique_clients;serverid=myserverid 0 1441207450
+p4_unique_ips;serverid=myserverid 0 1441207450
+p4_unique_clients;serverid=myserverid 0 1441207511
+p4_unique_ips;serverid=myserverid 0 1441207511
+p4_unique_clients;serverid=myserverid 1 1441207511
+p4_unique_ips;serverid=myserverid 1 1441207511
+p4_unique_users;serverid=myserverid 0 1441207450
+p4_unique_users;serverid=myserverid 0 1441207511
+p4_unique_users;serverid=myserverid 1 1441207511
+p4_cmd_cpu_efficiency;serverid=myserverid;cmd=user-sync 0.000 1441207511
 p4_sync_files_updated;serverid=myserverid 0 1441207511`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
 }
 
+func TestNewP4DMetricsMode(t *testing.T) {
+	cfg := &Config{ServerID: "myserverid"}
+	p4m := NewP4DMetrics(cfg, logger, ModeHistorical)
+	assert.True(t, p4m.historical)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	output := p4m.getCumulativeMetrics()
+	assert.NotContains(t, output, "# TYPE")
+	assert.Contains(t, output, "p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 ")
+
+	p4m = NewP4DMetrics(cfg, logger, ModeLive)
+	assert.False(t, p4m.historical)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, "# TYPE p4_cmd_counter gauge\n")
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`+"\n")
+
+	// Deprecated constructor
+	assert.True(t, NewP4DMetricsLogParser(cfg, logger, true).historical)
+	assert.False(t, NewP4DMetricsLogParser(cfg, logger, false).historical)
+}
+
+func TestP4PromTimeWindow(t *testing.T) {
+	// Only the middle command of three falls within the window
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Millisecond,
+		OutputCmdsByUser: false,
+		StartTime:        "2015/09/02 15:24:00",
+		EndTime:          "2015-09-02T15:25:00Z"}
+
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+
+Perforce server info:
+	2015/09/02 15:24:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:24:10 pid 1617 completed .032s
+
+Perforce server info:
+	2015/09/02 15:25:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:25:11 pid 1618 completed .033s
+`
+	output := basicTest(t, cfg, input, true)
+	counts := []string{}
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_counter;") || strings.HasPrefix(line, "p4_cmd_cumulative_seconds;") {
+			counts = append(counts, line)
+		}
+	}
+	assert.Equal(t, []string{"p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207511",
+		"p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-sync 0.032 1441207511"}, counts)
+}
+
+func TestP4PromLogTimeZone(t *testing.T) {
+	// Log times are EDT (UTC-4), so the window and the Graphite timestamps are 4 hours later than UTC
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		LogTimeZone:    "America/New_York",
+		StartTime:      "2015/09/02 15:24:00",
+		EndTime:        "2015-09-02T19:25:00Z"}
+
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+
+Perforce server info:
+	2015/09/02 15:24:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:24:10 pid 1617 completed .032s
+
+Perforce server info:
+	2015/09/02 15:25:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:25:11 pid 1618 completed .033s
+`
+	output := basicTest(t, cfg, input, true)
+	counts := make([]string, 0)
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_counter;") {
+			counts = append(counts, line)
+		}
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	ts := time.Date(2015, 9, 2, 15, 25, 11, 0, loc).Unix()
+	assert.Equal(t, int64(1441221911), ts)
+	assert.Equal(t, []string{fmt.Sprintf("p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 %d", ts)}, counts)
+
+	cfg.LogTimeZone = "Not/AZone"
+	p4m := NewP4DMetricsLogParser(cfg, logger, true)
+	assert.Equal(t, time.Local, p4m.logLocation)
+}
+
+func TestP4PromErrors(t *testing.T) {
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Millisecond,
+		OutputCmdsByUser: false}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:09:
+	Pid 1616
+	Operation: user-files
+	Request too large (over 500000); see 'p4 help maxresults'.
+
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:10:
+	Pid 1617
+	Operation: user-files
+	//... - no such file(s).
+`
+	output := oneOutputTest(t, cfg, input, false)
+	errors := []string{}
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_error_counter") || strings.HasPrefix(line, "p4_cmd_governor_rejections") {
+			errors = append(errors, line)
+		}
+	}
+	assert.Equal(t, []string{
+		`p4_cmd_error_counter{serverid="myserverid",cmd="user-files",severity="failed"} 1`,
+		`p4_cmd_error_counter{serverid="myserverid",cmd="user-files",severity="warning"} 1`,
+		`p4_cmd_governor_rejections{serverid="myserverid",cmd="user-files"} 1`}, errors)
+}
+
+func TestP4PromOutcome(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .011s
+
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:10:
+	Pid 1617
+	Operation: user-files
+	Request too large (over 500000); see 'p4 help maxresults'.
+
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:11:
+	Pid 1618
+	Operation: user-files
+	//... - no such file(s).
+
+Perforce server info:
+	2015/09/02 15:23:12 pid 1619 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:12:
+	Pid 1619
+	Operation: user-files
+	Your session has expired, please login again.
+
+Perforce server info:
+	2015/09/02 15:23:13 pid 1620 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:13:
+	Pid 1620
+	Operation: user-files
+	Command terminated by 'p4 monitor terminate'.
+`
+	output := oneOutputTest(t, cfg, input, false)
+	counts := []string{}
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_counter") {
+			counts = append(counts, line)
+		}
+	}
+	sort.Strings(counts)
+	// The warning counts as ok
+	assert.Equal(t, []string{
+		`p4_cmd_counter{serverid="myserverid",cmd="user-files",outcome="cancelled"} 1`,
+		`p4_cmd_counter{serverid="myserverid",cmd="user-files",outcome="error"} 1`,
+		`p4_cmd_counter{serverid="myserverid",cmd="user-files",outcome="governor"} 1`,
+		`p4_cmd_counter{serverid="myserverid",cmd="user-files",outcome="ok"} 2`}, counts)
+}
+
+func TestP4PromGovernorHits(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:09:
+	Pid 1616
+	Operation: user-files
+	Request too large (over 500000); see 'p4 help maxresults'.
+
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:10:
+	Pid 1617
+	Operation: user-files
+	Too many rows scanned (over 100000); see 'p4 help maxscanrows'.
+
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:11:
+	Pid 1618
+	Operation: user-files
+	Too many rows scanned (over 100000); see 'p4 help maxscanrows'.
+
+Perforce server info:
+	2015/09/02 15:23:12 pid 1619 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-integrate //depot/main/... //depot/rel/...'
+
+Perforce server error:
+	Date 2015/09/02 15:23:12:
+	Pid 1619
+	Operation: user-integrate
+	Operation took too long (over 30.00 seconds); see 'p4 help maxlocktime'.
+`
+	output := oneOutputTest(t, cfg, input, false)
+	hits := []string{}
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_governor_hit_total") {
+			hits = append(hits, line)
+		}
+	}
+	sort.Strings(hits)
+	assert.Equal(t, []string{
+		`p4_cmd_governor_hit_total{serverid="myserverid",cmd="user-files",type="maxresults"} 1`,
+		`p4_cmd_governor_hit_total{serverid="myserverid",cmd="user-files",type="maxscanrows"} 2`,
+		`p4_cmd_governor_hit_total{serverid="myserverid",cmd="user-integrate",type="maxlocktime"} 1`}, hits)
+	assert.Contains(t, output, `p4_cmd_governor_rejections{serverid="myserverid",cmd="user-files"} 3`)
+}
+
 func TestP4PromMultiCmds(t *testing.T) {
 	cfg := &Config{
 		ServerID:         "myserverid",
@@ -511,19 +952,27 @@ Perforce server info:
 	// cmdTime1, _ := time.Parse(p4timeformat, "2017/12/07 15:00:21")
 	cmdTime2, _ := time.Parse(p4timeformat, "2018/06/10 23:30:09")
 	historical := false
-	output := basicTest(t, cfg, input, historical)
+	output := oneOutputTest(t, cfg, input, historical)
 
-	expected := eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="dm-CommitSubmit"} 1
-p4_cmd_counter{serverid="myserverid",cmd="user-change"} 1
+	expected := eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="dm-CommitSubmit",outcome="ok"} 1
+p4_user_concurrent_max{serverid="myserverid",user="fred"} 1
+p4_cmd_counter{serverid="myserverid",cmd="user-change",outcome="ok"} 1
 p4_cmd_cumulative_seconds{serverid="myserverid",cmd="dm-CommitSubmit"} 1.380
 p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-change"} 0.413
-p4_cmd_program_counter{serverid="myserverid",program="3DSMax/1.0.0.0"} 1
-p4_cmd_program_counter{serverid="myserverid",program="p4/2016.2/LINUX26X86_64/1598668"} 1
-p4_cmd_program_cumulative_seconds{serverid="myserverid",program="3DSMax/1.0.0.0"} 0.413
-p4_cmd_program_cumulative_seconds{serverid="myserverid",program="p4/2016.2/LINUX26X86_64/1598668"} 1.380
+p4_cmd_net_bytes_rcvd{serverid="myserverid",cmd="user-change"} 23068672
+p4_cmd_net_bytes_sent{serverid="myserverid",cmd="user-change"} 24117248
+p4_cmd_program_counter{serverid="myserverid",program="3dsmax/1.0.0.0"} 1
+p4_cmd_program_counter{serverid="myserverid",program="p4/2016.2/linux26x86_64/1598668"} 1
+p4_cmd_program_cumulative_seconds{serverid="myserverid",program="3dsmax/1.0.0.0"} 0.413
+p4_cmd_program_cumulative_seconds{serverid="myserverid",program="p4/2016.2/linux26x86_64/1598668"} 1.380
 p4_cmd_replica_counter{serverid="myserverid",replica="10.40.16.14"} 1
 p4_cmd_replica_cumulative_seconds{serverid="myserverid",replica="10.40.16.14"} 0.413
+p4_cmd_direct_total{serverid="myserverid"} 1
+p4_cmd_forwarded_total{serverid="myserverid"} 1
+p4_cmd_lock_held_cumulative_seconds{serverid="myserverid",cmd="dm-CommitSubmit"} 1.630
+p4_cmd_lock_wait_cumulative_seconds{serverid="myserverid",cmd="dm-CommitSubmit"} 0.102
 p4_cmd_running{serverid="myserverid"} 1
+p4_cmd_running_max{serverid="myserverid"} 1
 p4_cmd_user_counter{serverid="myserverid",user="fred"} 2
 p4_cmd_cpu_system_cumulative_seconds{serverid="myserverid",cmd="dm-CommitSubmit"} 0.061
 p4_cmd_cpu_system_cumulative_seconds{serverid="myserverid",cmd="user-change"} 0.011
@@ -531,8 +980,14 @@ p4_cmd_cpu_user_cumulative_seconds{serverid="myserverid",cmd="dm-CommitSubmit"}
 p4_cmd_cpu_user_cumulative_seconds{serverid="myserverid",cmd="user-change"} 0.010
 p4_cmd_user_cumulative_seconds{serverid="myserverid",user="fred"} 1.793
 p4_prom_cmds_pending{serverid="myserverid"} 0
+p4_prom_cmds_pending_max{serverid="myserverid"} 0
+p4_prom_cmd_chan_depth{serverid="myserverid"} 0
+p4_prom_line_chan_depth{serverid="myserverid"} 0
 p4_prom_cmds_processed{serverid="myserverid"} 2
 p4_prom_log_lines_read{serverid="myserverid"} 37
+p4_prom_build_info{serverid="myserverid",version="unknown",revision="unknown",goversion="go1.18"} 1
+p4_prom_log_lag_seconds{serverid="myserverid"} 0.000
+p4_prom_log_lines_truncated{serverid="myserverid"} 0
 p4_prom_cpu_system{serverid="myserverid"} 0.0
 p4_prom_cpu_user{serverid="myserverid"} 0.0
 p4_sync_bytes_added{serverid="myserverid"} 0
@@ -547,34 +1002,63 @@ p4_total_read_wait_seconds{serverid="myserverid",table="archmap"} 0.032
 p4_total_read_wait_seconds{serverid="myserverid",table="counters"} 0.000
 p4_total_read_wait_seconds{serverid="myserverid",table="integed"} 0.012
 p4_total_trigger_lapse_seconds{serverid="myserverid",trigger="swarm.changesave"} 0.044
+p4_trigger_counter{serverid="myserverid",trigger="swarm.changesave"} 1
+p4_trigger_max_seconds{serverid="myserverid",trigger="swarm.changesave"} 0.044
 p4_total_write_held_seconds{serverid="myserverid",table="archmap"} 0.780
 p4_total_write_held_seconds{serverid="myserverid",table="counters"} 0.000
 p4_total_write_held_seconds{serverid="myserverid",table="integed"} 0.795
+p4_table_read_contention_ratio{serverid="myserverid",table="archmap"} 0.492
+p4_table_read_contention_ratio{serverid="myserverid",table="integed"} 0.353
+p4_table_write_contention_ratio{serverid="myserverid",table="archmap"} 0.042
+p4_table_write_contention_ratio{serverid="myserverid",table="integed"} 0.029
 p4_total_write_wait_seconds{serverid="myserverid",table="archmap"} 0.034
 p4_total_write_wait_seconds{serverid="myserverid",table="counters"} 0.000
+p4_cmd_rate_per_second{serverid="myserverid"} 200.000
+p4_unique_clients{serverid="myserverid"} 2
+p4_unique_ips{serverid="myserverid"} 2
+p4_unique_users{serverid="myserverid"} 1
+p4_cmd_cpu_efficiency{serverid="myserverid",cmd="dm-CommitSubmit"} 0.069
+p4_cmd_cpu_efficiency{serverid="myserverid",cmd="user-change"} 0.051
+p4_table_pages_cached{serverid="myserverid",table="counters"} 2
+p4_table_pages_in{serverid="myserverid",table="archmap"} 0
+p4_table_pages_in{serverid="myserverid",table="counters"} 6
+p4_table_pages_in{serverid="myserverid",table="integed"} 0
+p4_table_pages_out{serverid="myserverid",table="archmap"} 0
+p4_table_pages_out{serverid="myserverid",table="counters"} 3
+p4_table_pages_out{serverid="myserverid",table="integed"} 0
 p4_total_write_wait_seconds{serverid="myserverid",table="integed"} 0.024`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
 
 	historical = true
-	output = basicTest(t, cfg, input, historical)
+	output = oneOutputTest(t, cfg, input, historical)
 
 	// Cross check appropriate time is being produced for historical runs
 	// assert.Contains(t, output[0], fmt.Sprintf("%d", cmdTime1.Unix()))
 	assert.Contains(t, output[len(output)-1], fmt.Sprintf("%d", cmdTime2.Unix()))
-	expected = eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=dm-CommitSubmit 1 1528673409
-p4_cmd_counter;serverid=myserverid;cmd=user-change 1 1528673409
+	expected = eol.Split(`p4_cmd_counter;serverid=myserverid;cmd=dm-CommitSubmit;outcome=ok 1 1528673409
+p4_user_concurrent_max;serverid=myserverid;user=fred 1 1528673409
+p4_cmd_counter;serverid=myserverid;cmd=user-change;outcome=ok 1 1528673409
 p4_cmd_cumulative_seconds;serverid=myserverid;cmd=dm-CommitSubmit 1.380 1528673409
 p4_cmd_cumulative_seconds;serverid=myserverid;cmd=user-change 0.413 1528673409
-p4_cmd_program_counter;serverid=myserverid;program=3DSMax/1.0.0.0 1 1528673409
-p4_cmd_program_counter;serverid=myserverid;program=p4/2016.2/LINUX26X86_64/1598668 1 1528673409
-p4_cmd_program_cumulative_seconds;serverid=myserverid;program=3DSMax/1.0.0.0 0.413 1528673409
-p4_cmd_program_cumulative_seconds;serverid=myserverid;program=p4/2016.2/LINUX26X86_64/1598668 1.380 1528673409
+p4_cmd_net_bytes_rcvd;serverid=myserverid;cmd=user-change 23068672 1528673409
+p4_cmd_net_bytes_sent;serverid=myserverid;cmd=user-change 24117248 1528673409
+p4_cmd_program_counter;serverid=myserverid;program=3dsmax/1.0.0.0 1 1528673409
+p4_cmd_program_counter;serverid=myserverid;program=p4/2016.2/linux26x86_64/1598668 1 1528673409
+p4_cmd_program_cumulative_seconds;serverid=myserverid;program=3dsmax/1.0.0.0 0.413 1528673409
+p4_cmd_program_cumulative_seconds;serverid=myserverid;program=p4/2016.2/linux26x86_64/1598668 1.380 1528673409
 p4_cmd_replica_counter;serverid=myserverid;replica=10.40.16.14 1 1528673409
 p4_cmd_replica_cumulative_seconds;serverid=myserverid;replica=10.40.16.14 0.413 1528673409
+p4_cmd_direct_total;serverid=myserverid 1 1528673409
+p4_cmd_forwarded_total;serverid=myserverid 1 1528673409
+p4_cmd_lock_held_cumulative_seconds;serverid=myserverid;cmd=dm-CommitSubmit 1.630 1528673409
+p4_cmd_lock_wait_cumulative_seconds;serverid=myserverid;cmd=dm-CommitSubmit 0.102 1528673409
 p4_cmd_running;serverid=myserverid 0 1528673408
+p4_cmd_running_max;serverid=myserverid 0 1528673408
 p4_cmd_running;serverid=myserverid 0 1528673409
+p4_cmd_running_max;serverid=myserverid 0 1528673409
 p4_cmd_running;serverid=myserverid 1 1528673409
+p4_cmd_running_max;serverid=myserverid 1 1528673409
 p4_cmd_user_counter;serverid=myserverid;user=fred 2 1528673409
 p4_cmd_cpu_system_cumulative_seconds;serverid=myserverid;cmd=dm-CommitSubmit 0.061 1528673409
 p4_cmd_cpu_system_cumulative_seconds;serverid=myserverid;cmd=user-change 0.011 1528673409
@@ -582,14 +1066,32 @@ p4_cmd_cpu_user_cumulative_seconds;serverid=myserverid;cmd=dm-CommitSubmit 0.034
 p4_cmd_cpu_user_cumulative_seconds;serverid=myserverid;cmd=user-change 0.010 1528673409
 p4_cmd_user_cumulative_seconds;serverid=myserverid;user=fred 1.793 1528673409
 p4_prom_cmds_pending;serverid=myserverid 0 1528673408
+p4_prom_cmds_pending_max;serverid=myserverid 0 1528673408
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1528673408
+p4_prom_line_chan_depth;serverid=myserverid 0 1528673408
 p4_prom_cmds_pending;serverid=myserverid 0 1528673409
+p4_prom_cmds_pending_max;serverid=myserverid 0 1528673409
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1528673409
+p4_prom_line_chan_depth;serverid=myserverid 0 1528673409
 p4_prom_cmds_pending;serverid=myserverid 0 1528673409
+p4_prom_cmds_pending_max;serverid=myserverid 0 1528673409
+p4_prom_cmd_chan_depth;serverid=myserverid 0 1528673409
+p4_prom_line_chan_depth;serverid=myserverid 0 1528673409
 p4_prom_cmds_processed;serverid=myserverid 0 1528673408
 p4_prom_cmds_processed;serverid=myserverid 0 1528673409
 p4_prom_cmds_processed;serverid=myserverid 2 1528673409
 p4_prom_log_lines_read;serverid=myserverid 17 1528673408
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1528673408
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1528673408
+p4_prom_log_lines_truncated;serverid=myserverid 0 1528673408
 p4_prom_log_lines_read;serverid=myserverid 30 1528673409
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1528673409
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1528673409
+p4_prom_log_lines_truncated;serverid=myserverid 0 1528673409
 p4_prom_log_lines_read;serverid=myserverid 37 1528673409
+p4_prom_build_info;serverid=myserverid;version=unknown;revision=unknown;goversion=go1.18 1 1528673409
+p4_prom_log_lag_seconds;serverid=myserverid 0.000 1528673409
+p4_prom_log_lines_truncated;serverid=myserverid 0 1528673409
 p4_prom_cpu_system;serverid=myserverid 0.0 1528673408
 p4_prom_cpu_system;serverid=myserverid 0.0 1528673409
 p4_prom_cpu_system;serverid=myserverid 0.0 1528673409
@@ -618,11 +1120,38 @@ p4_total_read_wait_seconds;serverid=myserverid;table=archmap 0.032 1528673409
 p4_total_read_wait_seconds;serverid=myserverid;table=counters 0.000 1528673409
 p4_total_read_wait_seconds;serverid=myserverid;table=integed 0.012 1528673409
 p4_total_trigger_lapse_seconds;serverid=myserverid;trigger=swarm.changesave 0.044 1528673409
+p4_trigger_counter;serverid=myserverid;trigger=swarm.changesave 1 1528673409
+p4_trigger_max_seconds;serverid=myserverid;trigger=swarm.changesave 0.044 1528673409
 p4_total_write_held_seconds;serverid=myserverid;table=archmap 0.780 1528673409
 p4_total_write_held_seconds;serverid=myserverid;table=counters 0.000 1528673409
 p4_total_write_held_seconds;serverid=myserverid;table=integed 0.795 1528673409
+p4_table_read_contention_ratio;serverid=myserverid;table=archmap 0.492 1528673409
+p4_table_read_contention_ratio;serverid=myserverid;table=integed 0.353 1528673409
+p4_table_write_contention_ratio;serverid=myserverid;table=archmap 0.042 1528673409
+p4_table_write_contention_ratio;serverid=myserverid;table=integed 0.029 1528673409
 p4_total_write_wait_seconds;serverid=myserverid;table=archmap 0.034 1528673409
 p4_total_write_wait_seconds;serverid=myserverid;table=counters 0.000 1528673409
+p4_cmd_rate_per_second;serverid=myserverid 0.000 1528673408
+p4_cmd_rate_per_second;serverid=myserverid 0.000 1528673409
+p4_cmd_rate_per_second;serverid=myserverid 2.000 1528673409
+p4_unique_clients;serverid=myserverid 0 1528673408
+p4_unique_ips;serverid=myserverid 0 1528673408
+p4_unique_clients;serverid=myserverid 0 1528673409
+p4_unique_ips;serverid=myserverid 0 1528673409
+p4_unique_clients;serverid=myserverid 2 1528673409
+p4_unique_ips;serverid=myserverid 2 1528673409
+p4_unique_users;serverid=myserverid 0 1528673408
+p4_unique_users;serverid=myserverid 0 1528673409
+p4_unique_users;serverid=myserverid 1 1528673409
+p4_cmd_cpu_efficiency;serverid=myserverid;cmd=dm-CommitSubmit 0.069 1528673409
+p4_cmd_cpu_efficiency;serverid=myserverid;cmd=user-change 0.051 1528673409
+p4_table_pages_cached;serverid=myserverid;table=counters 2 1528673409
+p4_table_pages_in;serverid=myserverid;table=archmap 0 1528673409
+p4_table_pages_in;serverid=myserverid;table=counters 6 1528673409
+p4_table_pages_in;serverid=myserverid;table=integed 0 1528673409
+p4_table_pages_out;serverid=myserverid;table=archmap 0 1528673409
+p4_table_pages_out;serverid=myserverid;table=counters 3 1528673409
+p4_table_pages_out;serverid=myserverid;table=integed 0 1528673409
 p4_total_write_wait_seconds;serverid=myserverid;table=integed 0.024 1528673409`, -1)
 	assert.Equal(t, len(expected), len(output))
 	compareOutput(t, expected, output)
@@ -640,22 +1169,33 @@ Perforce server info:
 Perforce server info:
 	2015/09/02 15:23:10 pid 1616 completed .011s
 `
-var multiUserExpected = eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="user-fstat"} 2
+var multiUserExpected = eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="user-fstat",outcome="ok"} 2
 p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 0.022
 p4_cmd_program_counter{serverid="myserverid",program="p4/2016.2/LINUX26X86_64/1598668"} 2
 p4_cmd_program_cumulative_seconds{serverid="myserverid",program="p4/2016.2/LINUX26X86_64/1598668"} 0.022
 p4_cmd_running{serverid="myserverid"} 1
+p4_cmd_running_max{serverid="myserverid"} 1
 p4_cmd_cpu_system_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 0.000
 p4_cmd_cpu_user_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 0.000
 p4_prom_cmds_pending{serverid="myserverid"} 0
+p4_prom_cmds_pending_max{serverid="myserverid"} 0
+p4_prom_cmd_chan_depth{serverid="myserverid"} 0
+p4_prom_line_chan_depth{serverid="myserverid"} 0
 p4_prom_cmds_processed{serverid="myserverid"} 2
 p4_prom_log_lines_read{serverid="myserverid"} 11
+p4_prom_build_info{serverid="myserverid",version="unknown",revision="unknown",goversion="go1.18"} 1
+p4_prom_log_lag_seconds{serverid="myserverid"} 0.000
+p4_prom_log_lines_truncated{serverid="myserverid"} 0
 p4_prom_cpu_system{serverid="myserverid"} 0.0
 p4_prom_cpu_user{serverid="myserverid"} 0.0
 p4_sync_bytes_added{serverid="myserverid"} 0
 p4_sync_bytes_updated{serverid="myserverid"} 0
 p4_sync_files_added{serverid="myserverid"} 0
 p4_sync_files_deleted{serverid="myserverid"} 0
+p4_cmd_rate_per_second{serverid="myserverid"} 200.000
+p4_unique_clients{serverid="myserverid"} 1
+p4_unique_ips{serverid="myserverid"} 1
+p4_cmd_cpu_efficiency{serverid="myserverid",cmd="user-fstat"} 0.000
 p4_sync_files_updated{serverid="myserverid"} 0`, -1)
 
 func TestP4PromBasicMultiUserCaseSensitive(t *testing.T) {
@@ -665,8 +1205,11 @@ func TestP4PromBasicMultiUserCaseSensitive(t *testing.T) {
 		UpdateInterval:      10 * time.Millisecond,
 		OutputCmdsByUser:    true,
 		CaseSensitiveServer: true}
-	output := basicTest(t, cfg, multiUserInput, false)
+	output := oneOutputTest(t, cfg, multiUserInput, false)
 	expected := eol.Split(`p4_cmd_user_counter{serverid="myserverid",user="ROBERT"} 1
+p4_unique_users{serverid="myserverid"} 2
+p4_user_concurrent_max{serverid="myserverid",user="ROBERT"} 1
+p4_user_concurrent_max{serverid="myserverid",user="robert"} 1
 p4_cmd_user_counter{serverid="myserverid",user="robert"} 1
 p4_cmd_user_cumulative_seconds{serverid="myserverid",user="ROBERT"} 0.011
 p4_cmd_user_cumulative_seconds{serverid="myserverid",user="robert"} 0.011`, -1)
@@ -685,10 +1228,16 @@ func TestP4PromBasicMultiUserCaseInsensitive(t *testing.T) {
 		UpdateInterval:      10 * time.Millisecond,
 		OutputCmdsByUser:    true,
 		CaseSensitiveServer: false}
-	output := basicTest(t, cfg, multiUserInput, false)
+	output := oneOutputTest(t, cfg, multiUserInput, false)
 	expected := eol.Split(`p4_cmd_user_counter{serverid="myserverid",user="robert"} 2
+p4_unique_users{serverid="myserverid"} 1
+p4_user_concurrent_max{serverid="myserverid",user="robert"} 1
 p4_cmd_user_cumulative_seconds{serverid="myserverid",user="robert"} 0.022`, -1)
 	for _, l := range multiUserExpected {
+		// Program names are also lowercased
+		if strings.HasPrefix(l, "p4_cmd_program") {
+			l = strings.ToLower(l)
+		}
 		expected = append(expected, l)
 	}
 	assert.Equal(t, len(expected), len(output))
@@ -704,8 +1253,11 @@ func TestP4PromBasicMultiUserDetail(t *testing.T) {
 		CaseSensitiveServer:   true,
 		OutputCmdsByUserRegex: ".*",
 	}
-	output := basicTest(t, cfg, multiUserInput, false)
+	output := oneOutputTest(t, cfg, multiUserInput, false)
 	expected := eol.Split(`p4_cmd_user_counter{serverid="myserverid",user="ROBERT"} 1
+p4_unique_users{serverid="myserverid"} 2
+p4_user_concurrent_max{serverid="myserverid",user="ROBERT"} 1
+p4_user_concurrent_max{serverid="myserverid",user="robert"} 1
 p4_cmd_user_counter{serverid="myserverid",user="robert"} 1
 p4_cmd_user_detail_counter{serverid="myserverid",user="ROBERT",cmd="user-fstat"} 1
 p4_cmd_user_detail_counter{serverid="myserverid",user="robert",cmd="user-fstat"} 1
@@ -732,24 +1284,38 @@ Perforce server info:
 Perforce server info:
 	2015/09/02 15:23:10 pid 1616 completed .011s
 `
-var multiIPExpected = eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="user-fstat"} 2
+var multiIPExpected = eol.Split(`p4_cmd_counter{serverid="myserverid",cmd="user-fstat",outcome="ok"} 2
 p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 0.022
-p4_cmd_program_counter{serverid="myserverid",program="p4/2016.2/LINUX26X86_64/1598668"} 2
-p4_cmd_program_cumulative_seconds{serverid="myserverid",program="p4/2016.2/LINUX26X86_64/1598668"} 0.022
+p4_cmd_program_counter{serverid="myserverid",program="p4/2016.2/linux26x86_64/1598668"} 2
+p4_cmd_program_cumulative_seconds{serverid="myserverid",program="p4/2016.2/linux26x86_64/1598668"} 0.022
 p4_cmd_replica_counter{serverid="myserverid",replica="127.0.0.1"} 1
 p4_cmd_replica_cumulative_seconds{serverid="myserverid",replica="127.0.0.1"} 0.011
+p4_cmd_direct_total{serverid="myserverid"} 1
+p4_cmd_forwarded_total{serverid="myserverid"} 1
 p4_cmd_running{serverid="myserverid"} 1
+p4_cmd_running_max{serverid="myserverid"} 1
 p4_cmd_cpu_system_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 0.000
 p4_cmd_cpu_user_cumulative_seconds{serverid="myserverid",cmd="user-fstat"} 0.000
 p4_prom_cmds_pending{serverid="myserverid"} 0
+p4_prom_cmds_pending_max{serverid="myserverid"} 0
+p4_prom_cmd_chan_depth{serverid="myserverid"} 0
+p4_prom_line_chan_depth{serverid="myserverid"} 0
 p4_prom_cmds_processed{serverid="myserverid"} 2
 p4_prom_log_lines_read{serverid="myserverid"} 11
+p4_prom_build_info{serverid="myserverid",version="unknown",revision="unknown",goversion="go1.18"} 1
+p4_prom_log_lag_seconds{serverid="myserverid"} 0.000
+p4_prom_log_lines_truncated{serverid="myserverid"} 0
 p4_prom_cpu_system{serverid="myserverid"} 0.0
 p4_prom_cpu_user{serverid="myserverid"} 0.0
 p4_sync_bytes_added{serverid="myserverid"} 0
 p4_sync_bytes_updated{serverid="myserverid"} 0
 p4_sync_files_added{serverid="myserverid"} 0
 p4_sync_files_deleted{serverid="myserverid"} 0
+p4_cmd_rate_per_second{serverid="myserverid"} 200.000
+p4_unique_clients{serverid="myserverid"} 1
+p4_unique_ips{serverid="myserverid"} 2
+p4_unique_users{serverid="myserverid"} 1
+p4_cmd_cpu_efficiency{serverid="myserverid",cmd="user-fstat"} 0.000
 p4_sync_files_updated{serverid="myserverid"} 0`, -1)
 
 func TestP4PromBasicMultiIPFalse(t *testing.T) {
@@ -758,7 +1324,7 @@ func TestP4PromBasicMultiIPFalse(t *testing.T) {
 		ServerID:       "myserverid",
 		UpdateInterval: 10 * time.Millisecond,
 		OutputCmdsByIP: false}
-	output := basicTest(t, cfg, multiIPInput, false)
+	output := oneOutputTest(t, cfg, multiIPInput, false)
 	assert.Equal(t, len(multiIPExpected), len(output))
 	compareOutput(t, multiIPExpected, output)
 }
@@ -769,7 +1335,7 @@ func TestP4PromBasicMultiIPTrue(t *testing.T) {
 		ServerID:       "myserverid",
 		UpdateInterval: 10 * time.Millisecond,
 		OutputCmdsByIP: true}
-	output := basicTest(t, cfg, multiIPInput, false)
+	output := oneOutputTest(t, cfg, multiIPInput, false)
 
 	expected := eol.Split(`p4_cmd_ip_counter{serverid="myserverid",ip="10.1.2.3"} 1
 p4_cmd_ip_counter{serverid="myserverid",ip="10.10.4.5"} 1
@@ -782,31 +1348,1977 @@ p4_cmd_ip_cumulative_seconds{serverid="myserverid",ip="10.10.4.5"} 0.011`, -1)
 	compareOutput(t, expected, output)
 }
 
-func TestP4PromLabelValues(t *testing.T) {
-	// Tests for regex search and replace
+func TestP4PromRunningMax(t *testing.T) {
+	// High water mark of running commands is kept per interval
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	for _, running := range []int64{3, 7, 2} {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Running: running})
+	}
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_running{serverid="myserverid"} 2`)
+	assert.Contains(t, output, `p4_cmd_running_max{serverid="myserverid"} 7`)
+
+	p4m.resetToZero()
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_running_max{serverid="myserverid"} 0`)
+}
+
+func TestP4PromSnapshotReset(t *testing.T) {
+	testLogger, hook := test.NewNullLogger()
+	cfg := &Config{
+		ServerID:             "myserverid",
+		UpdateInterval:       10 * time.Millisecond,
+		DeltaOutput:          true,
+		SlowCommandThreshold: time.Second,
+		SlowCommandLogLimit:  1}
+	p4m := NewP4DMetrics(cfg, testLogger, ModeLive)
+	for _, running := range []int64{3, 2} {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Running: running, CompletedLapse: 0.5})
+	}
+	output := p4m.Snapshot()
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 2`)
+	assert.Contains(t, output, `p4_cmd_running_max{serverid="myserverid"} 3`)
+	assert.Contains(t, output, `p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 1.000`)
+	// No side effects - delta output doesn't apply
+	assert.Contains(t, p4m.Snapshot(), `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 2`)
+
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 1, CompletedLapse: 2})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 2, CompletedLapse: 2})
+	assert.Equal(t, 1, len(hook.Entries))
+	p4m.Snapshot()
+	assert.Equal(t, 1, len(hook.Entries))
+
+	// Interval values cleared and the slow cmd limit restarted, cumulative ones kept
+	p4m.Reset()
+	assert.Contains(t, hook.LastEntry().Message, "1 further slow cmds not logged")
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 3, CompletedLapse: 2})
+	assert.Contains(t, hook.LastEntry().Message, "Slow cmd user-sync pid 3")
+	p4m.Reset()
+	output = p4m.Snapshot()
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 0`)
+	assert.Contains(t, output, `p4_cmd_running_max{serverid="myserverid"} 0`)
+	assert.Contains(t, output, `p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 7.000`)
+
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 0.5})
+	output = p4m.Snapshot()
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+	assert.Contains(t, output, `p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-sync"} 7.500`)
+}
+
+// Validates OpenMetrics text format with the Prometheus parser, which checks syntax, that
+// units are name suffixes and output ends with # EOF. Also checks sample names match family types.
+func validateOpenMetrics(t *testing.T, output string) {
+	p := textparse.NewOpenMetricsParser([]byte(output))
+	family := ""
+	familyType := textparse.MetricTypeUnknown
+	for {
+		et, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		switch et {
+		case textparse.EntryType:
+			var name []byte
+			name, familyType = p.Type()
+			family = string(name)
+		case textparse.EntrySeries:
+			var lset labels.Labels
+			p.Metric(&lset)
+			name := lset.Get(labels.MetricName)
+			switch familyType {
+			case textparse.MetricTypeCounter:
+				assert.Equal(t, family+"_total", name)
+			case textparse.MetricTypeSummary:
+				assert.Contains(t, []string{family, family + "_sum", family + "_count"}, name)
+			default:
+				assert.Equal(t, family, name)
+			}
+		}
+	}
+}
+
+func TestP4PromOpenMetrics(t *testing.T) {
+	cfg := &Config{
+		ServerID:          "myserverid",
+		UpdateInterval:    10 * time.Millisecond,
+		OutputCmdsByUser:  true,
+		OutputOpenMetrics: true,
+		Quantiles:         []float64{0.5, 0.99}}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", CompletedLapse: 0.5, IP: "10.1.2.3", App: "p4/2016.2",
+		Tables: map[string]*p4dlog.Table{"rev": {TableName: "rev", TotalReadHeld: 10}}})
+	output := p4m.getCumulativeMetrics()
+	validateOpenMetrics(t, output)
+	assert.Contains(t, output, "# UNIT p4_cmd_cumulative_seconds seconds\n")
+	assert.Contains(t, output, `p4_prom_cmds_processed_total{serverid="myserverid"} 0`)
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+
+	// Historical (graphite) output is unaffected
+	p4m = NewP4DMetricsLogParser(cfg, logger, true)
+	output = p4m.getCumulativeMetrics()
+	assert.NotContains(t, output, "# EOF")
+	assert.NotContains(t, output, "_total")
+}
+
+func TestP4PromQuantiles(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		Quantiles:      []float64{0.5, 0.9, 1.5}} // last one invalid and ignored
+	// A second apart so that each cmd is output as the next starts - the estimates depend on order
+	var input strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&input, `
+Perforce server info:
+	2015/09/02 15:23:09 pid %d robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid %d completed %.2fs
+`, 1000+i, 1000+i, float64(i)/100)
+	}
+	input.WriteString(`
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .25s
+`)
+	output := strings.Join(oneOutputTest(t, cfg, input.String(), false), "\n")
+	assert.Contains(t, output, `p4_cmd_duration_seconds_count{serverid="myserverid",cmd="user-sync"} 100`)
+	assert.Contains(t, output, `p4_cmd_duration_seconds{serverid="myserverid",cmd="user-sync",quantile="0.5"} 0.50`)
+	assert.Contains(t, output, `p4_cmd_duration_seconds{serverid="myserverid",cmd="user-sync",quantile="0.9"} 0.90`)
+	assert.Contains(t, output, `p4_cmd_duration_seconds_sum{serverid="myserverid",cmd="user-sync"} 50.500`)
+	assert.Contains(t, output, `p4_cmd_duration_seconds{serverid="myserverid",cmd="user-fstat",quantile="0.5"} 0.250`)
+	assert.NotContains(t, output, `quantile="1.5"`)
+
+	// Estimators are reset per interval
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-fstat", CompletedLapse: 0.25})
+	assert.Contains(t, p4m.getCumulativeMetrics(), "# TYPE p4_cmd_duration_seconds summary\n")
+	p4m.resetToZero()
+	assert.NotContains(t, p4m.getCumulativeMetrics(), `p4_cmd_duration_seconds{`)
+}
+
+func TestP4PromQuantileWindow(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		Quantiles:      []float64{0.99},
+		QuantileWindow: 10 * time.Minute}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	start := time.Date(2015, 9, 2, 15, 0, 0, 0, time.UTC)
+	for i := 0; i < 1200; i++ {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 0.1,
+			StartTime: start.Add(time.Duration(i) * time.Second)})
+	}
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_duration_seconds{serverid="myserverid",cmd="user-sync",quantile="0.99"} 0.100`)
+
+	// Not reset each interval, the new latency is reflected once the window has passed
+	p4m.resetToZero()
+	shift := start.Add(20 * time.Minute)
+	for i := 0; i < 600; i++ {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 3,
+			StartTime: shift.Add(time.Duration(i) * time.Second)})
+	}
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_duration_seconds{serverid="myserverid",cmd="user-sync",quantile="0.99"} 3.000`)
+	assert.Contains(t, output, `p4_cmd_duration_seconds_sum{serverid="myserverid",cmd="user-sync"} 1920.000`)
+	assert.Contains(t, output, `p4_cmd_duration_seconds_count{serverid="myserverid",cmd="user-sync"} 1800`)
+}
+
+func TestP4PromTriggerCounts(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	for _, lapse := range []float32{0.1, 1.5, 0.2} {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-change", Tables: map[string]*p4dlog.Table{
+			"trigger_swarm.changesave": {TableName: "trigger_swarm.changesave", TriggerLapse: lapse}}})
+	}
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_trigger_counter{serverid="myserverid",trigger="swarm.changesave"} 3`)
+	assert.Contains(t, output, `p4_trigger_max_seconds{serverid="myserverid",trigger="swarm.changesave"} 1.500`)
+	assert.Contains(t, output, `p4_total_trigger_lapse_seconds{serverid="myserverid",trigger="swarm.changesave"} 1.800`)
+
+	p4m.resetToZero()
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_trigger_counter{serverid="myserverid",trigger="swarm.changesave"} 0`)
+	assert.Contains(t, output, `p4_trigger_max_seconds{serverid="myserverid",trigger="swarm.changesave"} 0.000`)
+}
+
+func TestP4PromTriggerClasses(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		TriggerClasses: []TriggerClass{
+			{Regex: "^swarm", Class: "swarm"},
+			{Regex: "^(check|validate).*", Class: "changelist"},
+			{Regex: "[", Class: "invalid"}}}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-change", Tables: map[string]*p4dlog.Table{
+		"trigger_swarm.changesave": {TableName: "trigger_swarm.changesave", TriggerLapse: 0.1},
+		"trigger_checkjob":         {TableName: "trigger_checkjob", TriggerLapse: 0.2},
+		"trigger_mytrigger":        {TableName: "trigger_mytrigger", TriggerLapse: 0.3}}})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_total_trigger_lapse_seconds{serverid="myserverid",trigger="swarm.changesave",class="swarm"} 0.100`)
+	assert.Contains(t, output, `p4_total_trigger_lapse_seconds{serverid="myserverid",trigger="checkjob",class="changelist"} 0.200`)
+	assert.Contains(t, output, `p4_total_trigger_lapse_seconds{serverid="myserverid",trigger="mytrigger",class="other"} 0.300`)
+	assert.Contains(t, output, `p4_trigger_counter{serverid="myserverid",trigger="mytrigger",class="other"} 1`)
+	assert.NotContains(t, output, `class="invalid"`)
+}
+
+func TestP4PromTriggerFailures(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14/10.40.48.29 [3DSMax/1.0.0.0] 'user-change -i' trigger swarm.changesave
+lapse .044s
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14/10.40.48.29 [3DSMax/1.0.0.0] 'user-change -i' trigger checkjob
+lapse .021s
+exit 1
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 completed .413s 7+4us 0+584io 0+0net 4580k 0pf
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_trigger_failures_total{serverid="myserverid",trigger="checkjob"} 1`)
+	assert.Contains(t, output, `p4_trigger_counter{serverid="myserverid",trigger="checkjob"} 1`)
+	assert.Contains(t, output, `p4_trigger_counter{serverid="myserverid",trigger="swarm.changesave"} 1`)
+	for _, line := range output {
+		assert.NotContains(t, line, `p4_trigger_failures_total{serverid="myserverid",trigger="swarm.changesave"}`)
+	}
+}
+
+func TestP4PromMaintenanceCmds(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		MaxLineLength:  150}
+	// The verify is truncated and starts with 3 syncs running
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 perforce@maint_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 perforce@maint_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 perforce@maint_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1619 perforce@maint_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-verify -q //depot/a/... //depot/b/... //depot/c/... //depot/d/... //depot/e/...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1616 completed 1.000s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed 1.000s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1618 completed 1.000s
+Perforce server info:
+	2015/09/02 15:24:09 pid 1619 completed 60.000s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1619 perforce@maint_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-verify -q //depot/a/... //depot/b/... //depot/c/... //depot/d/... //depot/e/...'
+--- lapse 60.000s
+--- usage 2000+1000us 0+0io 0+0net 4088k 0pf
+
+Perforce server info:
+	2015/09/02 15:24:10 pid 1620 perforce@maint_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-admin checkpoint'
+Perforce server info:
+	2015/09/02 15:24:40 pid 1620 completed 30.000s
+Perforce server info:
+	2015/09/02 15:24:10 pid 1620 perforce@maint_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-admin checkpoint'
+--- lapse 30.000s
+--- db.rev
+---   total lock wait+held read/write 0ms+30000ms/0ms+0ms
+`
+	lines := oneOutputTest(t, cfg, input, false)
+	output := strings.Join(lines, "\n")
+	assert.Contains(t, lines, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 3`)
+	assert.Contains(t, lines, `p4_maint_cmd_counter{serverid="myserverid",cmd="user-verify",outcome="ok"} 1`)
+	assert.Contains(t, lines, `p4_maint_cmd_cumulative_seconds{serverid="myserverid",cmd="user-verify"} 60.000`)
+	assert.Contains(t, lines, `p4_maint_cmd_cpu_user_cumulative_seconds{serverid="myserverid",cmd="user-verify"} 2.000`)
+	assert.Contains(t, lines, `p4_maint_cmd_cpu_system_cumulative_seconds{serverid="myserverid",cmd="user-verify"} 1.000`)
+	assert.Contains(t, lines, `p4_maint_cmd_counter{serverid="myserverid",cmd="user-admin",outcome="ok"} 1`)
+	// Locks held by maintenance cmds still count
+	assert.Contains(t, lines, `p4_total_read_held_seconds{serverid="myserverid",table="rev"} 30.000`)
+	assert.NotContains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-verify"`)
+	assert.NotContains(t, output, `p4_cmd_cumulative_seconds{serverid="myserverid",cmd="user-admin"`)
+	// As do they for server health
+	assert.Contains(t, lines, `p4_cmd_running_max{serverid="myserverid"} 4`)
+	assert.Contains(t, lines, `p4_cmd_long_running_total{serverid="myserverid",cmd="user-verify"} 1`)
+	assert.Contains(t, lines, `p4_cmd_truncated_counter{serverid="myserverid",cmd="user-verify"} 1`)
+	assert.Contains(t, lines, `p4_unique_users{serverid="myserverid"} 1`)
+	assert.Contains(t, lines, `p4_unique_clients{serverid="myserverid"} 1`)
+
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-verify", CompletedLapse: 60})
+	p4m.resetToZero()
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_maint_cmd_counter{serverid="myserverid",cmd="user-verify",outcome="ok"} 0`)
+
+	// Configured list, with or without the user- prefix, replaces the default
+	input = `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-verify //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1616 completed 1.000s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-obliterate -y //depot/a/...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed 1.000s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 svc_replica@unknown 10.1.2.3 [p4d/2016.2/LINUX26X86_64/1598668] 'rmt-Journal'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1618 completed 1.000s
+`
+	cfg.MaintenanceCmds = []string{"obliterate", "rmt-Journal"}
+	lines = oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, lines, `p4_cmd_counter{serverid="myserverid",cmd="user-verify",outcome="ok"} 1`)
+	assert.Contains(t, lines, `p4_maint_cmd_counter{serverid="myserverid",cmd="user-obliterate",outcome="ok"} 1`)
+	assert.Contains(t, lines, `p4_maint_cmd_counter{serverid="myserverid",cmd="rmt-Journal",outcome="ok"} 1`)
+
+	// Empty list turns it off
+	cfg.MaintenanceCmds = []string{}
+	assert.Contains(t, oneOutputTest(t, cfg, input, false), `p4_cmd_counter{serverid="myserverid",cmd="user-verify",outcome="ok"} 1`)
+}
+
+func TestP4PromTriggerPrefix(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		TriggerPrefix:  "hook_"}
+	input := `
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 fred@LONWS 10.40.16.14/10.40.48.29 [3DSMax/1.0.0.0] 'user-change -i' trigger swarm.changesave
+lapse .044s
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 completed .413s 7+4us 0+584io 0+0net 4580k 0pf
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_trigger_counter{serverid="myserverid",trigger="swarm.changesave"} 1`)
+	for _, line := range output {
+		assert.NotContains(t, line, `table="hook_swarm.changesave"`)
+	}
+
+	// Tables with the default prefix are now just tables
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-change", Tables: map[string]*p4dlog.Table{
+		"hook_checkjob":    {TableName: "hook_checkjob", TriggerLapse: 0.1},
+		"trigger_checkjob": {TableName: "trigger_checkjob", TotalReadHeld: 1000}}})
+	metrics := p4m.getCumulativeMetrics()
+	assert.Contains(t, metrics, `p4_trigger_counter{serverid="myserverid",trigger="checkjob"} 1`)
+	assert.Contains(t, metrics, `p4_total_read_held_seconds{serverid="myserverid",table="trigger_checkjob"} 1.000`)
+}
+
+func TestP4PromLatencyEWMA(t *testing.T) {
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Millisecond,
+		LatencyEWMAAlpha: 0.5}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 4})
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_latency_ewma_seconds{serverid="myserverid",cmd="user-sync"} 4.000`)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 2})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 1})
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_latency_ewma_seconds{serverid="myserverid",cmd="user-sync"} 2.000`)
+	// Survives interval resets
+	p4m.resetToZero()
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_latency_ewma_seconds{serverid="myserverid",cmd="user-sync"} 2.000`)
+
+	// Not output unless configured, and invalid values ignored
+	cfg.LatencyEWMAAlpha = 1.5
+	p4m = NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 4})
+	assert.NotContains(t, p4m.getCumulativeMetrics(), "p4_cmd_latency_ewma_seconds")
+}
 
+func TestP4PromNormalizeProgram(t *testing.T) {
 	var values = []struct {
 		input, expected string
 	}{
-		{"fred", "fred"},
-		{`fred"`, "fred_"},
-		{`fred'`, "fred_"},
-		{`fred;`, "fred_"},
-		{`fred^`, "fred_"},
-		{`fred!`, "fred_"},
-		{`fred@`, "fred@"},
-		{`p4/1.20`, "p4/1.20"},
-		{`p4/(1.20)`, "p4/(1.20)"},
-		{`p4\(1.20)`, "p4\\(1.20)"},
-		{`p4[1.20]`, "p4[1.20]"},
-		{`c:\prog.exe`, "c:\\prog.exe"},
-		{`c:\\prog.exe`, "c:\\\\prog.exe"},
-		{`a+prog.exe`, "a+prog.exe"},
+		{"Helix P4V/NTX64/2019.2/1904275/v86", "Helix P4V"},
+		{"P4V/MACOSX1015X86_64/2023.1/2442900/v93", "P4V"},
+		{"p4/2016.2/LINUX26X86_64/1598668", "p4"},
+		{"Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82", "Git Fusion"},
+		{`c:\jenkins\gen_stubs.py [PY2.7.9+/P4PY2020.1/API2020.1/2051818]/v88`, `c:\jenkins\gen_stubs.py`},
+		{"some unknown prog", "some unknown prog"},
 	}
-
 	for _, v := range values {
-		actual := NotLabelValueRE.ReplaceAllLiteralString(v.input, "_")
-		assert.Equal(t, v.expected, actual)
+		assert.Equal(t, v.expected, normalizeProgramName(v.input))
 	}
 
+	cfg := &Config{
+		ServerID:                 "myserverid",
+		UpdateInterval:           10 * time.Millisecond,
+		NormalizeProgramVersions: true}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", App: "P4V/NTX64/2023.1/2442900/v93"})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", App: "P4V/NTX64/2023.2/2531267/v94"})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", App: "Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82 (brokered)"})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_program_counter{serverid="myserverid",program="p4v"} 2`)
+	assert.Contains(t, output, `p4_cmd_program_counter{serverid="myserverid",program="git_fusion"} 1`)
+}
+
+func TestP4PromPlatform(t *testing.T) {
+	cfg := &Config{
+		ServerID:             "myserverid",
+		UpdateInterval:       10 * time.Millisecond,
+		OutputCmdsByPlatform: true}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [P4V/NTX64/2023.1/2442900/v93] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [P4V/NTX64/2023.2/2531267/v94] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1619 robert@robert-test 127.0.0.1 [P4Win] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1619 completed .031s
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_cmd_platform_counter{serverid="myserverid",platform="NTX64"} 2`)
+	assert.Contains(t, output, `p4_cmd_platform_counter{serverid="myserverid",platform="LINUX26X86_64"} 1`)
+	assert.Equal(t, 2, strings.Count(strings.Join(output, "\n"), "p4_cmd_platform_counter{"))
+
+	cfg.OutputCmdsByPlatform = false
+	assert.NotContains(t, strings.Join(oneOutputTest(t, cfg, input, false), "\n"), "p4_cmd_platform_counter")
+}
+
+func TestP4PromConfigError(t *testing.T) {
+	cfg := &Config{ServerID: "myserverid"}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	assert.NoError(t, p4m.Err())
+	p4m.SetDebugPID(1616, "")
+	assert.Error(t, p4m.Err())
+}
+
+func TestP4PromCmdLockTotals(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -d test'
+Perforce server info:
+	2018/06/10 23:30:07 pid 25568 completed 1.01s
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -d test'
+--- lapse 1.01s
+--- db.rev
+---   total lock wait+held read/write 100ms+200ms/300ms+400ms
+--- db.integed
+---   total lock wait+held read/write 0ms+0ms/50ms+1000ms
+
+Perforce server info:
+	2018/06/10 23:30:06 pid 25569 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -d test'
+Perforce server info:
+	2018/06/10 23:30:07 pid 25569 completed 1.01s
+Perforce server info:
+	2018/06/10 23:30:06 pid 25569 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -d test'
+--- lapse 1.01s
+--- db.rev
+---   total lock wait+held read/write 100ms+200ms/300ms+400ms
+--- db.integed
+---   total lock wait+held read/write 0ms+0ms/50ms+1000ms
+
+Perforce server info:
+	2018/06/10 23:30:08 pid 25570 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+	2018/06/10 23:30:08 pid 25570 completed .002s
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_cmd_lock_wait_cumulative_seconds{serverid="myserverid",cmd="user-submit"} 0.900`)
+	assert.Contains(t, output, `p4_cmd_lock_held_cumulative_seconds{serverid="myserverid",cmd="user-submit"} 3.200`)
+	// No locks so not output
+	assert.NotContains(t, strings.Join(output, "\n"), `p4_cmd_lock_wait_cumulative_seconds{serverid="myserverid",cmd="user-info"}`)
+}
+
+func TestP4PromRetryStorm(t *testing.T) {
+	cfg := &Config{
+		ServerID:            "myserverid",
+		RetryStormThreshold: 5,
+		RetryStormWindow:    time.Minute}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	start := time.Date(2015, 9, 2, 15, 0, 0, 0, time.UTC)
+	publish := func(user, cmdName, client string, offset time.Duration) {
+		p4m.publishEvent(p4dlog.Command{Cmd: cmdName, User: user, Workspace: client, StartTime: start.Add(offset)})
+	}
+	// A CI job retrying every 5 seconds, twice the threshold
+	for i := 0; i < 10; i++ {
+		publish("jenkins", "user-sync", "ci_ws", time.Duration(i)*5*time.Second)
+	}
+	// Below the threshold, spread over more than the window, or differing cmds/clients
+	for i := 0; i < 4; i++ {
+		publish("fred", "user-sync", "fred_ws", time.Duration(i)*time.Second)
+	}
+	for i := 0; i < 5; i++ {
+		publish("bill", "user-sync", "bill_ws", time.Duration(i)*20*time.Second)
+		publish("jim", "user-sync", fmt.Sprintf("jim_ws%d", i), 0)
+		publish("joe", fmt.Sprintf("user-cmd%d", i), "joe_ws", 0)
+	}
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_retry_storm_total{serverid="myserverid",user="jenkins"} 2`)
+	assert.Equal(t, 1, strings.Count(output, "p4_cmd_retry_storm_total{"))
+
+	// A counter so not reset each interval
+	p4m.resetToZero()
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_retry_storm_total{serverid="myserverid",user="jenkins"} 2`)
+
+	// Off by default
+	p4m = NewP4DMetricsLogParser(&Config{ServerID: "myserverid"}, logger, false)
+	for i := 0; i < 10; i++ {
+		publish("jenkins", "user-sync", "ci_ws", 0)
+	}
+	assert.NotContains(t, p4m.getCumulativeMetrics(), "p4_cmd_retry_storm_total")
+}
+
+func TestP4PromTableFilter(t *testing.T) {
+	cfg := &Config{
+		ServerID:      "myserverid",
+		IncludeTables: "rev|have|locks|custom.*",
+		ExcludeTables: "custom_tmp"}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Tables: map[string]*p4dlog.Table{
+		"rev":        {TableName: "rev", TotalReadWait: 100, TotalReadHeld: 300, PagesIn: 5},
+		"revsh":      {TableName: "revsh", TotalReadWait: 200, TotalReadHeld: 100, PagesIn: 1, PagesCached: 9},
+		"integed":    {TableName: "integed", TotalWriteHeld: 50, PagesIn: 2, PagesCached: 7},
+		"custom_tmp": {TableName: "custom_tmp", TotalReadWait: 100, PagesIn: 3}}})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_total_read_wait_seconds{serverid="myserverid",table="rev"} 0.100`)
+	assert.Contains(t, output, `p4_total_read_wait_seconds{serverid="myserverid",table="other"} 0.300`)
+	assert.Contains(t, output, `p4_total_write_held_seconds{serverid="myserverid",table="other"} 0.050`)
+	assert.Contains(t, output, `p4_table_pages_in{serverid="myserverid",table="other"} 6`)
+	assert.Contains(t, output, `p4_table_pages_cached{serverid="myserverid",table="other"} 9`)
+	assert.Contains(t, output, `p4_table_read_contention_ratio{serverid="myserverid",table="other"} 0.750`)
+	assert.Equal(t, 2, strings.Count(output, "p4_total_read_wait_seconds{"))
+	for _, table := range []string{"revsh", "integed", "custom_tmp"} {
+		assert.NotContains(t, output, fmt.Sprintf(`table="%s"`, table))
+	}
+	// Pages in/out are counters, cached is the max this interval
+	p4m.Reset()
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_table_pages_in{serverid="myserverid",table="other"} 6`)
+	assert.Contains(t, output, `p4_table_pages_cached{serverid="myserverid",table="other"} 0`)
+
+	// Unfiltered by default
+	p4m = NewP4DMetricsLogParser(&Config{ServerID: "myserverid"}, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Tables: map[string]*p4dlog.Table{
+		"revsh": {TableName: "revsh", TotalReadWait: 200}}})
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_total_read_wait_seconds{serverid="myserverid",table="revsh"} 0.200`)
+	assert.NotContains(t, output, `table="other"`)
+}
+
+func TestP4PromSyncAverages(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	// No files transferred so nothing to average
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	output := strings.Join(oneOutputTest(t, cfg, input, false), "\n")
+	assert.NotContains(t, output, "p4_sync_bytes_per_file")
+	assert.NotContains(t, output, "p4_sync_files_per_cmd")
+
+	input += `
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 compute end .031s
+Perforce server info:
+	Server network estimates: files added/updated/deleted=3/0/0, bytes added/updated=3000/0
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 compute end .031s
+Perforce server info:
+	Server network estimates: files added/updated/deleted=0/1/2, bytes added/updated=0/5000
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 completed .031s
+`
+	lines := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, lines, `p4_sync_bytes_per_file{serverid="myserverid"} 2000.000`)
+	assert.Contains(t, lines, `p4_sync_files_per_cmd{serverid="myserverid"} 1.333`)
+
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", NetFilesAdded: 3, NetBytesAdded: 3000})
+	p4m.resetToZero()
+	assert.NotContains(t, p4m.getCumulativeMetrics(), "p4_sync_bytes_per_file")
+}
+
+func TestP4PromAnonymizeLabels(t *testing.T) {
+	cfg := &Config{
+		ServerID:              "myserverid",
+		OutputCmdsByUser:      true,
+		OutputCmdsByIP:        true,
+		OutputCmdsByUserRegex: "fred",
+		AnonymizeLabels:       true,
+		AnonymizeSalt:         "salt1"}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	assert.Equal(t, p4m.anonymize("fred"), p4m.anonymize("fred"))
+	assert.NotEqual(t, p4m.anonymize("fred"), p4m.anonymize("bill"))
+	assert.Equal(t, "", p4m.anonymize(""))
+	fred := p4m.anonymize("fred")
+	ip := p4m.anonymize("10.1.2.3")
+
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "Fred", Workspace: "fred_ws", IP: "10.1.2.3"})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", Workspace: "fred_ws", IP: "10.1.2.3"})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, fmt.Sprintf(`p4_cmd_user_counter{serverid="myserverid",user="%s"} 2`, fred))
+	assert.Contains(t, output, fmt.Sprintf(`p4_cmd_user_detail_counter{serverid="myserverid",user="%s",cmd="user-sync"} 2`, fred))
+	assert.Contains(t, output, fmt.Sprintf(`p4_cmd_ip_counter{serverid="myserverid",ip="%s"} 2`, ip))
+	assert.NotContains(t, output, `"fred"`)
+	assert.NotContains(t, output, `10.1.2.3`)
+
+	// A different salt gives different hashes
+	cfg2 := *cfg
+	cfg2.AnonymizeSalt = "salt2"
+	p4m2 := NewP4DMetricsLogParser(&cfg2, logger, false)
+	assert.NotEqual(t, fred, p4m2.anonymize("fred"))
+
+	cfg2.AnonymizeLabels = false
+	assert.Equal(t, "fred", p4m2.anonymize("fred"))
+}
+
+func TestP4PromCmdNetBytes(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 compute end .020s 16+3us 0+0io 0+0net 8964k 0pf
+Perforce server info:
+	Server network estimates: files added/updated/deleted=2/3/0, bytes added/updated=1000/2000
+Perforce server info:
+	2018/06/10 23:30:07 pid 25568 completed .178s 96+17us 0+208io 0+0net 15668k 0pf
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+--- lapse .178s
+--- rpc msgs/size in+out 2+45/1mb+12mb himarks 318788/318788 snd/rcv 1.20s/.001s
+--- db.have
+---   total lock wait+held read/write 0ms+0ms/0ms+5ms
+
+Perforce server info:
+	2018/06/10 23:30:08 pid 25569 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+	2018/06/10 23:30:08 pid 25569 completed .002s
+`
+	output := strings.Join(oneOutputTest(t, cfg, input, false), "\n")
+	assert.Contains(t, output, `p4_cmd_net_bytes_sent{serverid="myserverid",cmd="user-sync"} 12582912`)
+	assert.Contains(t, output, `p4_cmd_net_bytes_rcvd{serverid="myserverid",cmd="user-sync"} 1048576`)
+	// File bytes are not added to by wire bytes
+	assert.Contains(t, output, `p4_net_bytes_added{serverid="myserverid",cmd="user-sync"} 1000`)
+	assert.NotContains(t, output, `p4_cmd_net_bytes_sent{serverid="myserverid",cmd="user-info"}`)
+}
+
+func TestP4PromAPILevel(t *testing.T) {
+	cfg := &Config{
+		ServerID:             "myserverid",
+		UpdateInterval:       10 * time.Millisecond,
+		OutputCmdsByAPILevel: true}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [P4V/NTX64/2023.2/2531267/v93] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [P4V/NTX64/2023.2/2531267/v93 (brokered)] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 robert@robert-test 127.0.0.1 [unnamed p4-python script/v81] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1619 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1619 completed .031s
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_cmd_apilevel_counter{serverid="myserverid",level="93"} 2`)
+	assert.Contains(t, output, `p4_cmd_apilevel_counter{serverid="myserverid",level="81"} 1`)
+	assert.Equal(t, 2, strings.Count(strings.Join(output, "\n"), "p4_cmd_apilevel_counter{"))
+
+	cfg.OutputCmdsByAPILevel = false
+	assert.NotContains(t, strings.Join(oneOutputTest(t, cfg, input, false), "\n"), "p4_cmd_apilevel_counter")
+}
+
+func TestP4PromDepotPaths(t *testing.T) {
+	var values = []struct {
+		args     string
+		expected []string
+	}{
+		{"//depot/main/...", []string{"//depot/main"}},
+		{"//depot/main/src/fred.c#head //depot/main/doc/...@1234", []string{"//depot/main"}},
+		{"-q //depot/main/... //stream/dev/...", []string{"//depot/main", "//stream/dev"}},
+		// Wildcards and revision specifiers terminate the path
+		{"//depot/...", []string{"//depot"}},
+		{"//depot/ma*/...", []string{"//depot"}},
+		{"//...", []string{}},
+		{"//depot@label", []string{"//depot"}},
+		// Client syntax paths are not depot paths - they start with the workspace name
+		{"//robert-test/main/...", []string{}},
+		// Local syntax paths are ignored
+		{"/home/robert/ws/... c:\\ws\\...", []string{}},
+		{"-c 1234", []string{}},
+	}
+	for _, v := range values {
+		assert.Equal(t, v.expected, depotPaths(v.args, "robert-test", 2), v.args)
+	}
+	assert.Equal(t, []string{"//depot/main/src"}, depotPaths("//depot/main/src/fred.c", "", 3))
+
+	cfg := &Config{
+		ServerID:          "myserverid",
+		UpdateInterval:    10 * time.Millisecond,
+		OutputCmdsByDepot: true}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Workspace: "robert-test", Args: "//depot/main/... //stream/dev/...",
+		NetBytesAdded: 100, NetBytesUpdated: 200})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Workspace: "robert-test", Args: "//depot/main/src/...",
+		NetBytesAdded: 50})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-fstat", Workspace: "robert-test", Args: "//depot/main/..."})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_depot_counter{serverid="myserverid",depot="//depot/main"} 2`)
+	assert.Contains(t, output, `p4_cmd_depot_counter{serverid="myserverid",depot="//stream/dev"} 1`)
+	assert.Contains(t, output, `p4_cmd_depot_bytes{serverid="myserverid",depot="//depot/main"} 200`)
+	assert.Contains(t, output, `p4_cmd_depot_bytes{serverid="myserverid",depot="//stream/dev"} 150`)
+}
+
+func TestP4PromLongLines(t *testing.T) {
+	// A sync with a 600KB argument list on a single line
+	args := strings.Repeat("//depot/main/src/file.c ", 25000)
+	input := fmt.Sprintf(`
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync %s'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`, args)
+	assert.Greater(t, len(input), 600*1000)
+
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_prom_log_lines_truncated{serverid="myserverid"} 0`)
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+
+	cfg.MaxLineLength = 100 * 1024
+	output = oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_prom_log_lines_truncated{serverid="myserverid"} 1`)
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+}
+
+func TestP4PromCancel(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: time.Hour}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	linesChan := make(chan string, 100)
+	// Nobody reads the cmds channel, so everything upstream backs up once the buffers are full
+	_, metricsChan := p4m.ProcessEvents(ctx, linesChan, true)
+
+	startTime, _ := time.Parse(p4timeformat, "2015/09/02 15:23:09")
+	go func() {
+		for i := 0; i < 100000; i++ {
+			lines := []string{
+				"Perforce server info:",
+				fmt.Sprintf("\t%s pid %d robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'",
+					startTime.Add(time.Duration(i)*time.Second).Format(p4timeformat), i+1),
+				"--- lapse .031s",
+				"--- db.rev",
+				"---   pages in+out+cached 1+0+1",
+				""}
+			for _, line := range lines {
+				select {
+				case linesChan <- line:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+
+	done := make(chan bool)
+	go func() {
+		for range metricsChan {
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessEvents did not exit after cancellation")
+	}
+}
+
+func TestP4PromNetByCmd(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", NetFilesAdded: 2, NetBytesAdded: 200})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", NetFilesUpdated: 1, NetBytesUpdated: 50})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-populate", NetFilesAdded: 5, NetBytesAdded: 500})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-fstat"})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_net_files_added{serverid="myserverid",cmd="user-sync"} 2`)
+	assert.Contains(t, output, `p4_net_files_updated{serverid="myserverid",cmd="user-sync"} 1`)
+	assert.Contains(t, output, `p4_net_bytes_added{serverid="myserverid",cmd="user-sync"} 200`)
+	assert.Contains(t, output, `p4_net_bytes_updated{serverid="myserverid",cmd="user-sync"} 50`)
+	assert.Contains(t, output, `p4_net_files_added{serverid="myserverid",cmd="user-populate"} 5`)
+	assert.Contains(t, output, `p4_net_bytes_added{serverid="myserverid",cmd="user-populate"} 500`)
+	assert.NotContains(t, output, `p4_net_files_added{serverid="myserverid",cmd="user-fstat"}`)
+	// Global values are still output
+	assert.Contains(t, output, `p4_sync_files_added{serverid="myserverid"} 7`)
+
+	p4m.resetToZero()
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_net_bytes_added{serverid="myserverid",cmd="user-sync"} 0`)
+}
+
+func TestP4PromTruncated(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		MaxLineLength:  150}
+	// Args truncated due to MaxLineLength, and by pid reuse before the first cmd completed
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //depot/a/... //depot/b/... //depot/c/... //depot/d/... //depot/e/... //depot/f/...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //depot/...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 completed .031s
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_cmd_truncated_counter{serverid="myserverid",cmd="user-files"} 1`)
+	assert.Contains(t, output, `p4_cmd_truncated_counter{serverid="myserverid",cmd="user-sync"} 1`)
+	assert.Equal(t, 2, strings.Count(strings.Join(output, "\n"), "p4_cmd_truncated_counter{"))
+
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-files", Truncated: true})
+	p4m.resetToZero()
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_truncated_counter{serverid="myserverid",cmd="user-files"} 0`)
+}
+
+func TestP4PromIncomplete(t *testing.T) {
+	// Log ends mid-command
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 completed .031s
+`
+	output := basicTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_cmd_incomplete_total{serverid="myserverid",cmd="user-sync"} 1`)
+	for _, l := range output {
+		assert.NotContains(t, l, `p4_cmd_incomplete_total{serverid="myserverid",cmd="user-fstat"}`)
+	}
+
+	p4m := NewP4DMetrics(cfg, logger, ModeLive)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-fstat"})
+	assert.NotContains(t, p4m.getCumulativeMetrics(), "p4_cmd_incomplete_total")
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Truncated: true, Incomplete: true})
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_incomplete_total{serverid="myserverid",cmd="user-sync"} 1`)
+	// Not reset each interval
+	p4m.Reset()
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Truncated: true, Incomplete: true})
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_incomplete_total{serverid="myserverid",cmd="user-sync"} 2`)
+}
+
+func TestP4PromContentionRatio(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-submit", Tables: map[string]*p4dlog.Table{
+		"rev":      {TableName: "rev", TotalWriteWait: 300, TotalWriteHeld: 100, TotalReadWait: 0, TotalReadHeld: 50},
+		"counters": {TableName: "counters"}}})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_table_write_contention_ratio{serverid="myserverid",table="rev"} 0.750`)
+	assert.Contains(t, output, `p4_table_read_contention_ratio{serverid="myserverid",table="rev"} 0.000`)
+	assert.NotContains(t, output, `p4_table_write_contention_ratio{serverid="myserverid",table="counters"}`)
+	// No lock time in this interval
+	p4m.resetToZero()
+	assert.NotContains(t, p4m.getCumulativeMetrics(), `p4_table_write_contention_ratio{serverid="myserverid",table="rev"}`)
+}
+
+func TestP4PromCPUEfficiency(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	// Lock bound and compute bound
+	input := `
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -d test'
+Perforce server info:
+	2018/06/10 23:30:16 pid 25568 completed 10.000s
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -d test'
+--- lapse 10.000s
+--- usage 80+20us 0+0io 0+0net 4088k 0pf
+
+Perforce server info:
+	2018/06/10 23:30:06 pid 25569 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2018/06/10 23:30:08 pid 25569 completed 2.000s
+Perforce server info:
+	2018/06/10 23:30:06 pid 25569 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+--- lapse 2.000s
+--- usage 1500+300us 0+0io 0+0net 4088k 0pf
+
+Perforce server info:
+	2018/06/10 23:30:08 pid 25570 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+Perforce server info:
+	2018/06/10 23:30:08 pid 25570 completed 0s
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_cmd_cpu_efficiency{serverid="myserverid",cmd="user-submit"} 0.010`)
+	assert.Contains(t, output, `p4_cmd_cpu_efficiency{serverid="myserverid",cmd="user-fstat"} 0.900`)
+	assert.NotContains(t, strings.Join(output, "\n"), `p4_cmd_cpu_efficiency{serverid="myserverid",cmd="user-info"}`)
+}
+
+func TestP4PromTablePages(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	// Track level 2 output
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+--- lapse .031s
+--- db.have
+---   pages in+out+cached 120+30+96
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+200 100+0
+--- db.rev
+---   pages in+out+cached 45+0+64
+---   locks read/write 1/0 rows get+pos+scan put+del 0+1+200 0+0
+
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .011s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+--- lapse .011s
+--- db.rev
+---   pages in+out+cached 5+0+64
+---   locks read/write 1/0 rows get+pos+scan put+del 0+1+20 0+0
+
+`
+	output := basicTest(t, cfg, input, true)
+	assert.Contains(t, output, "p4_table_pages_in;serverid=myserverid;table=have 120 1441207390")
+	assert.Contains(t, output, "p4_table_pages_out;serverid=myserverid;table=have 30 1441207390")
+	assert.Contains(t, output, "p4_table_pages_in;serverid=myserverid;table=rev 50 1441207390")
+	assert.Contains(t, output, "p4_table_pages_out;serverid=myserverid;table=rev 0 1441207390")
+	assert.Contains(t, output, "p4_table_pages_cached;serverid=myserverid;table=have 96 1441207390")
+	assert.Contains(t, output, "p4_table_pages_cached;serverid=myserverid;table=rev 64 1441207390")
+}
+
+func TestP4PromPeekLocks(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	// Lockless reads (db.peeking) report peek locks separately from read/write locks
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+--- lapse .031s
+--- db.have
+---   pages in+out+cached 12+3+96
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+200 100+0
+---   total lock wait+held read/write 0ms+0ms/10ms+20ms
+--- db.rev
+---   pages in+out+cached 45+0+64
+---   locks read/write 0/0 rows get+pos+scan put+del 0+1+200 0+0
+---   peek count 2 wait+held total/max 150ms+2500ms/100ms+2000ms
+
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .011s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //...'
+--- lapse .011s
+--- db.rev
+---   pages in+out+cached 5+0+64
+---   locks read/write 0/0 rows get+pos+scan put+del 0+1+20 0+0
+---   peek count 1 wait+held total/max 50ms+500ms/50ms+500ms
+
+`
+	output := basicTest(t, cfg, input, true)
+	assert.Contains(t, output, "p4_total_peek_count;serverid=myserverid;table=rev 3 1441207390")
+	assert.Contains(t, output, "p4_total_peek_wait_seconds;serverid=myserverid;table=rev 0.200 1441207390")
+	assert.Contains(t, output, "p4_total_peek_held_seconds;serverid=myserverid;table=rev 3.000 1441207390")
+	assert.Contains(t, output, "p4_total_write_held_seconds;serverid=myserverid;table=have 0.020 1441207390")
+	for _, line := range output {
+		assert.NotContains(t, line, "p4_total_peek_count;serverid=myserverid;table=have")
+	}
+}
+
+func TestP4PromCmdRate(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Second}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	for i := 0; i < 5; i++ {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	}
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_rate_per_second{serverid="myserverid"} 0.500`)
+	p4m.resetToZero()
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_rate_per_second{serverid="myserverid"} 0.000`)
+
+	// Once output, live rates are over the time since, not UpdateInterval
+	clock := newFakeClock(time.Now())
+	p4m.SetClock(clock)
+	p4m.Reset()
+	for i := 0; i < 5; i++ {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	}
+	clock.advance(2 * time.Second)
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_rate_per_second{serverid="myserverid"} 2.500`)
+	p4m.Reset()
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	clock.advance(4 * time.Second)
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_rate_per_second{serverid="myserverid"} 0.250`)
+
+	// Historical uses the log time between outputs
+	p4m = NewP4DMetricsLogParser(cfg, logger, true)
+	updateRequired(p4m, "\t2015/09/02 15:23:00 pid 1616 robert@robert-test")
+	for i := 0; i < 6; i++ {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	}
+	assert.True(t, updateRequired(p4m, "\t2015/09/02 15:23:20 pid 1617 robert@robert-test"))
+	assert.Contains(t, flushMetrics(p4m), "p4_cmd_rate_per_second;serverid=myserverid 0.300 1441207400")
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	assert.True(t, updateRequired(p4m, "\t2015/09/02 15:23:30 pid 1618 robert@robert-test"))
+	assert.Contains(t, flushMetrics(p4m), "p4_cmd_rate_per_second;serverid=myserverid 0.100 1441207410")
+}
+
+func TestP4PromFractionalTimestamps(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Second}
+	for _, frac := range []string{"", ".123"} {
+		p4m := NewP4DMetricsLogParser(cfg, logger, true)
+		assert.False(t, updateRequired(p4m, "\t2015/09/02 15:23:00"+frac+" pid 1616 robert@robert-test"))
+		// Far enough on for the parser to be sent the time
+		update, toParser := p4m.historicalUpdateRequired("\t2015/09/02 15:23:05" + frac + " pid 1617 robert@robert-test")
+		assert.False(t, update, frac)
+		expected, _ := time.Parse(p4timeformat, "2015/09/02 15:23:05"+frac)
+		assert.Equal(t, expected, toParser, frac)
+		assert.True(t, updateRequired(p4m, "\t2015/09/02 15:23:10"+frac+" pid 1618 robert@robert-test"), frac)
+		expected, _ = time.Parse(p4timeformat, "2015/09/02 15:23:10"+frac)
+		assert.Equal(t, expected, p4m.timeLatestStartCmd)
+		// Same second but later fraction is not a new interval
+		assert.False(t, updateRequired(p4m, "\t2015/09/02 15:23:10.999 pid 1619 robert@robert-test"), frac)
+	}
+
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09%s pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09%s pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:25%s pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:25%s pid 1617 completed .031s
+`
+	whole := basicTest(t, cfg, strings.ReplaceAll(input, "%s", ""), true)
+	fractional := basicTest(t, cfg, strings.ReplaceAll(input, "%s", ".456"), true)
+	assert.Equal(t, len(whole), len(fractional))
+	compareOutput(t, whole, fractional)
+	assert.Contains(t, fractional, "p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 2 1441207405")
+}
+
+func TestP4PromIntegResolveFiles(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-merge //depot/main/... //depot/rel/...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-merge //depot/main/... //depot/rel/...'
+--- lapse .031s
+--- db.resolve
+---   pages in+out+cached 8+12+6
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+0 12+0
+
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-resolve -as'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .021s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-resolve -as'
+--- lapse .021s
+--- db.resolve
+---   pages in+out+cached 8+10+6
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+12 9+0
+
+`
+	output := basicTest(t, cfg, input, true)
+	assert.Contains(t, output, "p4_cmd_integ_files;serverid=myserverid;cmd=user-merge 12 1441207390")
+	assert.Contains(t, output, "p4_cmd_resolve_files;serverid=myserverid;cmd=user-resolve 9 1441207390")
+	for _, line := range output {
+		assert.False(t, strings.HasPrefix(line, "p4_cmd_integ_files;serverid=myserverid;cmd=user-resolve"), line)
+	}
+}
+
+func TestP4PromPull(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	// Replica log - journal pull schedules 3 files and archive pull transfers 2 of them
+	input := `
+Perforce server info:
+	2018/06/01 04:29:43 pid 55997 svc0@unknown background [p4d/2018.1/DARWIN90X86_64/1660568] 'pull -i 1'
+--- lapse .001s
+--- db.rev
+---   pages in+out+cached 4+3+2
+---   locks read/write 0/1 rows get+pos+scan put+del 0+0+0 3+0
+--- rdb.lbr
+---   pages in+out+cached 4+3+2
+---   locks read/write 0/1 rows get+pos+scan put+del 0+0+0 3+0
+--- replica/pull(W)
+---   total lock wait+held read/write 0ms+0ms/0ms+0ms
+
+Perforce server info:
+	2018/06/01 04:29:44 pid 55998 svc0@unknown background [p4d/2018.1/DARWIN90X86_64/1660568] 'pull -u -i 1'
+--- lapse .051s
+--- rdb.lbr
+---   pages in+out+cached 6+4+4
+---   locks read/write 0/2 rows get+pos+scan put+del 0+2+4 0+2
+--- lbr Rcs
+---   opens+closes+checkins+exists 2+2+2+0
+---   reads+readbytes+writes+writebytes 0+0+2+1200
+
+`
+	output := basicTest(t, cfg, input, true)
+	assert.Contains(t, output, "p4_pull_files;serverid=myserverid 2 1527827384")
+	assert.Contains(t, output, "p4_pull_bytes;serverid=myserverid 1200 1527827384")
+	assert.Contains(t, output, "p4_pull_queue_depth;serverid=myserverid 1 1527827384")
+
+	// Not a replica - no pull metrics
+	input = `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	for _, line := range basicTest(t, cfg, input, true) {
+		assert.False(t, strings.HasPrefix(line, "p4_pull_"), line)
+	}
+}
+
+func TestP4PromExtraLabels(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		ExtraLabels: map[string]string{"region": "eu-west", "tier": "prod env", "bad-name": "x",
+			"__reserved": "x", "serverid": "other"}}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "robert"})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_cmd_counter{region="eu-west",tier="prod_env",serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+	assert.Contains(t, output, `p4_prom_log_lines_read{region="eu-west",tier="prod_env",serverid="myserverid"} 0`)
+	assert.NotContains(t, output, "bad-name")
+	assert.NotContains(t, output, "__reserved")
+	assert.NotContains(t, output, "other")
+
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	historical := basicTest(t, cfg, input, true)
+	assert.Contains(t, historical, "p4_cmd_counter;region=eu-west;tier=prod_env;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389")
+}
+
+func TestP4PromHourOfDay(t *testing.T) {
+	cfg := &Config{
+		ServerID:        "myserverid",
+		UpdateInterval:  10 * time.Millisecond,
+		OutputHourOfDay: true}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:40:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:40:09 pid 1617 completed 1.5s
+Perforce server info:
+	2015/09/03 02:10:00 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/03 02:10:00 pid 1618 completed .5s
+`
+	output := basicTest(t, cfg, input, true)
+	assert.Contains(t, output, "p4_cmd_hour_of_day_counter;serverid=myserverid;hour=15 2 1441246200")
+	assert.Contains(t, output, "p4_cmd_hour_of_day_cumulative_seconds;serverid=myserverid;hour=15 1.531 1441246200")
+	assert.Contains(t, output, "p4_cmd_hour_of_day_counter;serverid=myserverid;hour=02 1 1441246200")
+	assert.Contains(t, output, "p4_cmd_hour_of_day_counter;serverid=myserverid;hour=03 0 1441246200")
+	count := 0
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_cmd_hour_of_day_counter;") {
+			count++
+		}
+	}
+	assert.Equal(t, 24, count)
+
+	// Not output unless requested
+	cfg.OutputHourOfDay = false
+	for _, line := range basicTest(t, cfg, input, true) {
+		assert.False(t, strings.HasPrefix(line, "p4_cmd_hour_of_day"), line)
+	}
+}
+
+func TestP4PromMetricPrefix(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		MetricPrefix:   "perforce_prod"}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `perforce_prod_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+	assert.Contains(t, output, "# TYPE perforce_prod_cmd_counter gauge")
+	for _, line := range strings.Split(output, "\n") {
+		assert.False(t, strings.HasPrefix(line, "p4_"), line)
+	}
+
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	assert.Contains(t, basicTest(t, cfg, input, true), "perforce_prod_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389")
+
+	// Invalid prefix - default is used
+	cfg.MetricPrefix = "perforce-prod"
+	p4m = NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync"})
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+}
+
+func TestP4PromServerRestart(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce Server starting 2015/09/02 15:30:00 pid 1700 P4D/LINUX26X86_64/2016.2/1598668 (2017/09/12).
+Perforce server info:
+	2015/09/02 15:30:09 pid 1716 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:30:09 pid 1716 completed .031s
+`
+	output := basicTest(t, cfg, input, true)
+	assert.Contains(t, output, "p4_server_restart_timestamp;serverid=myserverid 1441207800 1441207809")
+	assert.Contains(t, output, "p4_server_restarts_total;serverid=myserverid 1 1441207809")
+	// Not output before the restart
+	for _, line := range output {
+		if strings.HasPrefix(line, "p4_server_restart") {
+			assert.True(t, strings.HasSuffix(line, " 1441207809"), line)
+		}
+	}
+
+	cfg.OutputOpenMetrics = true
+	output = oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_server_restarts_total{serverid="myserverid"} 1`)
+	// OpenMetrics family names don't include the _total suffix
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	buf := new(bytes.Buffer)
+	p4m.writeMetricHeader(buf, formatPrometheus, "p4_server_restarts_total", "help", "counter")
+	assert.Contains(t, buf.String(), "# TYPE p4_server_restarts counter")
+}
+
+func TestP4PromSinks(t *testing.T) {
+	cfg := &Config{
+		ServerID:        "myserverid",
+		UpdateInterval:  10 * time.Millisecond,
+		GraphiteAddress: "localhost:2003"}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.timeLatestStartCmd, _ = time.Parse(p4timeformat, "2015/09/02 15:23:09")
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 2})
+	metrics := p4m.getMetricsBuffer()
+	// Same values in both formats from one pass
+	assert.Contains(t, metrics.String(), `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+	assert.Equal(t, metrics.String(), metrics.format(formatPrometheus))
+	assert.Contains(t, metrics.format(formatGraphite), "p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389")
+	assert.NotContains(t, metrics.format(formatGraphite), "# HELP")
+
+	// Historical with a Prometheus textfile snapshot as well as the Graphite output
+	promFile := filepath.Join(t.TempDir(), "p4.prom")
+	cfg = &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		PrometheusFile: promFile}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	output := basicTest(t, cfg, input, true)
+	assert.Contains(t, output, "p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389")
+	buf, err := os.ReadFile(promFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), "# TYPE p4_cmd_counter gauge")
+	assert.Contains(t, string(buf), `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`+"\n")
+}
+
+func TestP4PromMaxLabelValueLen(t *testing.T) {
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Millisecond,
+		MaxLabelValueLen: 64}
+	program := strings.Repeat("p4v", 5000/3)
+	input := fmt.Sprintf(`
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [%s] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`, program)
+	output := oneOutputTest(t, cfg, input, false)
+	truncated := program[:64-len(LabelValueTruncatedSuffix)] + LabelValueTruncatedSuffix
+	assert.Contains(t, output, fmt.Sprintf(`p4_cmd_program_counter{serverid="myserverid",program="%s"} 1`, truncated))
+	for _, line := range output {
+		assert.Less(t, len(line), 200, line)
+	}
+
+	// Truncation doesn't split multi-byte chars
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.config.MaxLabelValueLen = 6
+	assert.Equal(t, "abc...", p4m.truncateLabelValue("abcdefgh"))
+	assert.Equal(t, "ab...", p4m.truncateLabelValue("ab\u00e9defgh"))
+	assert.Equal(t, "abcdef", p4m.truncateLabelValue("abcdef"))
+}
+
+func TestP4PromIntervalSummary(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		SummaryLogging: true}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	assert.Equal(t, "Interval summary: cmds 0, cpu 0.000s, busiest cmd none (0), busiest user none (0), max running 0", p4m.intervalSummary())
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", UCpu: 1000, SCpu: 500, Running: 2})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "bill", UCpu: 250, Running: 3})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-fstat", User: "bill", Running: 1})
+	assert.Equal(t, "Interval summary: cmds 3, cpu 1.750s, busiest cmd user-sync (2), busiest user bill (2), max running 3", p4m.intervalSummary())
+	p4m.resetToZero()
+	assert.Equal(t, "Interval summary: cmds 0, cpu 0.000s, busiest cmd none (0), busiest user none (0), max running 0", p4m.intervalSummary())
+
+	// Ties go to the first name alphabetically
+	name, count := busiest(map[string]int64{"b": 2, "a": 2, "c": 1})
+	assert.Equal(t, "a", name)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestP4PromUniqueUsers(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", Workspace: "fred_ws", IP: "10.1.2.3"})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "Fred", Workspace: "fred_ws2", IP: "10.1.2.3"})
+	// Forwarded by a replica, so the client IP is the one after the slash
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "bill", Workspace: "fred_ws", IP: "127.0.0.1/10.1.2.4"})
+	p4m.publishEvent(p4dlog.Command{Cmd: "rmt-Journal"})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_unique_users{serverid="myserverid"} 2`)
+	assert.Contains(t, output, `p4_unique_clients{serverid="myserverid"} 2`)
+	assert.Contains(t, output, `p4_unique_ips{serverid="myserverid"} 2`)
+	p4m.resetToZero()
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_unique_users{serverid="myserverid"} 0`)
+	assert.Contains(t, output, `p4_unique_clients{serverid="myserverid"} 0`)
+	assert.Contains(t, output, `p4_unique_ips{serverid="myserverid"} 0`)
+}
+
+func TestP4PromCaseInsensitiveClients(t *testing.T) {
+	cfg := &Config{
+		ServerID:            "myserverid",
+		UpdateInterval:      10 * time.Millisecond,
+		CaseSensitiveServer: false}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", Workspace: "Build1"})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", Workspace: "build1"})
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_unique_clients{serverid="myserverid"} 1`)
+
+	cfg.CaseSensitiveServer = true
+	p4m = NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", Workspace: "Build1"})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", Workspace: "build1"})
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_unique_clients{serverid="myserverid"} 2`)
+}
+
+func TestP4PromPending(t *testing.T) {
+	testLogger, hook := test.NewNullLogger()
+	cfg := &Config{
+		ServerID:             "myserverid",
+		UpdateInterval:       10 * time.Millisecond,
+		PendingWarnThreshold: 2}
+	p4m := NewP4DMetricsLogParser(cfg, testLogger, false)
+	p4m.checkPending(2)
+	assert.Equal(t, 0, len(hook.Entries))
+	p4m.checkPending(3)
+	p4m.checkPending(5)
+	assert.Equal(t, 1, len(hook.Entries))
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "Pending cmds 3 exceeds threshold 2")
+	// Warns again after dropping back below threshold
+	p4m.checkPending(1)
+	p4m.checkPending(4)
+	assert.Equal(t, 2, len(hook.Entries))
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_prom_cmds_pending_max{serverid="myserverid"} 5`)
+}
+
+func TestP4PromShed(t *testing.T) {
+	cfg := &Config{
+		ServerID:        "myserverid",
+		UpdateInterval:  10 * time.Millisecond,
+		MaxPendingCmds:  1,
+		PendingOverflow: PendingOverflowShed}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //a/...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 completed .031s
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_prom_shed_total{serverid="myserverid"} 1`)
+	// Shed cmds are output, as incomplete
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 2`)
+	assert.Contains(t, output, `p4_cmd_incomplete_total{serverid="myserverid",cmd="user-sync"} 1`)
+
+	// Not reset each interval
+	p4m := NewP4DMetrics(cfg, logger, ModeLive)
+	fp := p4dlog.NewP4dFileParser(logger)
+	fp.SetMaxPending(1, false)
+	p4m.fp = fp
+	for _, line := range strings.Split(input, "\n") {
+		for _, cmd := range fp.ParseLine(line) {
+			p4m.publishEvent(cmd)
+		}
+	}
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_prom_shed_total{serverid="myserverid"} 1`)
+	p4m.Reset()
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_prom_shed_total{serverid="myserverid"} 1`)
+
+	// Only output when shedding - when blocking 1616 is still running at the max, so parsing carries on
+	// and it is output as incomplete at the end of input
+	cfg.PendingOverflow = PendingOverflowBlock
+	output = oneOutputTest(t, cfg, input, false)
+	for _, l := range output {
+		assert.NotContains(t, l, "p4_prom_shed_total")
+	}
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 2`)
+	assert.Contains(t, output, `p4_cmd_incomplete_total{serverid="myserverid",cmd="user-sync"} 1`)
+}
+
+func TestP4PromLongRunning(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1616 completed 2.000s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:54 pid 1617 completed 45.000s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2015/09/02 15:23:39 pid 1618 completed 30.000s
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_cmd_long_running_total{serverid="myserverid",cmd="user-sync"} 1`)
+	assert.NotContains(t, strings.Join(output, "\n"), `p4_cmd_long_running_total{serverid="myserverid",cmd="user-fstat"}`)
+
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", CompletedLapse: 45})
+	p4m.resetToZero()
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_cmd_long_running_total{serverid="myserverid",cmd="user-sync"} 0`)
+
+	cfg.LongRunningThreshold = time.Minute
+	assert.NotContains(t, strings.Join(oneOutputTest(t, cfg, input, false), "\n"), "p4_cmd_long_running_total")
+}
+
+func TestP4PromLogLag(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	now := time.Date(2015, 9, 2, 15, 24, 9, 0, time.Local)
+	assert.Equal(t, float64(0), p4m.logLag(now))
+	p4m.updateLatestLogTime("\t2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'")
+	p4m.updateLatestLogTime("Perforce server info:")
+	assert.Equal(t, float64(60), p4m.logLag(now))
+	// Out of sequence times are ignored
+	p4m.updateLatestLogTime("\t2015/09/02 15:23:39 pid 1617 completed .031s")
+	p4m.updateLatestLogTime("\t2015/09/02 15:23:10 pid 1616 completed .031s")
+	assert.Equal(t, float64(30), p4m.logLag(now))
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_prom_log_lag_seconds{serverid="myserverid"} `)
+
+	p4m = NewP4DMetricsLogParser(cfg, logger, true)
+	p4m.timeLatestStartCmd = time.Date(2015, 9, 2, 15, 23, 9, 0, time.UTC)
+	assert.Equal(t, float64(0), p4m.logLag(now))
+}
+
+func TestP4PromBuildInfo(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	assert.Contains(t, p4m.getCumulativeMetrics(),
+		fmt.Sprintf(`p4_prom_build_info{serverid="myserverid",version="unknown",revision="unknown",goversion="%s"} 1`, runtime.Version()))
+
+	defer func(v, r string) { version.Version, version.Revision = v, r }(version.Version, version.Revision)
+	version.Version, version.Revision = "0.7.5", "abc123 dirty"
+	assert.Contains(t, p4m.getCumulativeMetrics(),
+		fmt.Sprintf(`p4_prom_build_info{serverid="myserverid",version="0.7.5",revision="abc123_dirty",goversion="%s"} 1`, runtime.Version()))
+}
+
+func TestP4PromChanDepth(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_prom_cmd_chan_depth{serverid="myserverid"} 0`)
+	assert.Contains(t, output, `p4_prom_line_chan_depth{serverid="myserverid"} 0`)
+
+	p4m.fpLinesChan = make(chan string, 10)
+	p4m.cmdsInChan = make(chan p4dlog.Command, 10)
+	p4m.fpLinesChan <- "Perforce server info:"
+	p4m.fpLinesChan <- "\t2015/09/02 15:23:09 pid 1616 completed .031s"
+	p4m.cmdsInChan <- p4dlog.Command{Cmd: "user-sync"}
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_prom_cmd_chan_depth{serverid="myserverid"} 1`)
+	assert.Contains(t, output, `p4_prom_line_chan_depth{serverid="myserverid"} 2`)
+}
+
+func TestP4PromRotationOrphans(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	// Completion of pid 1615 is from a cmd started in the previous log, and pid 1616 never completes
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1615 completed .011s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_prom_rotation_orphans_total{serverid="myserverid"} 2`)
+
+	input = `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	output = oneOutputTest(t, cfg, input, false)
+	for _, l := range output {
+		assert.NotContains(t, l, "p4_prom_rotation_orphans_total")
+	}
+}
+
+func TestP4PromBadLines(t *testing.T) {
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Millisecond,
+		OutputCmdsByUser: true}
+	input := "\nPerforce server info:\n" +
+		"\t2015/09/02 15:23:09 pid 1616 rob\x00\xfe\xffert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'\n" +
+		"Perforce server info:\n" +
+		"\t2015/09/02 15:23:09 pid 1616 completed .031s\n"
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_prom_bad_lines_total{serverid="myserverid"} 1`)
+	assert.Contains(t, output, "p4_cmd_user_counter{serverid=\"myserverid\",user=\"rob\ufffdert\"} 1")
+	for _, l := range output {
+		assert.True(t, utf8.ValidString(l), l)
+	}
+
+	// Control chars aren't output in label values from any source
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred\nbill"})
+	assert.Contains(t, p4m.getCumulativeMetrics(), "p4_cmd_user_counter{serverid=\"myserverid\",user=\"fredbill\"} 1\n")
+}
+
+func TestP4PromDeltaOutput(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		DeltaOutput:    true,
+		DeltaFullEvery: 3}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred"})
+	output := flushMetrics(p4m)
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`)
+	assert.Contains(t, output, `p4_unique_users{serverid="myserverid"} 1`)
+
+	// Reading the metrics doesn't affect what is output next
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_unique_users{serverid="myserverid"} 1`)
+
+	// Unchanged series omitted, headers are still output
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred"})
+	output = flushMetrics(p4m)
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 2`)
+	assert.NotContains(t, output, `p4_unique_users{serverid="myserverid"}`)
+	assert.Contains(t, output, "# TYPE p4_unique_users gauge")
+
+	output = flushMetrics(p4m)
+	assert.NotContains(t, output, `p4_cmd_counter{`)
+
+	// Full snapshot
+	output = flushMetrics(p4m)
+	assert.Contains(t, output, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 2`)
+	assert.Contains(t, output, `p4_unique_users{serverid="myserverid"} 1`)
+}
+
+func TestP4PromSlowCmds(t *testing.T) {
+	testLogger, hook := test.NewNullLogger()
+	cfg := &Config{
+		ServerID:             "myserverid",
+		UpdateInterval:       10 * time.Millisecond,
+		SlowCommandThreshold: 5 * time.Second,
+		SlowCommandLogLimit:  2}
+	p4m := NewP4DMetricsLogParser(cfg, testLogger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 1, CompletedLapse: 4.9})
+	assert.Equal(t, 0, len(hook.Entries))
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 2, User: "fred", CompletedLapse: 5})
+	assert.Equal(t, 1, len(hook.Entries))
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "Slow cmd user-sync pid 2 took 5.000s")
+	assert.Contains(t, hook.LastEntry().Message, `"user":"fred"`)
+	// Rate limited
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 3, CompletedLapse: 10})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 4, CompletedLapse: 10})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 5, CompletedLapse: 10})
+	assert.Equal(t, 2, len(hook.Entries))
+	// Limit restarts each interval, after reporting the number suppressed
+	p4m.getCumulativeMetrics()
+	assert.Equal(t, 2, len(hook.Entries))
+	flushMetrics(p4m)
+	assert.Equal(t, 3, len(hook.Entries))
+	assert.Contains(t, hook.LastEntry().Message, "2 further slow cmds not logged")
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", Pid: 6, CompletedLapse: 10})
+	assert.Equal(t, 4, len(hook.Entries))
+	assert.Contains(t, hook.LastEntry().Message, "pid 6")
+}
+
+func TestP4PromUserConcurrency(t *testing.T) {
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Millisecond,
+		OutputCmdsByUser: true}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	start, _ := time.Parse(p4timeformat, "2015/09/02 15:23:09")
+	// fred has 3 overlapping cmds, then one which starts as another ends
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", StartTime: start, CompletedLapse: 10})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", StartTime: start.Add(2 * time.Second), CompletedLapse: 5})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-fstat", User: "fred", StartTime: start.Add(3 * time.Second), CompletedLapse: 1})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-fstat", User: "fred", StartTime: start.Add(10 * time.Second), CompletedLapse: 1})
+	// bill's cmds are sequential
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "bill", StartTime: start, CompletedLapse: 1})
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "bill", StartTime: start.Add(2 * time.Second), CompletedLapse: 1})
+	output := p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_user_concurrent_max{serverid="myserverid",user="fred"} 3`)
+	assert.Contains(t, output, `p4_user_concurrent_max{serverid="myserverid",user="bill"} 1`)
+	flushMetrics(p4m)
+
+	p4m.resetToZero()
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", StartTime: start.Add(20 * time.Second), CompletedLapse: 1})
+	output = p4m.getCumulativeMetrics()
+	assert.Contains(t, output, `p4_user_concurrent_max{serverid="myserverid",user="fred"} 1`)
+	assert.Contains(t, output, `p4_user_concurrent_max{serverid="myserverid",user="bill"} 0`)
+
+	cfg.OutputCmdsByUser = false
+	p4m = NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", StartTime: start, CompletedLapse: 10})
+	assert.NotContains(t, p4m.getCumulativeMetrics(), "p4_user_concurrent_max")
+}
+
+func TestP4PromAlignToInterval(t *testing.T) {
+	input := `
+Perforce server info:
+	2015/09/02 15:23:50 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:51 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:24:05 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:24:06 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:25:01 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:25:02 pid 1618 completed .031s
+`
+	timestamps := func(output []string) []string {
+		result := make([]string, 0)
+		for _, line := range output {
+			if strings.HasPrefix(line, "p4_prom_log_lines_read;") {
+				fields := strings.Fields(line)
+				result = append(result, fields[len(fields)-1])
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: time.Minute}
+	// Not aligned: only output once a minute has passed since the first cmd (15:23:50), then at end
+	output := basicTest(t, cfg, input, true)
+	assert.Equal(t, []string{"1441207501", "1441207501"}, timestamps(output))
+
+	// Aligned: output when 15:24:00 and 15:25:00 are crossed, timestamped with the boundary
+	cfg.AlignToInterval = true
+	output = basicTest(t, cfg, input, true)
+	assert.Equal(t, []string{"1441207440", "1441207500", "1441207500"}, timestamps(output))
+}
+
+func TestP4PromConcurrentScrape(t *testing.T) {
+	// Run with -race to validate locking between event processing and scraping
+	cfg := &Config{
+		ServerID:         "myserverid",
+		UpdateInterval:   10 * time.Millisecond,
+		OutputCmdsByUser: true,
+		OutputCmdsByIP:   true}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: fmt.Sprintf("user%d", i%10), IP: "10.1.2.3",
+				CompletedLapse: 0.5, Tables: map[string]*p4dlog.Table{"rev": {TableName: "rev", TotalReadHeld: 10}}})
+			if i%100 == 0 {
+				p4m.resetToZero()
+			}
+		}
+	}()
+	scrapes := 0
+	for finished := false; !finished; scrapes++ {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		output := p4m.GetCumulativeMetrics()
+		assert.Contains(t, output, "p4_prom_cmds_processed")
+	}
+	assert.Greater(t, scrapes, 0)
+	assert.Contains(t, p4m.GetCumulativeMetrics(), `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 99`) // since last reset at i=400
+}
+
+func TestP4PromLabelValues(t *testing.T) {
+	// Tests for regex search and replace
+
+	var values = []struct {
+		input, expected string
+	}{
+		{"fred", "fred"},
+		{`fred"`, "fred_"},
+		{`fred'`, "fred_"},
+		{`fred;`, "fred_"},
+		{`fred^`, "fred_"},
+		{`fred!`, "fred_"},
+		{`fred@`, "fred@"},
+		{`p4/1.20`, "p4/1.20"},
+		{`p4/(1.20)`, "p4/(1.20)"},
+		{`p4\(1.20)`, "p4\\(1.20)"},
+		{`p4[1.20]`, "p4[1.20]"},
+		{`c:\prog.exe`, "c:\\prog.exe"},
+		{`c:\\prog.exe`, "c:\\\\prog.exe"},
+		{`a+prog.exe`, "a+prog.exe"},
+	}
+
+	for _, v := range values {
+		actual := NotLabelValueRE.ReplaceAllLiteralString(v.input, "_")
+		assert.Equal(t, v.expected, actual)
+	}
+
+}
+
+func TestP4PromForwarded(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	direct := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	// No split output until a forwarded cmd is seen
+	for _, l := range oneOutputTest(t, cfg, direct, false) {
+		assert.NotContains(t, l, "p4_cmd_forwarded_total")
+	}
+	input := direct + `
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test fd00::10/2001:db8::5 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test fe80::1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 completed .031s
+`
+	output := oneOutputTest(t, cfg, input, false)
+	assert.Contains(t, output, `p4_cmd_forwarded_total{serverid="myserverid"} 1`)
+	assert.Contains(t, output, `p4_cmd_direct_total{serverid="myserverid"} 2`)
+	assert.Contains(t, output, `p4_cmd_replica_counter{serverid="myserverid",replica="fd00::10"} 1`)
+}
+
+func TestP4PromDetailSampleRate(t *testing.T) {
+	cfg := &Config{
+		ServerID:              "myserverid",
+		UpdateInterval:        10 * time.Millisecond,
+		OutputCmdsByUser:      true,
+		OutputCmdsByUserRegex: ".*",
+		DetailSampleRate:      4}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	for i := 0; i < 8; i++ {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "fred", App: "p4v", CompletedLapse: 0.5})
+	}
+	for i := 0; i < 3; i++ {
+		p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "bill", App: "p4v", CompletedLapse: 0.5})
+	}
+	metrics := p4m.getCumulativeMetrics()
+	// Aggregates are exact
+	assert.Contains(t, metrics, "p4_cmd_counter{serverid=\"myserverid\",cmd=\"user-sync\",outcome=\"ok\"} 11\n")
+	assert.Contains(t, metrics, "p4_cmd_cumulative_seconds{serverid=\"myserverid\",cmd=\"user-sync\"} 5.500\n")
+	assert.Contains(t, metrics, "p4_unique_users{serverid=\"myserverid\"} 2\n")
+	// Every 4th cmd is sampled and scaled: cmds 4 and 8 (fred) but none of bill's 9-11
+	assert.Contains(t, metrics, "p4_cmd_user_counter{serverid=\"myserverid\",user=\"fred\"} 8\n")
+	assert.Contains(t, metrics, "p4_cmd_user_cumulative_seconds{serverid=\"myserverid\",user=\"fred\"} 4.000\n")
+	assert.NotContains(t, metrics, "p4_cmd_user_counter{serverid=\"myserverid\",user=\"bill\"}")
+	assert.Contains(t, metrics, "p4_cmd_user_detail_counter{serverid=\"myserverid\",user=\"fred\",cmd=\"user-sync\"} 8\n")
+	assert.Contains(t, metrics, "p4_cmd_user_detail_cumulative_seconds{serverid=\"myserverid\",user=\"fred\",cmd=\"user-sync\"} 4.000\n")
+	assert.Contains(t, metrics, "p4_cmd_program_counter{serverid=\"myserverid\",program=\"p4v\"} 8\n")
+	assert.Contains(t, metrics, "p4_cmd_program_cumulative_seconds{serverid=\"myserverid\",program=\"p4v\"} 4.000\n")
+
+	// One more completes bill's sample
+	p4m.publishEvent(p4dlog.Command{Cmd: "user-sync", User: "bill", App: "p4v", CompletedLapse: 0.5})
+	metrics = p4m.getCumulativeMetrics()
+	assert.Contains(t, metrics, "p4_cmd_user_counter{serverid=\"myserverid\",user=\"bill\"} 4\n")
+	assert.Contains(t, metrics, "p4_cmd_program_counter{serverid=\"myserverid\",program=\"p4v\"} 12\n")
+}
+
+func TestWriteEscaped(t *testing.T) {
+	for _, s := range []string{"", "abc", `\`, `c:\scripts\gen.py`, `\\x\`} {
+		var buf bytes.Buffer
+		writeEscaped(&buf, []byte(s))
+		assert.Equal(t, strings.ReplaceAll(s, `\`, `\\`), buf.String())
+	}
+}
+
+func BenchmarkPrintMetric(b *testing.B) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	fixedLabels := p4m.getFixedLabels()
+	labels := append(fixedLabels, labelStruct{"program", `c:\scripts\gen.py`})
+	metrics := p4m.newMetricsBuffer()
+	p4m.printMetricHeader(metrics, "p4_cmd_program_counter", "A count of completed p4 cmds (by program)", "gauge")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			metrics.bufs[0].Reset()
+		}
+		p4m.printMetric(metrics, "p4_cmd_program_counter", "gauge", labels, "12")
+	}
+}
+
+func TestTopN(t *testing.T) {
+	values := map[string]float64{"user-sync": 2.5, "user-files": 1, "user-fstat": 2.5, "user-changes": 1, "user-info": 0}
+	assert.Equal(t, []string{"user-fstat", "user-sync", "user-changes"}, topN(values, 3))
+	assert.Equal(t, []string{"user-fstat", "user-sync", "user-changes", "user-files"}, topN(values, 10))
+	assert.Equal(t, []string{}, topN(map[string]float64{}, 3))
+}
+
+func TestP4PromTopN(t *testing.T) {
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		TopN:           2}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	for _, c := range []struct {
+		cmd   string
+		lapse float32
+	}{{"user-sync", 1.5}, {"user-files", 0.5}, {"user-fstat", 1}, {"user-sync", 0.5}, {"user-changes", 2}} {
+		p4m.publishEvent(p4dlog.Command{Cmd: c.cmd, CompletedLapse: c.lapse})
+	}
+	topn := []string{}
+	for _, l := range strings.Split(p4m.getCumulativeMetrics(), "\n") {
+		if strings.HasPrefix(l, "p4_cmd_topn_seconds") {
+			topn = append(topn, l)
+		}
+	}
+	// Tie between user-changes and user-sync is ordered by name
+	assert.Equal(t, []string{
+		`p4_cmd_topn_seconds{serverid="myserverid",cmd="user-changes",rank="1"} 2.000`,
+		`p4_cmd_topn_seconds{serverid="myserverid",cmd="user-sync",rank="2"} 2.000`}, topn)
 }
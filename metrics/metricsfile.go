@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Permissions of metrics files so that node_exporter (or similar) can read them
+const metricsFileMode = 0644
+
+// WriteMetricsFile - replaces filename with the metrics, e.g. for the node_exporter textfile collector.
+// Metrics are written to a temp file in the same directory which is then renamed over the target.
+// Rename is atomic on the same filesystem, so a scraper sees either the old or the new contents,
+// never a partially written file.
+// If filename ends with .gz the metrics are gzip compressed, e.g. for archiving large historical
+// dumps - node_exporter doesn't read compressed files.
+func WriteMetricsFile(filename string, metrics string) error {
+	data := []byte(metrics)
+	if strings.HasSuffix(filename, ".gz") {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	return writeFileAtomic(filename, data, metricsFileMode)
+}
+
+func writeFileAtomic(filename string, data []byte, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	// CreateTemp uses 0600
+	if err = os.Chmod(tmpName, mode); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err = os.Rename(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteMetricsFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "p4.prom")
+	assert.NoError(t, os.WriteFile(filename, []byte("p4_old_metric 1\np4_old_metric2 2\n"), 0600))
+
+	assert.NoError(t, WriteMetricsFile(filename, "p4_cmd_counter{cmd=\"user-sync\",outcome=\"ok\"} 1\n"))
+	buf, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "p4_cmd_counter{cmd=\"user-sync\",outcome=\"ok\"} 1\n", string(buf))
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(metricsFileMode), info.Mode().Perm())
+
+	// No temp files left behind
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	// Directory doesn't exist - target not created
+	missing := filepath.Join(dir, "missing", "p4.prom")
+	assert.Error(t, WriteMetricsFile(missing, "p4_test 1\n"))
+	_, err = os.Stat(missing)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWriteMetricsFileGzip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "p4.prom.gz")
+	metrics := "p4_cmd_counter{cmd=\"user-sync\",outcome=\"ok\"} 1\n"
+	assert.NoError(t, WriteMetricsFile(filename, metrics))
+	assert.NoError(t, WriteMetricsFile(filename, metrics+"p4_prom_log_lines_read 10\n"))
+
+	f, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	buf, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, metrics+"p4_prom_log_lines_read 10\n", string(buf))
+}
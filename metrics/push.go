@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Defaults for pushing to a Prometheus Pushgateway
+const (
+	defaultPushJobName = "p4dlog"
+	pushAttempts       = 3
+	pushTimeout        = 30 * time.Second
+)
+
+// Returns the Pushgateway URL for our job, with serverid/sdpinst as grouping labels, e.g.
+// http://localhost:9091/metrics/job/p4dlog/serverid/myserverid
+func (p4m *P4DMetrics) pushURL() string {
+	job := p4m.config.JobName
+	if job == "" {
+		job = defaultPushJobName
+	}
+	u := fmt.Sprintf("%s/metrics/job/%s", strings.TrimSuffix(p4m.config.PushgatewayURL, "/"), url.PathEscape(job))
+	if p4m.config.ServerID != "" {
+		u += "/serverid/" + url.PathEscape(p4m.config.ServerID)
+	}
+	if p4m.config.SDPInstance != "" {
+		u += "/sdpinst/" + url.PathEscape(p4m.config.SDPInstance)
+	}
+	return u
+}
+
+// pushMetrics replaces the metrics for our grouping key on the Pushgateway (HTTP PUT), retrying on failure
+func (p4m *P4DMetrics) pushMetrics(metrics string) error {
+	u := p4m.pushURL()
+	client := &http.Client{Timeout: pushTimeout}
+	var err error
+	for attempt := 1; attempt <= pushAttempts; attempt++ {
+		if attempt > 1 {
+			p4m.logger.Warnf("Retrying push to %s: %v", u, err)
+			time.Sleep(p4m.pushRetryDelay * time.Duration(attempt-1))
+		}
+		if err = p4m.pushOnce(client, u, metrics); err == nil {
+			p4m.logger.Infof("Pushed metrics to %s", u)
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to push metrics to %s after %d attempts: %v", u, pushAttempts, err)
+}
+
+func (p4m *P4DMetrics) pushOnce(client *http.Client, u string, metrics string) error {
+	req, err := http.NewRequest(http.MethodPut, u, strings.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
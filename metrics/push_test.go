@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type pushRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+// Pushgateway which fails the first failCount requests
+func newTestPushgateway(failCount int) (*httptest.Server, *[]pushRequest, *sync.Mutex) {
+	var m sync.Mutex
+	requests := make([]pushRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		m.Lock()
+		defer m.Unlock()
+		requests = append(requests, pushRequest{r.Method, r.URL.Path, string(body)})
+		if len(requests) <= failCount {
+			http.Error(w, "pushgateway unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return server, &requests, &m
+}
+
+func TestPushAtEndOfInput(t *testing.T) {
+	server, requests, m := newTestPushgateway(0)
+	defer server.Close()
+
+	cfg := &Config{
+		ServerID:       "myserverid",
+		SDPInstance:    "1",
+		UpdateInterval: 10 * time.Millisecond,
+		PushgatewayURL: server.URL + "/",
+		JobName:        "log analysis"}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	oneOutputTest(t, cfg, input, false)
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, 1, len(*requests))
+	req := (*requests)[0]
+	assert.Equal(t, http.MethodPut, req.method)
+	assert.Equal(t, "/metrics/job/log analysis/serverid/myserverid/sdpinst/1", req.path)
+	assert.Contains(t, req.body, `p4_cmd_counter{serverid="myserverid",sdpinst="1",cmd="user-sync",outcome="ok"} 1`)
+}
+
+func TestPushAtEndOfHistoricalInput(t *testing.T) {
+	server, requests, m := newTestPushgateway(0)
+	defer server.Close()
+
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		PushgatewayURL: server.URL}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	output := oneOutputTest(t, cfg, input, true)
+	// Graphite is still the primary format, but the Pushgateway only accepts Prometheus format
+	assert.Contains(t, output, `p4_cmd_counter;serverid=myserverid;cmd=user-sync;outcome=ok 1 1441207389`)
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, 1, len(*requests))
+	req := (*requests)[0]
+	assert.Equal(t, "/metrics/job/p4dlog/serverid/myserverid", req.path)
+	assert.Contains(t, req.body, `p4_cmd_counter{serverid="myserverid",cmd="user-sync",outcome="ok"} 1`+"\n")
+	assert.NotContains(t, req.body, "1441207389")
+}
+
+func TestPushRetries(t *testing.T) {
+	cfg := &Config{ServerID: "myserverid", UpdateInterval: time.Second}
+
+	server, requests, m := newTestPushgateway(2)
+	defer server.Close()
+	cfg.PushgatewayURL = server.URL
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	p4m.pushRetryDelay = time.Millisecond
+	err := p4m.pushMetrics("p4_test 1\n")
+	assert.NoError(t, err)
+	m.Lock()
+	assert.Equal(t, 3, len(*requests))
+	assert.Equal(t, "/metrics/job/p4dlog/serverid/myserverid", (*requests)[2].path)
+	m.Unlock()
+
+	failServer, _, _ := newTestPushgateway(10)
+	defer failServer.Close()
+	cfg.PushgatewayURL = failServer.URL
+	err = p4m.pushMetrics("p4_test 1\n")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "after 3 attempts")
+	assert.Contains(t, err.Error(), "503")
+	assert.Contains(t, err.Error(), "pushgateway unavailable")
+}
@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"sort"
+	"time"
+)
+
+// p2Quantile is a streaming estimator for a single quantile using the P² algorithm
+// (Jain & Chlamtac 1985). It uses constant memory regardless of the number of observations.
+type p2Quantile struct {
+	p   float64    // quantile to estimate, e.g. 0.99
+	n   int        // number of observations
+	q   [5]float64 // marker heights
+	pos [5]float64 // actual marker positions (1 based)
+	des [5]float64 // desired marker positions
+	inc [5]float64 // increments of desired positions per observation
+}
+
+func newP2Quantile(p float64) *p2Quantile {
+	return &p2Quantile{p: p, inc: [5]float64{0, p / 2, p, (1 + p) / 2, 1}}
+}
+
+func (e *p2Quantile) add(x float64) {
+	if e.n < 5 {
+		// Initialisation - the first 5 observations become the markers
+		e.q[e.n] = x
+		e.n++
+		if e.n == 5 {
+			sort.Float64s(e.q[:])
+			for i := range e.pos {
+				e.pos[i] = float64(i + 1)
+			}
+			e.des = [5]float64{1, 1 + 2*e.p, 1 + 4*e.p, 3 + 2*e.p, 5}
+		}
+		return
+	}
+	e.n++
+	// Find cell k such that q[k] <= x < q[k+1], adjusting extremes as necessary
+	var k int
+	if x < e.q[0] {
+		e.q[0] = x
+		k = 0
+	} else if x >= e.q[4] {
+		e.q[4] = x
+		k = 3
+	} else {
+		for k = 0; k < 3 && x >= e.q[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.des {
+		e.des[i] += e.inc[i]
+	}
+	// Adjust heights of the middle markers if they are off their desired positions
+	for i := 1; i <= 3; i++ {
+		d := e.des[i] - e.pos[i]
+		if (d >= 1 && e.pos[i+1]-e.pos[i] > 1) || (d <= -1 && e.pos[i-1]-e.pos[i] < -1) {
+			s := 1.0
+			if d < 0 {
+				s = -1.0
+			}
+			qp := e.parabolic(i, s)
+			if e.q[i-1] < qp && qp < e.q[i+1] {
+				e.q[i] = qp
+			} else {
+				e.q[i] = e.linear(i, s)
+			}
+			e.pos[i] += s
+		}
+	}
+}
+
+func (e *p2Quantile) parabolic(i int, d float64) float64 {
+	return e.q[i] + d/(e.pos[i+1]-e.pos[i-1])*
+		((e.pos[i]-e.pos[i-1]+d)*(e.q[i+1]-e.q[i])/(e.pos[i+1]-e.pos[i])+
+			(e.pos[i+1]-e.pos[i]-d)*(e.q[i]-e.q[i-1])/(e.pos[i]-e.pos[i-1]))
+}
+
+func (e *p2Quantile) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.q[i] + d*(e.q[j]-e.q[i])/(e.pos[j]-e.pos[i])
+}
+
+// value returns the current estimate - exact (nearest rank) for fewer than 5 observations
+func (e *p2Quantile) value() float64 {
+	if e.n == 0 {
+		return 0
+	}
+	if e.n < 5 {
+		vals := make([]float64, e.n)
+		copy(vals, e.q[:e.n])
+		sort.Float64s(vals)
+		return vals[int(e.p*float64(e.n-1)+0.5)]
+	}
+	return e.q[2]
+}
+
+// Number of staggered sets of estimators used for a sliding window. As for Prometheus client
+// summaries, estimates cover between (n-1)/n of the window and the whole window.
+const quantileAgeBuckets = 5
+
+// cmdSummary holds the quantile estimators and totals for a single cmd.
+// Without a window the estimators cover everything added, and the caller resets the summary.
+// With a window, quantileAgeBuckets sets of estimators are started window/quantileAgeBuckets apart:
+// every value is added to all of them, and estimates come from the oldest, which is restarted when
+// it covers the whole window. So a shift in latency is fully reflected within the window, while sum
+// and count are never reset.
+type cmdSummary struct {
+	ps      []float64
+	streams [][]*p2Quantile // Oldest first
+	window  time.Duration
+	rotated time.Time // When the newest set of estimators was started
+	sum     float64
+	count   int64
+}
+
+func newCmdSummary(quantiles []float64, window time.Duration) *cmdSummary {
+	s := &cmdSummary{ps: quantiles, window: window}
+	n := 1
+	if window > 0 {
+		n = quantileAgeBuckets
+	}
+	for i := 0; i < n; i++ {
+		s.streams = append(s.streams, s.newStream())
+	}
+	return s
+}
+
+func (s *cmdSummary) newStream() []*p2Quantile {
+	stream := make([]*p2Quantile, len(s.ps))
+	for i, q := range s.ps {
+		stream[i] = newP2Quantile(q)
+	}
+	return stream
+}
+
+// rotate restarts the oldest estimators for each window/quantileAgeBuckets elapsed at t, which is
+// in log time. Earlier times, e.g. cmds completing out of order, are ignored.
+func (s *cmdSummary) rotate(t time.Time) {
+	if s.window <= 0 || t.IsZero() {
+		return
+	}
+	if s.rotated.IsZero() {
+		s.rotated = t
+		return
+	}
+	step := s.window / quantileAgeBuckets
+	n := int64(t.Sub(s.rotated) / step)
+	if n <= 0 {
+		return
+	}
+	s.rotated = s.rotated.Add(time.Duration(n) * step)
+	if n > int64(len(s.streams)) {
+		n = int64(len(s.streams))
+	}
+	for i := int64(0); i < n; i++ {
+		s.streams = append(s.streams[1:], s.newStream())
+	}
+}
+
+// add records x observed at t
+func (s *cmdSummary) add(x float64, t time.Time) {
+	s.rotate(t)
+	for _, stream := range s.streams {
+		for _, q := range stream {
+			q.add(x)
+		}
+	}
+	s.sum += x
+	s.count++
+}
+
+// quantiles returns the estimators to output
+func (s *cmdSummary) quantiles() []*p2Quantile {
+	return s.streams[0]
+}
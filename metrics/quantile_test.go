@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestP2QuantileUniform(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	values := r.Perm(10000)
+	for _, p := range []float64{0.5, 0.9, 0.99} {
+		e := newP2Quantile(p)
+		for _, v := range values {
+			e.add(float64(v))
+		}
+		// Allow 1% of the range as error
+		assert.InDelta(t, p*10000, e.value(), 100, "quantile %v", p)
+	}
+}
+
+func TestP2QuantileExponential(t *testing.T) {
+	// Long tailed distribution typical of cmd durations
+	r := rand.New(rand.NewSource(7))
+	e := newP2Quantile(0.99)
+	for i := 0; i < 100000; i++ {
+		e.add(r.ExpFloat64())
+	}
+	expected := -math.Log(1 - 0.99)
+	assert.InDelta(t, expected, e.value(), expected*0.05)
+}
+
+func TestP2QuantileFewValues(t *testing.T) {
+	e := newP2Quantile(0.5)
+	assert.Equal(t, 0.0, e.value())
+	e.add(3)
+	assert.Equal(t, 3.0, e.value())
+	e.add(1)
+	e.add(2)
+	assert.Equal(t, 2.0, e.value())
+}
+
+func TestCmdSummaryWindow(t *testing.T) {
+	start := time.Date(2015, 9, 2, 15, 0, 0, 0, time.UTC)
+	s := newCmdSummary([]float64{0.5, 0.99}, 10*time.Minute)
+	// 0.1s cmds for 30 minutes, then 2s cmds
+	for i := 0; i < 1800; i++ {
+		s.add(0.1, start.Add(time.Duration(i)*time.Second))
+	}
+	shift := start.Add(30 * time.Minute)
+	for i := 0; i < 600; i++ {
+		s.add(2, shift.Add(time.Duration(i)*time.Second))
+	}
+	// 10 minutes after the shift the old regime has aged out
+	for _, q := range s.quantiles() {
+		assert.Equal(t, 2.0, q.value(), "quantile %v", q.p)
+	}
+	assert.Equal(t, int64(2400), s.count)
+	assert.InDelta(t, 1380.0, s.sum, 0.001)
+
+	// Mixed within the window, and reset once the cmds stop
+	s.add(0.1, shift.Add(15*time.Minute))
+	assert.Equal(t, 2.0, s.quantiles()[1].value())
+	s.rotate(shift.Add(time.Hour))
+	assert.Equal(t, 0.0, s.quantiles()[1].value())
+
+	// Without a window nothing ages out
+	s = newCmdSummary([]float64{0.5}, 0)
+	for i := 0; i < 1800; i++ {
+		s.add(0.1, start.Add(time.Duration(i)*time.Second))
+	}
+	for i := 0; i < 600; i++ {
+		s.add(2, shift.Add(time.Duration(i)*time.Second))
+	}
+	assert.Less(t, s.quantiles()[0].value(), 1.0)
+}
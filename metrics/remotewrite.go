@@ -0,0 +1,287 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults for sending metrics using the Prometheus remote write protocol
+const (
+	remoteWriteBufferSize = 100
+	remoteWriteBatchSize  = 2000 // Max series per request
+	remoteWriteAttempts   = 5
+	remoteWriteTimeout    = 30 * time.Second
+	remoteWriteRetryDelay = time.Second // Doubled for each retry
+)
+
+// RemoteWriteSender sends metrics to a Prometheus remote write endpoint, e.g. a cloud hosted Prometheus.
+// Each Send is converted to samples, batched into requests and sent by a background goroutine which
+// backs off and retries on 429 and 5xx responses. Other failures are not retried as the protocol
+// requires.
+type RemoteWriteSender struct {
+	url           string
+	authorization string
+	logger        *logrus.Logger
+	client        *http.Client
+	buf           chan []byte
+	wg            sync.WaitGroup
+	retryDelay    time.Duration
+	m             sync.Mutex
+	dropped       int64
+}
+
+// NewRemoteWriteSender - returns a sender for url, e.g. http://localhost:9090/api/v1/write, and starts
+// its writer goroutine. If set, authorization is sent as the Authorization header, e.g. "Bearer <token>".
+// Call Close when finished to flush any buffered metrics.
+func NewRemoteWriteSender(url, authorization string, logger *logrus.Logger) *RemoteWriteSender {
+	r := &RemoteWriteSender{
+		url:           url,
+		authorization: authorization,
+		logger:        logger,
+		client:        &http.Client{Timeout: remoteWriteTimeout},
+		buf:           make(chan []byte, remoteWriteBufferSize),
+		retryDelay:    remoteWriteRetryDelay,
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+// Send queues metrics in Prometheus text format for sending, with samples at timestamp - never blocks.
+// Metrics are split into requests of at most remoteWriteBatchSize series, and any which don't fit in
+// the buffer are dropped, as counted by Dropped and output as p4_prom_remote_write_dropped_total.
+func (r *RemoteWriteSender) Send(metrics string, timestamp time.Time) {
+	series := parsePrometheusText(metrics)
+	for len(series) > 0 {
+		n := len(series)
+		if n > remoteWriteBatchSize {
+			n = remoteWriteBatchSize
+		}
+		select {
+		case r.buf <- encodeWriteRequest(series[:n], timestamp):
+		default:
+			r.m.Lock()
+			r.dropped++
+			r.m.Unlock()
+			r.logger.Warnf("Remote write buffer full, dropping metrics for %s", r.url)
+		}
+		series = series[n:]
+	}
+}
+
+// Dropped returns the count of requests dropped due to a full buffer or send failures
+func (r *RemoteWriteSender) Dropped() int64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.dropped
+}
+
+// Close sends any buffered metrics
+func (r *RemoteWriteSender) Close() {
+	close(r.buf)
+	r.wg.Wait()
+}
+
+func (r *RemoteWriteSender) run() {
+	defer r.wg.Done()
+	for req := range r.buf {
+		if err := r.write(req); err != nil {
+			r.m.Lock()
+			r.dropped++
+			r.m.Unlock()
+			r.logger.Errorf("Failed to send metrics to remote write %s: %v", r.url, err)
+		}
+	}
+}
+
+// write sends a request, retrying with exponential backoff if the response says to
+func (r *RemoteWriteSender) write(req []byte) error {
+	var err error
+	delay := r.retryDelay
+	for attempt := 1; attempt <= remoteWriteAttempts; attempt++ {
+		if attempt > 1 {
+			r.logger.Warnf("Retrying send to remote write %s in %v: %v", r.url, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var retryAfter time.Duration
+		var retry bool
+		if retry, retryAfter, err = r.writeOnce(req); err == nil || !retry {
+			return err
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+	return fmt.Errorf("after %d attempts: %v", remoteWriteAttempts, err)
+}
+
+// writeOnce - returns whether a failure should be retried, and any delay requested by the server
+func (r *RemoteWriteSender) writeOnce(body []byte) (bool, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if r.authorization != "" {
+		req.Header.Set("Authorization", r.authorization)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, 0, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode/100 != 5 {
+		return false, 0, err
+	}
+	var retryAfter time.Duration
+	if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	return true, retryAfter, err
+}
+
+type rwLabel struct {
+	name  string
+	value string
+}
+
+type rwSeries struct {
+	labels []rwLabel // Including __name__, sorted by name
+	value  float64
+}
+
+// parsePrometheusText - series in metrics as written by printMetric, ignoring comments and unparseable lines
+func parsePrometheusText(metrics string) []rwSeries {
+	result := make([]rwSeries, 0)
+	for _, line := range strings.Split(metrics, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if s, ok := parseSeries(line); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// parseSeries parses a line such as: p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 1
+func parseSeries(line string) (rwSeries, bool) {
+	var s rwSeries
+	i := strings.IndexAny(line, "{ ")
+	if i <= 0 {
+		return s, false
+	}
+	s.labels = append(s.labels, rwLabel{"__name__", line[:i]})
+	rest := line[i:]
+	if rest[0] == '{' {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, ", ")
+			if rest == "" {
+				return s, false
+			}
+			if rest[0] == '}' {
+				rest = rest[1:]
+				break
+			}
+			eq := strings.Index(rest, "=\"")
+			if eq <= 0 {
+				return s, false
+			}
+			name := rest[:eq]
+			rest = rest[eq+2:]
+			var value strings.Builder
+			j := 0
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+					if rest[j] == 'n' {
+						value.WriteByte('\n')
+						continue
+					}
+				}
+				value.WriteByte(rest[j])
+			}
+			if j >= len(rest) {
+				return s, false
+			}
+			s.labels = append(s.labels, rwLabel{name, value.String()})
+			rest = rest[j+1:]
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, false
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, false
+	}
+	s.value = v
+	sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+	return s, true
+}
+
+// encodeWriteRequest - snappy compressed protobuf prometheus.WriteRequest for the series, hand encoded
+// to avoid depending on the generated protobuf code:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; } // timestamp in ms
+func encodeWriteRequest(series []rwSeries, timestamp time.Time) []byte {
+	var req, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = appendProtoBytes(msg, 1, []byte(l.name))
+			msg = appendProtoBytes(msg, 2, []byte(l.value))
+			ts = appendProtoBytes(ts, 1, msg)
+		}
+		msg = msg[:0]
+		msg = appendUvarint(msg, 1<<3|1) // fixed64
+		var value [8]byte
+		binary.LittleEndian.PutUint64(value[:], math.Float64bits(s.value))
+		msg = append(msg, value[:]...)
+		msg = appendUvarint(msg, 2<<3|0) // varint
+		msg = appendUvarint(msg, uint64(timestamp.UnixMilli()))
+		ts = appendProtoBytes(ts, 2, msg)
+		req = appendProtoBytes(req, 1, ts)
+	}
+	return snappy.Encode(nil, req)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendProtoBytes appends a length delimited field
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
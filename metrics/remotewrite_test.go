@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func snappyDecode(t *testing.T, src []byte) []byte {
+	dst, err := snappy.Decode(nil, src)
+	assert.NoError(t, err)
+	return dst
+}
+
+func TestParsePrometheusText(t *testing.T) {
+	series := parsePrometheusText(`# HELP p4_cmd_counter A count of completed p4 cmds (by cmd)
+# TYPE p4_cmd_counter gauge
+p4_cmd_counter{serverid="myserverid",cmd="user-sync"} 3
+p4_prom_log_lines_read 10
+p4_cmd_program_counter{program="c:\\scripts\\gen.py"} 1.5
+not a metric
+`)
+	assert.Equal(t, []rwSeries{
+		{labels: []rwLabel{{"__name__", "p4_cmd_counter"}, {"cmd", "user-sync"}, {"serverid", "myserverid"}}, value: 3},
+		{labels: []rwLabel{{"__name__", "p4_prom_log_lines_read"}}, value: 10},
+		{labels: []rwLabel{{"__name__", "p4_cmd_program_counter"}, {"program", `c:\scripts\gen.py`}}, value: 1.5},
+	}, series)
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	series := []rwSeries{{labels: []rwLabel{{"__name__", "up"}}, value: 1}}
+	req := snappyDecode(t, encodeWriteRequest(series, time.UnixMilli(1000)))
+	label := []byte{0x0a, 8, '_', '_', 'n', 'a', 'm', 'e', '_', '_', 0x12, 2, 'u', 'p'}
+	sample := []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0xe8, 0x07}
+	ts := append([]byte{0x0a, byte(len(label))}, label...)
+	ts = append(ts, 0x12, byte(len(sample)))
+	ts = append(ts, sample...)
+	assert.Equal(t, append([]byte{0x0a, byte(len(ts))}, ts...), req)
+}
+
+type remoteWriteRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// Remote write endpoint which responds with the given statuses in turn, then 204
+func newTestRemoteWrite(statuses ...int) (*httptest.Server, *[]remoteWriteRequest, *sync.Mutex) {
+	var m sync.Mutex
+	requests := make([]remoteWriteRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		m.Lock()
+		defer m.Unlock()
+		requests = append(requests, remoteWriteRequest{r.Header, body})
+		if len(requests) <= len(statuses) {
+			http.Error(w, "failed", statuses[len(requests)-1])
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return server, &requests, &m
+}
+
+func TestRemoteWriteSender(t *testing.T) {
+	server, requests, m := newTestRemoteWrite(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer server.Close()
+
+	r := NewRemoteWriteSender(server.URL, "Bearer secret", logger)
+	r.retryDelay = time.Millisecond
+	r.Send("# TYPE p4_cmd_counter gauge\np4_cmd_counter{cmd=\"user-sync\",outcome=\"ok\"} 1\n", time.Unix(1441207389, 0))
+	r.Close()
+	assert.Equal(t, int64(0), r.Dropped())
+	m.Lock()
+	assert.Equal(t, 3, len(*requests))
+	req := (*requests)[2]
+	assert.Equal(t, "snappy", req.header.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", req.header.Get("Content-Type"))
+	assert.Equal(t, "0.1.0", req.header.Get("X-Prometheus-Remote-Write-Version"))
+	assert.Equal(t, "Bearer secret", req.header.Get("Authorization"))
+	assert.Equal(t, snappyDecode(t, encodeWriteRequest(parsePrometheusText("p4_cmd_counter{cmd=\"user-sync\",outcome=\"ok\"} 1"),
+		time.Unix(1441207389, 0))), snappyDecode(t, req.body))
+	m.Unlock()
+
+	// Client errors aren't retried
+	badServer, badRequests, m := newTestRemoteWrite(http.StatusBadRequest)
+	defer badServer.Close()
+	r = NewRemoteWriteSender(badServer.URL, "", logger)
+	r.retryDelay = time.Millisecond
+	r.Send("p4_cmd_counter 1\n", time.Now())
+	r.Close()
+	assert.Equal(t, int64(1), r.Dropped())
+	m.Lock()
+	assert.Equal(t, 1, len(*badRequests))
+	assert.Equal(t, "", (*badRequests)[0].header.Get("Authorization"))
+	m.Unlock()
+}
+
+func TestRemoteWriteDroppedMetric(t *testing.T) {
+	server, _, _ := newTestRemoteWrite(http.StatusBadRequest)
+	defer server.Close()
+
+	cfg := &Config{ServerID: "myserverid"}
+	p4m := NewP4DMetricsLogParser(cfg, logger, false)
+	assert.NotContains(t, p4m.getCumulativeMetrics(), "p4_prom_remote_write_dropped_total")
+
+	p4m.remoteWrite = NewRemoteWriteSender(server.URL, "", logger)
+	p4m.remoteWrite.Send("p4_cmd_counter 1\n", time.Now())
+	p4m.remoteWrite.Close()
+	assert.Contains(t, p4m.getCumulativeMetrics(), `p4_prom_remote_write_dropped_total{serverid="myserverid"} 1`)
+}
+
+func TestRemoteWriteAtEndOfInput(t *testing.T) {
+	server, requests, m := newTestRemoteWrite()
+	defer server.Close()
+
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Millisecond,
+		RemoteWriteURL: server.URL}
+	input := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+`
+	basicTest(t, cfg, input, true)
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, 1, len(*requests))
+	metrics := "p4_cmd_counter{serverid=\"myserverid\",cmd=\"user-sync\",outcome=\"ok\"} 1"
+	assert.Contains(t, string(snappyDecode(t, (*requests)[0].body)),
+		string(encodeWriteRequestSeries(t, metrics, time.Date(2015, 9, 2, 15, 23, 9, 0, time.UTC))))
+}
+
+// The protobuf encoded TimeSeries for a single series
+func encodeWriteRequestSeries(t *testing.T, metrics string, timestamp time.Time) []byte {
+	req := snappyDecode(t, encodeWriteRequest(parsePrometheusText(metrics), timestamp))
+	_, n := binary.Uvarint(req[1:])
+	return req[1+n:]
+}
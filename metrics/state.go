@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// HistoricalState - how far historical processing of a log got, so that a later run against the same
+// (appended) log can resume rather than reprocess it, e.g. when catching up hourly.
+// Accumulated values are not saved so counts restart from zero in each run, as after a server restart.
+// Nor are pending cmds: those still running at the saved offset are output as incomplete at the end of
+// the run, and their completion records in the next run are orphaned, as for a cmd spanning log rotation.
+type HistoricalState struct {
+	Logfile            string    `json:"logfile"`
+	Offset             int64     `json:"offset"`             // Bytes of Logfile processed - set by the caller which reads the log
+	LatestStartCmdBuf  string    `json:"latestStartCmdBuf"`  // Log timestamp of the last metrics output, e.g. "\t2015/09/02 15:23:09"
+	TimeLatestStartCmd time.Time `json:"timeLatestStartCmd"` // Parsed LatestStartCmdBuf, or interval boundary if AlignToInterval
+}
+
+// ReadStateFile - returns the saved state, or an empty state if filename doesn't exist yet
+func ReadStateFile(filename string) (HistoricalState, error) {
+	var state HistoricalState
+	buf, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(buf, &state)
+	return state, err
+}
+
+// WriteStateFile - replaces filename with state
+func WriteStateFile(filename string, state HistoricalState) error {
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(buf, '\n'), 0644)
+}
+
+// HistoricalState - the interval alignment reached so far. Offset is left for the caller to set.
+func (p4m *P4DMetrics) HistoricalState() HistoricalState {
+	p4m.m.Lock()
+	defer p4m.m.Unlock()
+	return HistoricalState{
+		LatestStartCmdBuf:  p4m.latestStartCmdBuf,
+		TimeLatestStartCmd: p4m.timeLatestStartCmd,
+	}
+}
+
+// SetHistoricalState - continues interval alignment from a previous run. Call before ProcessEvents.
+func (p4m *P4DMetrics) SetHistoricalState(state HistoricalState) {
+	p4m.m.Lock()
+	defer p4m.m.Unlock()
+	if state.LatestStartCmdBuf == "" {
+		return
+	}
+	p4m.latestStartCmdBuf = state.LatestStartCmdBuf
+	p4m.timeLatestStartCmd = state.TimeLatestStartCmd
+	p4m.timeLastFlush = state.TimeLatestStartCmd
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "log2sql.state")
+	state, err := ReadStateFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, HistoricalState{}, state)
+
+	cfg := &Config{
+		ServerID:       "myserverid",
+		UpdateInterval: 10 * time.Second}
+	p4m := NewP4DMetricsLogParser(cfg, logger, true)
+	updateRequired(p4m, "\t2015/09/02 15:23:00 pid 1616 robert@robert-test")
+	assert.True(t, updateRequired(p4m, "\t2015/09/02 15:23:10 pid 1617 robert@robert-test"))
+	state = p4m.HistoricalState()
+	state.Logfile = "log"
+	state.Offset = 1234
+	assert.NoError(t, WriteStateFile(filename, state))
+
+	saved, err := ReadStateFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "log", saved.Logfile)
+	assert.Equal(t, int64(1234), saved.Offset)
+	assert.Equal(t, "\t2015/09/02 15:23:10", saved.LatestStartCmdBuf)
+	assert.True(t, state.TimeLatestStartCmd.Equal(saved.TimeLatestStartCmd))
+
+	// Resumed run continues the same intervals rather than starting again from its first line
+	p4m = NewP4DMetricsLogParser(cfg, logger, true)
+	p4m.SetHistoricalState(saved)
+	assert.False(t, updateRequired(p4m, "\t2015/09/02 15:23:15 pid 1618 robert@robert-test"))
+	assert.True(t, updateRequired(p4m, "\t2015/09/02 15:23:20 pid 1619 robert@robert-test"))
+}
@@ -25,12 +25,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/sirupsen/logrus"
 )
 
 // GO standard reference value/format: Mon Jan 2 15:04:05 -0700 MST 2006
+// When parsing, time.Parse also accepts fractional seconds as logged by some p4d builds, e.g. 12:13:14.123
 const p4timeformat = "2006/01/02 15:04:05"
 
 // This defines the maximum number of running commands we allow
@@ -60,12 +63,13 @@ func FlagSet(flag int, level DebugLevel) bool {
 	return flag&int(level) > 0
 }
 
-var reCmd = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] \'([\w-]+) (.*)\'.*`)
-var reCmdNoarg = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] \'([\w-]+)\'.*`)
-var reCmdMultiLineDesc = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] \'([\w-]+)([^\']*)`)
-var reCompute = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) compute end ([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s.*`)
-var reCompleted = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d) pid (\d+) completed ([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s.*`)
+var reCmd = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d(?:\.\d+)?) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] \'([\w-]+) (.*)\'.*`)
+var reCmdNoarg = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d(?:\.\d+)?) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] \'([\w-]+)\'.*`)
+var reCmdMultiLineDesc = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d(?:\.\d+)?) pid (\d+) ([^ @]*)@([^ ]*) ([^ ]*) \[(.*?)\] \'([\w-]+)([^\']*)`)
+var reCompute = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d(?:\.\d+)?) pid (\d+) compute end ([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s.*`)
+var reCompleted = regexp.MustCompile(`^\t(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d(?:\.\d+)?) pid (\d+) completed ([0-9]+|[0-9]+\.[0-9]+|\.[0-9]+)s.*`)
 var reJSONCmdargs = regexp.MustCompile(`^(.*) \{.*\}$`)
+var reArgsChangelist = regexp.MustCompile(`(?:^| )-c (\d+)(?: |$)`)
 
 var infoBlock = "Perforce server info:"
 
@@ -83,6 +87,7 @@ const (
 	infoType
 	errorType
 	activeThreadsType
+	serverStartType
 )
 
 // Block is a block of lines parsed from a file
@@ -105,6 +110,9 @@ func (block *Block) addLine(line string, lineNo int64) {
 		} else if strings.HasSuffix(line, msgActiveThreads) {
 			block.btype = activeThreadsType
 			block.lines = append(block.lines, line)
+		} else if strings.HasPrefix(line, msgServerStarting) {
+			block.btype = serverStartType
+			block.lines = append(block.lines, line)
 		} else {
 			block.btype = errorType
 		}
@@ -126,8 +134,14 @@ type Command struct {
 	ComputeLapse            float32   `json:"computeLapse"`
 	CompletedLapse          float32   `json:"completedLapse"`
 	IP                      string    `json:"ip"`
+	Forwarded               bool      `json:"forwarded"` // Forwarded by a replica/edge server, which is included in IP
 	App                     string    `json:"app"`
+	ClientAPILevel          int64     `json:"clientApiLevel"` // Client protocol level, e.g. 90 from the /v90 suffix of App - 0 if not logged. p4d doesn't log the server level
 	Args                    string    `json:"args"`
+	ArgsLen                 int       `json:"argsLen"`    // Length of args as logged, before any stripping
+	Truncated               bool      `json:"truncated"`  // Args truncated in log, or no completion record seen
+	Incomplete              bool      `json:"incomplete"` // No completion record seen, e.g. cmd pending at end of log - values are partial
+	Changelist              int64     `json:"changelist"` // From -c in args or change lock in track info, e.g. dm-CommitSubmit - 0 if none
 	Running                 int64     `json:"running"`
 	UCpu                    int64     `json:"uCpu"`
 	SCpu                    int64     `json:"sCpu"`
@@ -150,7 +164,9 @@ type Command struct {
 	NetFilesDeleted         int64     `json:"netFilesDeleted"`
 	NetBytesAdded           int64     `json:"netBytesAdded"`
 	NetBytesUpdated         int64     `json:"netBytesUpdated"`
-	LbrRcsOpens             int64     `json:"lbrRcsOpens"` // Required for processing lbr records
+	IntegFiles              int64     `json:"integFiles"`   // Valid for integrate/copy/merge/populate - from db.resolve/db.integed tracking
+	ResolveFiles            int64     `json:"resolveFiles"` // Valid for resolve - from db.resolve tracking
+	LbrRcsOpens             int64     `json:"lbrRcsOpens"`  // Required for processing lbr records
 	LbrRcsCloses            int64     `json:"lbrRcsCloses"`
 	LbrRcsCheckins          int64     `json:"lbrRcsCheckins"`
 	LbrRcsExists            int64     `json:"lbrRcsExists"`
@@ -175,6 +191,9 @@ type Command struct {
 	LbrUncompressWrites     int64     `json:"lbrUncompressWrites"`
 	LbrUncompressWriteBytes int64     `json:"lbrUncompressWriteBytes"`
 	CmdError                bool      `json:"cmderror"`
+	ErrorSeverity           string    `json:"errorSeverity"` // Set if CmdError, e.g. warning/failed
+	ErrorSubsys             string    `json:"errorSubsys"`   // Set if CmdError and error type recognised, e.g. governor
+	GovernorLimit           string    `json:"governorLimit"` // Set if ErrorSubsys is governor, e.g. maxscanrows
 	Tables                  map[string]*Table
 	duplicateKey            bool
 	completed               bool
@@ -211,6 +230,7 @@ type Table struct {
 	MaxPeekWait        int64   `json:"maxPeekWait"`
 	MaxPeekHeld        int64   `json:"maxPeekHeld"`
 	TriggerLapse       float32 `json:"triggerLapse"`
+	TriggerExitStatus  int64   `json:"triggerExitStatus,omitempty"` // Nonzero if the trigger failed
 }
 
 func (t *Table) setPages(pagesIn, pagesOut, pagesCached string) {
@@ -282,6 +302,71 @@ func (c *Command) String() string {
 	return string(j)
 }
 
+// Components of app strings, e.g. p4/2016.2/LINUX26X86_64/1598668 or P4V/NTX64/2023.1/2442900/v90
+var reAppVersion = regexp.MustCompile(`^\d+(?:\.\d+)+[\w.-]*$`)
+var reAppPlatform = regexp.MustCompile(`(?i)^(?:nt|linux|macosx|darwin|freebsd|solaris|sol|aix|hpux|cygwin|windows|win|mac)[a-z0-9_]*$`)
+
+// AppComponents - splits App into program name, platform and version, e.g.
+// "P4V/NTX64/2023.1/2442900" -> "P4V", "NTX64", "2023.1" and "p4/2016.2/LINUX26X86_64/1598668" -> "p4", "LINUX26X86_64", "2016.2".
+// Parts which can't be identified are empty, e.g. API based scripts such as "gen.py [PY3.7/P4PY2020.1/API2020.1/2051818]"
+// only have a name. Build numbers and protocol levels (v90) are ignored.
+func (c *Command) AppComponents() (name, platform, version string) {
+	app := strings.TrimSpace(strings.ReplaceAll(c.App, " (brokered)", ""))
+	if i := strings.Index(app, "["); i >= 0 {
+		return strings.TrimSpace(app[:i]), "", ""
+	}
+	parts := strings.Split(app, "/")
+	name = strings.TrimSpace(parts[0])
+	for _, p := range parts[1:] {
+		if version == "" && reAppVersion.MatchString(p) {
+			version = p
+		} else if platform == "" && reAppPlatform.MatchString(p) {
+			platform = p
+		}
+	}
+	return name, platform, version
+}
+
+// ReplicaIP - splits IP into the forwarding replica/edge server and client IP, e.g. "10.1.2.3/10.5.6.7"
+// -> "10.1.2.3", "10.5.6.7". Replica is empty for direct commands.
+func (c *Command) ReplicaIP() (replica, ip string) {
+	return splitReplicaIP(c.IP)
+}
+
+// LockTotals - the total wait for and time holding read and write locks in ms, summed over all tables
+func (c *Command) LockTotals() (wait, held int64) {
+	for _, t := range c.Tables {
+		wait += t.TotalReadWait + t.TotalWriteWait
+		held += t.TotalReadHeld + t.TotalWriteHeld
+	}
+	return wait, held
+}
+
+// Only the first slash separates the replica - IPv6 addresses contain colons but never slashes
+func splitReplicaIP(addr string) (replica, ip string) {
+	if j := strings.Index(addr, "/"); j > 0 {
+		return addr[:j], addr[j+1:]
+	}
+	return "", addr
+}
+
+func (c *Command) setIP(ip string) {
+	c.IP = ip
+	replica, _ := splitReplicaIP(ip)
+	c.Forwarded = replica != ""
+}
+
+// Protocol level suffix of app strings, e.g. P4V/NTX64/2023.1/2442900/v90 or [unnamed p4-python script/v81]
+var reAppAPILevel = regexp.MustCompile(`/v(\d+)(?: \(brokered\))?$`)
+
+func (c *Command) setApp(app string) {
+	c.App = app
+	c.ClientAPILevel = 0
+	if m := reAppAPILevel.FindStringSubmatch(app); len(m) > 0 {
+		c.ClientAPILevel = toInt64(m[1])
+	}
+}
+
 func (c *Command) setStartTime(t string) {
 	c.StartTime, _ = time.Parse(p4timeformat, t)
 }
@@ -334,6 +419,28 @@ func (c *Command) setNetworkEstimates(netFilesAdded, netFilesUpdated, netFilesDe
 
 }
 
+// setIntegResolveFiles - there are no specific track records for integration, so the number of files
+// is derived from table tracking. Integrate/copy/merge write a db.resolve record per file scheduled,
+// populate writes db.integed records directly (one for each direction), and resolve updates
+// the db.resolve record of each file resolved.
+func (c *Command) setIntegResolveFiles() {
+	var resolvePuts, integedPuts int64
+	if t, ok := c.Tables["resolve"]; ok {
+		resolvePuts = t.PutRows
+	}
+	if t, ok := c.Tables["integed"]; ok {
+		integedPuts = t.PutRows
+	}
+	switch c.Cmd {
+	case "user-integrate", "user-integ", "user-copy", "user-merge":
+		c.IntegFiles = resolvePuts
+	case "user-populate":
+		c.IntegFiles = integedPuts / 2
+	case "user-resolve":
+		c.ResolveFiles = resolvePuts
+	}
+}
+
 func (c *Command) setRPC(rpcMsgsIn, rpcMsgsOut, rpcSizeIn, rpcSizeOut, rpcHimarkFwd, rpcHimarkRev, rpcSnd, rpcRcv string) {
 	c.RPCMsgsIn, _ = strconv.ParseInt(rpcMsgsIn, 10, 64)
 	c.RPCMsgsOut, _ = strconv.ParseInt(rpcMsgsOut, 10, 64)
@@ -461,8 +568,11 @@ func (c *Command) MarshalJSON() ([]byte, error) {
 		ComputeLapse            float32 `json:"computeLapse"`
 		CompletedLapse          float32 `json:"completedLapse"`
 		IP                      string  `json:"ip"`
+		Forwarded               bool    `json:"forwarded,omitempty"`
 		App                     string  `json:"app"`
+		ClientAPILevel          int64   `json:"clientApiLevel,omitempty"`
 		Args                    string  `json:"args"`
+		Changelist              int64   `json:"changelist,omitempty"`
 		StartTime               string  `json:"startTime"`
 		EndTime                 string  `json:"endTime"`
 		Running                 int64   `json:"running"`
@@ -487,6 +597,8 @@ func (c *Command) MarshalJSON() ([]byte, error) {
 		NetFilesDeleted         int64   `json:"netFilesDeleted"`
 		NetBytesAdded           int64   `json:"netBytesAdded"`
 		NetBytesUpdated         int64   `json:"netBytesUpdated"`
+		IntegFiles              int64   `json:"integFiles,omitempty"`
+		ResolveFiles            int64   `json:"resolveFiles,omitempty"`
 		LbrRcsOpens             int64   `json:"lbrRcsOpens"`
 		LbrRcsCloses            int64   `json:"lbrRcsCloses"`
 		LbrRcsCheckins          int64   `json:"lbrRcsCheckins"`
@@ -512,6 +624,11 @@ func (c *Command) MarshalJSON() ([]byte, error) {
 		LbrUncompressWrites     int64   `json:"lbrUncompressWrites"`
 		LbrUncompressWriteBytes int64   `json:"lbrUncompressWriteBytes"`
 		CmdError                bool    `json:"cmdError"`
+		Truncated               bool    `json:"truncated,omitempty"`
+		Incomplete              bool    `json:"incomplete,omitempty"`
+		ErrorSeverity           string  `json:"errorSeverity,omitempty"`
+		ErrorSubsys             string  `json:"errorSubsys,omitempty"`
+		GovernorLimit           string  `json:"governorLimit,omitempty"`
 		Tables                  []Table `json:"tables"`
 	}{
 		ProcessKey:              c.GetKey(),
@@ -523,8 +640,11 @@ func (c *Command) MarshalJSON() ([]byte, error) {
 		ComputeLapse:            c.ComputeLapse,
 		CompletedLapse:          c.CompletedLapse,
 		IP:                      c.IP,
+		Forwarded:               c.Forwarded,
 		App:                     c.App,
+		ClientAPILevel:          c.ClientAPILevel,
 		Args:                    c.Args,
+		Changelist:              c.Changelist,
 		StartTime:               c.StartTime.Format(p4timeformat),
 		EndTime:                 c.EndTime.Format(p4timeformat),
 		Running:                 c.Running,
@@ -549,6 +669,8 @@ func (c *Command) MarshalJSON() ([]byte, error) {
 		NetFilesDeleted:         c.NetFilesDeleted,
 		NetBytesAdded:           c.NetBytesAdded,
 		NetBytesUpdated:         c.NetBytesUpdated,
+		IntegFiles:              c.IntegFiles,
+		ResolveFiles:            c.ResolveFiles,
 		LbrRcsOpens:             c.LbrRcsOpens,
 		LbrRcsCloses:            c.LbrRcsCloses,
 		LbrRcsCheckins:          c.LbrRcsCheckins,
@@ -574,12 +696,29 @@ func (c *Command) MarshalJSON() ([]byte, error) {
 		LbrUncompressWrites:     c.LbrUncompressWrites,
 		LbrUncompressWriteBytes: c.LbrUncompressWriteBytes,
 		CmdError:                c.CmdError,
+		Truncated:               c.Truncated,
+		Incomplete:              c.Incomplete,
+		ErrorSeverity:           c.ErrorSeverity,
+		ErrorSubsys:             c.ErrorSubsys,
+		GovernorLimit:           c.GovernorLimit,
 		Tables:                  tables,
 	})
 }
 
 var blankTime time.Time
 
+// setArgs sets args, recording their length and whether they were truncated in the log
+func (c *Command) setArgs(args string) {
+	c.Args = args
+	c.ArgsLen = len(args)
+	if strings.HasSuffix(args, argsTruncatedMarker) {
+		c.Truncated = true
+	}
+	if m := reArgsChangelist.FindStringSubmatch(args); len(m) > 0 {
+		c.Changelist = toInt64(m[1])
+	}
+}
+
 func (c *Command) updateFrom(other *Command) {
 	// The first two fields are unusual but occur when we get a completed record with no start record
 	// and then get a record with track info.
@@ -600,12 +739,22 @@ func (c *Command) updateFrom(other *Command) {
 	}
 	if c.Args == "" {
 		c.Args = other.Args
+		c.ArgsLen = other.ArgsLen
+	}
+	if other.Truncated {
+		c.Truncated = true
+	}
+	if other.Incomplete {
+		c.Incomplete = true
+	}
+	if c.Changelist == 0 {
+		c.Changelist = other.Changelist
 	}
 	if c.IP == "" {
-		c.IP = other.IP
+		c.setIP(other.IP)
 	}
 	if c.App == "" {
-		c.App = other.App
+		c.setApp(other.App)
 	}
 	if c.EndTime == blankTime {
 		c.EndTime = other.EndTime
@@ -686,6 +835,12 @@ func (c *Command) updateFrom(other *Command) {
 	if other.NetBytesUpdated > 0 {
 		c.NetBytesUpdated = other.NetBytesUpdated
 	}
+	if other.IntegFiles > 0 {
+		c.IntegFiles = other.IntegFiles
+	}
+	if other.ResolveFiles > 0 {
+		c.ResolveFiles = other.ResolveFiles
+	}
 	if len(other.Tables) > 0 {
 		for k, t := range other.Tables {
 			c.Tables[k] = t
@@ -775,6 +930,7 @@ type P4dFileParser struct {
 	cmds                 map[int64]*Command
 	CmdsProcessed        int
 	cmdChan              chan Command
+	cmdChanSize          int // Buffer size of cmdChan
 	timeChan             chan time.Time
 	linesChan            *<-chan string
 	blockChan            chan *Block
@@ -786,11 +942,45 @@ type P4dFileParser struct {
 	running              int64
 	runningPids          map[int64]int64 // Maps pids to line nos
 	hadServerThreadsMsg  bool
+	serverRestarts       int64
+	lastServerRestart    time.Time
 	debugPID             int64 // Set if in debug mode for a conflict
 	debugCmd             string
 	outputCmdsContinued  int64
 	outputCmdsExited     int64
 	lastSyncPID          int64
+	maxLineLength        int   // Lines longer than this are truncated - 0 means no limit
+	linesTruncated       int64 // Accessed atomically
+	linesBad             int64 // Accessed atomically
+	ctx                  context.Context
+	cmdFilter            func(*Command) bool
+	redactCmds           map[string]bool
+	linePrefix           *regexp.Regexp // Removed from the start of lines if set - see SetLinePrefixRegex
+	triggerPrefix        string
+	pendingTimeout       time.Duration
+	maxPending           int        // If > 0 pending cmds are capped at this - see SetMaxPending
+	blockPending         bool       // Set if cmds over maxPending hold up parsing rather than being shed
+	pendingOrder         []*Command // Cmds in the order they became pending if maxPending is set, including some since output
+	cmdsShed             int64      // Accessed atomically
+	cmdsOrphaned         int64      // Accessed atomically
+	linesRead            int64      // Accessed atomically
+	blankLines           int64      // Accessed atomically
+	unrecognisedLines    int64
+	unrecognisedPrefixes map[string]int64
+	currBlock            *Block    // Block being built from lines
+	syncMode             bool      // Set by ParseLine/Flush - cmds are returned rather than sent on cmdChan
+	syncCmds             []Command // Cmds output by the current ParseLine/Flush call
+	err                  error     // First invalid configuration - see Err
+}
+
+// ParseStats - summary of how much of a log the parser understood, see P4dFileParser.ParseStats
+type ParseStats struct {
+	Lines                int64            `json:"lines"`
+	BlankLines           int64            `json:"blankLines"`
+	MatchedLines         int64            `json:"matchedLines"` // Non blank lines which were recognised
+	UnrecognisedLines    int64            `json:"unrecognisedLines"`
+	CmdsParsed           int64            `json:"cmdsParsed"`
+	UnrecognisedPrefixes map[string]int64 `json:"unrecognisedPrefixes"` // First token of unrecognised lines (ignoring date/pid)
 }
 
 // NewP4dFileParser - create and initialise properly
@@ -799,19 +989,41 @@ func NewP4dFileParser(logger *logrus.Logger) *P4dFileParser {
 	fp.cmds = make(map[int64]*Command)
 	fp.pidsSeenThisSecond = make(map[int64]bool)
 	fp.runningPids = make(map[int64]int64)
+	fp.unrecognisedPrefixes = make(map[string]int64)
+	fp.currBlock = new(Block)
 	fp.logger = logger
 	fp.outputDuration = time.Second * 1
 	fp.debugDuration = time.Second * 30
+	fp.cmdChanSize = 10000
+	fp.ctx = context.Background()
+	fp.SetRedactCommands(DefaultRedactCommands)
+	fp.triggerPrefix = DefaultTriggerPrefix
 	return &fp
 }
 
+// Err - the first invalid configuration passed to a Set method, e.g. SetDebugPID with a pid but no cmd, or nil.
+// LogParser doesn't start parsing if this is set - its channel is closed immediately - so callers should
+// check it after configuring the parser.
+func (fp *P4dFileParser) Err() error {
+	return fp.err
+}
+
+func (fp *P4dFileParser) setErr(err error) {
+	if fp.err == nil {
+		fp.err = err
+	}
+}
+
 // SetDebugMode - turn on debugging - very verbose!
 func (fp *P4dFileParser) SetDebugMode(level int) {
 	fp.debug = level
 }
 
-// SetDebugPID - turn on debugging for a PID
+// SetDebugPID - turn on debugging for a PID. Both pid and cmdName must be given, or neither to turn it off.
 func (fp *P4dFileParser) SetDebugPID(pid int64, cmdName string) {
+	if pid < 0 || (pid == 0) != (cmdName == "") {
+		fp.setErr(fmt.Errorf("invalid debug pid %d and cmd %q - both must be set", pid, cmdName))
+	}
 	fp.debugPID = pid
 	fp.debugCmd = cmdName
 }
@@ -820,8 +1032,176 @@ func (fp *P4dFileParser) debugLog(cmd *Command) bool {
 	return cmd.Pid == fp.debugPID && cmd.Cmd == fp.debugCmd
 }
 
-// SetDurations - for debugging
+// SetPendingTimeout - cmds without a completion record which started more than timeout before the
+// latest cmd in the log are output (marked as Truncated) rather than being held indefinitely.
+// This bounds memory when logs are missing completion records. Default 0 means no timeout.
+func (fp *P4dFileParser) SetPendingTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		fp.setErr(fmt.Errorf("invalid pending timeout %v", timeout))
+	}
+	fp.pendingTimeout = timeout
+}
+
+// SetMaxPending - caps the cmds pending (awaiting completion or track records) at max, to bound memory
+// under a burst of cmds. Default 0 means no limit.
+// If block is set, once max cmds are pending no further lines are parsed until completed ones, oldest first,
+// have been output - which waits while the reader of the output channel is behind. They are output without
+// waiting for any following track records. Cmds still running need later lines to complete, so parsing
+// carries on if none of the pending cmds have completed.
+// Otherwise once more than max are pending the oldest are shed: output straight away, marked Incomplete if
+// their completion record hasn't been seen (and so counted by the incomplete metrics).
+func (fp *P4dFileParser) SetMaxPending(max int, block bool) {
+	if max < 0 {
+		fp.setErr(fmt.Errorf("invalid max pending %d", max))
+	}
+	fp.maxPending = max
+	fp.blockPending = block
+}
+
+// CmdsShed - count of pending cmds output early due to SetMaxPending without block set
+func (fp *P4dFileParser) CmdsShed() int64 {
+	return atomic.LoadInt64(&fp.cmdsShed)
+}
+
+// CmdsOrphaned - count of cmds split across the start or end of the input, e.g. by log rotation:
+// completion records whose start wasn't seen, and cmds with no completion record at end of input.
+// Logs should be parsed in order by a single parser so that cmds spanning them are matched.
+func (fp *P4dFileParser) CmdsOrphaned() int64 {
+	return atomic.LoadInt64(&fp.cmdsOrphaned)
+}
+
+// SetCommandFilter - commands for which filter returns false are not output on the LogParser channel,
+// e.g. to ignore internal commands before doing expensive processing. The filter is called
+// once per command, from the parser goroutine, after any logging requested via SetDebugPID.
+// Filtered commands are still included in the running count.
+func (fp *P4dFileParser) SetCommandFilter(filter func(*Command) bool) {
+	fp.cmdFilter = filter
+}
+
+// DefaultRedactCommands - cmds whose args may contain passwords so are redacted by default
+var DefaultRedactCommands = []string{"login", "passwd", "trust"}
+
+// RedactedArgs replaces the args of redacted cmds
+const RedactedArgs = "***"
+
+// SetRedactCommands - args of these cmds are replaced by RedactedArgs on output. Names may be given
+// with or without the "user-" prefix, e.g. "login" or "user-login". An empty list turns off redaction.
+func (fp *P4dFileParser) SetRedactCommands(cmds []string) {
+	fp.redactCmds = make(map[string]bool, len(cmds))
+	for _, c := range cmds {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "-") {
+			c = "user-" + c
+		}
+		fp.redactCmds[c] = true
+	}
+}
+
+// DefaultTriggerPrefix - prefix of the pseudo table names which hold trigger lapse times and exit statuses
+const DefaultTriggerPrefix = "trigger_"
+
+// SetTriggerPrefix - cmd tables for triggers are named prefix + trigger name. "" means DefaultTriggerPrefix.
+func (fp *P4dFileParser) SetTriggerPrefix(prefix string) {
+	if prefix == "" {
+		prefix = DefaultTriggerPrefix
+	}
+	fp.triggerPrefix = prefix
+}
+
+// TruncatedSuffix is appended to lines truncated due to SetMaxLineLength, replacing the closing quote of the command
+const TruncatedSuffix = "... (truncated)'"
+
+// argsTruncatedMarker is how truncated args end once the closing quote has been stripped
+var argsTruncatedMarker = strings.TrimSuffix(TruncatedSuffix, "'")
+
+// SetMaxLineLength - lines longer than this (e.g. syncs with huge argument lists) are truncated
+// so that they can still be parsed. 0 (the default) means no limit.
+func (fp *P4dFileParser) SetMaxLineLength(maxLen int) {
+	if maxLen < 0 {
+		fp.setErr(fmt.Errorf("invalid max line length %d", maxLen))
+	}
+	fp.maxLineLength = maxLen
+}
+
+// SetLinePrefixRegex - text matching regex at the start of each line, e.g. the timestamp and hostname
+// added by syslog or journald, is removed before parsing. Lines not matching are parsed as they are.
+// "" (the default) means lines are not changed.
+func (fp *P4dFileParser) SetLinePrefixRegex(regex string) {
+	if regex == "" {
+		fp.linePrefix = nil
+		return
+	}
+	re, err := regexp.Compile(fmt.Sprintf("^(?:%s)", regex))
+	if err != nil {
+		fp.setErr(fmt.Errorf("invalid line prefix regex %q: %v", regex, err))
+		return
+	}
+	fp.linePrefix = re
+}
+
+// StripLinePrefix - line without any prefix matching SetLinePrefixRegex
+func (fp *P4dFileParser) StripLinePrefix(line string) string {
+	if fp.linePrefix == nil {
+		return line
+	}
+	if loc := fp.linePrefix.FindStringIndex(line); loc != nil {
+		return line[loc[1]:]
+	}
+	return line
+}
+
+// LinesTruncated - count of lines truncated due to SetMaxLineLength
+func (fp *P4dFileParser) LinesTruncated() int64 {
+	return atomic.LoadInt64(&fp.linesTruncated)
+}
+
+// BadLines - count of lines containing invalid UTF-8 or control chars, which were repaired before parsing
+func (fp *P4dFileParser) BadLines() int64 {
+	return atomic.LoadInt64(&fp.linesBad)
+}
+
+// sanitizeLine - replaces each run of invalid UTF-8 (e.g. binary garbage from a corrupted log) with U+FFFD and
+// strips control chars other than tab, reporting whether any changes were made
+func sanitizeLine(line string) (string, bool) {
+	if !needsSanitizing(line) {
+		return line, false
+	}
+	line = strings.ToValidUTF8(line, string(utf8.RuneError))
+	return strings.Map(func(r rune) rune {
+		if isControl(r) {
+			return -1
+		}
+		return r
+	}, line), true
+}
+
+// needsSanitizing - fast check as almost all lines are plain ASCII
+func needsSanitizing(line string) bool {
+	ascii := true
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c >= utf8.RuneSelf {
+			ascii = false
+		} else if isControl(rune(c)) {
+			return true
+		}
+	}
+	return !ascii && !utf8.ValidString(line)
+}
+
+func isControl(r rune) bool {
+	return (r < ' ' && r != '\t') || r == 0x7f
+}
+
+// SetDurations - for debugging. Both must be positive.
 func (fp *P4dFileParser) SetDurations(outputDuration, debugDuration time.Duration) {
+	if outputDuration <= 0 || debugDuration <= 0 {
+		fp.setErr(fmt.Errorf("invalid durations %v and %v - must be positive", outputDuration, debugDuration))
+		return
+	}
 	fp.outputDuration = outputDuration
 	fp.debugDuration = debugDuration
 }
@@ -875,9 +1255,11 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 	if debugLog {
 		fp.logger.Infof("addCommand: hasTrack %v, pid %d lineNo %d cmd %s dup %v", hasTrackInfo, newCmd.Pid, newCmd.LineNo, newCmd.Cmd, newCmd.duplicateKey)
 	}
+	fp.m.Lock()
 	if fp.currTime.IsZero() || newCmd.StartTime.After(fp.currTime) {
 		fp.currTime = newCmd.StartTime
 	}
+	fp.m.Unlock()
 	newCmd.Running = fp.running
 	if fp.currStartTime != newCmd.StartTime && newCmd.StartTime.After(fp.currStartTime) {
 		fp.currStartTime = newCmd.StartTime
@@ -891,8 +1273,8 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 			if debugLog {
 				fp.logger.Infof("addCommand outputting old since process key different")
 			}
-			fp.outputCmd(cmd)
-			fp.cmds[newCmd.Pid] = newCmd // Replace previous cmd with same PID
+			fp.outputReplacedCmd(cmd)
+			fp.setCmd(newCmd) // Replace previous cmd with same PID
 			if !cmdHasNoCompletionRecord(newCmd.Cmd) {
 				fp.trackRunning("t01", newCmd, 1)
 			}
@@ -903,7 +1285,7 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 			} else {
 				fp.outputCmd(cmd)
 				newCmd.duplicateKey = true
-				fp.cmds[newCmd.Pid] = newCmd // Replace previous cmd with same PID
+				fp.setCmd(newCmd) // Replace previous cmd with same PID
 			}
 		} else {
 			// Typically track info only present when command has completed - especially for duplicates
@@ -917,10 +1299,10 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 					if debugLog {
 						fp.logger.Infof("addCommand found duplicate - outputting old")
 					}
-					fp.outputCmd(cmd)
+					fp.outputReplacedCmd(cmd)
 					fp.trackRunning("t02", newCmd, 1)
 					newCmd.duplicateKey = true
-					fp.cmds[newCmd.Pid] = newCmd // Replace previous cmd with same PID
+					fp.setCmd(newCmd) // Replace previous cmd with same PID
 				}
 			} else {
 				if debugLog {
@@ -939,7 +1321,7 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 		if debugLog {
 			fp.logger.Infof("addCommand remembering newCmd")
 		}
-		fp.cmds[newCmd.Pid] = newCmd
+		fp.setCmd(newCmd)
 		if _, ok := fp.pidsSeenThisSecond[newCmd.Pid]; ok {
 			newCmd.duplicateKey = true
 		}
@@ -947,10 +1329,137 @@ func (fp *P4dFileParser) addCommand(newCmd *Command, hasTrackInfo bool) {
 		if !cmdHasNoCompletionRecord(newCmd.Cmd) && !newCmd.completed {
 			fp.trackRunning("t03", newCmd, 1)
 		}
+		fp.shedPending()
 	}
 	fp.outputCompletedCommands()
 }
 
+// Records cmd as pending - the lock is for readers on other goroutines such as CmdsPendingCount,
+// since only the block processing goroutine modifies fp.cmds
+func (fp *P4dFileParser) setCmd(cmd *Command) {
+	fp.m.Lock()
+	fp.cmds[cmd.Pid] = cmd
+	fp.m.Unlock()
+	if fp.maxPending > 0 {
+		fp.addPendingOrder(cmd)
+	}
+}
+
+// isPending - true if cmd hasn't been output or replaced by a later cmd with the same pid
+func (fp *P4dFileParser) isPending(cmd *Command) bool {
+	return fp.cmds[cmd.Pid] == cmd
+}
+
+// addPendingOrder - appends cmd to pendingOrder. Cmds which are no longer pending are left in place
+// until they make up half of it, and then removed in one go.
+func (fp *P4dFileParser) addPendingOrder(cmd *Command) {
+	limit := fp.maxPending
+	if len(fp.cmds) > limit {
+		limit = len(fp.cmds)
+	}
+	if len(fp.pendingOrder) >= 2*limit {
+		fp.setPendingOrder(fp.pendingOrder[:0], fp.pendingOrder, fp.pendingOrder)
+	}
+	fp.pendingOrder = append(fp.pendingOrder, cmd)
+}
+
+// setPendingOrder - sets pendingOrder to kept followed by the cmds of rest which are still pending.
+// Both are slices of order, with kept ending before rest starts. The remainder of order is cleared
+// so that output cmds can be garbage collected.
+func (fp *P4dFileParser) setPendingOrder(kept, rest, order []*Command) {
+	for _, cmd := range rest {
+		if fp.isPending(cmd) {
+			kept = append(kept, cmd)
+		}
+	}
+	for i := len(kept); i < len(order); i++ {
+		order[i] = nil
+	}
+	fp.pendingOrder = kept
+}
+
+// Sheds the oldest pending cmds (by line no) while there are more than maxPending - see SetMaxPending
+func (fp *P4dFileParser) shedPending() {
+	if fp.blockPending || fp.maxPending <= 0 || len(fp.cmds) <= fp.maxPending {
+		return
+	}
+	shed := make([]*Command, 0)
+	fp.m.Lock()
+	for len(fp.cmds) > fp.maxPending && len(fp.pendingOrder) > 0 {
+		oldest := fp.pendingOrder[0]
+		fp.pendingOrder[0] = nil
+		fp.pendingOrder = fp.pendingOrder[1:]
+		if !fp.isPending(oldest) {
+			continue
+		}
+		if fp.debugLog(oldest) {
+			fp.logger.Infof("shedPending: pid %d lineNo %d cmd %s", oldest.Pid, oldest.LineNo, oldest.Cmd)
+		}
+		if !oldest.completed && !cmdHasNoCompletionRecord(oldest.Cmd) {
+			oldest.setIncomplete()
+		}
+		delete(fp.cmds, oldest.Pid)
+		shed = append(shed, oldest)
+	}
+	fp.m.Unlock()
+	// Not under the lock, as output waits for the reader of cmdChan, which may be waiting for the lock
+	for _, cmd := range shed {
+		fp.outputCmd(cmd)
+		atomic.AddInt64(&fp.cmdsShed, 1)
+	}
+}
+
+// Outputs completed pending cmds, oldest first, until there are fewer than maxPending - see SetMaxPending.
+// Called before the next block is parsed, so that parsing waits for the output.
+func (fp *P4dFileParser) waitForPending() {
+	if !fp.blockPending || fp.maxPending <= 0 || len(fp.cmds) < fp.maxPending {
+		return
+	}
+	completed := make([]*Command, 0)
+	fp.m.Lock()
+	order := fp.pendingOrder
+	kept := order[:0]
+	i := 0
+	for ; i < len(order) && len(fp.cmds) >= fp.maxPending; i++ {
+		cmd := order[i]
+		if !fp.isPending(cmd) {
+			continue
+		}
+		if !cmd.completed && !cmdHasNoCompletionRecord(cmd.Cmd) {
+			kept = append(kept, cmd) // Still running
+			continue
+		}
+		if fp.debugLog(cmd) {
+			fp.logger.Infof("waitForPending: pid %d lineNo %d cmd %s", cmd.Pid, cmd.LineNo, cmd.Cmd)
+		}
+		delete(fp.cmds, cmd.Pid)
+		completed = append(completed, cmd)
+	}
+	fp.setPendingOrder(kept, order[i:], order)
+	fp.m.Unlock()
+	for _, cmd := range completed {
+		fp.outputCmd(cmd)
+	}
+}
+
+// Outputs a cmd which is being replaced by a new one for the same pid, e.g. when pids are reused
+// in a long log. If no completion record was seen it is marked as incomplete.
+func (fp *P4dFileParser) outputReplacedCmd(cmd *Command) {
+	if !cmd.completed && !cmdHasNoCompletionRecord(cmd.Cmd) {
+		if fp.debugLog(cmd) {
+			fp.logger.Infof("outputReplacedCmd: pid %d lineNo %d cmd %s not completed", cmd.Pid, cmd.LineNo, cmd.Cmd)
+		}
+		cmd.setIncomplete()
+	}
+	fp.outputCmd(cmd)
+}
+
+// setIncomplete marks a cmd output without its completion record - also Truncated as historically
+func (c *Command) setIncomplete() {
+	c.Truncated = true
+	c.Incomplete = true
+}
+
 // Special commands which only have start records not completion records
 func cmdHasNoCompletionRecord(cmdName string) bool {
 	return cmdName == "rmt-FileFetch" ||
@@ -967,6 +1476,7 @@ var trackRdbLbr = "--- rdb.lbr"
 var trackMeta = "--- meta"
 var trackClients = "--- clients"
 var trackChange = "--- change"
+var reTrackChange = regexp.MustCompile(`^--- change/(\d+)`)
 var trackClientEntity = "--- clientEntity"
 var trackReplicaPull = "--- replica/pull"
 var trackStorage = "--- storageup/"
@@ -975,6 +1485,7 @@ var trackLbrCompress = "--- lbr Compress"
 var trackLbrUncompress = "--- lbr Uncompress"
 var reCmdTrigger = regexp.MustCompile(` trigger ([^ ]+)$`)
 var reTriggerLapse = regexp.MustCompile(`^lapse (\d+\.\d+)s|^lapse (\.\d+)s|^lapse (\d+)s`)
+var reTriggerExit = regexp.MustCompile(`^exit (?:status )?(-?\d+)`)
 var prefixTrackRPC = "--- rpc msgs/size in+out "
 var prefixTrackLbr = "---   opens+closes"
 var prefixTrackLbr2 = "---   reads+readbytes"
@@ -1062,6 +1573,11 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 			hasTrackInfo = false
 			continue
 		}
+		if strings.HasPrefix(line, trackChange) {
+			if m := reTrackChange.FindStringSubmatch(line); len(m) > 0 {
+				cmd.Changelist = toInt64(m[1])
+			}
+		}
 		if strings.HasPrefix(line, trackMeta) ||
 			strings.HasPrefix(line, trackChange) ||
 			strings.HasPrefix(line, trackClients) ||
@@ -1166,6 +1682,7 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 		// At this point entries should be: "---  rpc" or similar. If not then this is an unknown table so ignore
 		if len(line) > 4 && strings.HasPrefix(line, "--- ") && line[5] != ' ' {
 			tableName = ""
+			fp.countUnrecognised(line)
 			if FlagSet(fp.debug, DebugUnrecognised) {
 				buf := fmt.Sprintf("Unrecognised track table: %d %s\n", cmd.LineNo, line)
 				if fp.logger != nil {
@@ -1224,6 +1741,7 @@ func (fp *P4dFileParser) processTrackRecords(cmd *Command, lines []string) {
 				continue
 			}
 		}
+		fp.countUnrecognised(line)
 		if FlagSet(fp.debug, DebugUnrecognised) {
 			buf := fmt.Sprintf("Unrecognised track: %d %s\n", cmd.LineNo, string(line))
 			if fp.logger != nil {
@@ -1282,7 +1800,30 @@ func (fp *P4dFileParser) outputCmd(cmd *Command) {
 		fp.logger.Infof("outputting: computelapse %v completelapse %v endTime %s", cmdcopy.ComputeLapse,
 			cmdcopy.CompletedLapse, cmdcopy.EndTime)
 	}
-	fp.cmdChan <- cmdcopy
+	cmdcopy.setIntegResolveFiles()
+	if fp.redactCmds[cmdcopy.Cmd] {
+		cmdcopy.Args = RedactedArgs
+		cmdcopy.ArgsLen = len(RedactedArgs)
+	}
+	if fp.cmdFilter != nil && !fp.cmdFilter(&cmdcopy) {
+		return
+	}
+	// Prefer to output if there is room (e.g. when flushing remaining commands on cancellation),
+	// but don't block forever if nobody is reading and we have been cancelled.
+	if fp.syncMode {
+		fp.syncCmds = append(fp.syncCmds, cmdcopy)
+		fp.CmdsProcessed++
+		return
+	}
+	select {
+	case fp.cmdChan <- cmdcopy:
+	default:
+		select {
+		case fp.cmdChan <- cmdcopy:
+		case <-fp.ctx.Done():
+			return
+		}
+	}
 	fp.CmdsProcessed++
 }
 
@@ -1322,12 +1863,12 @@ func (fp *P4dFileParser) debugOutputCommands() {
 
 // Output all completed commands 3 or more seconds ago - we wait that time for possible delayed track info to come in
 func (fp *P4dFileParser) outputCompletedCommands() {
+	fp.m.Lock()
 	if fp.currTime.Sub(fp.timeLastCmdProcessed) < fp.outputDuration {
 		fp.outputCmdsExited++
+		fp.m.Unlock()
 		return
 	}
-	fp.m.Lock()
-	defer fp.m.Unlock()
 	fp.outputCmdsContinued++
 	cmdsToOutput := make([]*Command, 0)
 	startCount := len(fp.cmds)
@@ -1369,13 +1910,24 @@ func (fp *P4dFileParser) outputCompletedCommands() {
 			}
 			completed = true
 		}
+		// Evict cmds pending for too long - completion record probably missing
+		if !completed && fp.pendingTimeout > 0 && !cmd.StartTime.IsZero() &&
+			fp.currStartTime.Sub(cmd.StartTime) >= fp.pendingTimeout {
+			if debugLog {
+				fp.logger.Infof("output: r6 pid %d lineNo %d cmd %s", cmd.Pid, cmd.LineNo, cmd.Cmd)
+			}
+			cmd.setIncomplete()
+			completed = true
+		}
 		if completed {
 			cmdHasBeenProcessed = true
 			cmdsToOutput = append(cmdsToOutput, cmd)
 			delete(fp.cmds, cmd.Pid)
 		}
 	}
-	// Sort by line no in log and output
+	currTime := fp.currTime
+	fp.m.Unlock()
+	// Sort by line no in log and output - not under the lock, as for shedPending
 	sort.Slice(cmdsToOutput[:], func(i, j int) bool {
 		return cmdsToOutput[i].LineNo < cmdsToOutput[j].LineNo
 	})
@@ -1384,7 +1936,7 @@ func (fp *P4dFileParser) outputCompletedCommands() {
 	}
 
 	if cmdHasBeenProcessed || fp.timeLastCmdProcessed == blankTime {
-		fp.timeLastCmdProcessed = fp.currTime
+		fp.timeLastCmdProcessed = currTime
 	}
 	if fp.logger != nil && fp.debug > 0 {
 		endCount := len(fp.cmds)
@@ -1396,10 +1948,26 @@ func (fp *P4dFileParser) outputCompletedCommands() {
 // Processes all remaining commands whether completed or not - intended for use at end of processing
 func (fp *P4dFileParser) outputRemainingCommands() {
 	startCount := len(fp.cmds)
+	remaining := make([]*Command, 0, len(fp.cmds))
 	for _, cmd := range fp.cmds {
+		remaining = append(remaining, cmd)
+	}
+	// In log order, as for outputCompletedCommands, rather than map order
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].LineNo < remaining[j].LineNo
+	})
+	for _, cmd := range remaining {
+		// No completion record seen - the log was probably rotated or cut short
+		if !cmd.completed && !cmdHasNoCompletionRecord(cmd.Cmd) {
+			cmd.setIncomplete()
+			atomic.AddInt64(&fp.cmdsOrphaned, 1)
+		}
 		fp.outputCmd(cmd)
 	}
+	fp.m.Lock()
 	fp.cmds = make(map[int64]*Command)
+	fp.m.Unlock()
+	fp.pendingOrder = nil
 	if fp.logger != nil && fp.debug > 0 {
 		endCount := len(fp.cmds)
 		fp.logger.Debugf("outputRemainingCommands: start %d, end %d, count %d",
@@ -1428,6 +1996,7 @@ func (fp *P4dFileParser) updateCompletionTime(pid int64, lineNo int64, endTime s
 	} else {
 		// This is a completion record for an unknown cmd start - maybe previous log file
 		// We create a new command because there may be a track record along soon with more info
+		atomic.AddInt64(&fp.cmdsOrphaned, 1)
 		cmd = newCommand()
 		cmd.Pid = pid
 		cmd.LineNo = lineNo
@@ -1452,23 +2021,28 @@ func (fp *P4dFileParser) updateNetworkEstimates(pid int64, netFilesAdded, netFil
 	}
 }
 
-func (fp *P4dFileParser) processTriggerLapse(cmd *Command, trigger string, line string) {
-	// Expects a single line with a lapse statement on it
+func (fp *P4dFileParser) processTriggerLapse(cmd *Command, trigger string, lines []string) {
+	// Expects a line with a lapse statement on it, followed by an exit status if the trigger failed
 	var triggerLapse float64
-	m := reTriggerLapse.FindStringSubmatch(line)
-	if len(m) > 0 {
-		for a := 0; a < len(m)-1; a++ {
-			if string(m[a+1]) != "" {
-				s := fmt.Sprintf("0%s", string(m[a+1]))
-				triggerLapse, _ = strconv.ParseFloat(s, 32)
-				break
+	var exitStatus int64
+	for _, line := range lines {
+		if m := reTriggerLapse.FindStringSubmatch(line); len(m) > 0 {
+			for a := 0; a < len(m)-1; a++ {
+				if string(m[a+1]) != "" {
+					s := fmt.Sprintf("0%s", string(m[a+1]))
+					triggerLapse, _ = strconv.ParseFloat(s, 32)
+					break
+				}
 			}
+		} else if m := reTriggerExit.FindStringSubmatch(line); len(m) > 0 {
+			exitStatus, _ = strconv.ParseInt(m[1], 10, 64)
 		}
 	}
-	if triggerLapse > 0 {
-		tableName := fmt.Sprintf("trigger_%s", trigger)
+	if triggerLapse > 0 || exitStatus != 0 {
+		tableName := fp.triggerPrefix + trigger
 		t := newTable(tableName)
 		t.TriggerLapse = float32(triggerLapse)
+		t.TriggerExitStatus = exitStatus
 		cmd.Tables[tableName] = t
 	}
 }
@@ -1511,13 +2085,13 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 			cmd.Pid = toInt64(m[2])
 			cmd.User = m[3]
 			cmd.Workspace = m[4]
-			cmd.IP = m[5]
-			cmd.App = m[6]
+			cmd.setIP(m[5])
+			cmd.setApp(m[6])
 			cmd.Cmd = m[7]
 			// # following gsub required due to a 2009.2 P4V bug
 			// App = match.group(6).replace("\x00", "/")
 			if len(m) > 8 {
-				cmd.Args = string(m[8])
+				cmd.setArgs(string(m[8]))
 				// Strip Swarm/Git Fusion commands with lots of json
 				sm := reJSONCmdargs.FindStringSubmatch(cmd.Args)
 				if len(sm) > 0 {
@@ -1542,7 +2116,7 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 			h := md5.Sum([]byte(line))
 			cmd.ProcessKey = hex.EncodeToString(h[:])
 			if len(trigger) > 0 {
-				fp.processTriggerLapse(cmd, trigger, block.lines[len(block.lines)-1])
+				fp.processTriggerLapse(cmd, trigger, block.lines[1:])
 			}
 			fp.addCommand(cmd, false)
 		}
@@ -1574,6 +2148,9 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 				fp.updateComputeTime(pid, computeLapse)
 			}
 		}
+		if !matched && !strings.HasPrefix(line, "server to client") {
+			fp.countUnrecognised(line)
+		}
 		if !matched && FlagSet(fp.debug, DebugUnrecognised) {
 			if !strings.HasPrefix(line, "server to client") {
 				buf := fmt.Sprintf("Unrecognised: %d %s\n", block.lineNo, line)
@@ -1588,9 +2165,70 @@ func (fp *P4dFileParser) processInfoBlock(block *Block) {
 	}
 }
 
+// Error severities - the text log doesn't include them so they are derived from the message
+const (
+	ErrorSeverityWarning = "warning"
+	ErrorSeverityFailed  = "failed"
+)
+
+// Error subsystems - coarse classification of recognised error messages
+const (
+	ErrorSubsysGovernor = "governor" // Rejected by maxresults/maxscanrows/maxlocktime etc
+	ErrorSubsysAuth     = "auth"
+	ErrorSubsysRPC      = "rpc"
+	ErrorSubsysCancel   = "cancel" // Terminated by p4 monitor terminate
+)
+
+var errorGovernorMsgs = []string{"p4 help maxresults", "p4 help maxscanrows", "p4 help maxlocktime",
+	"p4 help maxopenfiles", "p4 help maxmemory"}
+var errorAuthMsgs = []string{"Perforce password (P4PASSWD) invalid or unset", "Your session has expired",
+	"Password invalid", "You don't have permission for this operation"}
+var errorRPCMsgs = []string{"Connection reset", "Partner exited unexpectedly", "TCP receive failed",
+	"TCP send failed", "RpcTransport"}
+var errorCancelMsgs = []string{"p4 monitor terminate"}
+var errorWarningMsgs = []string{"no such file(s)", "file(s) up-to-date", "no file(s) resolved",
+	"no file(s) to resolve", "file(s) not on client", "file(s) not opened on this client",
+	"file(s) not in client view", "No files to submit"}
+
+// governorLimit - the limit exceeded according to a governor error message, e.g. maxscanrows
+func governorLimit(msg string) string {
+	for _, s := range errorGovernorMsgs {
+		if strings.Contains(msg, s) {
+			return strings.TrimPrefix(s, "p4 help ")
+		}
+	}
+	return ""
+}
+
+func msgContains(msg string, strs []string) bool {
+	for _, s := range strs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify error message text into severity and subsystem
+func classifyError(msg string) (severity string, subsys string) {
+	severity = ErrorSeverityFailed
+	if msgContains(msg, errorCancelMsgs) {
+		subsys = ErrorSubsysCancel
+	} else if msgContains(msg, errorGovernorMsgs) {
+		subsys = ErrorSubsysGovernor
+	} else if msgContains(msg, errorAuthMsgs) {
+		subsys = ErrorSubsysAuth
+	} else if msgContains(msg, errorRPCMsgs) {
+		subsys = ErrorSubsysRPC
+	} else if msgContains(msg, errorWarningMsgs) {
+		severity = ErrorSeverityWarning
+	}
+	return severity, subsys
+}
+
 func (fp *P4dFileParser) processErrorBlock(block *Block) {
 	var cmd *Command
-	for _, line := range block.lines {
+	for i, line := range block.lines {
 		m := rePid.FindStringSubmatch(line)
 		if len(m) > 0 {
 			pid := toInt64(m[1])
@@ -1598,6 +2236,18 @@ func (fp *P4dFileParser) processErrorBlock(block *Block) {
 			if cmd, ok = fp.cmds[pid]; ok {
 				cmd.CmdError = true
 				cmd.completed = true
+				// Message lines follow the Pid and Operation lines
+				msgs := make([]string, 0)
+				for _, l := range block.lines[i+1:] {
+					if !strings.HasPrefix(l, "\tOperation: ") {
+						msgs = append(msgs, strings.TrimSpace(l))
+					}
+				}
+				msg := strings.Join(msgs, " ")
+				cmd.ErrorSeverity, cmd.ErrorSubsys = classifyError(msg)
+				if cmd.ErrorSubsys == ErrorSubsysGovernor {
+					cmd.GovernorLimit = governorLimit(msg)
+				}
 				if !cmdHasNoCompletionRecord(cmd.Cmd) {
 					fp.trackRunning("t06", cmd, -1)
 				}
@@ -1623,11 +2273,29 @@ func (fp *P4dFileParser) processServerThreadsBlock(block *Block) {
 	}
 }
 
+// processServerStartBlock - counts restarts. Running cmds will be reset by the next server threads message.
+func (fp *P4dFileParser) processServerStartBlock(block *Block) {
+	m := reServerStarting.FindStringSubmatch(block.lines[0])
+	if len(m) == 0 {
+		fp.countUnrecognised(block.lines[0])
+		return
+	}
+	t, _ := time.Parse(p4timeformat, m[1])
+	fp.m.Lock()
+	fp.serverRestarts++
+	fp.lastServerRestart = t
+	fp.m.Unlock()
+	fp.hadServerThreadsMsg = false
+	fp.logger.Infof("Server restart detected at %s", m[1])
+}
+
 func (fp *P4dFileParser) processBlock(block *Block) {
 	if block.btype == infoType {
 		fp.processInfoBlock(block)
 	} else if block.btype == activeThreadsType {
 		fp.processServerThreadsBlock(block)
+	} else if block.btype == serverStartType {
+		fp.processServerStartBlock(block)
 	} else if block.btype == errorType {
 		fp.processErrorBlock(block)
 	} //TODO: output unrecognised block if wanted
@@ -1645,7 +2313,9 @@ var blockEnds = []string{
 	"server to client"}
 
 var msgActiveThreads = " active threads."
-var reServerThreads = regexp.MustCompile(`^\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d \d+ pid (\d+): Server is now using (\d+) active threads.`)
+var msgServerStarting = "Perforce Server starting "
+var reServerStarting = regexp.MustCompile(`^Perforce Server starting (\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d)`)
+var reServerThreads = regexp.MustCompile(`^\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d(?:\.\d+)? \d+ pid (\d+): Server is now using (\d+) active threads.`)
 
 func blockEnd(line string) bool {
 	if blankLine(line) {
@@ -1656,6 +2326,9 @@ func blockEnd(line string) bool {
 			return true
 		}
 	}
+	if strings.HasPrefix(line, msgServerStarting) {
+		return true
+	}
 	if strings.HasSuffix(line, msgActiveThreads) { // OK to do a regex as does occur frequently
 		if m := reServerThreads.FindStringSubmatch(line); len(m) > 0 {
 			return true
@@ -1664,6 +2337,49 @@ func blockEnd(line string) bool {
 	return false
 }
 
+// Returns false if cancelled before the block could be sent
+func (fp *P4dFileParser) sendBlock(ctx context.Context, block *Block) bool {
+	select {
+	case fp.blockChan <- block:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+var reLinePrefix = regexp.MustCompile(`^\s*(\d\d\d\d/\d\d/\d\d \d\d:\d\d:\d\d(?:\.\d+)?)?( pid \d+)?\s*`)
+
+// Records a line not recognised by the parser, keyed by its first token ignoring any date and pid
+func (fp *P4dFileParser) countUnrecognised(line string) {
+	prefix := "<blank>"
+	if fields := strings.Fields(reLinePrefix.ReplaceAllString(line, "")); len(fields) > 0 {
+		prefix = fields[0]
+	}
+	fp.m.Lock()
+	defer fp.m.Unlock()
+	fp.unrecognisedLines++
+	fp.unrecognisedPrefixes[prefix]++
+}
+
+// ParseStats - returns counts of lines read and recognised so far - typically called once the
+// LogParser output channel has been closed, e.g. to validate parsing of a new p4d version's logs
+func (fp *P4dFileParser) ParseStats() ParseStats {
+	fp.m.Lock()
+	defer fp.m.Unlock()
+	stats := ParseStats{
+		Lines:                atomic.LoadInt64(&fp.linesRead),
+		BlankLines:           atomic.LoadInt64(&fp.blankLines),
+		UnrecognisedLines:    fp.unrecognisedLines,
+		CmdsParsed:           int64(fp.CmdsProcessed),
+		UnrecognisedPrefixes: make(map[string]int64, len(fp.unrecognisedPrefixes)),
+	}
+	stats.MatchedLines = stats.Lines - stats.BlankLines - stats.UnrecognisedLines
+	for k, v := range fp.unrecognisedPrefixes {
+		stats.UnrecognisedPrefixes[k] = v
+	}
+	return stats
+}
+
 // CmdsPendingCount - count of unmatched commands
 func (fp *P4dFileParser) CmdsPendingCount() int {
 	fp.m.Lock()
@@ -1671,11 +2387,112 @@ func (fp *P4dFileParser) CmdsPendingCount() int {
 	return len(fp.cmds)
 }
 
-// LogParser - interface to be run on a go routine - commands are returned on cmdchan
+// ServerRestarts - returns the count of server startup banners seen so far, and the (log) time of the latest
+func (fp *P4dFileParser) ServerRestarts() (int64, time.Time) {
+	fp.m.Lock()
+	defer fp.m.Unlock()
+	return fp.serverRestarts, fp.lastServerRestart
+}
+
+// addLine - adds a line to the current block, returning the previous block if this line ends it
+// (nil if not)
+func (fp *P4dFileParser) addLine(line string) *Block {
+	line = fp.StripLinePrefix(strings.TrimRight(line, "\r\n"))
+	atomic.AddInt64(&fp.linesRead, 1)
+	if blankLine(line) {
+		atomic.AddInt64(&fp.blankLines, 1)
+	}
+	if sanitized, bad := sanitizeLine(line); bad {
+		line = sanitized
+		atomic.AddInt64(&fp.linesBad, 1)
+	}
+	if fp.maxLineLength > 0 && len(line) > fp.maxLineLength {
+		// Don't split a UTF-8 char
+		n := fp.maxLineLength
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		line = line[:n] + TruncatedSuffix
+		atomic.AddInt64(&fp.linesTruncated, 1)
+	}
+	var completed *Block
+	if blockEnd(line) {
+		if len(fp.currBlock.lines) > 0 && !blankLine(fp.currBlock.lines[0]) {
+			completed = fp.currBlock
+		}
+		fp.currBlock = new(Block)
+		fp.currBlock.addLine(line, fp.lineNo)
+	} else {
+		fp.currBlock.addLine(line, fp.lineNo)
+	}
+	fp.lineNo++
+	return completed
+}
+
+// lastBlock - returns the current block at end of input, or nil if there isn't one
+func (fp *P4dFileParser) lastBlock() *Block {
+	block := fp.currBlock
+	fp.currBlock = new(Block)
+	if len(block.lines) > 0 && !blankLine(block.lines[0]) {
+		return block
+	}
+	return nil
+}
+
+func (fp *P4dFileParser) handleBlock(block *Block) {
+	fp.processBlock(block)
+	fp.waitForPending()
+	if fp.running > maxRunningCount {
+		panic(fmt.Sprintf("ERROR: max running command limit (%d) exceeded. Does this server log have completion records configured (configurable server=3)?",
+			maxRunningCount))
+	}
+}
+
+func (fp *P4dFileParser) startSync() {
+	if !fp.syncMode {
+		fp.syncMode = true
+		fp.lineNo = 1
+		fp.ctx = context.Background()
+	}
+	fp.syncCmds = nil
+}
+
+// ParseLine - synchronous alternative to LogParser, e.g. for tests or embedding without goroutines.
+// Parses a single line and returns any cmds completed as a result, in the same order LogParser would
+// output them. As with LogParser, cmds are usually only complete after later lines have been read, and
+// time only advances as per the log. Call Flush at end of input. Don't mix with LogParser on the same parser.
+func (fp *P4dFileParser) ParseLine(line string) []Command {
+	fp.startSync()
+	if block := fp.addLine(line); block != nil {
+		fp.handleBlock(block)
+	}
+	return fp.syncCmds
+}
+
+// Flush - for use with ParseLine at end of input - returns all remaining cmds
+func (fp *P4dFileParser) Flush() []Command {
+	fp.startSync()
+	if block := fp.lastBlock(); block != nil {
+		fp.handleBlock(block)
+	}
+	fp.outputRemainingCommands()
+	return fp.syncCmds
+}
+
+// LogParser - interface to be run on a go routine - commands are returned on cmdchan.
+// If the parser is misconfigured (see Err) nothing is parsed and the returned channel is closed.
 func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string, timeChan <-chan time.Time) chan Command {
 	fp.lineNo = 1
+	fp.ctx = ctx
 
-	fp.cmdChan = make(chan Command, 10000)
+	fp.cmdChan = make(chan Command, fp.cmdChanSize)
+	if fp.err != nil {
+		if fp.logger != nil {
+			fp.logger.Errorf("Not parsing log: %v", fp.err)
+		}
+		close(fp.cmdChan)
+		return fp.cmdChan
+	}
 	fp.linesChan = &linesChan
 	fp.blockChan = make(chan *Block, 1000)
 
@@ -1721,7 +2538,6 @@ func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string,
 	// sends blocks on the blockChannel
 	go func() {
 		defer close(fp.blockChan)
-		block := new(Block)
 		for {
 			select {
 			case <-ctx.Done():
@@ -1731,25 +2547,17 @@ func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string,
 				return
 			case line, ok := <-linesChan:
 				if ok {
-					line = strings.TrimRight(line, "\r\n")
-					if blockEnd(line) {
-						if len(block.lines) > 0 {
-							if !blankLine(block.lines[0]) {
-								fp.blockChan <- block
-							}
+					if block := fp.addLine(line); block != nil {
+						if !fp.sendBlock(ctx, block) {
+							return
 						}
-						block = new(Block)
-						block.addLine(line, fp.lineNo)
-					} else {
-						block.addLine(line, fp.lineNo)
 					}
-					fp.lineNo++
 				} else {
 					if fp.logger != nil {
 						fp.logger.Debugf("LogParser lines channel closed")
 					}
-					if len(block.lines) > 0 && !blankLine(block.lines[0]) {
-						fp.blockChan <- block
+					if block := fp.lastBlock(); block != nil {
+						fp.sendBlock(ctx, block)
 					}
 					return
 				}
@@ -1770,11 +2578,7 @@ func (fp *P4dFileParser) LogParser(ctx context.Context, linesChan <-chan string,
 				return
 			case b, ok := <-fp.blockChan:
 				if ok {
-					fp.processBlock(b)
-					if fp.running > maxRunningCount {
-						panic(fmt.Sprintf("ERROR: max running command limit (%d) exceeded. Does this server log have completion records configured (configurable server=3)?",
-							maxRunningCount))
-					}
+					fp.handleBlock(b)
 				} else {
 					fp.outputRemainingCommands()
 					return
@@ -3,9 +3,12 @@ package p4dlog
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -45,6 +48,33 @@ func parseLogLines(input string) []string {
 	return output
 }
 
+// As parseLogLines but returns the commands themselves, in log line order
+func parseLogCmds(input string) []Command {
+
+	inchan := make(chan string, 10)
+
+	logger := logrus.New()
+	logger.Level = logrus.InfoLevel
+	fp := NewP4dFileParser(logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cmdChan := fp.LogParser(ctx, inchan, nil)
+
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	for scanner.Scan() {
+		inchan <- scanner.Text()
+	}
+	close(inchan)
+
+	output := []Command{}
+	for cmd := range cmdChan {
+		output = append(output, cmd)
+	}
+	sort.Slice(output, func(i, j int) bool { return output[i].LineNo < output[j].LineNo })
+	return output
+}
+
 type lbrRegex struct {
 	line   string
 	result bool
@@ -78,6 +108,41 @@ Perforce server info:
 
 }
 
+func TestParseLine(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:15 pid 1617 fred@fred-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-change -o'
+Perforce server info:
+	2015/09/02 15:23:15 pid 1617 completed .011s`
+
+	logger := logrus.New()
+	logger.Level = logrus.InfoLevel
+	fp := NewP4dFileParser(logger)
+	output := []Command{}
+	for _, line := range strings.Split(testInput, "\n") {
+		output = append(output, fp.ParseLine(line)...)
+	}
+	// Cmds are only complete once the parser has seen later lines
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "user-sync", output[0].Cmd)
+	output = append(output, fp.Flush()...)
+	assert.Equal(t, 2, len(output))
+	assert.Equal(t, "user-change", output[1].Cmd)
+	assert.Equal(t, 2, fp.CmdsProcessed)
+
+	// Same results as streaming
+	streamed := parseLogCmds(testInput)
+	assert.Equal(t, len(streamed), len(output))
+	for i := range streamed {
+		assert.Equal(t, streamed[i].String(), output[i].String())
+	}
+	assert.Equal(t, 0, len(fp.Flush()))
+}
+
 func TestClientLockRecords(t *testing.T) {
 	testInput := `
 Perforce server info:
@@ -226,10 +291,521 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, `{"processKey":"e2bf456007fe305acdae759996dbbeb9","cmd":"user-reconcile","pid":4500,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0,"completedLapse":0.187,"ip":"127.0.0.1","app":"Microsoft Visual Studio 2013/12.0.21005.1","args":"-eadf -c 12253 c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt","startTime":"2015/09/02 16:43:36","endTime":"2015/09/02 16:43:36","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
+	assert.JSONEq(t, `{"processKey":"e2bf456007fe305acdae759996dbbeb9","cmd":"user-reconcile","changelist":12253,"pid":4500,"lineNo":2,"user":"robert","workspace":"robert-test","computeLapse":0,"completedLapse":0.187,"ip":"127.0.0.1","app":"Microsoft Visual Studio 2013/12.0.21005.1","args":"-eadf -c 12253 c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt c:\\temp\\robert-test\\test\\VEER!-%-#-@-$-\u0026-(-)\\fred - Copy.txt","startTime":"2015/09/02 16:43:36","endTime":"2015/09/02 16:43:36","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
 		output[0])
 }
 
+func TestLongLineTruncated(t *testing.T) {
+	args := strings.Repeat("//depot/main/src/file.c ", 25000) // 600KB line
+	testInput := fmt.Sprintf(`
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync %s'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s`, args)
+
+	for _, maxLen := range []int{0, 100 * 1024} {
+		inchan := make(chan string, 10)
+		logger := logrus.New()
+		fp := NewP4dFileParser(logger)
+		fp.SetMaxLineLength(maxLen)
+		ctx, cancel := context.WithCancel(context.Background())
+		cmdChan := fp.LogParser(ctx, inchan, nil)
+		for _, line := range strings.Split(testInput, "\n") {
+			inchan <- line
+		}
+		close(inchan)
+		output := []Command{}
+		for cmd := range cmdChan {
+			output = append(output, cmd)
+		}
+		cancel()
+		assert.Equal(t, 1, len(output))
+		assert.Equal(t, "user-sync", output[0].Cmd)
+		assert.Equal(t, float32(0.031), output[0].CompletedLapse)
+		if maxLen == 0 {
+			assert.Equal(t, int64(0), fp.LinesTruncated())
+			assert.True(t, args == output[0].Args)
+		} else {
+			assert.Equal(t, int64(1), fp.LinesTruncated())
+			assert.True(t, strings.HasSuffix(output[0].Args, "... (truncated)"))
+			assert.Less(t, len(output[0].Args), maxLen)
+		}
+	}
+}
+
+func TestCommandFilter(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-monitor show'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 completed .001s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 svc@unknown 127.0.0.1 [p4d/2019.2/LINUX26X86_64/1891638] 'dm-CommitSubmit'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1618 completed .002s`
+
+	inchan := make(chan string, 10)
+	fp := NewP4dFileParser(logrus.New())
+	fp.SetCommandFilter(func(cmd *Command) bool {
+		return cmd.Cmd != "user-monitor" && !strings.HasPrefix(cmd.Cmd, "dm-")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmdChan := fp.LogParser(ctx, inchan, nil)
+	for _, line := range strings.Split(testInput, "\n") {
+		inchan <- line
+	}
+	close(inchan)
+	output := []Command{}
+	for cmd := range cmdChan {
+		output = append(output, cmd)
+	}
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, "user-sync", output[0].Cmd)
+	assert.Equal(t, 1, fp.CmdsProcessed)
+}
+
+func TestRedactCommands(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-login secretpassword'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 completed .001s`
+
+	parse := func(fp *P4dFileParser) []Command {
+		inchan := make(chan string, 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cmdChan := fp.LogParser(ctx, inchan, nil)
+		for _, line := range strings.Split(testInput, "\n") {
+			inchan <- line
+		}
+		close(inchan)
+		output := []Command{}
+		for cmd := range cmdChan {
+			output = append(output, cmd)
+		}
+		sort.Slice(output, func(i, j int) bool { return output[i].LineNo < output[j].LineNo })
+		return output
+	}
+
+	// Default
+	output := parse(NewP4dFileParser(logrus.New()))
+	assert.Equal(t, 2, len(output))
+	assert.Equal(t, "user-login", output[0].Cmd)
+	assert.Equal(t, "***", output[0].Args)
+	assert.NotContains(t, output[0].String(), "secretpassword")
+	assert.Equal(t, "//...", output[1].Args)
+
+	fp := NewP4dFileParser(logrus.New())
+	fp.SetRedactCommands([]string{"user-sync"})
+	output = parse(fp)
+	assert.Equal(t, "secretpassword", output[0].Args)
+	assert.Equal(t, "***", output[1].Args)
+
+	fp = NewP4dFileParser(logrus.New())
+	fp.SetRedactCommands([]string{})
+	output = parse(fp)
+	assert.Equal(t, "secretpassword", output[0].Args)
+}
+
+func TestFractionalTimestamps(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:10.123 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2015/09/02 15:23:10.123456 pid 1617 compute end .010s
+Perforce server info:
+	2015/09/02 15:23:10.654 pid 1617 completed .531s`
+	cmds := parseLogCmds(testInput)
+	assert.Equal(t, 2, len(cmds))
+	assert.Equal(t, "user-sync", cmds[0].Cmd)
+	assert.Equal(t, "2015/09/02 15:23:09", cmds[0].StartTime.Format(p4timeformat))
+	assert.Equal(t, "user-fstat", cmds[1].Cmd)
+	assert.Equal(t, "//...", cmds[1].Args)
+	assert.Equal(t, "2015/09/02 15:23:10.123", cmds[1].StartTime.Format("2006/01/02 15:04:05.000"))
+	assert.Equal(t, "2015/09/02 15:23:10.654", cmds[1].EndTime.Format("2006/01/02 15:04:05.000"))
+	assert.Equal(t, float32(0.01), cmds[1].ComputeLapse)
+	assert.Equal(t, float32(0.531), cmds[1].CompletedLapse)
+}
+
+func TestTruncatedCommand(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-files //depot/a/... //depot/b/... (truncated)'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //depot/c/...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //depot/d/...'`
+	cmds := parseLogCmds(testInput)
+	assert.Equal(t, 3, len(cmds))
+	assert.Equal(t, "user-files", cmds[0].Cmd)
+	assert.True(t, cmds[0].Truncated)
+	assert.Equal(t, len("//depot/a/... //depot/b/... (truncated)"), cmds[0].ArgsLen)
+	assert.Contains(t, cmds[0].String(), `"truncated":true`)
+	assert.Equal(t, "user-fstat", cmds[1].Cmd)
+	assert.False(t, cmds[1].Truncated)
+	assert.Equal(t, len("//depot/c/..."), cmds[1].ArgsLen)
+	assert.NotContains(t, cmds[1].String(), `truncated`)
+	// No completion record
+	assert.Equal(t, "user-sync", cmds[2].Cmd)
+	assert.True(t, cmds[2].Truncated)
+}
+
+func TestPidReuse(t *testing.T) {
+	// pid 1616 never completes before being reused for a different cmd, with other pids interleaved
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //depot/a/...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 fred@fred_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1616 fred@fred_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-changes -m1'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:23:11 pid 1616 completed 1.031s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1616 fred@fred_ws 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-changes -m1'
+--- lapse 1.031s
+--- db.change
+---   pages in+out+cached 3+0+2
+`
+	cmds := parseLogCmds(testInput)
+	assert.Equal(t, 3, len(cmds))
+	assert.Equal(t, "user-sync", cmds[0].Cmd)
+	assert.Equal(t, int64(1616), cmds[0].Pid)
+	assert.Equal(t, "robert", cmds[0].User)
+	assert.True(t, cmds[0].Truncated)
+	assert.Equal(t, float32(0), cmds[0].CompletedLapse)
+	assert.Equal(t, 0, len(cmds[0].Tables))
+
+	assert.Equal(t, "user-fstat", cmds[1].Cmd)
+	assert.False(t, cmds[1].Truncated)
+	assert.Equal(t, float32(0.031), cmds[1].CompletedLapse)
+
+	assert.Equal(t, "user-changes", cmds[2].Cmd)
+	assert.Equal(t, int64(1616), cmds[2].Pid)
+	assert.Equal(t, "fred", cmds[2].User)
+	assert.Equal(t, "-m1", cmds[2].Args)
+	assert.False(t, cmds[2].Truncated)
+	assert.Equal(t, float32(1.031), cmds[2].CompletedLapse)
+	assert.Equal(t, int64(3), cmds[2].Tables["change"].PagesIn)
+	assert.NotEqual(t, cmds[0].ProcessKey, cmds[2].ProcessKey)
+}
+
+func TestPendingTimeout(t *testing.T) {
+	// The sync never completes - with a timeout it should be output without waiting for end of log
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:20 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2015/09/02 15:23:20 pid 1617 completed .031s
+Perforce server info:
+	2015/09/02 15:23:30 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-changes -m1'
+Perforce server info:
+	2015/09/02 15:23:30 pid 1618 completed .031s
+Perforce server info:
+`
+	inchan := make(chan string, 100)
+	fp := NewP4dFileParser(logrus.New())
+	fp.SetDurations(time.Millisecond, time.Minute)
+	fp.SetPendingTimeout(10 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Time only advances as per the log, rather than with a wall clock ticker which races with it
+	timeChan := make(chan time.Time)
+	defer close(timeChan)
+	cmdChan := fp.LogParser(ctx, inchan, timeChan)
+	for _, line := range strings.Split(testInput, "\n") {
+		inchan <- line
+	}
+	var sync *Command
+	timeout := time.After(5 * time.Second)
+	for sync == nil {
+		select {
+		case cmd := <-cmdChan:
+			if cmd.Cmd == "user-sync" {
+				sync = &cmd
+			}
+		case <-timeout:
+			t.Fatal("pending cmd not output before end of input")
+		}
+	}
+	assert.True(t, sync.Truncated)
+	assert.True(t, sync.Incomplete)
+	assert.Equal(t, int64(1616), sync.Pid)
+	close(inchan)
+	for range cmdChan {
+	}
+}
+
+func TestIncompleteAtEndOfLog(t *testing.T) {
+	// The log ends while the sync is running - it is still output, marked incomplete
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-fstat //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1617 completed .031s
+`
+	fp := NewP4dFileParser(logrus.New())
+	output := []Command{}
+	for _, line := range strings.Split(testInput, "\n") {
+		output = append(output, fp.ParseLine(line)...)
+	}
+	output = append(output, fp.Flush()...)
+	assert.Equal(t, 2, len(output))
+	sort.Slice(output, func(i, j int) bool { return output[i].Pid < output[j].Pid })
+	assert.Equal(t, "user-sync", output[0].Cmd)
+	assert.True(t, output[0].Incomplete)
+	assert.Contains(t, output[0].String(), `"incomplete":true`)
+	assert.False(t, output[1].Incomplete)
+	assert.NotContains(t, output[1].String(), `incomplete`)
+	assert.Equal(t, int64(1), fp.CmdsOrphaned())
+}
+
+func TestMaxPending(t *testing.T) {
+	// None of the syncs complete - with a max of 2 pending the oldest is shed, output as incomplete
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //a/...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //b/...'
+Perforce server info:
+`
+	fp := NewP4dFileParser(logrus.New())
+	fp.SetMaxPending(2, false)
+	output := []Command{}
+	for _, line := range strings.Split(testInput, "\n") {
+		output = append(output, fp.ParseLine(line)...)
+	}
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, int64(1616), output[0].Pid)
+	assert.True(t, output[0].Incomplete)
+	assert.Equal(t, 2, fp.CmdsPendingCount())
+	assert.Equal(t, int64(1), fp.CmdsShed())
+	output = fp.Flush()
+	assert.Equal(t, 2, len(output))
+	// Order of remaining cmds isn't defined
+	sort.Slice(output, func(i, j int) bool { return output[i].Pid < output[j].Pid })
+	assert.Equal(t, int64(1617), output[0].Pid)
+	assert.Equal(t, int64(1618), output[1].Pid)
+	assert.Equal(t, int64(1), fp.CmdsShed())
+}
+
+func TestMaxPendingBlock(t *testing.T) {
+	// With a max of 2 pending, 1616 is output once 1617 starts rather than waiting for any track records.
+	// 1617 is still running when 1618 starts, so parsing carries on past the max.
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //a/...'
+Perforce server info:
+	2015/09/02 15:23:11 pid 1618 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //b/...'
+Perforce server info:
+	2015/09/02 15:23:12 pid 1619 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //c/...'
+Perforce server info:
+	2015/09/02 15:23:12 pid 1618 completed .031s
+Perforce server info:
+`
+	fp := NewP4dFileParser(logrus.New())
+	fp.SetMaxPending(2, true)
+	output := []Command{}
+	for _, line := range strings.Split(testInput, "\n") {
+		output = append(output, fp.ParseLine(line)...)
+	}
+	assert.Equal(t, 2, len(output))
+	assert.Equal(t, int64(1616), output[0].Pid)
+	assert.Equal(t, int64(1618), output[1].Pid)
+	assert.False(t, output[1].Incomplete)
+	assert.Equal(t, 2, fp.CmdsPendingCount())
+	assert.Equal(t, int64(0), fp.CmdsShed())
+	output = fp.Flush()
+	assert.Equal(t, 2, len(output))
+}
+
+func TestMaxPendingConcurrentFlush(t *testing.T) {
+	// None of the syncs complete, so each start sheds the oldest. The reader of a small output channel
+	// checks the pending count after each cmd, as the metrics do when flushing - this mustn't deadlock
+	// with the parser waiting to output a shed cmd.
+	var b strings.Builder
+	const count = 200
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&b, "Perforce server info:\n\t2015/09/02 15:23:09 pid %d robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'\n", 1000+i)
+	}
+	inchan := make(chan string, 100)
+	fp := NewP4dFileParser(logrus.New())
+	fp.cmdChanSize = 1
+	fp.SetMaxPending(2, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timeChan := make(chan time.Time)
+	defer close(timeChan)
+	cmdChan := fp.LogParser(ctx, inchan, timeChan)
+	go func() {
+		for _, line := range strings.Split(b.String(), "\n") {
+			inchan <- line
+		}
+		close(inchan)
+	}()
+	// Read on another goroutine, since a deadlock would block it in CmdsPendingCount
+	var output int64
+	maxPending := 0
+	done := make(chan bool)
+	go func() {
+		for range cmdChan {
+			atomic.AddInt64(&output, 1)
+			if n := fp.CmdsPendingCount(); n > maxPending {
+				maxPending = n
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("parser blocked after %d cmds", atomic.LoadInt64(&output))
+	}
+	assert.Equal(t, int64(count), output)
+	assert.LessOrEqual(t, maxPending, 2)
+	assert.Equal(t, int64(count-2), fp.CmdsShed())
+}
+
+func TestAppComponents(t *testing.T) {
+	var values = []struct {
+		app, name, platform, version string
+	}{
+		{"P4V/NTX64/2023.1/2442900", "P4V", "NTX64", "2023.1"},
+		{"P4V/MACOSX1015X86_64/2021.3/2186916/v90", "P4V", "MACOSX1015X86_64", "2021.3"},
+		{"p4/2016.2/LINUX26X86_64/1598668", "p4", "LINUX26X86_64", "2016.2"},
+		{"jenkins.p4-plugin/1.10.11-SNAPSHOT/Linux (brokered)", "jenkins.p4-plugin", "Linux", "1.10.11-SNAPSHOT"},
+		{"Git Fusion/2017.1.SNAPSHOT/1778910 (2019/04/01)/v82", "Git Fusion", "", "2017.1.SNAPSHOT"},
+		{`c:\scripts\gen.py [PY3.7/P4PY2020.1/API2020.1/2051818`, `c:\scripts\gen.py`, "", ""},
+		{"P4Win", "P4Win", "", ""},
+		{"", "", "", ""},
+	}
+	for _, v := range values {
+		cmd := Command{App: v.app}
+		name, platform, version := cmd.AppComponents()
+		assert.Equal(t, v.name, name, v.app)
+		assert.Equal(t, v.platform, platform, v.app)
+		assert.Equal(t, v.version, version, v.app)
+	}
+}
+
+func TestAPILevel(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2020/03/11 06:08:16 pid 15855 fred@fred_ws 10.1.4.213 [Helix P4V/NTX64/2019.2/1904275/v86] 'user-change -i'
+Perforce server info:
+	2020/03/11 06:08:16 pid 15855 completed .010s
+Perforce server info:
+	2020/03/11 06:08:17 pid 15856 fred@fred_ws 10.1.4.213 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2020/03/11 06:08:17 pid 15856 completed .010s
+`
+	cmds := parseLogCmds(testInput)
+	assert.Equal(t, 2, len(cmds))
+	assert.Equal(t, int64(86), cmds[0].ClientAPILevel)
+	assert.Contains(t, cmds[0].String(), `"clientApiLevel":86`)
+	// Not logged
+	assert.Equal(t, int64(0), cmds[1].ClientAPILevel)
+	assert.NotContains(t, cmds[1].String(), `"clientApiLevel"`)
+
+	for app, level := range map[string]int64{
+		"P4V/MACOSX1015X86_64/2021.3/2186916/v90":                90,
+		"unnamed p4-python script/v81":                           81,
+		"jenkins.p4-plugin/1.10.11/Linux/1851945/v84 (brokered)": 84,
+		"P4Win": 0,
+	} {
+		cmd := Command{}
+		cmd.setApp(app)
+		assert.Equal(t, level, cmd.ClientAPILevel, app)
+	}
+}
+
+func TestReplicaIP(t *testing.T) {
+	var values = []struct {
+		addr, replica, ip string
+	}{
+		{"10.1.2.3", "", "10.1.2.3"},
+		{"10.40.16.14/10.40.48.29", "10.40.16.14", "10.40.48.29"},
+		{"fe80::1", "", "fe80::1"},
+		{"fd00::10/2001:db8::5", "fd00::10", "2001:db8::5"},
+		{"10.40.16.14/2001:db8::5", "10.40.16.14", "2001:db8::5"},
+		{"", "", ""},
+	}
+	for _, v := range values {
+		cmd := newCommand()
+		cmd.setIP(v.addr)
+		replica, ip := cmd.ReplicaIP()
+		assert.Equal(t, v.replica, replica, v.addr)
+		assert.Equal(t, v.ip, ip, v.addr)
+		assert.Equal(t, v.replica != "", cmd.Forwarded, v.addr)
+	}
+}
+
+func TestParseStats(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 some new record type
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+--- lapse .031s
+--- db.rev
+---   pages in+out+cached 1+0+1
+---   new table stat 3
+--- newtrack 1+2
+`
+	inchan := make(chan string, 10)
+	fp := NewP4dFileParser(logrus.New())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmdChan := fp.LogParser(ctx, inchan, nil)
+	for _, line := range strings.Split(testInput, "\n") {
+		inchan <- line
+	}
+	close(inchan)
+	for range cmdChan {
+	}
+	stats := fp.ParseStats()
+	assert.Equal(t, int64(15), stats.Lines)
+	assert.Equal(t, int64(2), stats.BlankLines)
+	assert.Equal(t, int64(3), stats.UnrecognisedLines)
+	assert.Equal(t, int64(10), stats.MatchedLines)
+	assert.Equal(t, int64(1), stats.CmdsParsed)
+	assert.Equal(t, map[string]int64{"some": 1, "---": 2}, stats.UnrecognisedPrefixes)
+}
+
 func TestNetworkEstimates(t *testing.T) {
 	testInput := `
 Perforce server info:
@@ -246,12 +822,62 @@ Perforce server info:
 	2017/02/15 10:11:30 pid 4917 completed .034s 19+4us 0+8io 0+0net 8996k 0pf`
 	output := parseLogLines(testInput)
 	assert.Equal(t, 2, len(output))
-	assert.JSONEq(t, `{"processKey":"4964a5f82541f47985f0965ab47c1e39","cmd":"user-have","pid":4917,"lineNo":2,"user":"bruno","workspace":"bruno.140451462678608","computeLapse":0,"completedLapse":0.002,"ip":"10.62.185.99","app":"unnamed p4-python script/v81","args":"","startTime":"2017/02/15 10:11:30","endTime":"2017/02/15 10:11:30","running":1,"uCpu":2,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":8932,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
+	assert.JSONEq(t, `{"processKey":"4964a5f82541f47985f0965ab47c1e39","cmd":"user-have","pid":4917,"lineNo":2,"user":"bruno","workspace":"bruno.140451462678608","computeLapse":0,"completedLapse":0.002,"ip":"10.62.185.99","app":"unnamed p4-python script/v81","clientApiLevel":81,"args":"","startTime":"2017/02/15 10:11:30","endTime":"2017/02/15 10:11:30","running":1,"uCpu":2,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":8932,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
 		output[0])
-	assert.JSONEq(t, `{"processKey":"7c65428ac3b32f6f42f84ead5694ffb4","cmd":"user-sync","pid":4917,"lineNo":6,"user":"bruno","workspace":"bruno.140451462678608","computeLapse":0.02,"completedLapse":0.034,"ip":"10.62.185.99","app":"unnamed p4-python script/v81","args":"//bruno.140451462678608/...","startTime":"2017/02/15 10:11:30","endTime":"2017/02/15 10:11:30","running":1,"uCpu":19,"sCpu":4,"diskIn":0,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":8996,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":111325,"netBytesUpdated":813906,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":1,"netFilesDeleted":3,"netFilesUpdated":2,"cmdError":false,"tables":[]}`,
+	assert.JSONEq(t, `{"processKey":"7c65428ac3b32f6f42f84ead5694ffb4","cmd":"user-sync","pid":4917,"lineNo":6,"user":"bruno","workspace":"bruno.140451462678608","computeLapse":0.02,"completedLapse":0.034,"ip":"10.62.185.99","app":"unnamed p4-python script/v81","clientApiLevel":81,"args":"//bruno.140451462678608/...","startTime":"2017/02/15 10:11:30","endTime":"2017/02/15 10:11:30","running":1,"uCpu":19,"sCpu":4,"diskIn":0,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":8996,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":111325,"netBytesUpdated":813906,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":1,"netFilesDeleted":3,"netFilesUpdated":2,"cmdError":false,"tables":[]}`,
 		output[1])
 }
 
+func TestIntegResolveFiles(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2017/02/15 10:11:30 pid 4917 bruno@bruno_ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1598668] 'user-integrate //depot/main/... //depot/rel/...'
+Perforce server info:
+	2017/02/15 10:11:30 pid 4917 completed .034s 19+4us 0+8io 0+0net 8996k 0pf
+Perforce server info:
+	2017/02/15 10:11:30 pid 4917 bruno@bruno_ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1598668] 'user-integrate //depot/main/... //depot/rel/...'
+--- lapse .034s
+--- db.resolve
+---   pages in+out+cached 8+12+6
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+0 25+0
+--- db.working
+---   pages in+out+cached 6+9+4
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+0 25+0
+
+Perforce server info:
+	2017/02/15 10:11:32 pid 4918 bruno@bruno_ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1598668] 'user-resolve -am'
+Perforce server info:
+	2017/02/15 10:11:32 pid 4918 completed .021s 10+2us 0+8io 0+0net 8996k 0pf
+Perforce server info:
+	2017/02/15 10:11:32 pid 4918 bruno@bruno_ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1598668] 'user-resolve -am'
+--- lapse .021s
+--- db.resolve
+---   pages in+out+cached 8+10+6
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+25 20+0
+
+Perforce server info:
+	2017/02/15 10:11:34 pid 4919 bruno@bruno_ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1598668] 'user-populate //depot/main/... //depot/dev/...'
+Perforce server info:
+	2017/02/15 10:11:34 pid 4919 completed .051s 10+2us 0+8io 0+0net 8996k 0pf
+Perforce server info:
+	2017/02/15 10:11:34 pid 4919 bruno@bruno_ws 10.62.185.99 [p4/2016.2/LINUX26X86_64/1598668] 'user-populate //depot/main/... //depot/dev/...'
+--- lapse .051s
+--- db.integed
+---   pages in+out+cached 4+10+6
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+0 30+0
+`
+	cmds := parseLogCmds(testInput)
+	assert.Equal(t, 3, len(cmds))
+	assert.Equal(t, "user-integrate", cmds[0].Cmd)
+	assert.Equal(t, int64(25), cmds[0].IntegFiles)
+	assert.Equal(t, int64(0), cmds[0].ResolveFiles)
+	assert.Equal(t, "user-resolve", cmds[1].Cmd)
+	assert.Equal(t, int64(0), cmds[1].IntegFiles)
+	assert.Equal(t, int64(20), cmds[1].ResolveFiles)
+	assert.Equal(t, "user-populate", cmds[2].Cmd)
+	assert.Equal(t, int64(15), cmds[2].IntegFiles)
+}
+
 // Thes get duplicate pids in same second and have no completed record
 func TestRemoteFileFetches(t *testing.T) {
 	testInput := `
@@ -406,6 +1032,44 @@ Perforce server info:
 	// 	output[3])
 }
 
+func TestLogParseChangelist(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2018/06/10 23:30:06 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-submit -c 12345'
+
+Perforce server info:
+	2018/06/10 23:30:07 pid 25568 completed .178s 96+17us 0+208io 0+0net 15668k 0pf
+Perforce server info:
+	2018/06/10 23:30:08 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'dm-CommitSubmit'
+--- change/12345(W)
+---   total lock wait+held read/write 0ms+0ms/0ms+795ms
+
+Perforce server info:
+	2018/06/10 23:30:09 pid 25568 completed 1.38s 34+61us 59680+59904io 0+0net 127728k 1pf
+Perforce server info:
+	2018/06/10 23:30:08 pid 25568 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'dm-CommitSubmit'
+--- db.integed
+---   total lock wait+held read/write 0ms+0ms/0ms+795ms
+
+Perforce server info:
+	2018/06/10 23:30:10 pid 25569 fred@lon_ws 10.1.2.3 [p4/2016.2/LINUX26X86_64/1598668] 'user-changes -m 1'
+Perforce server info:
+	2018/06/10 23:30:10 pid 25569 completed .010s
+`
+	cmds := parseLogCmds(testInput)
+	assert.Equal(t, 3, len(cmds))
+	assert.Equal(t, "user-submit", cmds[0].Cmd)
+	assert.Equal(t, int64(12345), cmds[0].Changelist)
+	assert.Equal(t, "dm-CommitSubmit", cmds[1].Cmd)
+	assert.Equal(t, int64(12345), cmds[1].Changelist)
+	assert.Equal(t, 1, len(cmds[1].Tables))
+	assert.Equal(t, "user-changes", cmds[2].Cmd)
+	assert.Equal(t, int64(0), cmds[2].Changelist)
+
+	assert.Contains(t, cmds[1].String(), `"changelist":12345`)
+	assert.NotContains(t, cmds[2].String(), `"changelist"`)
+}
+
 func TestPopulateMultilineDesc(t *testing.T) {
 	// p4 submit and populate can take a -d flag and end up with multiline descriptions - annoying!
 	testInput := `
@@ -493,9 +1157,9 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 2, len(output))
-	assert.JSONEq(t, `{"processKey":"9b2bf87ce1b8e88d0d89cf44cffc4a8c","cmd":"user-change","pid":4496,"lineNo":2,"user":"lcheng","workspace":"lcheng","computeLapse":0,"completedLapse":0.015,"ip":"10.100.72.195","app":"P4V/NTX64/2014.1/888424/v76","args":"-o","startTime":"2016/10/19 14:53:48","endTime":"2016/10/19 14:53:48","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":1,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":523588,"rpcHimarkRev":64836,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"group","pagesIn":1,"pagesOut":0,"pagesCached":7,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":0,"posRows":6,"scanRows":11,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"user","pagesIn":1,"pagesOut":0,"pagesCached":3,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":1,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
+	assert.JSONEq(t, `{"processKey":"9b2bf87ce1b8e88d0d89cf44cffc4a8c","cmd":"user-change","pid":4496,"lineNo":2,"user":"lcheng","workspace":"lcheng","computeLapse":0,"completedLapse":0.015,"ip":"10.100.72.195","app":"P4V/NTX64/2014.1/888424/v76","clientApiLevel":76,"args":"-o","startTime":"2016/10/19 14:53:48","endTime":"2016/10/19 14:53:48","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":1,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":523588,"rpcHimarkRev":64836,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"group","pagesIn":1,"pagesOut":0,"pagesCached":7,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":0,"posRows":6,"scanRows":11,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"user","pagesIn":1,"pagesOut":0,"pagesCached":3,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":1,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
 		output[0])
-	assert.JSONEq(t, `{"processKey":"9b2bf87ce1b8e88d0d89cf44cffc4a8c.18","cmd":"user-change","pid":4496,"lineNo":18,"user":"lcheng","workspace":"lcheng","computeLapse":0,"completedLapse":0.016,"ip":"10.100.72.195","app":"P4V/NTX64/2014.1/888424/v76","args":"-o","startTime":"2016/10/19 14:53:48","endTime":"2016/10/19 14:53:48","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":1,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":523588,"rpcHimarkRev":64836,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"group","pagesIn":1,"pagesOut":0,"pagesCached":7,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":0,"posRows":6,"scanRows":11,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"user","pagesIn":1,"pagesOut":0,"pagesCached":3,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":1,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
+	assert.JSONEq(t, `{"processKey":"9b2bf87ce1b8e88d0d89cf44cffc4a8c.18","cmd":"user-change","pid":4496,"lineNo":18,"user":"lcheng","workspace":"lcheng","computeLapse":0,"completedLapse":0.016,"ip":"10.100.72.195","app":"P4V/NTX64/2014.1/888424/v76","clientApiLevel":76,"args":"-o","startTime":"2016/10/19 14:53:48","endTime":"2016/10/19 14:53:48","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":1,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":523588,"rpcHimarkRev":64836,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"group","pagesIn":1,"pagesOut":0,"pagesCached":7,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":0,"posRows":6,"scanRows":11,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"user","pagesIn":1,"pagesOut":0,"pagesCached":3,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":1,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
 		output[1])
 }
 
@@ -518,10 +1182,30 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, `{"processKey":"25aeba7a5658170fea61117076fa00d5","cmd":"user-change","pid":148469,"lineNo":2,"user":"Fred","workspace":"LONWS","computeLapse":0,"completedLapse":0.413,"ip":"10.40.16.14/10.40.48.29","app":"3DSMax/1.0.0.0","args":"-i","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:21","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesOut":3,"pagesCached":2,"pagesSplitInternal":41,"pagesSplitLeaf":42,"readLocks":0,"writeLocks":2,"getRows":2,"posRows":0,"scanRows":0,"putRows":1,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"trigger_swarm.changesave","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0.044}]}`,
+	assert.JSONEq(t, `{"processKey":"25aeba7a5658170fea61117076fa00d5","cmd":"user-change","pid":148469,"lineNo":2,"user":"Fred","workspace":"LONWS","computeLapse":0,"completedLapse":0.413,"ip":"10.40.16.14/10.40.48.29","forwarded":true,"app":"3DSMax/1.0.0.0","args":"-i","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:21","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesOut":3,"pagesCached":2,"pagesSplitInternal":41,"pagesSplitLeaf":42,"readLocks":0,"writeLocks":2,"getRows":2,"posRows":0,"scanRows":0,"putRows":1,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"trigger_swarm.changesave","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0.044}]}`,
 		output[0])
 }
 
+func TestLogTriggerFailure(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 Fred@LONWS 10.40.16.14/10.40.48.29 [3DSMax/1.0.0.0] 'user-change -i' trigger checkjob
+lapse .044s
+exit 2
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 Fred@LONWS 10.40.16.14/10.40.48.29 [3DSMax/1.0.0.0] 'user-change -i' trigger swarm.changesave
+lapse .012s
+Perforce server info:
+	2017/12/07 15:00:21 pid 148469 completed .413s 7+4us 0+584io 0+0net 4580k 0pf
+`
+	output := parseLogCmds(testInput)
+	assert.Equal(t, 1, len(output))
+	assert.Equal(t, int64(2), output[0].Tables["trigger_checkjob"].TriggerExitStatus)
+	assert.Equal(t, float32(0.044), output[0].Tables["trigger_checkjob"].TriggerLapse)
+	assert.Equal(t, int64(0), output[0].Tables["trigger_swarm.changesave"].TriggerExitStatus)
+	assert.Equal(t, float32(0.012), output[0].Tables["trigger_swarm.changesave"].TriggerLapse)
+}
+
 func TestLogChangeI(t *testing.T) {
 	testInput := `
 Perforce server info:
@@ -564,7 +1248,7 @@ Perforce server info:
 	assert.Equal(t, 2, len(output))
 	assert.JSONEq(t, `{"processKey":"128e10d7fe570c2d2f5f7f03e1186827","cmd":"dm-CommitSubmit","pid":25568,"lineNo":16,"user":"fred","workspace":"lon_ws","computeLapse":0,"completedLapse":1.38,"ip":"10.1.2.3","app":"p4/2016.2/LINUX26X86_64/1598668","args":"","startTime":"2018/06/10 23:30:08","endTime":"2018/06/10 23:30:09","running":1,"uCpu":34,"sCpu":61,"diskIn":59680,"diskOut":59904,"ipcIn":0,"ipcOut":0,"maxRss":127728,"pageFaults":1,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"archmap","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":780,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"integed","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":795,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
 		output[0])
-	assert.JSONEq(t, `{"processKey":"441371d8e17558bfb8e6cf7c1ca7b3ac","cmd":"user-change","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","computeLapse":0,"completedLapse":0.413,"ip":"10.40.16.14/10.40.48.29","app":"3DSMax/1.0.0.0","args":"-i","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:21","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesOut":3,"pagesCached":2,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":2,"getRows":2,"posRows":0,"scanRows":0,"putRows":1,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"trigger_swarm.changesave","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0.044}]}`,
+	assert.JSONEq(t, `{"processKey":"441371d8e17558bfb8e6cf7c1ca7b3ac","cmd":"user-change","pid":148469,"lineNo":2,"user":"fred","workspace":"LONWS","computeLapse":0,"completedLapse":0.413,"ip":"10.40.16.14/10.40.48.29","forwarded":true,"app":"3DSMax/1.0.0.0","args":"-i","startTime":"2017/12/07 15:00:21","endTime":"2017/12/07 15:00:21","running":1,"uCpu":10,"sCpu":11,"diskIn":12,"diskOut":13,"ipcIn":14,"ipcOut":15,"maxRss":4088,"pageFaults":22,"rpcMsgsIn":20,"rpcMsgsOut":21,"rpcSizeIn":22,"rpcSizeOut":23,"rpcHimarkFwd":318788,"rpcHimarkRev":318789,"rpcSnd":0.001,"rpcRcv":0.002,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":6,"pagesOut":3,"pagesCached":2,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":2,"getRows":2,"posRows":0,"scanRows":0,"putRows":1,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"trigger_swarm.changesave","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0.044}]}`,
 		output[1])
 }
 
@@ -608,7 +1292,7 @@ Perforce server info:
 	assert.Equal(t, 2, len(output))
 	assert.JSONEq(t, `{"processKey":"7c437167b3eef0a81ba6ecb710ad7572","cmd":"user-serverid","pid":25396,"lineNo":2,"user":"p4sdp","workspace":"chi","computeLapse":0,"completedLapse":0.002,"ip":"127.0.0.1","app":"p4/2019.2/LINUX26X86_64/1891638","args":"","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":8036,"pageFaults":0,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":795800,"rpcHimarkRev":795656,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
 		output[0])
-	assert.JSONEq(t, `{"processKey":"9bbbb204208b1af212c38a906294708c","cmd":"user-login","pid":25390,"lineNo":4,"user":"bot-integ","workspace":"_____CLIENT_UNSET_____","computeLapse":0,"completedLapse":0.008,"ip":"127.0.0.1/10.5.40.103","app":"jenkins.p4-plugin/1.10.3-SNAPSHOT/Linux (brokered)","args":"-s","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":7632,"pageFaults":0,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":795800,"rpcHimarkRev":185540,"rpcSnd":0,"rpcRcv":0.007,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
+	assert.JSONEq(t, `{"processKey":"9bbbb204208b1af212c38a906294708c","cmd":"user-login","pid":25390,"lineNo":4,"user":"bot-integ","workspace":"_____CLIENT_UNSET_____","computeLapse":0,"completedLapse":0.008,"ip":"127.0.0.1/10.5.40.103","forwarded":true,"app":"jenkins.p4-plugin/1.10.3-SNAPSHOT/Linux (brokered)","args":"***","startTime":"2020/01/11 02:00:02","endTime":"2020/01/11 02:00:02","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":7632,"pageFaults":0,"rpcMsgsIn":2,"rpcMsgsOut":3,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":795800,"rpcHimarkRev":185540,"rpcSnd":0,"rpcRcv":0.007,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
 		output[1])
 }
 
@@ -625,10 +1309,188 @@ Perforce server error:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, `{"processKey":"227e3b54b1283b1fef89bc5843eb87d5","cmd":"user-resolved","pid":25883,"lineNo":2,"user":"user1","workspace":"ws1","computeLapse":0,"completedLapse":0,"ip":"10.1.3.158","app":"IntelliJ_IDEA_resolved/2018.1/LINUX26X86_64/1637071","args":"/home/user1/perforce_ws/ws1/.idea/... /home/user1/perforce_ws/ws1/...","startTime":"2019/12/20 09:42:15","endTime":"0001/01/01 00:00:00","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":true,"tables":[]}`,
+	assert.JSONEq(t, `{"processKey":"227e3b54b1283b1fef89bc5843eb87d5","cmd":"user-resolved","pid":25883,"lineNo":2,"user":"user1","workspace":"ws1","computeLapse":0,"completedLapse":0,"ip":"10.1.3.158","app":"IntelliJ_IDEA_resolved/2018.1/LINUX26X86_64/1637071","args":"/home/user1/perforce_ws/ws1/.idea/... /home/user1/perforce_ws/ws1/...","startTime":"2019/12/20 09:42:15","endTime":"0001/01/01 00:00:00","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":true,"errorSeverity":"warning","tables":[]}`,
 		output[0])
 }
 
+func TestLogErrorsGovernor(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2019/12/20 09:42:15 pid 25883 user1@ws1 10.1.3.158 [p4/2019.2/LINUX26X86_64/1891638] 'user-files //...'
+
+Perforce server error:
+	Date 2019/12/20 09:42:15:
+	Pid 25883
+	Operation: user-files
+	Too many rows scanned (over 100000); see 'p4 help maxscanrows'.
+
+Perforce server info:
+	2019/12/20 09:42:16 pid 25884 user1@ws1 10.1.3.158 [p4/2019.2/LINUX26X86_64/1891638] 'user-edit //depot/fred.txt'
+
+Perforce server error:
+	Date 2019/12/20 09:42:16:
+	Pid 25884
+	Operation: user-edit
+	Unable to lock file //depot/fred.txt - write failed.
+`
+	cmds := parseLogCmds(testInput)
+	assert.Equal(t, 2, len(cmds))
+	assert.Equal(t, "user-files", cmds[0].Cmd)
+	assert.True(t, cmds[0].CmdError)
+	assert.Equal(t, ErrorSeverityFailed, cmds[0].ErrorSeverity)
+	assert.Equal(t, ErrorSubsysGovernor, cmds[0].ErrorSubsys)
+	assert.Equal(t, "maxscanrows", cmds[0].GovernorLimit)
+	assert.Equal(t, "user-edit", cmds[1].Cmd)
+	assert.True(t, cmds[1].CmdError)
+	assert.Equal(t, ErrorSeverityFailed, cmds[1].ErrorSeverity)
+	assert.Equal(t, "", cmds[1].ErrorSubsys)
+	assert.Equal(t, "", cmds[1].GovernorLimit)
+}
+
+func TestGovernorLimit(t *testing.T) {
+	var values = []struct {
+		msg, limit string
+	}{
+		{"Request too large (over 500000); see 'p4 help maxresults'.", "maxresults"},
+		{"Too many rows scanned (over 100000); see 'p4 help maxscanrows'.", "maxscanrows"},
+		{"Operation took too long (over 30.00 seconds); see 'p4 help maxlocktime'.", "maxlocktime"},
+		{"Opening too many files (over 1000); see 'p4 help maxopenfiles'.", "maxopenfiles"},
+		{"Unable to lock file //depot/fred.txt - write failed.", ""},
+	}
+	for _, v := range values {
+		assert.Equal(t, v.limit, governorLimit(v.msg))
+	}
+}
+
+func TestSanitizeLine(t *testing.T) {
+	var values = []struct {
+		line, result string
+		bad          bool
+	}{
+		{"\t2015/09/02 15:23:09 pid 1616 completed .031s", "\t2015/09/02 15:23:09 pid 1616 completed .031s", false},
+		{"user r\u00e9my", "user r\u00e9my", false},
+		{"a\x00b\x01c\x7f", "abc", true},
+		{"a\xffb\xc3", "a\ufffdb\ufffd", true},
+		{"", "", false},
+	}
+	for _, v := range values {
+		result, bad := sanitizeLine(v.line)
+		assert.Equal(t, v.result, result, v.line)
+		assert.Equal(t, v.bad, bad, v.line)
+	}
+}
+
+func TestBadLines(t *testing.T) {
+	testInput := "\nPerforce server info:\n" +
+		"\t2015/09/02 15:23:09 pid 1616 rob\x00ert@robert-\xfftest 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'\n" +
+		"Perforce server info:\n" +
+		"\t2015/09/02 15:23:09 pid 1616 completed .031s\n"
+	logger := logrus.New()
+	logger.Level = logrus.InfoLevel
+	fp := NewP4dFileParser(logger)
+	cmds := []Command{}
+	for _, line := range strings.Split(testInput, "\n") {
+		cmds = append(cmds, fp.ParseLine(line)...)
+	}
+	cmds = append(cmds, fp.Flush()...)
+	assert.Equal(t, 1, len(cmds))
+	assert.Equal(t, "robert", cmds[0].User)
+	assert.Equal(t, "robert-\ufffdtest", cmds[0].Workspace)
+	assert.Equal(t, float32(0.031), cmds[0].CompletedLapse)
+	assert.Equal(t, int64(1), fp.BadLines())
+}
+
+func TestLinePrefixRegex(t *testing.T) {
+	// As written by rsyslog - a tab is still needed before the date for the parser
+	testInput := `Sep  2 15:23:09 perforce01 p4d[1234]: Perforce server info:
+Sep  2 15:23:09 perforce01 p4d[1234]: 	2015/09/02 15:23:09 pid 1616 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-sync //...'
+Sep  2 15:23:09 perforce01 p4d[1234]: Perforce server info:
+Sep  2 15:23:09 perforce01 p4d[1234]: 	2015/09/02 15:23:09 pid 1616 completed .031s
+Perforce server info:
+	2015/09/02 15:23:10 pid 1617 robert@robert-test 127.0.0.1 [p4/2016.2/LINUX26X86_64/1598668] 'user-info'
+`
+	logger := logrus.New()
+	logger.Level = logrus.InfoLevel
+	fp := NewP4dFileParser(logger)
+	fp.SetLinePrefixRegex(`\w{3} [ \d]\d \d\d:\d\d:\d\d \S+ p4d\[\d+\]: `)
+	assert.NoError(t, fp.Err())
+	cmds := []Command{}
+	for _, line := range strings.Split(testInput, "\n") {
+		cmds = append(cmds, fp.ParseLine(line)...)
+	}
+	cmds = append(cmds, fp.Flush()...)
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Pid < cmds[j].Pid })
+	assert.Equal(t, 2, len(cmds))
+	assert.Equal(t, "user-sync", cmds[0].Cmd)
+	assert.Equal(t, "robert-test", cmds[0].Workspace)
+	assert.Equal(t, float32(0.031), cmds[0].CompletedLapse)
+	assert.Equal(t, "user-info", cmds[1].Cmd)
+
+	// Only removed from the start of lines
+	assert.Equal(t, "x Sep  2 15:23:09 perforce01 p4d[1: ", fp.StripLinePrefix("x Sep  2 15:23:09 perforce01 p4d[1: "))
+	fp.SetLinePrefixRegex("")
+	assert.Equal(t, "Sep  2 15:23:09 perforce01 p4d[1]: a", fp.StripLinePrefix("Sep  2 15:23:09 perforce01 p4d[1]: a"))
+
+	fp.SetLinePrefixRegex("(")
+	assert.Error(t, fp.Err())
+}
+
+func TestClassifyError(t *testing.T) {
+	var values = []struct {
+		msg, severity, subsys string
+	}{
+		{"Request too large (over 500000); see 'p4 help maxresults'.", ErrorSeverityFailed, ErrorSubsysGovernor},
+		{"Command terminated by 'p4 monitor terminate'.", ErrorSeverityFailed, ErrorSubsysCancel},
+		{"Your session has expired, please login again.", ErrorSeverityFailed, ErrorSubsysAuth},
+		{"TCP receive failed.", ErrorSeverityFailed, ErrorSubsysRPC},
+		{"//... - no such file(s).", ErrorSeverityWarning, ""},
+		{"Unable to lock file //depot/fred.txt - write failed.", ErrorSeverityFailed, ""},
+	}
+	for _, v := range values {
+		severity, subsys := classifyError(v.msg)
+		assert.Equal(t, v.severity, severity, v.msg)
+		assert.Equal(t, v.subsys, subsys, v.msg)
+	}
+}
+
+func TestParserConfigErrors(t *testing.T) {
+	fp := NewP4dFileParser(nil)
+	assert.NoError(t, fp.Err())
+	fp.SetDebugPID(0, "")
+	fp.SetDebugPID(1616, "user-sync")
+	fp.SetDurations(time.Second, time.Second)
+	assert.NoError(t, fp.Err())
+
+	var values = []func(fp *P4dFileParser){
+		func(fp *P4dFileParser) { fp.SetDebugPID(1616, "") },
+		func(fp *P4dFileParser) { fp.SetDebugPID(0, "user-sync") },
+		func(fp *P4dFileParser) { fp.SetDebugPID(-1, "user-sync") },
+		func(fp *P4dFileParser) { fp.SetMaxLineLength(-1) },
+		func(fp *P4dFileParser) { fp.SetMaxPending(-1, false) },
+		func(fp *P4dFileParser) { fp.SetPendingTimeout(-time.Second) },
+		func(fp *P4dFileParser) { fp.SetDurations(0, time.Second) },
+	}
+	for i, set := range values {
+		fp := NewP4dFileParser(nil)
+		set(fp)
+		assert.Error(t, fp.Err(), "case %d", i)
+	}
+
+	// The first error is kept
+	fp = NewP4dFileParser(nil)
+	fp.SetDebugPID(1616, "")
+	fp.SetMaxLineLength(-1)
+	assert.EqualError(t, fp.Err(), `invalid debug pid 1616 and cmd "" - both must be set`)
+
+	// Nothing is parsed
+	linesChan := make(chan string, 10)
+	linesChan <- "Perforce server info:"
+	close(linesChan)
+	cmdChan := fp.LogParser(context.Background(), linesChan, nil)
+	_, ok := <-cmdChan
+	assert.False(t, ok)
+}
+
 func TestIDLEErrors(t *testing.T) {
 	testInput := `
 Perforce server info:
@@ -662,6 +1524,38 @@ Perforce server info:
 		output[1])
 }
 
+func TestServerRestart(t *testing.T) {
+	testInput := `
+Perforce server info:
+	2020/01/11 02:00:02 pid 25396 p4sdp@chi 127.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-serverid'
+Perforce server info:
+	2020/01/11 02:00:02 pid 25396 completed .008s 0+0us 0+8io 0+0net 7632k 0pf
+Perforce Server starting 2020/01/11 02:10:00 pid 26001 P4D/LINUX26X86_64/2019.2/1891638 (2020/01/05).
+2020/01/11 02:10:01 731966731 pid 26001: Server is now using 2 active threads.
+Perforce server info:
+	2020/01/11 02:10:05 pid 26010 p4sdp@chi 127.0.0.1 [p4/2019.2/LINUX26X86_64/1891638] 'user-info'
+Perforce server info:
+	2020/01/11 02:10:05 pid 26010 completed .008s 0+0us 0+8io 0+0net 7632k 0pf
+`
+	inchan := make(chan string, 100)
+	fp := NewP4dFileParser(logrus.New())
+	fp.SetDurations(time.Millisecond, time.Minute)
+	cmdChan := fp.LogParser(context.Background(), inchan, nil)
+	for _, line := range strings.Split(testInput, "\n") {
+		inchan <- line
+	}
+	close(inchan)
+	cmds := make([]Command, 0)
+	for cmd := range cmdChan {
+		cmds = append(cmds, cmd)
+	}
+	assert.Equal(t, 2, len(cmds))
+	restarts, last := fp.ServerRestarts()
+	assert.Equal(t, int64(1), restarts)
+	assert.Equal(t, "2020/01/11 02:10:00", last.Format(p4timeformat))
+	assert.Equal(t, int64(0), fp.ParseStats().UnrecognisedLines)
+}
+
 func TestDuplicatePulls(t *testing.T) {
 	testInput := `
 Perforce server info:
@@ -761,7 +1655,7 @@ Perforce server info:
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, `{"processKey":"026c2d4135085764d23fd21f41d30f77","cmd":"user-sync","pid":145941,"lineNo":2,"user":"builder","workspace":"LON","computeLapse":0.14,"completedLapse":0.111,"ip":"10.10.16.171/10.10.20.195","app":"AutoWorker/1.0.0.0","args":"//assets/level/instances.xml","startTime":"2017/12/07 15:00:01","endTime":"2017/12/07 15:00:01","running":1,"uCpu":77,"sCpu":25,"diskIn":112,"diskOut":3136,"ipcIn":0,"ipcOut":0,"maxRss":4964,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
+	assert.JSONEq(t, `{"processKey":"026c2d4135085764d23fd21f41d30f77","cmd":"user-sync","pid":145941,"lineNo":2,"user":"builder","workspace":"LON","computeLapse":0.14,"completedLapse":0.111,"ip":"10.10.16.171/10.10.20.195","forwarded":true,"app":"AutoWorker/1.0.0.0","args":"//assets/level/instances.xml","startTime":"2017/12/07 15:00:01","endTime":"2017/12/07 15:00:01","running":1,"uCpu":77,"sCpu":25,"diskIn":112,"diskOut":3136,"ipcIn":0,"ipcOut":0,"maxRss":4964,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[]}`,
 		output[0])
 }
 
@@ -842,9 +1736,9 @@ locks acquired by blocking after 3 non-blocking attempts
 `
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, `{"processKey":"f7d483631e94d16adde6c5306be15fbe","cmd":"user-revert","pid":22245,"lineNo":2,"user":"auto","workspace":"archive_auto","computeLapse":0,"completedLapse":6.92,"ip":"127.0.0.1","app":"archive/v60","args":"/usr/local/arch/datastore/...","startTime":"2018/09/06 06:00:02","endTime":"2018/09/06 06:00:02","running":1,"uCpu":6901,"sCpu":4,"diskIn":32,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":19996,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"protect","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":4,"totalReadHeld":6875,"totalWriteWait":5,"totalWriteHeld":6,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"resolve","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":23792,"totalReadHeld":3,"totalWriteWait":2,"totalWriteHeld":1,"maxReadWait":23792,"maxReadHeld":3,"maxWriteWait":2,"maxWriteHeld":1,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
+	assert.JSONEq(t, `{"processKey":"f7d483631e94d16adde6c5306be15fbe","cmd":"user-revert","pid":22245,"lineNo":2,"user":"auto","workspace":"archive_auto","computeLapse":0,"completedLapse":6.92,"ip":"127.0.0.1","app":"archive/v60","clientApiLevel":60,"args":"/usr/local/arch/datastore/...","startTime":"2018/09/06 06:00:02","endTime":"2018/09/06 06:00:02","running":1,"uCpu":6901,"sCpu":4,"diskIn":32,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":19996,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"protect","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":4,"totalReadHeld":6875,"totalWriteWait":5,"totalWriteHeld":6,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"resolve","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":23792,"totalReadHeld":3,"totalWriteWait":2,"totalWriteHeld":1,"maxReadWait":23792,"maxReadHeld":3,"maxWriteWait":2,"maxWriteHeld":1,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
 		output[0])
-	assert.JSONEq(t, `{"processKey":"f7d483631e94d16adde6c5306be15fbe","cmd":"user-revert","pid":22245,"lineNo":2,"user":"auto","workspace":"archive_auto","computeLapse":0,"completedLapse":6.92,"ip":"127.0.0.1","app":"archive/v60","args":"/usr/local/arch/datastore/...","startTime":"2018/09/06 06:00:02","endTime":"2018/09/06 06:00:02","running":1,"uCpu":6901,"sCpu":4,"diskIn":32,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":19996,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"protect","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":4,"totalReadHeld":6875,"totalWriteWait":5,"totalWriteHeld":6,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"resolve","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":23792,"totalReadHeld":3,"totalWriteWait":2,"totalWriteHeld":1,"maxReadWait":23792,"maxReadHeld":3,"maxWriteWait":2,"maxWriteHeld":1,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
+	assert.JSONEq(t, `{"processKey":"f7d483631e94d16adde6c5306be15fbe","cmd":"user-revert","pid":22245,"lineNo":2,"user":"auto","workspace":"archive_auto","computeLapse":0,"completedLapse":6.92,"ip":"127.0.0.1","app":"archive/v60","clientApiLevel":60,"args":"/usr/local/arch/datastore/...","startTime":"2018/09/06 06:00:02","endTime":"2018/09/06 06:00:02","running":1,"uCpu":6901,"sCpu":4,"diskIn":32,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":19996,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"protect","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":4,"totalReadHeld":6875,"totalWriteWait":5,"totalWriteHeld":6,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"resolve","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":23792,"totalReadHeld":3,"totalWriteWait":2,"totalWriteHeld":1,"maxReadWait":23792,"maxReadHeld":3,"maxWriteWait":2,"maxWriteHeld":1,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
 		output[0])
 }
 
@@ -908,7 +1802,7 @@ Perforce server info:
 		output[0])
 	assert.JSONEq(t, `{"processKey":"b9ec8da8ea642419a06f8ac4060f261c.12","cmd":"rmt-Journal","pid":17916,"lineNo":12,"user":"svc_p4d_ha_chi","workspace":"unknown","computeLapse":0,"completedLapse":0.001,"ip":"10.5.70.41","app":"p4d/2019.2/LINUX26X86_64/1908095","args":"","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:16","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":1,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":280100,"rpcHimarkRev":278660,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":1,"pagesOut":0,"pagesCached":2,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":1,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
 		output[1])
-	assert.JSONEq(t, `{"processKey":"b9f9aee10027df004a0e35a3c9931e27","cmd":"user-change","pid":15855,"lineNo":2,"user":"fred","workspace":"fred_ws","computeLapse":0,"completedLapse":0.276,"ip":"10.1.4.213/10.1.3.243","app":"Helix P4V/NTX64/2019.2/1904275/v86","args":"-i","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:17","running":1,"uCpu":4,"sCpu":4,"diskIn":256,"diskOut":240,"ipcIn":0,"ipcOut":0,"maxRss":9212,"pageFaults":0,"rpcMsgsIn":3,"rpcMsgsOut":5,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":280100,"rpcHimarkRev":280100,"rpcSnd":0,"rpcRcv":0.19,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":7,"pagesOut":6,"pagesCached":2,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":2,"getRows":3,"posRows":0,"scanRows":0,"putRows":2,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":256,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":2,"getRows":0,"posRows":0,"scanRows":0,"putRows":2,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"protect","pagesIn":9,"pagesOut":0,"pagesCached":7,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":0,"posRows":1,"scanRows":345,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":1,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"storagemasterup_R","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":1,"totalReadHeld":2,"totalWriteWait":3,"totalWriteHeld":4,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"storageup_R","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":1,"totalReadHeld":2,"totalWriteWait":3,"totalWriteHeld":4,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"trigger_swarm.changesave","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0.076}]}`,
+	assert.JSONEq(t, `{"processKey":"b9f9aee10027df004a0e35a3c9931e27","cmd":"user-change","pid":15855,"lineNo":2,"user":"fred","workspace":"fred_ws","computeLapse":0,"completedLapse":0.276,"ip":"10.1.4.213/10.1.3.243","forwarded":true,"app":"Helix P4V/NTX64/2019.2/1904275/v86","clientApiLevel":86,"args":"-i","startTime":"2020/03/11 06:08:16","endTime":"2020/03/11 06:08:17","running":1,"uCpu":4,"sCpu":4,"diskIn":256,"diskOut":240,"ipcIn":0,"ipcOut":0,"maxRss":9212,"pageFaults":0,"rpcMsgsIn":3,"rpcMsgsOut":5,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":280100,"rpcHimarkRev":280100,"rpcSnd":0,"rpcRcv":0.19,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"counters","pagesIn":7,"pagesOut":6,"pagesCached":2,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":2,"getRows":3,"posRows":0,"scanRows":0,"putRows":2,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":256,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":2,"getRows":0,"posRows":0,"scanRows":0,"putRows":2,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"protect","pagesIn":9,"pagesOut":0,"pagesCached":7,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":0,"posRows":1,"scanRows":345,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":1,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"storagemasterup_R","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":1,"totalReadHeld":2,"totalWriteWait":3,"totalWriteHeld":4,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"storageup_R","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":1,"totalReadHeld":2,"totalWriteWait":3,"totalWriteHeld":4,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"trigger_swarm.changesave","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0.076}]}`,
 		output[2])
 }
 
@@ -921,7 +1815,7 @@ lapse .079s
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	// assert.Equal(t, []string{}, output)
-	assert.JSONEq(t, `{"processKey":"940a4da8bf0e516fdd8685452d489537","cmd":"dm-CommitSubmit","pid":59469,"lineNo":2,"user":"robomerge","workspace":"ROBOMERGE_EOSSDK_EOSSDK_Dev_EAC","computeLapse":0,"completedLapse":0,"ip":"10.1.20.80","app":"robomerge/v717","args":"","startTime":"2020/07/20 15:00:13","endTime":"0001/01/01 00:00:00","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"trigger_swarm.commit","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0.079}]}`,
+	assert.JSONEq(t, `{"processKey":"940a4da8bf0e516fdd8685452d489537","cmd":"dm-CommitSubmit","pid":59469,"lineNo":2,"user":"robomerge","workspace":"ROBOMERGE_EOSSDK_EOSSDK_Dev_EAC","computeLapse":0,"completedLapse":0,"ip":"10.1.20.80","app":"robomerge/v717","clientApiLevel":717,"args":"","startTime":"2020/07/20 15:00:13","endTime":"0001/01/01 00:00:00","running":1,"truncated":true,"incomplete":true,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"trigger_swarm.commit","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0.079}]}`,
 		output[0])
 }
 
@@ -933,7 +1827,7 @@ lapse 1.39s
 `
 	output := parseLogLines(testInput)
 	//assert.Equal(t, 1, len(output))
-	assert.JSONEq(t, `{"processKey":"940a4da8bf0e516fdd8685452d489537","cmd":"dm-CommitSubmit","pid":59469,"lineNo":2,"user":"robomerge","workspace":"ROBOMERGE_EOSSDK_EOSSDK_Dev_EAC","computeLapse":0,"completedLapse":0,"ip":"10.1.20.80","app":"robomerge/v717","args":"","startTime":"2020/07/20 15:00:13","endTime":"0001/01/01 00:00:00","running":1,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"trigger_swarm.strict","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":1.39}]}`,
+	assert.JSONEq(t, `{"processKey":"940a4da8bf0e516fdd8685452d489537","cmd":"dm-CommitSubmit","pid":59469,"lineNo":2,"user":"robomerge","workspace":"ROBOMERGE_EOSSDK_EOSSDK_Dev_EAC","computeLapse":0,"completedLapse":0,"ip":"10.1.20.80","app":"robomerge/v717","clientApiLevel":717,"args":"","startTime":"2020/07/20 15:00:13","endTime":"0001/01/01 00:00:00","running":1,"truncated":true,"incomplete":true,"uCpu":0,"sCpu":0,"diskIn":0,"diskOut":0,"ipcIn":0,"ipcOut":0,"maxRss":0,"pageFaults":0,"rpcMsgsIn":0,"rpcMsgsOut":0,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":0,"rpcHimarkRev":0,"rpcSnd":0,"rpcRcv":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":0,"lbrRcsCloses":0,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":0,"lbrRcsReadBytes":0,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":0,"lbrCompressCloses":0,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":0,"lbrCompressReadBytes":0,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"netFilesAdded":0,"netFilesDeleted":0,"netFilesUpdated":0,"cmdError":false,"tables":[{"tableName":"trigger_swarm.strict","pagesIn":0,"pagesOut":0,"pagesCached":0,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":0,"getRows":0,"posRows":0,"scanRows":0,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":1.39}]}`,
 		output[0])
 }
 
@@ -1032,7 +1926,7 @@ Perforce server info:
 	output := parseLogLines(testInput)
 	assert.Equal(t, 1, len(output))
 	//assert.Equal(t, "", output[0])
-	assert.JSONEq(t, `{"processKey":"c64b38c5e71582bd477ffcaab5b3514d","cmd":"user-transmit","pid":1871637,"lineNo":5,"user":"build","workspace":"cmdr-tools-change-155476395","computeLapse":0,"completedLapse":0.011,"ip":"127.0.0.1/10.5.64.108","app":"p4/2018.1/LINUX26X86_64/1957529 (brokered)","args":"-t1871630 -b8 -s524288 -p","startTime":"2023/07/01 02:00:02","endTime":"2023/07/01 02:00:02","running":0,"uCpu":5,"sCpu":4,"diskIn":0,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":10364,"pageFaults":0,"rpcMsgsIn":2,"rpcMsgsOut":74,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":97604,"rpcHimarkRev":318788,"rpcSnd":0,"rpcRcv":0.001,"netFilesAdded":0,"netFilesUpdated":0,"netFilesDeleted":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":8,"lbrRcsCloses":8,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":16,"lbrRcsReadBytes":202547,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":16,"lbrCompressCloses":16,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":32,"lbrCompressReadBytes":142028,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"cmdError":false,"tables":[{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":4096,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":2,"getRows":0,"posRows":0,"scanRows":0,"putRows":2,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":1,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":1,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"topology","pagesIn":5,"pagesOut":0,"pagesCached":4,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":0,"posRows":1,"scanRows":1,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
+	assert.JSONEq(t, `{"processKey":"c64b38c5e71582bd477ffcaab5b3514d","cmd":"user-transmit","pid":1871637,"lineNo":5,"user":"build","workspace":"cmdr-tools-change-155476395","computeLapse":0,"completedLapse":0.011,"ip":"127.0.0.1/10.5.64.108","forwarded":true,"app":"p4/2018.1/LINUX26X86_64/1957529 (brokered)","args":"-t1871630 -b8 -s524288 -p","startTime":"2023/07/01 02:00:02","endTime":"2023/07/01 02:00:02","running":0,"uCpu":5,"sCpu":4,"diskIn":0,"diskOut":8,"ipcIn":0,"ipcOut":0,"maxRss":10364,"pageFaults":0,"rpcMsgsIn":2,"rpcMsgsOut":74,"rpcSizeIn":0,"rpcSizeOut":0,"rpcHimarkFwd":97604,"rpcHimarkRev":318788,"rpcSnd":0,"rpcRcv":0.001,"netFilesAdded":0,"netFilesUpdated":0,"netFilesDeleted":0,"netBytesAdded":0,"netBytesUpdated":0,"lbrRcsOpens":8,"lbrRcsCloses":8,"lbrRcsCheckins":0,"lbrRcsExists":0,"lbrRcsReads":16,"lbrRcsReadBytes":202547,"lbrRcsWrites":0,"lbrRcsWriteBytes":0,"lbrCompressOpens":16,"lbrCompressCloses":16,"lbrCompressCheckins":0,"lbrCompressExists":0,"lbrCompressReads":32,"lbrCompressReadBytes":142028,"lbrCompressWrites":0,"lbrCompressWriteBytes":0,"lbrUncompressOpens":0,"lbrUncompressCloses":0,"lbrUncompressCheckins":0,"lbrUncompressExists":0,"lbrUncompressReads":0,"lbrUncompressReadBytes":0,"lbrUncompressWrites":0,"lbrUncompressWriteBytes":0,"cmdError":false,"tables":[{"tableName":"monitor","pagesIn":2,"pagesOut":4,"pagesCached":4096,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":0,"writeLocks":2,"getRows":0,"posRows":0,"scanRows":0,"putRows":2,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":1,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":1,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0},{"tableName":"topology","pagesIn":5,"pagesOut":0,"pagesCached":4,"pagesSplitInternal":0,"pagesSplitLeaf":0,"readLocks":1,"writeLocks":0,"getRows":0,"posRows":1,"scanRows":1,"putRows":0,"delRows":0,"totalReadWait":0,"totalReadHeld":0,"totalWriteWait":0,"totalWriteHeld":0,"maxReadWait":0,"maxReadHeld":0,"maxWriteWait":0,"maxWriteHeld":0,"peekCount":0,"totalPeekWait":0,"totalPeekHeld":0,"maxPeekWait":0,"maxPeekHeld":0,"triggerLapse":0}]}`,
 		output[0])
 }
 